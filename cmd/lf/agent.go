@@ -0,0 +1,213 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package main
+
+// This is the owner key agent, which caches unlocked owner private keys in memory so scripts
+// using passphrase-locked owners are not prompted every time.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"lf/pkg/lf"
+)
+
+// agentDirName is the name of the directory in the client base path that holds the agent's socket.
+// It's only accessible by its owner so the socket is never reachable by others, even briefly.
+const agentDirName = "agent"
+
+// agentSocketName is the name of the agent's Unix domain socket in its directory.
+const agentSocketName = "agent.sock"
+
+// agentDefaultTTL is how long the agent keeps unlocked keys by default.
+const agentDefaultTTL = 900
+
+type agentRequest struct {
+	Op      string         // "get", "put", or "forget"
+	Owner   lf.OwnerPublic // Owner whose private key is being stored or requested
+	Private lf.Blob        `json:",omitempty"` // Private key (put only)
+}
+
+type agentResponse struct {
+	Private lf.Blob `json:",omitempty"` // Private key (get only)
+	Error   string  `json:",omitempty"`
+}
+
+type agentKey struct {
+	private []byte
+	expires time.Time
+}
+
+func agentSocketPath(basePath string) string {
+	return path.Join(basePath, agentDirName, agentSocketName)
+}
+
+// agentDo sends a request to the agent if one is running.
+func agentDo(basePath string, req *agentRequest) (*agentResponse, error) {
+	c, err := net.DialTimeout("unix", agentSocketPath(basePath), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+	_ = c.SetDeadline(time.Now().Add(time.Second * 5))
+	err = json.NewEncoder(c).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp agentResponse
+	err = json.NewDecoder(c).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Error) > 0 {
+		return nil, fmt.Errorf("agent: %s", resp.Error)
+	}
+	return &resp, nil
+}
+
+// agentGetOwner returns an owner from the agent's cache or nil if there is no agent or the owner isn't cached.
+// Nil is also returned if the agent returns a key for a different owner, so the caller prompts for a passphrase.
+func agentGetOwner(basePath string, ownerPublic lf.OwnerPublic) *lf.Owner {
+	resp, err := agentDo(basePath, &agentRequest{Op: "get", Owner: ownerPublic})
+	if err != nil || len(resp.Private) == 0 {
+		return nil
+	}
+	o, err := lf.NewOwnerFromPrivateBytes(resp.Private)
+	if err != nil || !bytes.Equal(o.Public, ownerPublic) {
+		return nil
+	}
+	return o
+}
+
+// agentPutOwner stores an unlocked owner in the agent's cache if an agent is running.
+func agentPutOwner(basePath string, o *lf.Owner) {
+	priv, err := o.PrivateBytes()
+	if err == nil {
+		_, _ = agentDo(basePath, &agentRequest{Op: "put", Owner: o.Public, Private: priv})
+	}
+}
+
+func doAgent(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
+	agentOpts := flag.NewFlagSet("agent", flag.ContinueOnError)
+	ttl := agentOpts.Int("ttl", agentDefaultTTL, "")
+	agentOpts.SetOutput(ioutil.Discard)
+	err := agentOpts.Parse(args)
+	if err != nil || len(agentOpts.Args()) != 0 || *ttl <= 0 {
+		printHelp("")
+		exitCode = 1
+		return
+	}
+
+	sockDir := path.Join(basePath, agentDirName)
+	if err = os.MkdirAll(sockDir, 0700); err == nil {
+		err = os.Chmod(sockDir, 0700) // in case it already existed with other permissions
+	}
+	if err != nil {
+		logger.Printf("ERROR: unable to create %s: %s", sockDir, err.Error())
+		exitCode = 1
+		return
+	}
+
+	sockPath := agentSocketPath(basePath)
+	if c, err := net.Dial("unix", sockPath); err == nil {
+		_ = c.Close()
+		logger.Printf("ERROR: an agent is already running at %s", sockPath)
+		exitCode = 1
+		return
+	}
+	_ = os.Remove(sockPath) // remove stale socket
+
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		logger.Printf("ERROR: unable to listen at %s: %s", sockPath, err.Error())
+		exitCode = 1
+		return
+	}
+	_ = os.Chmod(sockPath, 0600)
+
+	osSignalChannel := make(chan os.Signal, 2)
+	signal.Notify(osSignalChannel, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-osSignalChannel
+		_ = listener.Close()
+	}()
+
+	var keys = make(map[string]*agentKey)
+	var keysLock sync.Mutex
+	go func() {
+		for {
+			time.Sleep(time.Second * 10)
+			now := time.Now()
+			keysLock.Lock()
+			for k, v := range keys {
+				if now.After(v.expires) {
+					delete(keys, k)
+				}
+			}
+			keysLock.Unlock()
+		}
+	}()
+
+	fmt.Printf("agent listening at %s (keys kept for %d seconds)\n", sockPath, *ttl)
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go func() {
+			defer func() {
+				_ = c.Close()
+			}()
+			_ = c.SetDeadline(time.Now().Add(time.Second * 5))
+			var req agentRequest
+			var resp agentResponse
+			if json.NewDecoder(c).Decode(&req) != nil {
+				return
+			}
+			keyName := req.Owner.String()
+			keysLock.Lock()
+			switch req.Op {
+			case "get":
+				if k := keys[keyName]; k != nil && time.Now().Before(k.expires) {
+					resp.Private = k.private
+				}
+			case "put":
+				if len(req.Private) > 0 {
+					keys[keyName] = &agentKey{private: req.Private, expires: time.Now().Add(time.Second * time.Duration(*ttl))}
+				}
+			case "forget":
+				delete(keys, keyName)
+			default:
+				resp.Error = "unrecognized operation"
+			}
+			keysLock.Unlock()
+			_ = json.NewEncoder(c).Encode(&resp)
+		}()
+	}
+
+	_ = os.Remove(sockPath)
+	return
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package main
+
+// This is the resumable record download used by node-bootstrap. Records are downloaded into
+// bootstrap.lf.part and verified as they arrive, so the file always ends on a record boundary
+// that matches a data offset on the remote node. If a download is interrupted it's resumed from
+// that offset with an HTTP Range request. When complete the file is renamed to bootstrap.lf and
+// imported by the node on its next start.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"lf/pkg/lf"
+)
+
+const (
+	bootstrapPartFileName   = "bootstrap.lf.part"
+	bootstrapSourceFileName = "bootstrap.lf.source"
+)
+
+// bootstrapInProgress returns true if there is a partial download to resume.
+func bootstrapInProgress(basePath string) bool {
+	_, err := os.Stat(path.Join(basePath, bootstrapPartFileName))
+	return err == nil
+}
+
+// bootstrapVerifiedSize scans a partial download and returns the size of its valid records.
+func bootstrapVerifiedSize(partPath string) (uint64, error) {
+	f, err := os.Open(partPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	in := lf.CountingReader{R: bufio.NewReaderSize(f, 1048576)}
+	var size uint64
+	for {
+		var rec lf.Record
+		if rec.UnmarshalFrom(&in) != nil {
+			return size, nil
+		}
+		size = in.N
+	}
+}
+
+// downloadBootstrapRecords downloads records from a remote node into bootstrap.lf, resuming a previous download if present.
+func downloadBootstrapRecords(remote lf.RemoteNode, basePath string, remoteIdentity []byte) error {
+	partPath := path.Join(basePath, bootstrapPartFileName)
+	sourcePath := path.Join(basePath, bootstrapSourceFileName)
+	source := lf.Base62Encode(remoteIdentity)
+
+	var offset uint64
+	if bootstrapInProgress(basePath) {
+		prevSource, _ := ioutil.ReadFile(sourcePath)
+		if strings.TrimSpace(string(prevSource)) != source {
+			return fmt.Errorf("partial download in %s is from a different node, remove it and genesis.lf to start over", partPath)
+		}
+		var err error
+		offset, err = bootstrapVerifiedSize(partPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Resuming download at byte %d...\n", offset)
+	} else {
+		err := ioutil.WriteFile(sourcePath, []byte(source), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = out.Close()
+	}()
+	err = out.Truncate(int64(offset)) // discard any trailing partial record
+	if err == nil {
+		_, err = out.Seek(int64(offset), io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	body, start, total, err := remote.RecordsSince(offset)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	if start != offset { // node could not resume, so start over from the beginning
+		fmt.Printf("Remote node could not resume at byte %d, starting over...\n", offset)
+		offset = 0
+		if err = out.Truncate(0); err == nil {
+			_, err = out.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(sourcePath, []byte(source), 0644)
+		}
+		if err != nil {
+			return err
+		}
+		if start != 0 {
+			_ = body.Close()
+			body, start, total, err = remote.RecordsSince(0)
+			if err != nil {
+				return err
+			}
+			if start != 0 {
+				return fmt.Errorf("remote node returned records starting at byte %d instead of the beginning", start)
+			}
+		}
+	}
+
+	br := bufio.NewReaderSize(body, 1048576)
+	in := lf.CountingReader{R: br}
+	w := bufio.NewWriterSize(out, 1048576)
+	var count uint64
+	lastProgress := time.Now()
+	for {
+		if next, _ := br.Peek(1); len(next) == 1 && next[0] == 0xff { // gap marker, only found in records.lf on partial nodes
+			_ = w.Flush()
+			return fmt.Errorf("record data gap at byte %d, remote node is a partial node that has discarded some record values, bootstrap from a full node", offset)
+		}
+		var rec lf.Record
+		start := in.N
+		err = rec.UnmarshalFrom(&in)
+		if err != nil {
+			if err == io.EOF && in.N == start {
+				break
+			}
+			_ = w.Flush()
+			return fmt.Errorf("download interrupted at byte %d (%s), run node-bootstrap again to resume", offset, err.Error())
+		}
+		if rec.IsAbbreviated() {
+			_ = w.Flush()
+			return fmt.Errorf("record at byte %d has no value, remote node is a partial node that has discarded some record values, bootstrap from a full node", offset)
+		}
+		if err = rec.Validate(); err != nil {
+			_ = w.Flush()
+			return fmt.Errorf("invalid record at byte %d (%s)", offset, err.Error())
+		}
+		rb := rec.Bytes()
+		if uint64(len(rb)) != (in.N - start) {
+			_ = w.Flush()
+			return fmt.Errorf("record at byte %d is not in canonical form", offset)
+		}
+		if _, err = w.Write(rb); err != nil {
+			return err
+		}
+		offset += uint64(len(rb))
+		count++
+
+		if time.Since(lastProgress) >= time.Second {
+			lastProgress = time.Now()
+			if total > 0 {
+				fmt.Printf("  %d/%d bytes (%d%%), %d records\n", offset, total, (offset*100)/total, count)
+			} else {
+				fmt.Printf("  %d bytes, %d records\n", offset, count)
+			}
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	fmt.Printf("  %d bytes, %d records, download complete\n", offset, count)
+
+	_ = out.Close()
+	if err = os.Rename(partPath, path.Join(basePath, "bootstrap.lf")); err != nil {
+		return err
+	}
+	_ = os.Remove(sourcePath)
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"lf/pkg/lf"
+)
+
+func doNodeFsck(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
+	fsckOpts := flag.NewFlagSet("node-fsck", flag.ContinueOnError)
+	checkWeights := fsckOpts.Bool("weights", false, "")
+	repair := fsckOpts.Bool("repair", false, "")
+	rebuild := fsckOpts.Bool("rebuild", false, "")
+	fsckOpts.SetOutput(ioutil.Discard)
+	err := fsckOpts.Parse(args)
+	if err != nil || len(fsckOpts.Args()) != 0 {
+		printHelp("")
+		exitCode = 1
+		return
+	}
+	progress := log.New(os.Stdout, "", 0)
+
+	if *rebuild {
+		fmt.Printf("Rebuilding database in %s from records.lf...\n", basePath)
+		recordCount, skippedCount, backupPath, err := lf.RebuildDatabase(basePath, progress)
+		if err != nil {
+			logger.Printf("FATAL: rebuild failed: %s", err.Error())
+			if len(backupPath) > 0 {
+				logger.Printf("FATAL: original database files are in %s", backupPath)
+			}
+			exitCode = 1
+			return
+		}
+		fmt.Printf("Rebuilt database with %d records (%d skipped). Original files are in %s.\n", recordCount, skippedCount, backupPath)
+	}
+
+	fr, err := lf.CheckDatabase(basePath, *checkWeights, *repair, progress)
+	if err != nil {
+		logger.Printf("FATAL: check failed: %s", err.Error())
+		exitCode = 1
+		return
+	}
+	for _, p := range fr.Problems {
+		fmt.Printf("PROBLEM: %s\n", p)
+	}
+	if fr.OK() {
+		if fr.OrphansRepaired && (fr.OrphanedSelectors > 0 || fr.OrphanedHoles > 0 || fr.OrphanedDanglingLinks > 0 || fr.OrphanedPending > 0) {
+			fmt.Println("Orphaned index entries were deleted.")
+		}
+		fmt.Printf("OK: %d records checked, no errors found.\n", fr.IndexedRecords)
+		return
+	}
+	fmt.Println("ERRORS FOUND: run node-fsck -repair to delete orphaned index entries or node-fsck -rebuild to rebuild the database from records.lf.")
+	exitCode = 1
+	return
+}
@@ -15,6 +15,7 @@ package main
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	secrand "crypto/rand"
@@ -25,7 +26,6 @@ import (
 	"encoding/pem"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
@@ -33,8 +33,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -115,6 +117,22 @@ func tokenizeStringWithEsc(s string, sep, escape rune) (tokens []string) {
 	return
 }
 
+// remoteNodesFromFlag parses a comma-separated list of URLs given with -url, or returns the configured URLs if it's empty.
+func remoteNodesFromFlag(cfg *lf.ClientConfig, s string) ([]lf.RemoteNode, error) {
+	if len(s) == 0 {
+		return cfg.RemoteNodes(), nil
+	}
+	var urls []lf.RemoteNode
+	for _, us := range tokenizeStringWithEsc(s, ',', '\\') {
+		u, err := lf.NewRemoteNode(us)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL: %s (%s)", us, err.Error())
+		}
+		urls = append(urls, cfg.RemoteNode(u))
+	}
+	return urls, nil
+}
+
 func prompt(prompt string, required bool, dfl string) string {
 	var b [1]byte
 	var s strings.Builder
@@ -147,6 +165,44 @@ func prompt(prompt string, required bool, dfl string) string {
 	}
 }
 
+// promptPassphrase prompts for a passphrase with terminal echo disabled if possible.
+// If LF_OWNER_PASSPHRASE is set in the environment it is used instead so scripts can supply it.
+func promptPassphrase(promptStr string) string {
+	if pp := os.Getenv("LF_OWNER_PASSPHRASE"); len(pp) > 0 {
+		return pp
+	}
+	echoDisabled := false
+	if runtime.GOOS != "windows" {
+		stty := exec.Command("stty", "-echo")
+		stty.Stdin = os.Stdin
+		echoDisabled = stty.Run() == nil
+	}
+	pp := prompt(promptStr, true, "")
+	if echoDisabled {
+		stty := exec.Command("stty", "echo")
+		stty.Stdin = os.Stdin
+		_ = stty.Run()
+		fmt.Println()
+	}
+	return pp
+}
+
+// getConfigOwner gets an owner with its private key, using the agent or prompting for a passphrase if it's locked.
+func getConfigOwner(basePath string, co *lf.ClientConfigOwner) (*lf.Owner, error) {
+	if !co.IsLocked() {
+		return co.GetOwner()
+	}
+	if o := agentGetOwner(basePath, co.Public); o != nil {
+		return o, nil
+	}
+	o, err := co.GetOwnerWithPassphrase(promptPassphrase("Passphrase for owner " + co.Public.String() + ": "))
+	if err != nil {
+		return nil, err
+	}
+	agentPutOwner(basePath, o)
+	return o, nil
+}
+
 func printHelp(cmd string) {
 	// NOTE: When editing make sure your editor doesn't indent help with
 	// tabs, otherwise it will format funny on a console. Also try to keep
@@ -170,6 +226,7 @@ Commands:
     database                              Test DAG and database (long!)
   makegenesis                             Create a private database (see docs)
   node-bootstrap <url>                    Bootstrap new node from existing
+                                          (run again to resume if interrupted)
   node-start [-...]                       Start a full LF node
     -p2p <port>                           P2P TCP port (default: ` + lfDefaultP2PPortStr + `)
     -http <port>                          HTTP TCP port (default: ` + lfDefaultHTTPPortStr + `)
@@ -179,6 +236,13 @@ Commands:
     -letsencrypt <host[,host]>            Run LetsEncrypt HTTPS on port 443
     -localtest                            Disable P2P and ignore proof of work
   node-connect <ip> <port> <identity>     Tell node to try a P2P endpoint
+  node-snapshot [-...] <file>             Save snapshot of running node's DB
+    -url <url>                            Override configured node URL
+  node-restore <file>                     Restore and verify a DB snapshot
+  node-fsck [-...]                        Check DB of stopped node for errors
+    -weights                              Also recompute weights (slow)
+    -repair                               Delete orphaned index entries
+    -rebuild                              Rebuild index/graph from records
   status                                  Get status from remote node/proxy
   set [-...] [name[#ord]...] <value>      Set a value in the data store
     -file                                 Value is a file path ("-" for stdin)
@@ -187,12 +251,21 @@ Commands:
     -url <url[,url,...]>                  Override configured node/proxy URLs
     -nowork                               Abort if an auth cert doesn't exist
     -pulse                                Generate pulse if value unchanged
+  delete [-...] <name[#ord]> [...]        Retract owner's value for selector(s)
+    -owner <owner>                        Use this owner instead of default
+    -url <url[,url,...]>                  Override configured node/proxy URLs
+    -nowork                               Abort if an auth cert doesn't exist
   get [-...] <name[#start[#end]]> [...]   Find by selector (optional range)
     -mask <key>                           Override default masking key
     -tstart <time>                        Constrain to after this time
     -tend <time>                          Constrain to before this time
     -open                                 Include entries with extra selectors
     -raw                                  Dump raw un-escaped value(s) only
+    -trust <policy>                       Use a named trust policy
+    -count                                Only count results, owners, ordinals
+    -latest                               Only get latest record per selector
+    -alive <duration>                     Only records pulsed within duration
+                                          (e.g. 10m, most recently pulsed first)
     -url <url[,url,...]>                  Override configured node/proxy URLs
   owner <operation> [...]
     list                                  List owners
@@ -201,21 +274,48 @@ Commands:
     default <name>                        Set default owner
     delete <name>                         Delete an owner (PERMANENT)
     rename <old name> <new name>          Rename an owner
+    lock <name>                           Encrypt owner's key with a passphrase
+    unlock <name>                         Remove passphrase encryption from key
     export <name> [pem file]              Export owner as PEM
     exportstring <name> [pem file]        Export owner as PEM for JSON use
     import <name> <pem file>              Import owner from PEM export
     makecsr <name>                        Generate a CSR for an owner
     showcsr <csr>                         Dump CSR information
     authorize <ca key> <csr> <ttl days>   Generate and store auth certificate
+  record <operation> [...]
+    build [-...] <file> <name[#ord]> [...] <value>  Build unsigned record
+      -owner <owner|@owner>               Use this owner instead of default
+      -mask <key>                         Override default masking key
+      -file                               Value is a file path ("-" for stdin)
+      -url <url[,url,...]>                Override configured node/proxy URLs
+    work [-url <url>] <file> [out file]   Compute proof of work for record
+                                          (-url delegates work to a node)
+    sign [-owner <owner>] <file> [out]    Sign record (default: its owner)
+    submit [-url <url>] <file> [...]      Submit signed record(s) to a node
+  pulse-daemon [-...]                     Keep records alive by pulsing them
+    -once                                 Pulse each record once and exit
+    -url <url[,url,...]>                  Override configured node/proxy URLs
+  work-estimate [-...] [bytes]            Estimate proof of work time for record
+                                          (bytes: work billable size, see below)
+    -calibrate                            Save benchmark (set then shows ETA)
+    -time <seconds>                       Benchmark duration (default: 10)
+    -url <url>                            Ask a node instead of benchmarking
+  agent [-...]                            Cache unlocked owner keys in memory
+    -ttl <seconds>                        Seconds to keep keys (default: ` + strconv.Itoa(agentDefaultTTL) + `)
   url <operation> [...]
     list                                  Show client URLs
     add <url>                             Add a URL
     delete <url>                          Delete a URL
     default <url>                         Move URL to front (first to try)
+    token <url> [token]                   Set (or clear) URL's API auth token
   oracle
     list                                  List trusted oracles
     add <@oracle>                         Add trusted oracle
     delete <@oracle>                      Delete trusted oracle
+  trust
+    list                                  List named trust policies
+    set <name> <json>                     Create or replace a trust policy
+    delete <name>                         Delete a trust policy
 
 Global options must precede commands, while command options must come after
 the command name.
@@ -232,10 +332,67 @@ Unix time is a decimal number indicating seconds since the Unix epoch.
 
 Default home path is ` + lfDefaultPath + ` unless overriden with -path.
 
-Owner certificate note: CSRs can thus certificate authorizations currently
-can't be created for ed25519 owners due to lack of support in upstream Go
-x509 libraries for EDDSA. Once this support exists then ed25519 certificate
-support will be added.
+A node becomes a partial node if a partial.json file exists in its home path.
+Partial nodes keep the whole DAG but discard values of records older than
+ValueHorizon seconds or not matching Owners or SelectorKeyRanges (if present)
+and fetch them from peers when needed.
+
+Node HTTP API requests may present a token as "Authorization: Bearer <token>".
+The token in authtoken.secret in the node's home path has all scopes. More
+tokens with scopes (query, post, makerecord, work, connect, admin) can be
+defined in apiauth.json, which can also set the scopes granted without a token
+(default: query and post) and enable TrustLoopback to give loopback clients all
+scopes (unsafe behind a proxy). Use 'url token' to send a token to a URL. URLs
+on loopback addresses without a token get the token in authtoken.secret in the
+home path, if any. The work scope allows proof of work to be delegated to a
+node without revealing records or keys, limited by hourly difficulty quotas
+(WorkQuota per token, AnonymousWorkQuota per address, default about one 1KiB
+record per minute; only the authtoken.secret token is unlimited).
+Proof of work for makerecord, makepulse, and work requests runs in a queue that
+callers take turns in. With ?async those requests return a job whose progress
+can be polled with GET /jobs/<ID> and which can be cancelled with DELETE.
+
+The pulse daemon reads a list of records to keep alive from pulsedaemon.json
+in the home path, e.g. {"Pulses":[{"Owner":"me","Selectors":["host#1"],
+"Interval":300}]}. Each is pulsed every Interval seconds (default: 300) until
+it's a year old and too old to pulse, then replaced by a new record with the
+same value. Progress is saved in pulsedaemon-state.json across restarts. With
+"Remote":true the node makes pulses and new records, which sends it the owner's
+private key.
+
+Proof of work time depends on a record's work billable size and varies a lot
+since work is a random search. The work billable size is the value plus the
+selectors, links, owner, and other fields, which add about 180-200 bytes to a
+record with one selector and three links. 'work-estimate <bytes>' takes this
+size, not the value size. It benchmarks this machine and prints average and
+percentile times; -calibrate saves the benchmark so set, delete, and record
+work show an ETA. Nodes answer GET /workestimate/<bytes> with the same estimate
+for their own work function.
+
+A querypolicy.json file in a node's home path sets its query privacy policy.
+RejectNames refuses queries with plain text selector names (this client always
+sends selector keys), RejectMaskingKey refuses server-side value unmasking, and
+AuditNames logs plain text selector names that are queried.
+
+Trust policies are JSON objects that weigh local trust (LocalWeight), oracle
+opinions (OracleWeight), proof of work (WorkWeight), and owner certificates
+(SignedWeight), and can list TrustedOwners and set a MinTrust for results. For
+example: lf trust set pow '{"LocalWeight":1,"WorkWeight":2,"MinTrust":0.5}'
+
+Owners locked with 'owner lock' prompt for their passphrase when used unless
+LF_OWNER_PASSPHRASE is set. If 'agent' is running (in the background) keys
+unlocked by other commands are cached by it and are not prompted for again
+until they expire.
+
+The record commands split 'set' into steps that can run on different hosts,
+e.g. work on a fast machine and signing on an air-gapped one holding the
+owner's key. Each step reads and writes a PEM file. Records built this way
+have no pulse token and so can't be extended with pulses.
+
+Owner certificate note: CSRs can be created for all owner types. The CA key
+file given to 'authorize' must contain the CA certificate and its private
+key as either an ECDSA PRIVATE KEY (P-224 or P-384) or a PKCS#8 PRIVATE KEY
+(P-224, P-384, or ed25519).
 
 `)
 }
@@ -257,13 +414,14 @@ func doNodeBootstrap(cfg *lf.ClientConfig, basePath string, args []string) (exit
 	}
 
 	genesisLf := path.Join(basePath, "genesis.lf")
-	if _, err := os.Stat(genesisLf); err == nil {
+	resuming := bootstrapInProgress(basePath)
+	if _, err := os.Stat(genesisLf); err == nil && !resuming {
 		logger.Printf("FATAL: node-bootstrap cannot be run on an already-bootstrapped node")
 		exitCode = 1
 		return
 	}
 
-	remote := lf.RemoteNode(args[0])
+	remote := cfg.RemoteNode(lf.RemoteNode(strings.TrimSuffix(args[0], "/")))
 
 	status, err := remote.NodeStatus()
 	if err != nil {
@@ -276,6 +434,11 @@ func doNodeBootstrap(cfg *lf.ClientConfig, basePath string, args []string) (exit
 		exitCode = 1
 		return
 	}
+	if status.PartialNode {
+		logger.Printf("FATAL: %s is a partial node that has discarded some record values, bootstrap from a full node", args[0])
+		exitCode = 1
+		return
+	}
 
 	ips, err := net.LookupIP(urlParsed.Hostname())
 	if err != nil {
@@ -298,49 +461,26 @@ func doNodeBootstrap(cfg *lf.ClientConfig, basePath string, args []string) (exit
 		})
 	}
 
+	if resuming {
+		localGenesis, _ := ioutil.ReadFile(genesisLf)
+		if !bytes.Equal(localGenesis, status.GenesisRecords) {
+			logger.Printf("FATAL: %s has different genesis records than the partially bootstrapped node in %s", args[0], basePath)
+			exitCode = 1
+			return
+		}
+	}
+
 	peersJSON := lf.PrettyJSON(peers)
 	ioutil.WriteFile(path.Join(basePath, "peers.json"), []byte(peersJSON), 0644)
-	ioutil.WriteFile(genesisLf, status.GenesisRecords, 0644)
+	if !resuming {
+		ioutil.WriteFile(genesisLf, status.GenesisRecords, 0644)
+	}
 
 	statusJSON := lf.PrettyJSON(status)
 	fmt.Printf("%s\nDownloading current records...\n", statusJSON)
-	var dumpRecordsURL string
-	if strings.HasSuffix(args[0], "/") {
-		dumpRecordsURL = args[0] + "dumprecords"
-	} else {
-		dumpRecordsURL = args[0] + "/dumprecords"
-	}
-	resp, err := http.Get(dumpRecordsURL)
-	if resp.StatusCode == 200 {
-		var total uint64
-		out, err := os.OpenFile(path.Join(basePath, "bootstrap.lf"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Printf("FAILED: could not open bootstrap.lf for writing (%s)", err.Error())
-			exitCode = 1
-			return
-		}
-		var buf [1048576]byte
-		for {
-			n, err := resp.Body.Read(buf[:])
-			if n > 0 {
-				total += uint64(n)
-				fmt.Printf("  %d bytes\n", total)
-				_, err := out.Write(buf[0:n])
-				if err != nil {
-					break
-				}
-			} else {
-				if err != nil && err != io.EOF {
-					log.Printf("FAILED: aborted transfer after unexpected error: %s", err.Error())
-					exitCode = 1
-					return
-				}
-				break
-			}
-		}
-		out.Close()
-	} else {
-		log.Printf("FAILED: %d (%s)", resp.StatusCode, resp.Status)
+	err = downloadBootstrapRecords(remote, basePath, status.Identity)
+	if err != nil {
+		logger.Printf("FAILED: %s", err.Error())
 		exitCode = 1
 		return
 	}
@@ -504,7 +644,7 @@ func doNodeConnect(cfg *lf.ClientConfig, basePath string, args []string) (exitCo
 		exitCode = 1
 		return
 	}
-	urls := cfg.URLs
+	urls := cfg.RemoteNodes()
 	for _, u := range urls {
 		err = u.Connect(ip, int(port), lf.Base62Decode(args[2]))
 		if err == nil {
@@ -527,7 +667,7 @@ func doStatus(cfg *lf.ClientConfig, basePath string, args []string) (exitCode in
 	}
 	var stat *lf.NodeStatus
 	var err error
-	urls := cfg.URLs
+	urls := cfg.RemoteNodes()
 	for _, u := range urls {
 		stat, err = u.NodeStatus()
 		if err == nil {
@@ -545,6 +685,9 @@ func doStatus(cfg *lf.ClientConfig, basePath string, args []string) (exitCode in
 
 var one = 1
 
+// getPageSize is the number of results requested per page when get follows paged query results.
+var getPageSize = 256
+
 func doGet(cfg *lf.ClientConfig, basePath string, args []string, jsonOutput bool) (exitCode int) {
 	getOpts := flag.NewFlagSet("get", flag.ContinueOnError)
 	maskKey := getOpts.String("mask", "", "")
@@ -553,6 +696,10 @@ func doGet(cfg *lf.ClientConfig, basePath string, args []string, jsonOutput bool
 	tEnd := getOpts.String("tend", "", "")
 	rawOutput := getOpts.Bool("raw", false, "")
 	urlOverride := getOpts.String("url", "", "")
+	trustPolicy := getOpts.String("trust", "", "")
+	countOnly := getOpts.Bool("count", false, "")
+	latestOnly := getOpts.Bool("latest", false, "")
+	alive := getOpts.String("alive", "", "")
 	json2 := getOpts.Bool("json", jsonOutput, "") // allow -json after get for convenience
 	getOpts.SetOutput(ioutil.Discard)
 	err := getOpts.Parse(args)
@@ -574,19 +721,11 @@ func doGet(cfg *lf.ClientConfig, basePath string, args []string, jsonOutput bool
 		mk = []byte(*maskKey)
 	}
 
-	urls := cfg.URLs
-	if len(*urlOverride) > 0 {
-		urls2 := tokenizeStringWithEsc(*urlOverride, ',', '\\')
-		urls = nil
-		for i := 0; i < len(urls2); i++ {
-			u, err := lf.NewRemoteNode(urls2[i])
-			if err != nil {
-				logger.Printf("ERROR: invalid URL: %s (%s)", urls2[i], err.Error())
-				exitCode = 1
-				return
-			}
-			urls = append(urls, u)
-		}
+	urls, err := remoteNodesFromFlag(cfg, *urlOverride)
+	if err != nil {
+		logger.Printf("ERROR: get query failed: %s", err.Error())
+		exitCode = 1
+		return
 	}
 	if len(urls) == 0 {
 		logger.Println("ERROR: get query failed: no URLs configured!")
@@ -643,6 +782,30 @@ func doGet(cfg *lf.ClientConfig, basePath string, args []string, jsonOutput bool
 		Open:      openQuery,
 		Oracles:   cfg.Oracles,
 	}
+	if len(*trustPolicy) > 0 {
+		req.TrustPolicy = cfg.TrustPolicies[*trustPolicy]
+		if req.TrustPolicy == nil {
+			logger.Printf("ERROR: get query failed: trust policy %s not found", *trustPolicy)
+			exitCode = 1
+			return
+		}
+	}
+	if len(*alive) > 0 {
+		// Accept a duration like 10m or a number of seconds.
+		maxAge, err := time.ParseDuration(*alive)
+		if err != nil {
+			var secs uint64
+			secs, err = strconv.ParseUint(*alive, 10, 64)
+			maxAge = time.Duration(secs) * time.Second
+		}
+		if err != nil || maxAge < time.Second {
+			logger.Printf("ERROR: get query failed: invalid -alive duration: %s", *alive)
+			exitCode = 1
+			return
+		}
+		req.MaxPulseAge = uint64(maxAge / time.Second)
+		req.SortOrder = lf.QuerySortOrderPulse
+	}
 	if *rawOutput {
 		jsonOutput = false
 	}
@@ -651,17 +814,76 @@ func doGet(cfg *lf.ClientConfig, basePath string, args []string, jsonOutput bool
 	}
 
 	var results lf.QueryResults
-	for _, u := range urls {
-		results, err = u.ExecuteQuery(req)
-		if err == nil {
-			break
+	if *countOnly || *latestOnly {
+		// Aggregates are computed by the node, so only a summary and/or the latest records are transferred.
+		req.Aggregate = lf.QueryAggregateCount
+		if *latestOnly {
+			req.Aggregate = lf.QueryAggregateLatest
+		}
+		var qa *lf.QueryAggregate
+		for _, u := range urls {
+			qa, err = u.ExecuteAggregateQuery(req)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			logger.Printf("ERROR: get query failed: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+		if !*latestOnly {
+			if jsonOutput {
+				fmt.Println(lf.PrettyJSON(qa))
+				return
+			}
+			fmt.Printf("results: %d records: %d owners: %d\n", qa.ResultCount, qa.RecordCount, len(qa.Owners))
+			if qa.RecordCount > 0 {
+				fmt.Printf("time: %s .. %s\n", time.Unix(int64(qa.MinTimestamp), 0).Format(time.RFC1123), time.Unix(int64(qa.MaxTimestamp), 0).Format(time.RFC1123))
+			}
+			for i := range selectorNames {
+				if i < len(qa.MinOrdinal) && i < len(qa.MaxOrdinal) {
+					sn := []byte(selectorNames[i])
+					fmt.Printf("%s#%d..%d\n", selectorNames[i], qa.MinOrdinal[i].Get(sn), qa.MaxOrdinal[i].Get(sn))
+				}
+			}
+			return
+		}
+		results = qa.Latest
+	} else {
+		req.PageSize = &getPageSize
+		for {
+			var page lf.QueryResults
+			for _, u := range urls {
+				page, err = u.ExecuteQuery(req)
+				if err == nil {
+					break
+				}
+			}
+
+			if err != nil {
+				logger.Printf("ERROR: get query failed: %s\n", err.Error())
+				exitCode = 1
+				return
+			}
+
+			results = append(results, page...)
+			req.Cursor = page.Cursor()
+			if len(page) < getPageSize || len(req.Cursor) == 0 {
+				break
+			}
 		}
 	}
 
-	if err != nil {
-		logger.Printf("ERROR: get query failed: %s\n", err.Error())
-		exitCode = 1
-		return
+	if req.SortOrder == lf.QuerySortOrderPulse {
+		// The node puts the most recently pulsed record first within each result but returns results in
+		// ordinal order, so order results by their most recent pulse here once all pages are fetched.
+		sort.SliceStable(results, func(a, b int) bool {
+			if len(results[a]) == 0 || len(results[b]) == 0 {
+				return len(results[b]) == 0 && len(results[a]) > 0
+			}
+			return results[a][0].Pulse > results[b][0].Pulse
+		})
 	}
 
 	for _, ress := range results {
@@ -750,6 +972,84 @@ func doGet(cfg *lf.ClientConfig, basePath string, args []string, jsonOutput bool
 	return
 }
 
+// getRecordWriter gets the named or default owner with its private key and a node that can tell it how
+// to link a new record, for commands like set and delete that create and submit records.
+func getRecordWriter(cfg *lf.ClientConfig, basePath, ownerName, urlOverride string) (*lf.Owner, lf.RemoteNode, *lf.OwnerStatus, error) {
+	var owner *lf.ClientConfigOwner
+	if len(ownerName) > 0 {
+		owner = cfg.Owners[ownerName]
+		if owner == nil {
+			return nil, "", nil, fmt.Errorf("owner '%s' not found", ownerName)
+		}
+	}
+	if owner == nil {
+		for _, o := range cfg.Owners {
+			if o.Default {
+				owner = o
+				break
+			}
+		}
+	}
+	if owner == nil {
+		return nil, "", nil, fmt.Errorf("owner not found and no default specified")
+	}
+
+	urls, err := remoteNodesFromFlag(cfg, urlOverride)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if len(urls) == 0 {
+		return nil, "", nil, fmt.Errorf("no URLs configured!")
+	}
+
+	var workingURL lf.RemoteNode
+	var ownerInfo *lf.OwnerStatus
+	for _, u := range urls {
+		ownerInfo, err = u.OwnerStatus(owner.Public)
+		if err == nil {
+			workingURL = u
+			break
+		}
+	}
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("unable to get links for new record: %s", err.Error())
+	}
+
+	if !ownerInfo.HasCurrentCertificate && ownerInfo.AuthRequired {
+		return nil, "", nil, fmt.Errorf("owner %s must have a certificate (database requires authentication)", owner.Public.String())
+	}
+
+	o, err := getConfigOwner(basePath, owner)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("unable to get owner private key: %s", err.Error())
+	}
+	return o, workingURL, ownerInfo, nil
+}
+
+// addNewRecord creates a record, doing proof of work unless the owner has a certificate, and submits it to a node.
+func addNewRecord(basePath string, recordType int, value, maskingKey []byte, selectorNames [][]byte, selectorOrdinals []uint64, noWork bool, o *lf.Owner, workingURL lf.RemoteNode, ownerInfo *lf.OwnerStatus) (*lf.Record, error) {
+	var wf *lf.Wharrgarblr
+	if !ownerInfo.HasCurrentCertificate {
+		if noWork {
+			return nil, fmt.Errorf("no auth certificate found for owner %s and -nowork was specified", o.String())
+		}
+		wf = lf.NewWharrgarblr(lf.RecordDefaultWharrgarblMemory, 0)
+	}
+	stopProgress := startWorkProgress(basePath, wf)
+	rec, err := lf.NewRecord(recordType, value, lf.CastHashBlobsToArrays(ownerInfo.NewRecordLinks), maskingKey, selectorNames, selectorOrdinals, ownerInfo.ServerTime, wf, o)
+	stopProgress()
+	if err != nil {
+		return nil, err
+	}
+	for trials := 0; trials < 2; trials++ {
+		err = workingURL.AddRecord(rec)
+		if err == nil {
+			break
+		}
+	}
+	return rec, err
+}
+
 func doSet(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
 	go lf.WharrgarblInitTable(path.Join(basePath, "wharrgarbl-table.bin"))
 
@@ -774,59 +1074,17 @@ func doSet(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int)
 		return
 	}
 
-	var owner *lf.ClientConfigOwner
-	if len(*ownerName) > 0 {
-		owner = cfg.Owners[*ownerName]
-		if owner == nil {
-			logger.Printf("ERROR: set failed: owner '%s' not found\n", *ownerName)
-			exitCode = 1
-			return
-		}
-	}
-	if owner == nil {
-		for _, o := range cfg.Owners {
-			if o.Default {
-				owner = o
-				break
-			}
-		}
-	}
-	if owner == nil {
-		logger.Println("ERROR: set failed: owner not found and no default specified")
+	plainTextSelectorNames, plainTextSelectorOrdinals, err := parseSelectorArgs(args[0 : len(args)-1])
+	if err != nil {
+		logger.Printf("ERROR: set failed: %s\n", err.Error())
 		exitCode = 1
 		return
 	}
-
 	var mk []byte
 	if len(*maskKey) > 0 {
 		mk = []byte(*maskKey)
-	}
-
-	var plainTextSelectorNames [][]byte
-	var plainTextSelectorOrdinals []uint64
-	for i := 0; i < len(args)-1; i++ {
-		var unesc string
-		json.Unmarshal([]byte("\""+args[i]+"\""), &unesc) // use JSON string escaping for selector arguments
-		if len(unesc) > 0 {
-			selOrd := tokenizeStringWithEsc(unesc, '#', '\\')
-			if len(selOrd) > 0 {
-				if len(selOrd) > 2 {
-					logger.Println("ERROR: set failed: invalid selector#ordinal: \"" + args[i] + "\"")
-					exitCode = 1
-					return
-				}
-				sel := []byte(selOrd[0])
-				var ord uint64
-				if len(selOrd) == 2 {
-					ord, _ = strconv.ParseUint(selOrd[1], 10, 64)
-				}
-				plainTextSelectorNames = append(plainTextSelectorNames, sel)
-				plainTextSelectorOrdinals = append(plainTextSelectorOrdinals, ord)
-				if len(mk) == 0 {
-					mk = sel
-				}
-			}
-		}
+	} else if len(plainTextSelectorNames) > 0 {
+		mk = plainTextSelectorNames[0]
 	}
 
 	vstr := args[len(args)-1]
@@ -849,51 +1107,9 @@ func doSet(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int)
 		}
 	}
 
-	urls := cfg.URLs
-	if len(*urlOverride) > 0 {
-		urls2 := tokenizeStringWithEsc(*urlOverride, ',', '\\')
-		urls = nil
-		for i := 0; i < len(urls2); i++ {
-			u, err := lf.NewRemoteNode(urls2[i])
-			if err != nil {
-				logger.Printf("ERROR: invalid URL: %s (%s)", urls2[i], err.Error())
-				exitCode = 1
-				return
-			}
-			urls = append(urls, u)
-		}
-	}
-	if len(urls) == 0 {
-		logger.Println("ERROR: set failed: no URLs configured!")
-		exitCode = 1
-		return
-	}
-
-	var workingURL lf.RemoteNode
-	var ownerInfo *lf.OwnerStatus
-	for _, u := range urls {
-		ownerInfo, err = u.OwnerStatus(owner.Public)
-		if err == nil {
-			workingURL = u
-			break
-		}
-	}
+	o, workingURL, ownerInfo, err := getRecordWriter(cfg, basePath, *ownerName, *urlOverride)
 	if err != nil {
-		logger.Printf("ERROR: set failed: unable to get links for new record: %s", err.Error())
-		exitCode = 1
-		return
-	}
-
-	if !ownerInfo.HasCurrentCertificate && ownerInfo.AuthRequired {
-		logger.Printf("ERROR: owner %s must have a certificate (database requires authentication)", owner.Public.String())
-		exitCode = 1
-		return
-	}
-
-	var o *lf.Owner
-	o, err = owner.GetOwner()
-	if err != nil {
-		logger.Printf("ERROR: invalid owner in config: %s", err.Error())
+		logger.Printf("ERROR: set failed: %s\n", err.Error())
 		exitCode = 1
 		return
 	}
@@ -906,7 +1122,7 @@ func doSet(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int)
 	one := 1
 	query := lf.Query{
 		Ranges:  ranges,
-		Owners:  []lf.OwnerPublic{owner.Public},
+		Owners:  []lf.OwnerPublic{o.Public},
 		Limit:   &one,
 		Oracles: cfg.Oracles,
 	}
@@ -944,27 +1160,58 @@ func doSet(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int)
 		}
 	}
 
-	var rec *lf.Record
+	rec, err := addNewRecord(basePath, lf.RecordTypeDatum, value, mk, plainTextSelectorNames, plainTextSelectorOrdinals, *noWork, o, workingURL, ownerInfo)
+	if err != nil {
+		logger.Printf("ERROR: %s\n", err.Error())
+		exitCode = 1
+		return
+	}
 
-	var wf *lf.Wharrgarblr
-	if !ownerInfo.HasCurrentCertificate {
-		if *noWork {
-			logger.Printf("ERROR: no auth certificate found for owner %s and -nowork was specified.\n", o.String())
-			exitCode = 1
-			return
-		}
-		wf = lf.NewWharrgarblr(lf.RecordDefaultWharrgarblMemory, 0)
+	rh := rec.Hash()
+	fmt.Printf("%s =%s\n", o.String(), lf.Base62Encode(rh[:]))
+
+	return
+}
+
+func doDelete(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
+	go lf.WharrgarblInitTable(path.Join(basePath, "wharrgarbl-table.bin"))
+
+	deleteOpts := flag.NewFlagSet("delete", flag.ContinueOnError)
+	ownerName := deleteOpts.String("owner", "", "")
+	urlOverride := deleteOpts.String("url", "", "")
+	noWork := deleteOpts.Bool("nowork", false, "")
+	deleteOpts.SetOutput(ioutil.Discard)
+	err := deleteOpts.Parse(args)
+	if err != nil {
+		printHelp("")
+		exitCode = 1
+		return
 	}
-	rec, err = lf.NewRecord(lf.RecordTypeDatum, value, lf.CastHashBlobsToArrays(ownerInfo.NewRecordLinks), mk, plainTextSelectorNames, plainTextSelectorOrdinals, ownerInfo.ServerTime, wf, o)
-	if err == nil {
-		for trials := 0; trials < 2; trials++ {
-			err = workingURL.AddRecord(rec)
-			if err == nil {
-				break
-			}
-		}
+	args = deleteOpts.Args()
+	if len(args) < 1 { // must have at least one selector
+		printHelp("")
+		exitCode = 1
+		return
 	}
 
+	plainTextSelectorNames, plainTextSelectorOrdinals, err := parseSelectorArgs(args)
+	if err == nil && len(plainTextSelectorNames) == 0 {
+		err = fmt.Errorf("at least one selector is required")
+	}
+	if err != nil {
+		logger.Printf("ERROR: delete failed: %s\n", err.Error())
+		exitCode = 1
+		return
+	}
+
+	o, workingURL, ownerInfo, err := getRecordWriter(cfg, basePath, *ownerName, *urlOverride)
+	if err != nil {
+		logger.Printf("ERROR: delete failed: %s\n", err.Error())
+		exitCode = 1
+		return
+	}
+
+	rec, err := addNewRecord(basePath, lf.RecordTypeDelete, nil, plainTextSelectorNames[0], plainTextSelectorNames, plainTextSelectorOrdinals, *noWork, o, workingURL, ownerInfo)
 	if err != nil {
 		logger.Printf("ERROR: %s\n", err.Error())
 		exitCode = 1
@@ -996,7 +1243,11 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 			if o.Default {
 				dfl = "*"
 			}
-			fmt.Printf("%-24s %s %-7s %s\n", n, dfl, o.Public.TypeString(), o.Public.String())
+			locked := ""
+			if o.IsLocked() {
+				locked = " (locked)"
+			}
+			fmt.Printf("%-24s %s %-7s %s%s\n", n, dfl, o.Public.TypeString(), o.Public.String(), locked)
 		}
 
 	case "new":
@@ -1111,7 +1362,7 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 			owner = cfgOwner.Public
 		}
 		found := false
-		for _, u := range cfg.URLs {
+		for _, u := range cfg.RemoteNodes() {
 			ownerInfo, err := u.OwnerStatus(owner)
 			if err == nil {
 				fmt.Println(lf.PrettyJSON(ownerInfo))
@@ -1177,6 +1428,66 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 		cfg.Dirty = true
 		fmt.Printf("%s renamed from %s to %s\n", old.Public.String(), oldName, newName)
 
+	case "lock":
+		if len(args) < 2 {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		name := strings.TrimSpace(args[1])
+		cfgOwner := cfg.Owners[name]
+		if cfgOwner == nil {
+			logger.Printf("ERROR: an owner named '%s' does not exist.\n", name)
+			exitCode = 1
+			return
+		}
+		if cfgOwner.IsLocked() {
+			logger.Printf("ERROR: owner '%s' is already locked.\n", name)
+			exitCode = 1
+			return
+		}
+		passphrase := promptPassphrase("New passphrase: ")
+		if os.Getenv("LF_OWNER_PASSPHRASE") == "" && promptPassphrase("Repeat passphrase: ") != passphrase {
+			logger.Println("ERROR: passphrases do not match.")
+			exitCode = 1
+			return
+		}
+		err := cfgOwner.Lock(passphrase)
+		if err != nil {
+			logger.Printf("ERROR: unable to lock owner: %s", err.Error())
+			exitCode = 1
+			return
+		}
+		cfg.Dirty = true
+		fmt.Printf("%s locked\n", cfgOwner.Public.String())
+
+	case "unlock":
+		if len(args) < 2 {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		name := strings.TrimSpace(args[1])
+		cfgOwner := cfg.Owners[name]
+		if cfgOwner == nil {
+			logger.Printf("ERROR: an owner named '%s' does not exist.\n", name)
+			exitCode = 1
+			return
+		}
+		if !cfgOwner.IsLocked() {
+			logger.Printf("ERROR: owner '%s' is not locked.\n", name)
+			exitCode = 1
+			return
+		}
+		err := cfgOwner.Unlock(promptPassphrase("Passphrase for owner " + cfgOwner.Public.String() + ": "))
+		if err != nil {
+			logger.Printf("ERROR: unable to unlock owner: %s", err.Error())
+			exitCode = 1
+			return
+		}
+		cfg.Dirty = true
+		fmt.Printf("%s unlocked (private key is stored without encryption)\n", cfgOwner.Public.String())
+
 	case "export", "exportstring":
 		if len(args) < 2 {
 			printHelp("")
@@ -1191,9 +1502,9 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 			return
 		}
 
-		owner, err := cfgOwner.GetOwner()
+		owner, err := getConfigOwner(basePath, cfgOwner)
 		if err != nil {
-			logger.Printf("ERROR: invalid owner in config: %s", err.Error())
+			logger.Printf("ERROR: unable to get owner private key: %s", err.Error())
 			exitCode = 1
 			return
 		}
@@ -1283,9 +1594,9 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 			exitCode = 1
 			return
 		}
-		owner, _ := cfgOwner.GetOwner()
-		if owner == nil {
-			logger.Println("ERROR: an owner named '" + args[1] + "' does not exist.")
+		owner, err := getConfigOwner(basePath, cfgOwner)
+		if err != nil {
+			logger.Printf("ERROR: unable to get owner private key: %s", err.Error())
 			exitCode = 1
 			return
 		}
@@ -1369,7 +1680,7 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 			return
 		}
 		var cert *x509.Certificate
-		var key *ecdsa.PrivateKey
+		var key crypto.PrivateKey
 		var err error
 		for len(certPemBytes) > 0 {
 			pemBlock, nextBytes := pem.Decode(certPemBytes)
@@ -1392,6 +1703,13 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 					exitCode = 1
 					return
 				}
+			} else if pemBlock.Type == "PRIVATE KEY" {
+				key, err = x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+				if err != nil {
+					logger.Printf("ERROR: unable to read certificate and key from PEM data in %s (PKCS#8 private key decode failed: %s)\n", args[1], err.Error())
+					exitCode = 1
+					return
+				}
 			} else {
 				logger.Printf("ERROR: unable to read certificate and key from PEM data in %s (PEM type not recognized: %s)\n", args[1], pemBlock.Type)
 				exitCode = 1
@@ -1400,11 +1718,9 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 			certPemBytes = nextBytes
 		}
 		if cert == nil || key == nil {
-			if err != nil {
-				logger.Printf("ERROR: unable to read certificate and key from PEM data in %s (PEM must contain both certificate and private key)\n", args[1])
-				exitCode = 1
-				return
-			}
+			logger.Printf("ERROR: unable to read certificate and key from PEM data in %s (PEM must contain both certificate and private key)\n", args[1])
+			exitCode = 1
+			return
 		}
 
 		csrPemBytes, _ := ioutil.ReadFile(args[2])
@@ -1432,16 +1748,16 @@ func doOwner(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int
 			return
 		}
 
-		owner, err := lf.NewOwnerFromECDSAPrivateKey(key)
+		owner, err := lf.NewOwnerFromPrivateKey(key)
 		if err != nil {
-			logger.Printf("ERROR: unable to derive owner from ECDSA private key: %s", err.Error())
+			logger.Printf("ERROR: unable to derive owner from CA private key: %s", err.Error())
 			exitCode = 1
 			return
 		}
 
 		var workingURL lf.RemoteNode
 		var links [][32]byte
-		for _, u := range cfg.URLs {
+		for _, u := range cfg.RemoteNodes() {
 			ownerStatus, _ := u.OwnerStatus(owner.Public)
 			if ownerStatus != nil {
 				links = lf.CastHashBlobsToArrays(ownerStatus.NewRecordLinks)
@@ -1568,6 +1884,28 @@ func doURL(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int)
 			fmt.Println(u)
 		}
 
+	case "token":
+		if len(args) < 2 || len(args) > 3 {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		url, err := lf.NewRemoteNode(strings.TrimSpace(args[1]))
+		if err != nil {
+			fmt.Printf("ERROR: invalid URL: %s (%s)", args[1], err.Error())
+			exitCode = 1
+			return
+		}
+		if len(args) == 3 && len(strings.TrimSpace(args[2])) > 0 {
+			if cfg.AuthTokens == nil {
+				cfg.AuthTokens = make(map[string]string)
+			}
+			cfg.AuthTokens[string(url)] = strings.TrimSpace(args[2])
+		} else {
+			delete(cfg.AuthTokens, string(url))
+		}
+		cfg.Dirty = true
+
 	default:
 		printHelp("")
 		exitCode = 1
@@ -1640,6 +1978,88 @@ func doOracle(cfg *lf.ClientConfig, basePath string, args []string) (exitCode in
 	return
 }
 
+func doTrust(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
+	cmd := "list"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+
+	case "list":
+		names := make([]string, 0, len(cfg.TrustPolicies))
+		for name := range cfg.TrustPolicies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tpj, _ := json.Marshal(cfg.TrustPolicies[name])
+			fmt.Printf("%s %s\n", name, string(tpj))
+		}
+
+	case "set":
+		if len(args) < 3 {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		var tp lf.TrustPolicy
+		if err := json.Unmarshal([]byte(args[2]), &tp); err != nil {
+			logger.Printf("ERROR: invalid trust policy: %s", err.Error())
+			exitCode = 1
+			return
+		}
+		if cfg.TrustPolicies == nil {
+			cfg.TrustPolicies = make(map[string]*lf.TrustPolicy)
+		}
+		cfg.TrustPolicies[args[1]] = &tp
+		cfg.Dirty = true
+		fmt.Printf("trust policy %s set\n", args[1])
+
+	case "delete":
+		if len(args) < 2 {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		if _, have := cfg.TrustPolicies[args[1]]; !have {
+			logger.Printf("ERROR: trust policy %s not found", args[1])
+			exitCode = 1
+			return
+		}
+		delete(cfg.TrustPolicies, args[1])
+		cfg.Dirty = true
+		fmt.Printf("trust policy %s deleted\n", args[1])
+
+	default:
+		printHelp("")
+		exitCode = 1
+	}
+	return
+}
+
+// parseSeedPeers parses the comma separated ip/port/identity seed peers entered when making genesis records.
+func parseSeedPeers(s string) ([]lf.Peer, error) {
+	var peers []lf.Peer
+	for _, ps := range strings.Split(s, ",") {
+		ps = strings.TrimSpace(ps)
+		if len(ps) == 0 {
+			continue
+		}
+		f := strings.Split(ps, "/")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("invalid seed peer '%s' (format: ip/port/identity)", ps)
+		}
+		ip := net.ParseIP(f[0])
+		port, err := strconv.ParseUint(f[1], 10, 64)
+		identity := lf.Base62Decode(f[2])
+		if ip == nil || err != nil || port == 0 || port > 65535 || len(identity) == 0 {
+			return nil, fmt.Errorf("invalid seed peer '%s' (format: ip/port/identity)", ps)
+		}
+		peers = append(peers, lf.Peer{IP: ip, Port: int(port), Identity: identity})
+	}
+	return peers, nil
+}
+
 // doMakeGenesis is currently code for making the default genesis records and isn't very useful to anyone else.
 func doMakeGenesis(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
 	var g lf.GenesisParameters
@@ -1663,7 +2083,15 @@ func doMakeGenesis(cfg *lf.ClientConfig, basePath string, args []string) (exitCo
 	}
 	g.RecordMaxTimeDrift = atoUI(prompt("Record maximum time drift (seconds) [60]: ", false, "60"))
 	for {
-		af := prompt("Amendable fields (comma separated) [authcertificates]: ", false, "authcertificates")
+		sp, err := parseSeedPeers(prompt("Seed peers (comma separated ip/port/identity) []: ", false, ""))
+		if err == nil {
+			g.SeedPeers = sp
+			break
+		}
+		logger.Printf("ERROR: %s\n", err.Error())
+	}
+	for {
+		af := prompt("Amendable fields (comma separated) [authcertificates,seedpeers]: ", false, "authcertificates,seedpeers")
 		if len(af) > 0 {
 			err := g.SetAmendableFields(strings.Split(af, ","))
 			if err == nil {
@@ -1853,6 +2281,10 @@ func main() {
 		return
 	}
 
+	// Loopback requests need a token, so use a local node's master token if it's readable.
+	localAuthToken, _ := ioutil.ReadFile(path.Join(*basePath, "authtoken.secret"))
+	cfg.LocalAuthToken = string(bytes.TrimSpace(localAuthToken))
+
 	switch args[0] {
 
 	case "help":
@@ -1903,12 +2335,24 @@ func main() {
 	case "node-connect":
 		exitCode = doNodeConnect(&cfg, *basePath, cmdArgs)
 
+	case "node-snapshot":
+		exitCode = doNodeSnapshot(&cfg, *basePath, cmdArgs)
+
+	case "node-restore":
+		exitCode = doNodeRestore(&cfg, *basePath, cmdArgs)
+
+	case "node-fsck":
+		exitCode = doNodeFsck(&cfg, *basePath, cmdArgs)
+
 	case "status":
 		exitCode = doStatus(&cfg, *basePath, cmdArgs)
 
 	case "set":
 		exitCode = doSet(&cfg, *basePath, cmdArgs)
 
+	case "delete":
+		exitCode = doDelete(&cfg, *basePath, cmdArgs)
+
 	case "get":
 		exitCode = doGet(&cfg, *basePath, cmdArgs, *jsonOutput)
 
@@ -1921,6 +2365,21 @@ func main() {
 	case "oracle":
 		exitCode = doOracle(&cfg, *basePath, cmdArgs)
 
+	case "trust":
+		exitCode = doTrust(&cfg, *basePath, cmdArgs)
+
+	case "record":
+		exitCode = doRecord(&cfg, *basePath, cmdArgs)
+
+	case "pulse-daemon":
+		exitCode = doPulseDaemon(&cfg, *basePath, cmdArgs)
+
+	case "work-estimate":
+		exitCode = doWorkEstimate(&cfg, *basePath, cmdArgs, *jsonOutput)
+
+	case "agent":
+		exitCode = doAgent(&cfg, *basePath, cmdArgs)
+
 	case "makegenesis":
 		exitCode = doMakeGenesis(&cfg, *basePath, cmdArgs)
 
@@ -0,0 +1,354 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package main
+
+// This is the pulse daemon, which keeps records alive by pulsing them on a schedule and
+// replacing them with new records with the same value when they can't be pulsed any more.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"lf/pkg/lf"
+)
+
+// pulseDaemonConfigName is the name of the pulse daemon's configuration file in the client base path.
+const pulseDaemonConfigName = "pulsedaemon.json"
+
+// pulseDaemonStateName is the name of the file in the client base path where the pulse daemon saves its state.
+const pulseDaemonStateName = "pulsedaemon-state.json"
+
+const (
+	pulseDaemonDefaultInterval = 300 // Default seconds between pulses
+	pulseDaemonMinInterval     = 60  // Pulses count minutes, so pulsing more often does nothing
+	pulseDaemonRetryInterval   = 60  // Seconds to wait before retrying after a failure
+)
+
+// pulseDaemonEntry is a record to keep alive.
+type pulseDaemonEntry struct {
+	Owner      string   `json:",omitempty"` // Owner name (default owner if empty)
+	Selectors  []string ``                  // Selectors of record to pulse as name[#ordinal] (same escaping as set)
+	MaskingKey string   `json:",omitempty"` // Masking key (default: first selector name)
+	Interval   uint     `json:",omitempty"` // Seconds between pulses (default: 300, minimum: 60)
+	Remote     bool     `json:",omitempty"` // If true have the node make pulses and new records (sends owner's private key to node!)
+}
+
+// pulseDaemonConfig is the contents of pulsedaemon.json.
+type pulseDaemonConfig struct {
+	Pulses []*pulseDaemonEntry
+}
+
+// pulseDaemonEntryState is the saved state of an entry, keyed by owner and selectors.
+type pulseDaemonEntryState struct {
+	RecordHash      lf.HashBlob `json:",omitempty"` // Hash of record being pulsed
+	RecordTimestamp uint64      `json:",omitempty"` // Timestamp of record being pulsed
+	Minutes         uint        `json:",omitempty"` // Minutes of last pulse sent for this record
+	LastPulse       uint64      ``                  // Time of last successful pulse or new record (seconds since epoch)
+}
+
+// pulseDaemonTask is an entry with its owner and selectors resolved.
+type pulseDaemonTask struct {
+	key        string
+	remote     bool
+	owner      *lf.Owner
+	names      [][]byte
+	ordinals   []uint64
+	maskingKey []byte
+	interval   time.Duration
+	next       time.Time
+}
+
+func loadPulseDaemonState(statePath string) map[string]*pulseDaemonEntryState {
+	state := make(map[string]*pulseDaemonEntryState)
+	d, err := ioutil.ReadFile(statePath)
+	if err == nil && len(d) > 0 {
+		if json.Unmarshal(d, &state) != nil {
+			logger.Printf("WARNING: ignoring invalid %s", statePath)
+			state = make(map[string]*pulseDaemonEntryState)
+		}
+	}
+	return state
+}
+
+// pulse pulses a task's record, or replaces it with a new record with the same value if it's too old to pulse.
+func (t *pulseDaemonTask) pulse(urls []lf.RemoteNode, st *pulseDaemonEntryState) error {
+	var err error
+	var u lf.RemoteNode
+	var ownerInfo *lf.OwnerStatus
+	for _, u = range urls {
+		ownerInfo, err = u.OwnerStatus(t.owner.Public)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if t.remote {
+		priv, err := t.owner.PrivateBytes()
+		if err != nil {
+			return err
+		}
+		var selectors []lf.MakeSelector
+		for i := range t.names {
+			selectors = append(selectors, lf.MakeSelector{Name: t.names[i], Ordinal: t.ordinals[i]})
+		}
+		yes := true
+		pulse, rec, ok, err := u.ExecuteMakePulse(&lf.MakePulse{Selectors: selectors, OwnerPrivate: priv, MaskingKey: t.maskingKey, NewRecordIfPulseSpanExceeded: &yes})
+		if err != nil {
+			return err
+		}
+		if rec != nil {
+			rh := rec.Hash()
+			logger.Printf("%s: created new record =%s (record was too old to pulse)", t.key, lf.Base62Encode(rh[:]))
+		} else if len(pulse) > 0 && ok {
+			logger.Printf("%s: pulse %s", t.key, pulse.String())
+		}
+		st.LastPulse = ownerInfo.ServerTime
+		return nil
+	}
+
+	var ranges []lf.QueryRange
+	for i := range t.names {
+		key := lf.MakeSelectorKey(t.names[i], t.ordinals[i])
+		ranges = append(ranges, lf.QueryRange{KeyRange: []lf.Blob{key, key}})
+	}
+	one := 1
+	results, err := u.ExecuteQuery(&lf.Query{Ranges: ranges, Owners: []lf.OwnerPublic{t.owner.Public}, Limit: &one})
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 || len(results[0]) == 0 || results[0][0].Record == nil {
+		return lf.ErrRecordNotFound
+	}
+	old := &results[0][0]
+	if old.Record.Type == lf.RecordTypeDelete {
+		return fmt.Errorf("record =%s was deleted", lf.Base62Encode(old.Hash[:]))
+	}
+	if old.Record.Timestamp < st.RecordTimestamp { // a newer record (e.g. from a rollover) hasn't reached the node yet
+		return nil
+	}
+	if old.Hash != st.RecordHash {
+		*st = pulseDaemonEntryState{RecordHash: old.Hash, RecordTimestamp: old.Record.Timestamp, LastPulse: st.LastPulse}
+	}
+	if old.Record.Timestamp >= ownerInfo.ServerTime {
+		return nil
+	}
+	minutes := uint((ownerInfo.ServerTime - old.Record.Timestamp) / 60)
+	if minutes <= st.Minutes { // nothing new to say, e.g. if restarted right after a pulse
+		return nil
+	}
+
+	if minutes > lf.RecordMaxPulseSpan {
+		// Replace the record with a new one with the same value, as MakePulse does if NewRecordIfPulseSpanExceeded is set.
+		value, err := old.Record.GetValue(t.maskingKey)
+		if err != nil {
+			return err
+		}
+		var wf *lf.Wharrgarblr
+		if !ownerInfo.HasCurrentCertificate {
+			wf = lf.NewWharrgarblr(lf.RecordDefaultWharrgarblMemory, 0)
+		}
+		rec, err := lf.NewRecord(old.Record.Type, value, lf.CastHashBlobsToArrays(ownerInfo.NewRecordLinks), t.maskingKey, t.names, t.ordinals, ownerInfo.ServerTime, wf, t.owner)
+		if err != nil {
+			return err
+		}
+		err = u.AddRecord(rec)
+		if err != nil {
+			return err
+		}
+		rh := rec.Hash()
+		*st = pulseDaemonEntryState{RecordHash: rh, RecordTimestamp: rec.Timestamp, LastPulse: ownerInfo.ServerTime}
+		logger.Printf("%s: created new record =%s (record =%s was too old to pulse)", t.key, lf.Base62Encode(rh[:]), lf.Base62Encode(old.Hash[:]))
+		return nil
+	}
+
+	pulse, err := lf.NewPulse(t.owner, t.names, t.ordinals, old.Record.Timestamp, minutes)
+	if err != nil {
+		return err
+	}
+	_, err = u.DoPulse(pulse, true)
+	if err != nil {
+		return err
+	}
+	st.Minutes = minutes
+	st.LastPulse = ownerInfo.ServerTime
+	logger.Printf("%s: pulse %s (record =%s + %d minutes)", t.key, pulse.String(), lf.Base62Encode(old.Hash[:]), minutes)
+	return nil
+}
+
+func doPulseDaemon(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
+	pdOpts := flag.NewFlagSet("pulse-daemon", flag.ContinueOnError)
+	urlOverride := pdOpts.String("url", "", "")
+	once := pdOpts.Bool("once", false, "")
+	pdOpts.SetOutput(ioutil.Discard)
+	err := pdOpts.Parse(args)
+	if err != nil || len(pdOpts.Args()) != 0 {
+		printHelp("")
+		exitCode = 1
+		return
+	}
+	logger = log.New(os.Stderr, "", log.LstdFlags)
+
+	configPath := path.Join(basePath, pulseDaemonConfigName)
+	var pdc pulseDaemonConfig
+	d, err := ioutil.ReadFile(configPath)
+	if err == nil {
+		err = json.Unmarshal(d, &pdc)
+	}
+	if err != nil {
+		logger.Printf("ERROR: unable to read %s: %s", configPath, err.Error())
+		exitCode = 1
+		return
+	}
+	if len(pdc.Pulses) == 0 {
+		logger.Printf("ERROR: no records to pulse are configured in %s", configPath)
+		exitCode = 1
+		return
+	}
+
+	urls, err := remoteNodesFromFlag(cfg, *urlOverride)
+	if err != nil {
+		logger.Printf("ERROR: %s", err.Error())
+		exitCode = 1
+		return
+	}
+	if len(urls) == 0 {
+		logger.Println("ERROR: no URLs configured!")
+		exitCode = 1
+		return
+	}
+
+	statePath := path.Join(basePath, pulseDaemonStateName)
+	state := loadPulseDaemonState(statePath)
+
+	var tasks []*pulseDaemonTask
+	owners := make(map[string]*lf.Owner)
+	for _, e := range pdc.Pulses {
+		var co *lf.ClientConfigOwner
+		if len(e.Owner) > 0 {
+			co = cfg.Owners[e.Owner]
+		} else {
+			for _, o := range cfg.Owners {
+				if o.Default {
+					co = o
+					break
+				}
+			}
+		}
+		if co == nil {
+			logger.Printf("ERROR: owner '%s' not found and no default specified", e.Owner)
+			exitCode = 1
+			return
+		}
+		o := owners[co.Public.String()]
+		if o == nil {
+			o, err = getConfigOwner(basePath, co)
+			if err != nil {
+				logger.Printf("ERROR: unable to get owner private key: %s", err.Error())
+				exitCode = 1
+				return
+			}
+			owners[co.Public.String()] = o
+		}
+
+		t := &pulseDaemonTask{
+			key:      co.Public.String() + " " + strings.Join(e.Selectors, " "),
+			remote:   e.Remote,
+			owner:    o,
+			interval: time.Duration(e.Interval) * time.Second,
+		}
+		t.names, t.ordinals, err = parseSelectorArgs(e.Selectors)
+		if err == nil && len(t.names) == 0 {
+			err = lf.ErrQueryRequiresSelectors
+		}
+		if err != nil {
+			logger.Printf("ERROR: %s: %s", configPath, err.Error())
+			exitCode = 1
+			return
+		}
+		if len(e.MaskingKey) > 0 {
+			t.maskingKey = []byte(e.MaskingKey)
+		} else {
+			t.maskingKey = t.names[0]
+		}
+		if e.Interval == 0 {
+			t.interval = pulseDaemonDefaultInterval * time.Second
+		} else if e.Interval < pulseDaemonMinInterval {
+			t.interval = pulseDaemonMinInterval * time.Second
+		}
+		if st := state[t.key]; st != nil && !*once {
+			t.next = time.Unix(int64(st.LastPulse), 0).Add(t.interval)
+		}
+		tasks = append(tasks, t)
+	}
+
+	osSignalChannel := make(chan os.Signal, 2)
+	signal.Notify(osSignalChannel, syscall.SIGINT, syscall.SIGTERM)
+
+	logger.Printf("pulse daemon started (%d records, state in %s)", len(tasks), statePath)
+	for {
+		now := time.Now()
+		next := now.Add(time.Hour)
+		for _, t := range tasks {
+			if !now.Before(t.next) {
+				st := state[t.key]
+				if st == nil {
+					st = new(pulseDaemonEntryState)
+					state[t.key] = st
+				}
+				err = t.pulse(urls, st)
+				if err != nil {
+					logger.Printf("ERROR: %s: %s", t.key, err.Error())
+					exitCode = 1
+					t.next = time.Now().Add(pulseDaemonRetryInterval * time.Second)
+				} else {
+					t.next = time.Now().Add(t.interval)
+				}
+				if d, err := json.MarshalIndent(state, "", "\t"); err == nil {
+					err = ioutil.WriteFile(statePath, d, 0600)
+					if err != nil {
+						logger.Printf("WARNING: cannot write %s: %s", statePath, err.Error())
+					}
+				}
+			}
+			if t.next.Before(next) {
+				next = t.next
+			}
+		}
+		if *once {
+			return
+		}
+		exitCode = 0
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-osSignalChannel:
+			timer.Stop()
+			logger.Printf("pulse daemon stopped")
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,453 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package main
+
+// This is the offline record builder, which allows proof of work, signing, and submission
+// of a record to take place on different machines (e.g. signing on an air-gapped host).
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"lf/pkg/lf"
+)
+
+// PEM types for records in progress and completed records.
+const (
+	recordUnsignedPEMType = "LF UNSIGNED RECORD"
+	recordPEMType         = "LF RECORD"
+)
+
+// parseSelectorArgs decodes name[#ordinal] selector arguments for set, delete, record build, and the pulse daemon.
+func parseSelectorArgs(args []string) (names [][]byte, ordinals []uint64, err error) {
+	for i := 0; i < len(args); i++ {
+		var unesc string
+		json.Unmarshal([]byte("\""+args[i]+"\""), &unesc) // use JSON string escaping for selector arguments
+		if len(unesc) > 0 {
+			selOrd := tokenizeStringWithEsc(unesc, '#', '\\')
+			if len(selOrd) > 0 {
+				if len(selOrd) > 2 {
+					err = fmt.Errorf("invalid selector#ordinal: \"%s\"", args[i])
+					return
+				}
+				var ord uint64
+				if len(selOrd) == 2 {
+					ord, _ = strconv.ParseUint(selOrd[1], 10, 64)
+				}
+				names = append(names, []byte(selOrd[0]))
+				ordinals = append(ordinals, ord)
+			}
+		}
+	}
+	return
+}
+
+// readRecordFile reads a record from a PEM file written by 'record build', 'record work', or 'record sign'.
+func readRecordFile(fileName string) (*lf.Record, bool, error) {
+	pemBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, false, err
+	}
+	pemBlock, _ := pem.Decode(pemBytes)
+	if pemBlock == nil {
+		return nil, false, fmt.Errorf("%s: PEM decode failed", fileName)
+	}
+	if pemBlock.Type != recordUnsignedPEMType && pemBlock.Type != recordPEMType {
+		return nil, false, fmt.Errorf("%s: PEM does not contain a record (type: %s)", fileName, pemBlock.Type)
+	}
+	rec, err := lf.NewRecordFromBytes(pemBlock.Bytes)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: invalid record: %s", fileName, err.Error())
+	}
+	signed := pemBlock.Type == recordPEMType && len(rec.Signature) > 0
+	return rec, signed, nil
+}
+
+// writeRecordFile writes a record to a PEM file with some informational headers.
+func writeRecordFile(fileName string, rec *lf.Record, signed bool) error {
+	hdrs := make(map[string]string)
+	hdrs["Owner"] = rec.Owner.String()
+	hdrs["Timestamp"] = strconv.FormatUint(rec.Timestamp, 10)
+	if rec.WorkAlgorithm == lf.RecordWorkAlgorithmWharrgarbl {
+		hdrs["Work"] = "wharrgarbl"
+	} else {
+		hdrs["Work"] = "none"
+	}
+	pemType := recordUnsignedPEMType
+	if signed {
+		pemType = recordPEMType
+		hdrs["Hash"] = "=" + rec.HashString()
+	}
+	return ioutil.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: pemType, Headers: hdrs, Bytes: rec.Bytes()}), 0644)
+}
+
+func doRecord(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
+	if len(args) < 1 {
+		printHelp("")
+		exitCode = 1
+		return
+	}
+	cmd := args[0]
+	args = args[1:]
+	switch cmd {
+
+	case "build":
+		buildOpts := flag.NewFlagSet("build", flag.ContinueOnError)
+		ownerName := buildOpts.String("owner", "", "")
+		maskKey := buildOpts.String("mask", "", "")
+		valueIsFile := buildOpts.Bool("file", false, "")
+		urlOverride := buildOpts.String("url", "", "")
+		buildOpts.SetOutput(ioutil.Discard)
+		err := buildOpts.Parse(args)
+		if err != nil {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		args = buildOpts.Args()
+		if len(args) < 3 { // must have an output file, at least one selector, and a value
+			printHelp("")
+			exitCode = 1
+			return
+		}
+
+		// The owner may be given as @owner since only the public key is needed here.
+		var ownerPublic lf.OwnerPublic
+		if strings.HasPrefix(*ownerName, "@") {
+			ownerPublic, err = lf.NewOwnerPublicFromString(*ownerName)
+			if err != nil || ownerPublic.Type() == 0 {
+				logger.Printf("ERROR: build failed: invalid owner %s\n", *ownerName)
+				exitCode = 1
+				return
+			}
+		} else if len(*ownerName) > 0 {
+			owner := cfg.Owners[*ownerName]
+			if owner == nil {
+				logger.Printf("ERROR: build failed: owner '%s' not found\n", *ownerName)
+				exitCode = 1
+				return
+			}
+			ownerPublic = owner.Public
+		} else {
+			for _, o := range cfg.Owners {
+				if o.Default {
+					ownerPublic = o.Public
+					break
+				}
+			}
+		}
+		if len(ownerPublic) == 0 {
+			logger.Println("ERROR: build failed: owner not found and no default specified")
+			exitCode = 1
+			return
+		}
+
+		selectorNames, selectorOrdinals, err := parseSelectorArgs(args[1 : len(args)-1])
+		if err != nil {
+			logger.Printf("ERROR: build failed: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+		var mk []byte
+		if len(*maskKey) > 0 {
+			mk = []byte(*maskKey)
+		} else if len(selectorNames) > 0 {
+			mk = selectorNames[0]
+		}
+
+		vstr := args[len(args)-1]
+		value := []byte(vstr)
+		if *valueIsFile {
+			if vstr == "-" {
+				value, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				value, err = ioutil.ReadFile(vstr)
+			}
+			if err != nil {
+				logger.Printf("ERROR: build failed: unable to read value from '%s' (%s)\n", vstr, err.Error())
+				exitCode = 1
+				return
+			}
+		}
+
+		urls, err := remoteNodesFromFlag(cfg, *urlOverride)
+		if err != nil {
+			logger.Printf("ERROR: build failed: %s", err.Error())
+			exitCode = 1
+			return
+		}
+		if len(urls) == 0 {
+			logger.Println("ERROR: build failed: no URLs configured!")
+			exitCode = 1
+			return
+		}
+
+		var links [][32]byte
+		var serverTime uint64
+		for _, u := range urls {
+			links, serverTime, err = u.Links(0)
+			if err == nil && len(links) > 0 {
+				break
+			}
+		}
+		if len(links) == 0 {
+			if err == nil {
+				err = lf.ErrRecordInsufficientLinks
+			}
+			logger.Printf("ERROR: build failed: unable to get links for new record: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+
+		// Pulse tokens are derived from the owner's private key, which isn't available here,
+		// so records built offline have no pulse token and can't be extended with pulses.
+		var rb lf.RecordBuilder
+		err = rb.Start(lf.RecordTypeDatum, value, links, mk, selectorNames, selectorOrdinals, ownerPublic, 0, serverTime)
+		if err != nil {
+			logger.Printf("ERROR: build failed: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+		err = writeRecordFile(args[0], rb.Record(), false)
+		if err != nil {
+			logger.Printf("ERROR: build failed: unable to write %s: %s\n", args[0], err.Error())
+			exitCode = 1
+			return
+		}
+		fmt.Printf("%s unsigned record written to %s\n", ownerPublic.String(), args[0])
+
+	case "work":
+		workOpts := flag.NewFlagSet("work", flag.ContinueOnError)
+		workURL := workOpts.String("url", "", "")
+		workOpts.SetOutput(ioutil.Discard)
+		err := workOpts.Parse(args)
+		if err != nil {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		args = workOpts.Args()
+		if len(args) < 1 || len(args) > 2 {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		outFile := args[0]
+		if len(args) == 2 {
+			outFile = args[1]
+		}
+
+		rec, signed, err := readRecordFile(args[0])
+		if err != nil {
+			logger.Printf("ERROR: work failed: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+		if signed {
+			logger.Printf("ERROR: work failed: %s is already signed\n", args[0])
+			exitCode = 1
+			return
+		}
+
+		var rb lf.RecordBuilder
+		err = rb.Resume(rec)
+		if err == nil {
+			if len(*workURL) > 0 {
+				// Delegate work to a node, which sees only the work hash and not the record.
+				var u lf.RemoteNode
+				u, err = lf.NewRemoteNode(*workURL)
+				if err == nil {
+					var wr *lf.WorkResult
+					wr, err = cfg.RemoteNode(u).ExecuteWork(&lf.WorkRequest{WorkHash: rb.WorkHash(), Difficulty: rb.WorkDifficulty()})
+					if err == nil {
+						err = rb.SetWork(wr.Work)
+					}
+				}
+			} else {
+				go lf.WharrgarblInitTable(path.Join(basePath, "wharrgarbl-table.bin"))
+				wf := lf.NewWharrgarblr(lf.RecordDefaultWharrgarblMemory, 0)
+				stopProgress := startWorkProgress(basePath, wf)
+				err = rb.AddWork(wf, 0)
+				stopProgress()
+			}
+		}
+		if err == nil {
+			err = writeRecordFile(outFile, rb.Record(), false)
+		}
+		if err != nil {
+			logger.Printf("ERROR: work failed: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+		fmt.Printf("%s worked record written to %s\n", rec.Owner.String(), outFile)
+
+	case "sign":
+		signOpts := flag.NewFlagSet("sign", flag.ContinueOnError)
+		ownerName := signOpts.String("owner", "", "")
+		signOpts.SetOutput(ioutil.Discard)
+		err := signOpts.Parse(args)
+		if err != nil {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		args = signOpts.Args()
+		if len(args) < 1 || len(args) > 2 {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		outFile := args[0]
+		if len(args) == 2 {
+			outFile = args[1]
+		}
+
+		rec, signed, err := readRecordFile(args[0])
+		if err != nil {
+			logger.Printf("ERROR: sign failed: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+		if signed {
+			logger.Printf("ERROR: sign failed: %s is already signed\n", args[0])
+			exitCode = 1
+			return
+		}
+
+		// If no owner is specified use the one whose public key matches the record.
+		var owner *lf.ClientConfigOwner
+		if len(*ownerName) > 0 {
+			owner = cfg.Owners[*ownerName]
+		} else {
+			for _, o := range cfg.Owners {
+				if bytes.Equal(o.Public, rec.Owner) {
+					owner = o
+					break
+				}
+			}
+		}
+		if owner == nil {
+			logger.Printf("ERROR: sign failed: no owner found for %s\n", rec.Owner.String())
+			exitCode = 1
+			return
+		}
+		if !bytes.Equal(owner.Public, rec.Owner) {
+			logger.Printf("ERROR: sign failed: record is owned by %s, not %s\n", rec.Owner.String(), owner.Public.String())
+			exitCode = 1
+			return
+		}
+		o, err := getConfigOwner(basePath, owner)
+		if err != nil {
+			logger.Printf("ERROR: unable to get owner private key: %s", err.Error())
+			exitCode = 1
+			return
+		}
+
+		var rb lf.RecordBuilder
+		err = rb.Resume(rec)
+		if err == nil {
+			rec, err = rb.Complete(o)
+		}
+		if err == nil {
+			err = rec.Validate()
+		}
+		if err == nil {
+			err = writeRecordFile(outFile, rec, true)
+		}
+		if err != nil {
+			logger.Printf("ERROR: sign failed: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+		if rec.WorkAlgorithm == lf.RecordWorkAlgorithmNone {
+			fmt.Println("WARNING: record has no proof of work and will only be accepted if its owner has a certificate.")
+		}
+		fmt.Printf("%s =%s written to %s\n", o.String(), rec.HashString(), outFile)
+
+	case "submit":
+		submitOpts := flag.NewFlagSet("submit", flag.ContinueOnError)
+		urlOverride := submitOpts.String("url", "", "")
+		submitOpts.SetOutput(ioutil.Discard)
+		err := submitOpts.Parse(args)
+		if err != nil {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+		args = submitOpts.Args()
+		if len(args) < 1 {
+			printHelp("")
+			exitCode = 1
+			return
+		}
+
+		var recs []*lf.Record
+		for _, fn := range args {
+			rec, signed, err := readRecordFile(fn)
+			if err == nil && !signed {
+				err = fmt.Errorf("%s is not signed", fn)
+			}
+			if err == nil {
+				err = rec.Validate()
+			}
+			if err != nil {
+				logger.Printf("ERROR: submit failed: %s\n", err.Error())
+				exitCode = 1
+				return
+			}
+			recs = append(recs, rec)
+		}
+
+		urls, err := remoteNodesFromFlag(cfg, *urlOverride)
+		if err != nil {
+			logger.Printf("ERROR: submit failed: %s", err.Error())
+			exitCode = 1
+			return
+		}
+		if len(urls) == 0 {
+			logger.Println("ERROR: submit failed: no URLs configured!")
+			exitCode = 1
+			return
+		}
+
+		for _, rec := range recs {
+			for _, u := range urls {
+				err = u.AddRecord(rec)
+				if err == nil {
+					break
+				}
+			}
+			if err != nil {
+				logger.Printf("ERROR: submit of =%s failed: %s\n", rec.HashString(), err.Error())
+				exitCode = 1
+				return
+			}
+			fmt.Printf("%s =%s\n", rec.Owner.String(), rec.HashString())
+		}
+
+	default:
+		printHelp("")
+		exitCode = 1
+	}
+
+	return
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"lf/pkg/lf"
+)
+
+func doNodeSnapshot(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
+	snapshotOpts := flag.NewFlagSet("node-snapshot", flag.ContinueOnError)
+	urlOverride := snapshotOpts.String("url", "", "")
+	snapshotOpts.SetOutput(ioutil.Discard)
+	err := snapshotOpts.Parse(args)
+	if err != nil || len(snapshotOpts.Args()) != 1 {
+		printHelp("")
+		exitCode = 1
+		return
+	}
+	outPath := snapshotOpts.Arg(0)
+
+	urls := cfg.RemoteNodes()
+	if len(*urlOverride) > 0 {
+		urls = []lf.RemoteNode{lf.RemoteNode(*urlOverride)}
+	}
+
+	// Download to a temporary file and rename when complete so a failed snapshot never looks valid.
+	tmpPath := outPath + ".tmp"
+	for _, u := range urls {
+		var out *os.File
+		out, err = os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			break
+		}
+		w := bufio.NewWriterSize(out, 1048576)
+		err = u.Snapshot(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = out.Sync()
+		}
+		_ = out.Close()
+		if err == nil {
+			break
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		logger.Printf("ERROR: snapshot failed: %s", err.Error())
+		exitCode = 1
+		return
+	}
+
+	// Check that the snapshot is complete and its file hashes match its manifest.
+	var m *lf.SnapshotManifest
+	in, err := os.Open(outPath)
+	if err == nil {
+		m, err = lf.ReadSnapshotManifest(bufio.NewReaderSize(in, 1048576))
+		_ = in.Close()
+	}
+	if err != nil {
+		logger.Printf("ERROR: snapshot is incomplete or invalid: %s", err.Error())
+		exitCode = 1
+		return
+	}
+	fmt.Printf("%s: %d records, %d bytes of record data, CRC64 %.16x\n", outPath, m.RecordCount, m.DataSize, m.CRC64)
+	return
+}
+
+func doNodeRestore(cfg *lf.ClientConfig, basePath string, args []string) (exitCode int) {
+	if len(args) != 1 {
+		printHelp("")
+		exitCode = 1
+		return
+	}
+
+	in, err := os.Open(args[0])
+	if err != nil {
+		logger.Printf("ERROR: unable to open %s: %s", args[0], err.Error())
+		exitCode = 1
+		return
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	fmt.Printf("Restoring snapshot %s into %s and verifying hashes and database CRC64...\n", args[0], basePath)
+	m, err := lf.RestoreSnapshot(bufio.NewReaderSize(in, 1048576), basePath)
+	if err != nil {
+		logger.Printf("FATAL: restore failed: %s", err.Error())
+		exitCode = 1
+		return
+	}
+	fmt.Printf("Restored %d records (CRC64 %.16x). Node is ready to start.\n", m.RecordCount, m.CRC64)
+	return
+}
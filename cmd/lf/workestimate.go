@@ -0,0 +1,196 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package main
+
+// This is the proof of work time estimator and the progress bar shown while computing work.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lf/pkg/lf"
+)
+
+// workProgressInterval is how often the proof of work progress bar is redrawn.
+const workProgressInterval = 250 * time.Millisecond
+
+// workProgressBarWidth is the width of the progress bar in characters (not counting brackets).
+const workProgressBarWidth = 40
+
+// formatWorkTime formats a time in seconds for display, with more precision for short times.
+func formatWorkTime(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+	if d < 10*time.Second {
+		return d.Round(10 * time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// isTerminal returns true if a file is a terminal (character device).
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && (fi.Mode()&os.ModeCharDevice) != 0
+}
+
+// startWorkProgress shows the progress of a Wharrgarblr's Compute() on stderr until the returned function is called.
+// Nothing is shown unless stderr is a terminal and a benchmark from 'work-estimate -calibrate' exists for wf's settings.
+func startWorkProgress(basePath string, wf *lf.Wharrgarblr) (stop func()) {
+	stop = func() {}
+	if wf == nil || !isTerminal(os.Stderr) {
+		return
+	}
+	b, _ := lf.LoadWorkBenchmark(path.Join(basePath, lf.WorkBenchmarkName))
+	if b == nil || !b.Matches(wf) || b.IterationsPerSecond <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shown := false
+		ticker := time.NewTicker(workProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				if shown {
+					fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", workProgressBarWidth+32))
+				}
+				return
+			case <-ticker.C:
+			}
+			iter, diff, _ := wf.Progress()
+			if diff == 0 {
+				continue
+			}
+			expected := b.ExpectedIterations(diff)
+			frac := 0.99
+			eta := "soon"
+			if iter < expected {
+				frac = float64(iter) / float64(expected)
+				if frac > 0.99 {
+					frac = 0.99
+				}
+				eta = formatWorkTime(float64(expected-iter) / b.IterationsPerSecond)
+			}
+			filled := int(frac * workProgressBarWidth)
+			fmt.Fprintf(os.Stderr, "\rWork [%s%s] %3d%% ETA %-10s", strings.Repeat("#", filled), strings.Repeat(" ", workProgressBarWidth-filled), int(frac*100.0), eta)
+			shown = true
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func doWorkEstimate(cfg *lf.ClientConfig, basePath string, args []string, jsonOutput bool) (exitCode int) {
+	estOpts := flag.NewFlagSet("work-estimate", flag.ContinueOnError)
+	calibrate := estOpts.Bool("calibrate", false, "")
+	benchTime := estOpts.Int("time", int(lf.WorkBenchmarkDefaultDuration/time.Second), "")
+	urlOverride := estOpts.String("url", "", "")
+	estOpts.SetOutput(ioutil.Discard)
+	err := estOpts.Parse(args)
+	if err != nil || *benchTime <= 0 {
+		printHelp("")
+		exitCode = 1
+		return
+	}
+	args = estOpts.Args()
+	if len(args) > 1 || (len(args) == 0 && !*calibrate) || (*calibrate && len(*urlOverride) > 0) {
+		printHelp("")
+		exitCode = 1
+		return
+	}
+	var recordSize uint64
+	if len(args) == 1 {
+		recordSize, err = strconv.ParseUint(args[0], 10, 64)
+		if err != nil || recordSize == 0 || recordSize > lf.RecordMaxSize {
+			logger.Printf("ERROR: work billable size must be between 1 and %d bytes\n", lf.RecordMaxSize)
+			exitCode = 1
+			return
+		}
+	}
+
+	var e *lf.WorkEstimate
+	var b *lf.WorkBenchmark
+	if len(*urlOverride) > 0 {
+		// Ask a node how long it would take to handle a makerecord or work request.
+		var u lf.RemoteNode
+		u, err = lf.NewRemoteNode(*urlOverride)
+		if err == nil {
+			e, err = cfg.RemoteNode(u).WorkEstimate(uint(recordSize))
+		}
+		if err != nil {
+			logger.Printf("ERROR: work estimate failed: %s\n", err.Error())
+			exitCode = 1
+			return
+		}
+	} else {
+		go lf.WharrgarblInitTable(path.Join(basePath, "wharrgarbl-table.bin"))
+		wf := lf.NewWharrgarblr(lf.RecordDefaultWharrgarblMemory, 0)
+		benchPath := path.Join(basePath, lf.WorkBenchmarkName)
+		b, _ = lf.LoadWorkBenchmark(benchPath)
+		if *calibrate || b == nil || !b.Matches(wf) {
+			logger.Printf("Benchmarking proof of work for %d seconds...\n", *benchTime)
+			b, err = lf.BenchmarkWharrgarblr(wf, time.Duration(*benchTime)*time.Second)
+			if err != nil {
+				logger.Printf("ERROR: benchmark failed: %s\n", err.Error())
+				exitCode = 1
+				return
+			}
+			if *calibrate {
+				err = b.Save(benchPath)
+				if err != nil {
+					logger.Printf("ERROR: cannot write %s: %s\n", benchPath, err.Error())
+					exitCode = 1
+					return
+				}
+				logger.Printf("Benchmark saved to %s (used by set to show an ETA)\n", benchPath)
+			}
+		}
+		if recordSize > 0 {
+			e = b.Estimate(uint(recordSize))
+		}
+	}
+
+	if e == nil {
+		if jsonOutput {
+			fmt.Println(lf.PrettyJSON(b))
+		} else {
+			fmt.Printf("%.0f iterations/second (%d threads, %d MiB)\n", b.IterationsPerSecond, b.Threads, b.MemorySize/1048576)
+		}
+		return
+	}
+	if jsonOutput {
+		fmt.Println(lf.PrettyJSON(e))
+		return
+	}
+	fmt.Printf("Billable:    %d bytes (difficulty %.8x)\n", e.Bytes, e.Difficulty)
+	fmt.Printf("Expected:    %s (%d iterations at %.0f/second)\n", formatWorkTime(e.Expected), e.Iterations, e.IterationsPerSecond)
+	fmt.Printf("Median:      %s\n", formatWorkTime(e.Median))
+	fmt.Printf("90%%:         %s\n", formatWorkTime(e.P90))
+	fmt.Printf("99%%:         %s\n", formatWorkTime(e.P99))
+	return
+}
@@ -1,6 +1,6 @@
 module lf
 
-go 1.12
+go 1.13
 
 require (
 	github.com/andybalholm/brotli v1.0.0
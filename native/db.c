@@ -11,6 +11,10 @@
  */
 /****/
 
+#if defined(__linux__) && !defined(_GNU_SOURCE)
+#define _GNU_SOURCE /* for fallocate() */
+#endif
+
 #include "db.h"
 #include "vector.h"
 #include "iset.h"
@@ -33,6 +37,8 @@
 #define ZTLF_DB_SELECTOR_QUERY_RESULT_LIMIT "4194304"
 
 static void *_ZTLF_DB_graphThreadMain(void *arg);
+static void _ZTLF_DB_addToReconcileBucket(struct ZTLF_DB *db,const uint64_t ts,const void *hash);
+static void _ZTLF_DB_rebuildReconcileBuckets(struct ZTLF_DB *db);
 
 /*
  * config
@@ -160,6 +166,7 @@ static void *_ZTLF_DB_graphThreadMain(void *arg);
 "CREATE INDEX IF NOT EXISTS record_reputation_linked_count ON record(reputation,linked_count);\n" \
 "CREATE INDEX IF NOT EXISTS record_id_owner_ts ON record(id,owner,ts);\n" \
 "CREATE INDEX IF NOT EXISTS record_owner_ts ON record(owner,ts);\n" \
+"CREATE INDEX IF NOT EXISTS record_ts_hash ON record(ts,hash);\n" \
 \
 "CREATE TABLE IF NOT EXISTS cert (" \
 "subject_serial_no TEXT NOT NULL," \
@@ -236,9 +243,18 @@ static void *_ZTLF_DB_graphThreadMain(void *arg);
 "PRIMARY KEY(token,start)" \
 ") WITHOUT ROWID;\n" \
 \
+"CREATE TABLE IF NOT EXISTS reconcile_bucket (" \
+"b INTEGER PRIMARY KEY NOT NULL," \
+"count INTEGER NOT NULL," \
+"s0 INTEGER NOT NULL," \
+"s1 INTEGER NOT NULL," \
+"s2 INTEGER NOT NULL," \
+"s3 INTEGER NOT NULL" \
+");\n" \
+\
 "ATTACH DATABASE ':memory:' AS tmp;\n" \
 \
-"CREATE TABLE IF NOT EXISTS tmp.rs (\"i\" INTEGER PRIMARY KEY NOT NULL);\n"
+"CREATE TABLE IF NOT EXISTS tmp.rs (\"i\" INTEGER PRIMARY KEY NOT NULL,\"k\" BLOB NOT NULL);\n"
 
 #ifdef S
 #define ZTLF_oldS S
@@ -422,6 +438,8 @@ int ZTLF_DB_Open(
 		"SELECT w.retries FROM wanted AS w,dangling_link AS dl WHERE w.retries <= ? AND dl.hash = w.hash AND NOT EXISTS (SELECT l.hash FROM limbo AS l WHERE l.hash = w.hash) LIMIT 1");
 	S(db->sGetWanted, /* this excludes records in limbo since we already have those and are possibly awaiting a cert */
 		"SELECT w.hash FROM wanted AS w WHERE w.retries BETWEEN ? AND ? AND NOT EXISTS (SELECT l.hash FROM limbo AS l WHERE l.hash = w.hash) ORDER BY w.retries LIMIT ?");
+	S(db->sGetWantedCount, /* this must use the same criteria as sGetWanted */
+		"SELECT COUNT(1) FROM wanted AS w WHERE w.retries BETWEEN ? AND ? AND NOT EXISTS (SELECT l.hash FROM limbo AS l WHERE l.hash = w.hash)");
 	S(db->sIncWantedRetries,
 		"UPDATE wanted SET retries = (retries + 1) WHERE hash = ?");
 	S(db->sLogComment,
@@ -431,14 +449,14 @@ int ZTLF_DB_Open(
 	S(db->sQueryClearRecordSet,
 		"DELETE FROM tmp.rs");
 	S(db->sQueryOrSelectorRange,
-		"INSERT OR IGNORE INTO tmp.rs SELECT record_doff AS \"i\" FROM selector WHERE "
+		"INSERT OR IGNORE INTO tmp.rs SELECT record_doff AS \"i\",sel AS \"k\" FROM selector WHERE "
 		"sel BETWEEN ? AND ? "
 		"AND selidx = ? "
 		"LIMIT " ZTLF_DB_SELECTOR_QUERY_RESULT_LIMIT);
 	S(db->sQueryAndSelectorRange,
 		"DELETE FROM tmp.rs WHERE \"i\" NOT IN (SELECT record_doff FROM selector WHERE sel BETWEEN ? AND ? AND selidx = ?)");
 	S(db->sQueryGetResults,
-		"SELECT r.doff,r.dlen,r.goff,r.ts,r.reputation,r.hash,r.ckey,r.owner FROM "
+		"SELECT r.doff,r.dlen,r.goff,r.ts,r.reputation,r.hash,r.ckey,r.owner,rs.k FROM "
 		"tmp.rs AS rs,record AS r "
 		"WHERE "
 		"r.doff = rs.i "
@@ -460,6 +478,24 @@ int ZTLF_DB_Open(
 		"DELETE FROM limbo WHERE hash = ?");
 	S(db->sHaveRecordInLimbo,
 		"SELECT hash FROM limbo WHERE hash = ?");
+	S(db->sGetLimboCount,
+		"SELECT COUNT(1) FROM limbo");
+	S(db->sGetRangeHashes,
+		"SELECT hash,ts FROM record WHERE (ts,hash) >= (?,?) AND (ts,hash) < (?,?) ORDER BY ts,hash LIMIT ? OFFSET ?");
+	S(db->sGetRangeSum,
+		"SELECT hash FROM record WHERE (ts,hash) >= (?,?) AND (ts,hash) < (?,?)");
+	S(db->sGetRangeCount,
+		"SELECT COUNT(1) FROM record WHERE (ts,hash) >= (?,?) AND (ts,hash) < (?,?)");
+	S(db->sGetReconcileBucket,
+		"SELECT count,s0,s1,s2,s3 FROM reconcile_bucket WHERE b = ?");
+	S(db->sSetReconcileBucket,
+		"INSERT OR REPLACE INTO reconcile_bucket (b,count,s0,s1,s2,s3) VALUES (?,?,?,?,?,?)");
+	S(db->sGetReconcileBuckets,
+		"SELECT b,count,s0,s1,s2,s3 FROM reconcile_bucket WHERE b >= ? AND b < ? ORDER BY b");
+	S(db->sGetReconcileBucketCount,
+		"SELECT COUNT(1) FROM reconcile_bucket");
+	S(db->sGetFirstDoffSince,
+		"SELECT MIN(doff) FROM record WHERE ts >= ?");
 	S(db->sRegisterPulseToken,
 		"INSERT OR IGNORE INTO pulse (token,start,minutes) VALUES (?,?,0)");
 	S(db->sUpdatePulse,
@@ -489,6 +525,11 @@ int ZTLF_DB_Open(
 		goto exit_with_error;
 	}
 
+	/* Databases created before reconciliation hash sums were kept need them computed once. */
+	sqlite3_reset(db->sGetReconcileBucketCount);
+	if ((sqlite3_step(db->sGetReconcileBucketCount) == SQLITE_ROW)&&(sqlite3_column_int64(db->sGetReconcileBucketCount,0) == 0))
+		_ZTLF_DB_rebuildReconcileBuckets(db);
+
 	db->running = 1;
 	if (pthread_create(&db->graphThread,NULL,_ZTLF_DB_graphThreadMain,db) != 0) {
 		ZTLF_L_fatal("pthread_create() failed");
@@ -864,6 +905,7 @@ void ZTLF_DB_Close(struct ZTLF_DB *db)
 		if (db->sGetPendingCount)                      sqlite3_finalize(db->sGetPendingCount);
 		if (db->sHaveDanglingLinks)                    sqlite3_finalize(db->sHaveDanglingLinks);
 		if (db->sGetWanted)                            sqlite3_finalize(db->sGetWanted);
+		if (db->sGetWantedCount)                       sqlite3_finalize(db->sGetWantedCount);
 		if (db->sIncWantedRetries)                     sqlite3_finalize(db->sIncWantedRetries);
 		if (db->sLogComment)                           sqlite3_finalize(db->sLogComment);
 		if (db->sGetCommentsBySubjectAndCommentOracle) sqlite3_finalize(db->sGetCommentsBySubjectAndCommentOracle);
@@ -878,6 +920,15 @@ void ZTLF_DB_Close(struct ZTLF_DB *db)
 		if (db->sMarkInLimbo)                          sqlite3_finalize(db->sMarkInLimbo);
 		if (db->sTakeFromLimbo)                        sqlite3_finalize(db->sTakeFromLimbo);
 		if (db->sHaveRecordInLimbo)                    sqlite3_finalize(db->sHaveRecordInLimbo);
+		if (db->sGetLimboCount)                        sqlite3_finalize(db->sGetLimboCount);
+		if (db->sGetRangeHashes)                       sqlite3_finalize(db->sGetRangeHashes);
+		if (db->sGetRangeSum)                          sqlite3_finalize(db->sGetRangeSum);
+		if (db->sGetRangeCount)                        sqlite3_finalize(db->sGetRangeCount);
+		if (db->sGetReconcileBucket)                   sqlite3_finalize(db->sGetReconcileBucket);
+		if (db->sSetReconcileBucket)                   sqlite3_finalize(db->sSetReconcileBucket);
+		if (db->sGetReconcileBuckets)                  sqlite3_finalize(db->sGetReconcileBuckets);
+		if (db->sGetReconcileBucketCount)              sqlite3_finalize(db->sGetReconcileBucketCount);
+		if (db->sGetFirstDoffSince)                    sqlite3_finalize(db->sGetFirstDoffSince);
 		if (db->sRegisterPulseToken)                   sqlite3_finalize(db->sRegisterPulseToken);
 		if (db->sUpdatePulse)                          sqlite3_finalize(db->sUpdatePulse);
 		if (db->sGetPulse)                             sqlite3_finalize(db->sGetPulse);
@@ -955,6 +1006,40 @@ void ZTLF_DB_UpdateRecordReputationByHash(struct ZTLF_DB *db,const void *const h
 	pthread_mutex_unlock(&db->dbLock);
 }
 
+int ZTLF_DB_RewriteRecordData(struct ZTLF_DB *db,const uint64_t doff,const void *data,const unsigned int len,const unsigned int dlen)
+{
+	int result = 0;
+	if ((len == 0)||(len > dlen))
+		return ZTLF_NEG(EINVAL);
+	pthread_mutex_lock(&db->dbLock);
+	if (db->snapshotsInProgress > 0) {
+		result = ZTLF_NEG(EBUSY); /* snapshots copy record data without locks */
+	} else if ((long)pwrite(db->df,data,(size_t)len,(off_t)doff) != (long)len) {
+		result = ZTLF_NEG(EIO);
+	} else if (len < dlen) {
+		const off_t zoff = (off_t)(doff + len);
+		const off_t zlen = (off_t)(dlen - len);
+#ifdef FALLOC_FL_PUNCH_HOLE
+		if (fallocate(db->df,FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE,zoff,zlen) != 0)
+#endif
+		{
+			/* Zero the rest by hand if holes can't be punched in this file. */
+			uint8_t zero[4096];
+			memset(zero,0,sizeof(zero));
+			for(off_t o=0;o<zlen;) {
+				const size_t n = ((zlen - o) > (off_t)sizeof(zero)) ? sizeof(zero) : (size_t)(zlen - o);
+				if ((long)pwrite(db->df,zero,n,zoff + o) != (long)n) {
+					result = ZTLF_NEG(EIO);
+					break;
+				}
+				o += (off_t)n;
+			}
+		}
+	}
+	pthread_mutex_unlock(&db->dbLock);
+	return result;
+}
+
 int ZTLF_DB_PutRecord(
 	struct ZTLF_DB *db,
 	const void *rec,
@@ -1091,6 +1176,7 @@ int ZTLF_DB_PutRecord(
 		result = ZTLF_POS(e);
 		goto exit_putRecord;
 	}
+	_ZTLF_DB_addToReconcileBucket(db,ts,hash);
 
 	/* Add selectors for this record. */
 	for(unsigned int i=0;i<selCount;++i) {
@@ -1286,7 +1372,7 @@ struct ZTLF_QueryResults *ZTLF_DB_Query(
 	memset(lastOwner,0,sizeof(lastOwner));
 	int lastOwnerSize = -1;
 	sqlite3_reset(db->sQueryGetResults);
-	while (sqlite3_step(db->sQueryGetResults) == SQLITE_ROW) { /* columns: doff,dlen,goff,ts,reputation,hash,ckey,owner */
+	while (sqlite3_step(db->sQueryGetResults) == SQLITE_ROW) { /* columns: doff,dlen,goff,ts,reputation,hash,ckey,owner,k */
 		const void *owner = sqlite3_column_blob(db->sQueryGetResults,7);
 		const int ownerSize = sqlite3_column_bytes(db->sQueryGetResults,7);
 		if ((!owner)||(ownerSize <= 0)||(ownerSize > ZTLF_DB_QUERY_MAX_OWNER_SIZE))
@@ -1319,6 +1405,11 @@ struct ZTLF_QueryResults *ZTLF_DB_Query(
 			qr->localReputation = ZTLF_DB_REPUTATION_DEFAULT; /* this gets set to minimum of all records in a group */
 			qr->ckey = (uint64_t)ckey;
 			memcpy(qr->owner,owner,ownerSize);
+			memset(qr->selectorKey,0,sizeof(qr->selectorKey));
+			const void *const k = sqlite3_column_blob(db->sQueryGetResults,8);
+			const int kSize = sqlite3_column_bytes(db->sQueryGetResults,8);
+			if (k)
+				memcpy(qr->selectorKey,k,(kSize < ZTLF_DB_SELECTOR_KEY_SIZE) ? kSize : ZTLF_DB_SELECTOR_KEY_SIZE);
 		} else {
 			qr = &(r->results[r->count]);
 		}
@@ -1464,11 +1555,10 @@ void ZTLF_DB_Stats(struct ZTLF_DB *db,uint64_t *recordCount,uint64_t *dataSize)
 	*dataSize = (uint64_t)ds;
 }
 
-uint64_t ZTLF_DB_CRC64(struct ZTLF_DB *db)
+/* Compute CRC64, must be called with gfLock held for write and dbLock held. */
+static uint64_t _ZTLF_DB_CRC64(struct ZTLF_DB *db)
 {
 	uint64_t crc = 0;
-	pthread_rwlock_wrlock(&db->gfLock); /* acquire exclusive lock to get the most objective result */
-	pthread_mutex_lock(&db->dbLock);
 	sqlite3_reset(db->sGetAllRecords);
 	while (sqlite3_step(db->sGetAllRecords) == SQLITE_ROW) {
 		const struct ZTLF_DB_GraphNode *const gn = (struct ZTLF_DB_GraphNode *)ZTLF_MappedFile_TryGet(&db->gf,(uintptr_t)sqlite3_column_int64(db->sGetAllRecords,0),ZTLF_DB_MAX_GRAPH_NODE_SIZE);
@@ -1482,11 +1572,204 @@ uint64_t ZTLF_DB_CRC64(struct ZTLF_DB *db)
 			_ZTLF_CRC64(crc,(const uint8_t *)&linkedCount,sizeof(linkedCount));
 		}
 	}
+	return crc;
+}
+
+uint64_t ZTLF_DB_CRC64(struct ZTLF_DB *db)
+{
+	pthread_rwlock_wrlock(&db->gfLock); /* acquire exclusive lock to get the most objective result */
+	pthread_mutex_lock(&db->dbLock);
+	const uint64_t crc = _ZTLF_DB_CRC64(db);
 	pthread_mutex_unlock(&db->dbLock);
 	pthread_rwlock_unlock(&db->gfLock);
 	return crc;
 }
 
+/* Number of SQLite pages copied by each step of a snapshot, between which the database is unlocked. */
+#define ZTLF_SNAPSHOT_BACKUP_STEP_PAGES 256
+
+/* Write len bytes from data to a new file at path, returning 0 or an errno value. */
+static int _ZTLF_DB_writeSnapshotFile(const char *path,const void *data,uint64_t len)
+{
+	const int fd = open(path,O_WRONLY|O_CREAT|O_TRUNC,0644);
+	if (fd < 0)
+		return errno;
+	const uint8_t *p = (const uint8_t *)data;
+	while (len > 0) {
+		const long n = (long)write(fd,p,(len > 1048576) ? 1048576 : (size_t)len);
+		if (n <= 0) {
+			const int e = errno;
+			close(fd);
+			return (e) ? e : EIO;
+		}
+		p += n;
+		len -= (uint64_t)n;
+	}
+	if (fsync(fd) != 0) {
+		const int e = errno;
+		close(fd);
+		return e;
+	}
+	close(fd);
+	return 0;
+}
+
+/* Copy record data in [start,end) to the same place in another file using a 1MiB buffer, returning 0 or an errno value. */
+static int _ZTLF_DB_copyRecordData(struct ZTLF_DB *db,const int rf,uint8_t *buf,const int64_t start,const int64_t end)
+{
+	for(int64_t off=start;off<end;) {
+		const long n = (long)pread(db->df,buf,((end - off) > 1048576) ? 1048576 : (size_t)(end - off),(off_t)off);
+		if ((n <= 0)||((long)pwrite(rf,buf,(size_t)n,(off_t)off) != n))
+			return EIO;
+		off += n;
+	}
+	return 0;
+}
+
+int ZTLF_DB_Snapshot(struct ZTLF_DB *db,const char *outPath,uint64_t *crc,uint64_t *recordCount,uint64_t *dataSize)
+{
+	char tmp[PATH_MAX];
+	int e = 0;
+	int rf = -1;
+	sqlite3 *bdb = NULL;
+	sqlite3_backup *backup = NULL;
+	uint8_t *buf = NULL;
+	LogOutputCallback logger = db->logger;
+	void *loggerArg = (void *)db->loggerArg;
+
+	if (strlen(outPath) >= (PATH_MAX - 16))
+		return ZTLF_NEG(ENAMETOOLONG);
+
+	buf = (uint8_t *)malloc(1048576);
+	if (!buf)
+		return ZTLF_NEG(ENOMEM);
+	snprintf(tmp,sizeof(tmp),"%s" ZTLF_PATH_SEPARATOR "records.lf",outPath);
+	rf = open(tmp,O_WRONLY|O_CREAT|O_TRUNC,0644);
+	if (rf < 0) {
+		e = ZTLF_POS(errno);
+		goto exit_snapshot;
+	}
+
+	/* Copy record data up to the end of the last record without holding locks. Records are only
+	 * appended past this point and record data is not rewritten while a snapshot is in progress. */
+	int64_t ds = 0;
+	pthread_mutex_lock(&db->dbLock);
+	++db->snapshotsInProgress;
+	sqlite3_reset(db->sGetDataSize);
+	if (sqlite3_step(db->sGetDataSize) == SQLITE_ROW)
+		ds = sqlite3_column_int64(db->sGetDataSize,0);
+	pthread_mutex_unlock(&db->dbLock);
+	e = _ZTLF_DB_copyRecordData(db,rf,buf,0,ds);
+	pthread_mutex_lock(&db->dbLock);
+	--db->snapshotsInProgress;
+	pthread_mutex_unlock(&db->dbLock);
+	if (e) {
+		e = ZTLF_POS(e);
+		goto exit_snapshot;
+	}
+
+	/* Copy the SQLite database with the online backup API a chunk at a time, releasing the lock in
+	 * between so the node keeps running. Changes made in the meantime go through the same connection
+	 * and so are applied to the copy by SQLite. */
+	snprintf(tmp,sizeof(tmp),"%s" ZTLF_PATH_SEPARATOR "node.db",outPath);
+	if (sqlite3_open_v2(tmp,&bdb,SQLITE_OPEN_CREATE|SQLITE_OPEN_READWRITE|SQLITE_OPEN_NOMUTEX,NULL) != SQLITE_OK) {
+		e = ZTLF_POS(EIO);
+		goto exit_snapshot;
+	}
+	pthread_mutex_lock(&db->dbLock);
+	backup = sqlite3_backup_init(bdb,"main",db->dbc,"main");
+	pthread_mutex_unlock(&db->dbLock);
+	if (!backup) {
+		e = ZTLF_POS(EIO);
+		goto exit_snapshot;
+	}
+	int bstep;
+	do {
+		pthread_mutex_lock(&db->dbLock);
+		bstep = sqlite3_backup_step(backup,ZTLF_SNAPSHOT_BACKUP_STEP_PAGES);
+		pthread_mutex_unlock(&db->dbLock);
+	} while ((bstep == SQLITE_OK)||(bstep == SQLITE_BUSY)||(bstep == SQLITE_LOCKED));
+	if (bstep != SQLITE_DONE) {
+		ZTLF_L_warning("snapshot: SQLite backup failed: %d (%s)",bstep,sqlite3_errmsg(bdb));
+		e = ZTLF_POS(EIO);
+		goto exit_snapshot;
+	}
+
+	/* Holding both locks stops record addition and graph weight application, so the rest is consistent.
+	 * The backup is finished here so it includes any changes made since its last step. */
+	pthread_rwlock_wrlock(&db->gfLock);
+	pthread_mutex_lock(&db->dbLock);
+
+	bstep = sqlite3_backup_step(backup,-1);
+	sqlite3_backup_finish(backup);
+	backup = NULL;
+	if (bstep != SQLITE_DONE) {
+		ZTLF_L_warning("snapshot: SQLite backup failed: %d (%s)",bstep,sqlite3_errmsg(bdb));
+		e = ZTLF_POS(EIO);
+		goto exit_snapshot_locked;
+	}
+
+	/* Copy records added since the unlocked copy above. */
+	int64_t rc = 0,ds2 = 0;
+	sqlite3_reset(db->sGetRecordCount);
+	if (sqlite3_step(db->sGetRecordCount) == SQLITE_ROW)
+		rc = sqlite3_column_int64(db->sGetRecordCount,0);
+	sqlite3_reset(db->sGetDataSize);
+	if (sqlite3_step(db->sGetDataSize) == SQLITE_ROW)
+		ds2 = sqlite3_column_int64(db->sGetDataSize,0);
+	*recordCount = (uint64_t)rc;
+	*dataSize = (uint64_t)ds2;
+	if ((e = _ZTLF_DB_copyRecordData(db,rf,buf,ds,ds2))) {
+		e = ZTLF_POS(e);
+		goto exit_snapshot_locked;
+	}
+
+	/* Copy memory mapped graph and weights files. */
+	snprintf(tmp,sizeof(tmp),"%s" ZTLF_PATH_SEPARATOR "graph.bin",outPath);
+	if ((e = _ZTLF_DB_writeSnapshotFile(tmp,db->gf.ptr,(uint64_t)db->gf.size))) {
+		e = ZTLF_POS(e);
+		goto exit_snapshot_locked;
+	}
+	pthread_mutex_lock(&db->wf.lock);
+	snprintf(tmp,sizeof(tmp),"%s" ZTLF_PATH_SEPARATOR "weights.b00",outPath);
+	e = _ZTLF_DB_writeSnapshotFile(tmp,db->wf.l.ptr,(uint64_t)db->wf.l.size);
+	if (!e) {
+		snprintf(tmp,sizeof(tmp),"%s" ZTLF_PATH_SEPARATOR "weights.b32",outPath);
+		e = _ZTLF_DB_writeSnapshotFile(tmp,db->wf.m.ptr,(uint64_t)db->wf.m.size);
+	}
+	if (!e) {
+		snprintf(tmp,sizeof(tmp),"%s" ZTLF_PATH_SEPARATOR "weights.b64",outPath);
+		e = _ZTLF_DB_writeSnapshotFile(tmp,db->wf.h.ptr,(uint64_t)db->wf.h.size);
+	}
+	pthread_mutex_unlock(&db->wf.lock);
+	if (e) {
+		e = ZTLF_POS(e);
+		goto exit_snapshot_locked;
+	}
+
+	*crc = _ZTLF_DB_CRC64(db);
+
+exit_snapshot_locked:
+	pthread_mutex_unlock(&db->dbLock);
+	pthread_rwlock_unlock(&db->gfLock);
+exit_snapshot:
+	if (backup) {
+		pthread_mutex_lock(&db->dbLock);
+		sqlite3_backup_finish(backup);
+		pthread_mutex_unlock(&db->dbLock);
+	}
+	if (bdb)
+		sqlite3_close(bdb);
+	if (rf >= 0) {
+		if ((!e)&&(fsync(rf) != 0))
+			e = ZTLF_POS(errno);
+		close(rf);
+	}
+	if (buf)
+		free(buf);
+	return e;
+}
+
 int ZTLF_DB_HasPending(struct ZTLF_DB *db)
 {
 	int has = 0;
@@ -1506,6 +1789,17 @@ int ZTLF_DB_HasPending(struct ZTLF_DB *db)
 	return has;
 }
 
+long ZTLF_DB_GetPendingCount(struct ZTLF_DB *db)
+{
+	long count = 0;
+	pthread_mutex_lock(&db->dbLock);
+	sqlite3_reset(db->sGetPendingCount);
+	if (sqlite3_step(db->sGetPendingCount) == SQLITE_ROW)
+		count = (long)sqlite3_column_int64(db->sGetPendingCount,0);
+	pthread_mutex_unlock(&db->dbLock);
+	return count;
+}
+
 int ZTLF_DB_HaveDanglingLinks(struct ZTLF_DB *db,int ignoreWantedAfterNRetries)
 {
 	int has = 0;
@@ -1547,6 +1841,19 @@ unsigned int ZTLF_DB_GetWanted(struct ZTLF_DB *db,void *buf,const unsigned int m
 	return count;
 }
 
+long ZTLF_DB_GetWantedCount(struct ZTLF_DB *db,const unsigned int retryCountMin,const unsigned int retryCountMax)
+{
+	long count = 0;
+	pthread_mutex_lock(&db->dbLock);
+	sqlite3_reset(db->sGetWantedCount);
+	sqlite3_bind_int(db->sGetWantedCount,1,(int)retryCountMin);
+	sqlite3_bind_int(db->sGetWantedCount,2,(int)retryCountMax);
+	if (sqlite3_step(db->sGetWantedCount) == SQLITE_ROW)
+		count = (long)sqlite3_column_int64(db->sGetWantedCount,0);
+	pthread_mutex_unlock(&db->dbLock);
+	return count;
+}
+
 int ZTLF_DB_LogComment(struct ZTLF_DB *db,const int64_t byRecordDoff,const int assertion,const int reason,const void *const subject,const int subjectLen)
 {
 	pthread_mutex_lock(&db->dbLock);
@@ -1725,6 +2032,324 @@ int ZTLF_DB_HaveRecordIncludeLimbo(struct ZTLF_DB *db,const void *hash)
 	return have;
 }
 
+long ZTLF_DB_GetLimboCount(struct ZTLF_DB *db)
+{
+	long count = 0;
+	pthread_mutex_lock(&db->dbLock);
+	sqlite3_reset(db->sGetLimboCount);
+	if (sqlite3_step(db->sGetLimboCount) == SQLITE_ROW)
+		count = (long)sqlite3_column_int64(db->sGetLimboCount,0);
+	pthread_mutex_unlock(&db->dbLock);
+	return count;
+}
+
+/* Add a hash to a 256-bit little-endian sum of hashes, ignoring overflow. */
+static void _ZTLF_DB_sumAddHash(uint64_t sum[4],const uint8_t *h)
+{
+	uint64_t carry = 0;
+	for(int i=0;i<4;++i) {
+		uint64_t w = 0;
+		for(int j=7;j>=0;--j)
+			w = (w << 8) | (uint64_t)h[(i * 8) + j];
+		const uint64_t s1 = sum[i] + w;
+		const uint64_t c1 = (s1 < w) ? 1 : 0;
+		const uint64_t s2 = s1 + carry;
+		carry = c1 + ((s2 < s1) ? 1 : 0);
+		sum[i] = s2;
+	}
+}
+
+/* Add one 256-bit little-endian sum to another, ignoring overflow. */
+static void _ZTLF_DB_sumAdd(uint64_t sum[4],const uint64_t s[4])
+{
+	uint64_t carry = 0;
+	for(int i=0;i<4;++i) {
+		const uint64_t s1 = sum[i] + s[i];
+		const uint64_t c1 = (s1 < s[i]) ? 1 : 0;
+		const uint64_t s2 = s1 + carry;
+		carry = c1 + ((s2 < s1) ? 1 : 0);
+		sum[i] = s2;
+	}
+}
+
+static void _ZTLF_DB_setReconcileBucket(struct ZTLF_DB *db,const uint64_t b,const uint64_t count,const uint64_t sum[4])
+{
+	LogOutputCallback logger = db->logger;
+	void *loggerArg = (void *)db->loggerArg;
+	sqlite3_reset(db->sSetReconcileBucket);
+	sqlite3_bind_int64(db->sSetReconcileBucket,1,(sqlite_int64)b);
+	sqlite3_bind_int64(db->sSetReconcileBucket,2,(sqlite_int64)count);
+	for(int i=0;i<4;++i)
+		sqlite3_bind_int64(db->sSetReconcileBucket,3 + i,(sqlite_int64)sum[i]);
+	if (sqlite3_step(db->sSetReconcileBucket) != SQLITE_DONE) {
+		ZTLF_L_warning("database error updating reconciliation hash sums, I/O error or database corrupt!");
+	}
+}
+
+/* Add a new record to its reconciliation hash sum bucket (dbLock must be held). */
+static void _ZTLF_DB_addToReconcileBucket(struct ZTLF_DB *db,const uint64_t ts,const void *hash)
+{
+	const uint64_t b = ts / ZTLF_DB_RECONCILE_BUCKET_SECONDS;
+	uint64_t count = 0,sum[4] = { 0,0,0,0 };
+	sqlite3_reset(db->sGetReconcileBucket);
+	sqlite3_bind_int64(db->sGetReconcileBucket,1,(sqlite_int64)b);
+	if (sqlite3_step(db->sGetReconcileBucket) == SQLITE_ROW) {
+		count = (uint64_t)sqlite3_column_int64(db->sGetReconcileBucket,0);
+		for(int i=0;i<4;++i)
+			sum[i] = (uint64_t)sqlite3_column_int64(db->sGetReconcileBucket,1 + i);
+	}
+	sqlite3_reset(db->sGetReconcileBucket);
+	_ZTLF_DB_sumAddHash(sum,(const uint8_t *)hash);
+	_ZTLF_DB_setReconcileBucket(db,b,count + 1,sum);
+}
+
+/* Compute reconciliation hash sum buckets for all records (called on open before other threads start). */
+static void _ZTLF_DB_rebuildReconcileBuckets(struct ZTLF_DB *db)
+{
+	sqlite3_stmt *s = NULL;
+	if (sqlite3_prepare_v2(db->dbc,"SELECT ts,hash FROM record ORDER BY ts,hash",-1,&s,NULL) != SQLITE_OK)
+		return;
+	sqlite3_exec(db->dbc,"BEGIN",NULL,NULL,NULL);
+	uint64_t b = 0,count = 0,sum[4] = { 0,0,0,0 };
+	while (sqlite3_step(s) == SQLITE_ROW) {
+		const uint64_t rb = (uint64_t)sqlite3_column_int64(s,0) / ZTLF_DB_RECONCILE_BUCKET_SECONDS;
+		const uint8_t *h = (const uint8_t *)sqlite3_column_blob(s,1);
+		if ((h)&&(sqlite3_column_bytes(s,1) == 32)) {
+			if ((count)&&(rb != b)) {
+				_ZTLF_DB_setReconcileBucket(db,b,count,sum);
+				count = 0;
+				sum[0] = 0; sum[1] = 0; sum[2] = 0; sum[3] = 0;
+			}
+			b = rb;
+			_ZTLF_DB_sumAddHash(sum,h);
+			++count;
+		}
+	}
+	if (count)
+		_ZTLF_DB_setReconcileBucket(db,b,count,sum);
+	sqlite3_exec(db->dbc,"COMMIT",NULL,NULL,NULL);
+	sqlite3_finalize(s);
+}
+
+/* Get the range of reconciliation buckets [b0,b1) entirely within [start,end), with b1 <= b0 if there are none. */
+static void _ZTLF_DB_reconcileBuckets(const uint64_t tsStart,const void *hashStart,const uint64_t tsEnd,uint64_t *b0,uint64_t *b1)
+{
+	static const uint8_t zeroHash[32] = { 0 };
+	*b0 = tsStart / ZTLF_DB_RECONCILE_BUCKET_SECONDS;
+	if (((tsStart % ZTLF_DB_RECONCILE_BUCKET_SECONDS) != 0)||(memcmp(hashStart,zeroHash,32) != 0))
+		++*b0;
+	*b1 = tsEnd / ZTLF_DB_RECONCILE_BUCKET_SECONDS;
+}
+
+/* Scan records in [start,end) adding their hashes to sum and count (dbLock must be held). */
+static void _ZTLF_DB_scanRangeSum(struct ZTLF_DB *db,const uint64_t tsStart,const void *hashStart,const uint64_t tsEnd,const void *hashEnd,uint64_t sum[4],uint64_t *count)
+{
+	sqlite3_reset(db->sGetRangeSum);
+	sqlite3_bind_int64(db->sGetRangeSum,1,(sqlite_int64)tsStart);
+	sqlite3_bind_blob(db->sGetRangeSum,2,hashStart,32,SQLITE_STATIC);
+	sqlite3_bind_int64(db->sGetRangeSum,3,(sqlite_int64)tsEnd);
+	sqlite3_bind_blob(db->sGetRangeSum,4,hashEnd,32,SQLITE_STATIC);
+	while (sqlite3_step(db->sGetRangeSum) == SQLITE_ROW) {
+		const uint8_t *h = (const uint8_t *)sqlite3_column_blob(db->sGetRangeSum,0);
+		if ((h)&&(sqlite3_column_bytes(db->sGetRangeSum,0) == 32)) {
+			_ZTLF_DB_sumAddHash(sum,h);
+			++*count;
+		}
+	}
+	sqlite3_reset(db->sGetRangeSum);
+}
+
+long ZTLF_DB_GetRangeHashes(struct ZTLF_DB *db,const uint64_t tsStart,const void *hashStart,const uint64_t tsEnd,const void *hashEnd,long offset,const long maxCount,void *hashes,uint64_t *timestamps)
+{
+	static const uint8_t zeroHash[32] = { 0 };
+	long count = 0;
+	uint64_t ts0 = tsStart;
+	const void *hash0 = hashStart;
+	pthread_mutex_lock(&db->dbLock);
+
+	/* Large offsets skip whole reconciliation buckets by their counts so only one bucket's records are stepped over. */
+	uint64_t b0,b1;
+	_ZTLF_DB_reconcileBuckets(tsStart,hashStart,tsEnd,&b0,&b1);
+	if ((offset > 0)&&(b1 > b0)) {
+		long headCount = 0;
+		sqlite3_reset(db->sGetRangeCount);
+		sqlite3_bind_int64(db->sGetRangeCount,1,(sqlite_int64)tsStart);
+		sqlite3_bind_blob(db->sGetRangeCount,2,hashStart,32,SQLITE_STATIC);
+		sqlite3_bind_int64(db->sGetRangeCount,3,(sqlite_int64)(b0 * ZTLF_DB_RECONCILE_BUCKET_SECONDS));
+		sqlite3_bind_blob(db->sGetRangeCount,4,zeroHash,32,SQLITE_STATIC);
+		if (sqlite3_step(db->sGetRangeCount) == SQLITE_ROW)
+			headCount = (long)sqlite3_column_int64(db->sGetRangeCount,0);
+		sqlite3_reset(db->sGetRangeCount);
+		if (offset >= headCount) {
+			offset -= headCount;
+			ts0 = b1 * ZTLF_DB_RECONCILE_BUCKET_SECONDS;
+			hash0 = zeroHash;
+			sqlite3_reset(db->sGetReconcileBuckets);
+			sqlite3_bind_int64(db->sGetReconcileBuckets,1,(sqlite_int64)b0);
+			sqlite3_bind_int64(db->sGetReconcileBuckets,2,(sqlite_int64)b1);
+			while (sqlite3_step(db->sGetReconcileBuckets) == SQLITE_ROW) {
+				const long bc = (long)sqlite3_column_int64(db->sGetReconcileBuckets,1);
+				if (offset < bc) {
+					ts0 = (uint64_t)sqlite3_column_int64(db->sGetReconcileBuckets,0) * ZTLF_DB_RECONCILE_BUCKET_SECONDS;
+					break;
+				}
+				offset -= bc;
+			}
+			sqlite3_reset(db->sGetReconcileBuckets);
+		}
+	}
+
+	sqlite3_reset(db->sGetRangeHashes);
+	sqlite3_bind_int64(db->sGetRangeHashes,1,(sqlite_int64)ts0);
+	sqlite3_bind_blob(db->sGetRangeHashes,2,hash0,32,SQLITE_STATIC);
+	sqlite3_bind_int64(db->sGetRangeHashes,3,(sqlite_int64)tsEnd);
+	sqlite3_bind_blob(db->sGetRangeHashes,4,hashEnd,32,SQLITE_STATIC);
+	sqlite3_bind_int64(db->sGetRangeHashes,5,(sqlite_int64)maxCount);
+	sqlite3_bind_int64(db->sGetRangeHashes,6,(sqlite_int64)offset);
+	while ((count < maxCount)&&(sqlite3_step(db->sGetRangeHashes) == SQLITE_ROW)) {
+		const void *h = sqlite3_column_blob(db->sGetRangeHashes,0);
+		if ((h)&&(sqlite3_column_bytes(db->sGetRangeHashes,0) == 32)) {
+			memcpy(((uint8_t *)hashes) + (count * 32),h,32);
+			timestamps[count] = (uint64_t)sqlite3_column_int64(db->sGetRangeHashes,1);
+			++count;
+		}
+	}
+	sqlite3_reset(db->sGetRangeHashes);
+	pthread_mutex_unlock(&db->dbLock);
+	return count;
+}
+
+void ZTLF_DB_GetRangeSum(struct ZTLF_DB *db,const uint64_t tsStart,const void *hashStart,const uint64_t tsEnd,const void *hashEnd,uint64_t sum[4],uint64_t *count)
+{
+	static const uint8_t zeroHash[32] = { 0 };
+	sum[0] = 0; sum[1] = 0; sum[2] = 0; sum[3] = 0;
+	*count = 0;
+	pthread_mutex_lock(&db->dbLock);
+
+	/* Whole reconciliation buckets are summed from their stored sums and only records in partial buckets at each end are scanned. */
+	uint64_t b0,b1;
+	_ZTLF_DB_reconcileBuckets(tsStart,hashStart,tsEnd,&b0,&b1);
+	if (b1 <= b0) {
+		_ZTLF_DB_scanRangeSum(db,tsStart,hashStart,tsEnd,hashEnd,sum,count);
+	} else {
+		_ZTLF_DB_scanRangeSum(db,tsStart,hashStart,b0 * ZTLF_DB_RECONCILE_BUCKET_SECONDS,zeroHash,sum,count);
+		sqlite3_reset(db->sGetReconcileBuckets);
+		sqlite3_bind_int64(db->sGetReconcileBuckets,1,(sqlite_int64)b0);
+		sqlite3_bind_int64(db->sGetReconcileBuckets,2,(sqlite_int64)b1);
+		while (sqlite3_step(db->sGetReconcileBuckets) == SQLITE_ROW) {
+			uint64_t s[4];
+			for(int i=0;i<4;++i)
+				s[i] = (uint64_t)sqlite3_column_int64(db->sGetReconcileBuckets,2 + i);
+			_ZTLF_DB_sumAdd(sum,s);
+			*count += (uint64_t)sqlite3_column_int64(db->sGetReconcileBuckets,1);
+		}
+		sqlite3_reset(db->sGetReconcileBuckets);
+		_ZTLF_DB_scanRangeSum(db,b1 * ZTLF_DB_RECONCILE_BUCKET_SECONDS,zeroHash,tsEnd,hashEnd,sum,count);
+	}
+
+	pthread_mutex_unlock(&db->dbLock);
+}
+
+int64_t ZTLF_DB_GetFirstDoffSince(struct ZTLF_DB *db,const uint64_t ts)
+{
+	int64_t doff = -1;
+	pthread_mutex_lock(&db->dbLock);
+	sqlite3_reset(db->sGetFirstDoffSince);
+	sqlite3_bind_int64(db->sGetFirstDoffSince,1,(sqlite_int64)ts);
+	if (sqlite3_step(db->sGetFirstDoffSince) == SQLITE_ROW) {
+		if (sqlite3_column_type(db->sGetFirstDoffSince,0) != SQLITE_NULL)
+			doff = (int64_t)sqlite3_column_int64(db->sGetFirstDoffSince,0);
+	}
+	pthread_mutex_unlock(&db->dbLock);
+	return doff;
+}
+
+void ZTLF_DB_StopGraphThread(struct ZTLF_DB *db)
+{
+	__sync_and_and_fetch(&db->running,0);
+	if (__sync_or_and_fetch(&db->graphThreadStarted,0)) {
+		pthread_join(db->graphThread,NULL);
+		__sync_and_and_fetch(&db->graphThreadStarted,0);
+	}
+}
+
+/*
+ * The functions below are used by the offline integrity checker (and ZTLF_DB_GetRecordInfo by
+ * partial nodes now and then) and so prepare their statements on demand instead of keeping them
+ * around for the life of the database.
+ */
+
+long ZTLF_DB_GetRecordInfo(struct ZTLF_DB *db,const int64_t afterDoff,struct ZTLF_DB_RecordInfo *ri,const long max)
+{
+	long count = 0;
+	sqlite3_stmt *s = NULL;
+	pthread_mutex_lock(&db->dbLock);
+	if (sqlite3_prepare_v2(db->dbc,"SELECT doff,dlen,goff,score,link_count,hash FROM record WHERE doff > ? ORDER BY doff ASC LIMIT ?",-1,&s,NULL) == SQLITE_OK) {
+		sqlite3_bind_int64(s,1,(sqlite_int64)afterDoff);
+		sqlite3_bind_int64(s,2,(sqlite_int64)max);
+		while ((count < max)&&(sqlite3_step(s) == SQLITE_ROW)) {
+			ri[count].doff = (uint64_t)sqlite3_column_int64(s,0);
+			ri[count].dlen = (uint64_t)sqlite3_column_int64(s,1);
+			ri[count].goff = (int64_t)sqlite3_column_int64(s,2);
+			ri[count].score = (uint64_t)sqlite3_column_int64(s,3);
+			ri[count].linkCount = (unsigned int)sqlite3_column_int(s,4);
+			const void *h = sqlite3_column_blob(s,5);
+			if ((h)&&(sqlite3_column_bytes(s,5) == 32))
+				memcpy(ri[count].hash,h,32);
+			else memset(ri[count].hash,0,32);
+			++count;
+		}
+		sqlite3_finalize(s);
+	}
+	pthread_mutex_unlock(&db->dbLock);
+	return count;
+}
+
+int ZTLF_DB_GetGraphNode(struct ZTLF_DB *db,const int64_t goff,int64_t *links,uint32_t weight[3])
+{
+	int linkCount = -1;
+	if (goff < 0)
+		return -1;
+	pthread_rwlock_rdlock(&db->gfLock);
+	const struct ZTLF_DB_GraphNode *const gn = (const struct ZTLF_DB_GraphNode *)ZTLF_MappedFile_TryGet(&db->gf,(uintptr_t)goff,ZTLF_DB_MAX_GRAPH_NODE_SIZE);
+	if (gn) {
+		linkCount = (int)gn->linkCount;
+		for(int i=0;i<linkCount;++i)
+			links[i] = ZTLF_get64_le(gn->linkedRecordGoff[i]);
+		weight[0] = 0; weight[1] = 0; weight[2] = 0;
+		ZTLF_SUint96_Get(&db->wf,(uintptr_t)gn->weightsFileOffset,weight,weight + 1,weight + 2);
+	}
+	pthread_rwlock_unlock(&db->gfLock);
+	return linkCount;
+}
+
+void ZTLF_DB_CheckOrphans(struct ZTLF_DB *db,const int repair,int64_t counts[4])
+{
+	static const char *const where[4] = {
+		"selector WHERE record_doff NOT IN (SELECT doff FROM record)",
+		"hole WHERE waiting_record_goff NOT IN (SELECT goff FROM record) OR incomplete_goff NOT IN (SELECT goff FROM record)",
+		"dangling_link WHERE linking_record_goff NOT IN (SELECT goff FROM record)",
+		"graph_pending WHERE record_goff NOT IN (SELECT goff FROM record)"
+	};
+	char sql[512];
+	pthread_mutex_lock(&db->dbLock);
+	for(int i=0;i<4;++i) {
+		sqlite3_stmt *s = NULL;
+		counts[i] = 0;
+		snprintf(sql,sizeof(sql),"SELECT COUNT(1) FROM %s",where[i]);
+		if (sqlite3_prepare_v2(db->dbc,sql,-1,&s,NULL) == SQLITE_OK) {
+			if (sqlite3_step(s) == SQLITE_ROW)
+				counts[i] = (int64_t)sqlite3_column_int64(s,0);
+			sqlite3_finalize(s);
+		}
+		if ((repair)&&(counts[i] > 0)) {
+			snprintf(sql,sizeof(sql),"DELETE FROM %s",where[i]);
+			sqlite3_exec(db->dbc,sql,NULL,NULL,NULL);
+		}
+	}
+	pthread_mutex_unlock(&db->dbLock);
+}
+
 int ZTLF_DB_UpdatePulse(struct ZTLF_DB *db,const uint64_t token,const uint64_t minutes,const uint64_t startRangeStart,const uint64_t startRangeEnd)
 {
 	int changed = 0;
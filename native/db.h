@@ -54,6 +54,12 @@ ZTLF_PACKED_STRUCT(struct ZTLF_DB_GraphNode
 /* Big enough for the largest NIST ECC curve, can be increased if needed. */
 #define ZTLF_DB_QUERY_MAX_OWNER_SIZE 72
 
+/* Size of a selector key in the selector index. */
+#define ZTLF_DB_SELECTOR_KEY_SIZE 32
+
+/* Timestamp span of the hash sums kept for set reconciliation (must match reconcileSumBucketSeconds in Go). */
+#define ZTLF_DB_RECONCILE_BUCKET_SECONDS 86400
+
 struct ZTLF_DB;
 
 struct ZTLF_QueryResult
@@ -67,6 +73,7 @@ struct ZTLF_QueryResult
 	int localReputation;
 	uint64_t ckey;
 	uint8_t owner[ZTLF_DB_QUERY_MAX_OWNER_SIZE];
+	uint8_t selectorKey[ZTLF_DB_SELECTOR_KEY_SIZE]; /* key of the first selector, which sorts in ordinal order */
 };
 
 struct ZTLF_QueryResults
@@ -96,6 +103,17 @@ struct ZTLF_CertificateResults
 	unsigned long crlCount;
 };
 
+/* Index information about a record used by the integrity checker */
+struct ZTLF_DB_RecordInfo
+{
+	uint64_t doff;
+	uint64_t dlen;
+	int64_t goff;
+	uint64_t score;
+	unsigned int linkCount;
+	uint8_t hash[32];
+};
+
 #define ZTLF_DB_MAX_GRAPH_NODE_SIZE (sizeof(struct ZTLF_DB_GraphNode) + (256 * sizeof(int64_t)))
 
 /**
@@ -153,6 +171,7 @@ struct ZTLF_DB
 	sqlite3_stmt *sGetPendingCount;
 	sqlite3_stmt *sHaveDanglingLinks;
 	sqlite3_stmt *sGetWanted;
+	sqlite3_stmt *sGetWantedCount;
 	sqlite3_stmt *sIncWantedRetries;
 	sqlite3_stmt *sLogComment;
 	sqlite3_stmt *sGetCommentsBySubjectAndCommentOracle;
@@ -167,6 +186,15 @@ struct ZTLF_DB
 	sqlite3_stmt *sMarkInLimbo;
 	sqlite3_stmt *sTakeFromLimbo;
 	sqlite3_stmt *sHaveRecordInLimbo;
+	sqlite3_stmt *sGetLimboCount;
+	sqlite3_stmt *sGetRangeHashes;
+	sqlite3_stmt *sGetRangeSum;
+	sqlite3_stmt *sGetRangeCount;
+	sqlite3_stmt *sGetReconcileBucket;
+	sqlite3_stmt *sSetReconcileBucket;
+	sqlite3_stmt *sGetReconcileBuckets;
+	sqlite3_stmt *sGetReconcileBucketCount;
+	sqlite3_stmt *sGetFirstDoffSince;
 	sqlite3_stmt *sRegisterPulseToken;
 	sqlite3_stmt *sUpdatePulse;
 	sqlite3_stmt *sGetPulse;
@@ -177,6 +205,7 @@ struct ZTLF_DB
 	struct ZTLF_MappedFile gf;
 	pthread_rwlock_t gfLock; /* this is only locked for write when the mapped file's size might be adjusted */
 	int df;
+	int snapshotsInProgress; /* record data is not rewritten in place while this is non-zero (guarded by dbLock) */
 	struct ZTLF_SUInt96 wf;
 
 	pthread_t graphThread;
@@ -234,21 +263,33 @@ unsigned int ZTLF_DB_GetLinks(struct ZTLF_DB *db,void *const lbuf,unsigned int c
 /* This sets a record's reputation */
 void ZTLF_DB_UpdateRecordReputationByHash(struct ZTLF_DB *db,const void *const hash,const int reputation);
 
+/* Overwrite len bytes of a record's data in place and zero (deallocating if possible) the rest of its dlen bytes */
+int ZTLF_DB_RewriteRecordData(struct ZTLF_DB *db,const uint64_t doff,const void *data,const unsigned int len,const unsigned int dlen);
+
 /* Fill result pointer arguments with statistics about this database. */
 void ZTLF_DB_Stats(struct ZTLF_DB *db,uint64_t *recordCount,uint64_t *dataSize);
 
 /* Compute a CRC64 of all record hashes and their weights in deterministic order (for testing and consistency checking) */
 uint64_t ZTLF_DB_CRC64(struct ZTLF_DB *db);
 
+/* Write a consistent copy of the database's files into an existing directory and get its CRC64 and stats (returns 0 on success) */
+int ZTLF_DB_Snapshot(struct ZTLF_DB *db,const char *outPath,uint64_t *crc,uint64_t *recordCount,uint64_t *dataSize);
+
 /* -1: no records at all, 0: no pending, 1: pending records */
 int ZTLF_DB_HasPending(struct ZTLF_DB *db);
 
+/* get the number of records awaiting weight application in the graph thread */
+long ZTLF_DB_GetPendingCount(struct ZTLF_DB *db);
+
 /* returns non-zero if we have dangling links that haven't been retried more than N times */
 int ZTLF_DB_HaveDanglingLinks(struct ZTLF_DB *db,int ignoreWantedAfterNRetries);
 
 /* gets wanted hashes, returns count of hashes. buf must have enough space for up to maxHashes hashes. */
 unsigned int ZTLF_DB_GetWanted(struct ZTLF_DB *db,void *buf,const unsigned int maxHashes,const unsigned int retryCountMin,const unsigned int retryCountMax,const int incrementRetryCount);
 
+/* get the number of hashes ZTLF_DB_GetWanted() would return if maxHashes were unlimited */
+long ZTLF_DB_GetWantedCount(struct ZTLF_DB *db,const unsigned int retryCountMin,const unsigned int retryCountMax);
+
 /* log commentary */
 int ZTLF_DB_LogComment(struct ZTLF_DB *db,const int64_t byRecordDoff,const int assertion,const int reason,const void *const subject,const int subjectLen);
 
@@ -297,6 +338,30 @@ int ZTLF_DB_MarkInLimbo(struct ZTLF_DB *db,const void *hash,const void *owner,co
 
 int ZTLF_DB_HaveRecordIncludeLimbo(struct ZTLF_DB *db,const void *hash);
 
+/* get the number of records in limbo */
+long ZTLF_DB_GetLimboCount(struct ZTLF_DB *db);
+
+/* get up to maxCount hashes (32 bytes each) and timestamps of records ordered by (ts,hash) in [start,end) beginning at offset */
+long ZTLF_DB_GetRangeHashes(struct ZTLF_DB *db,const uint64_t tsStart,const void *hashStart,const uint64_t tsEnd,const void *hashEnd,long offset,const long maxCount,void *hashes,uint64_t *timestamps);
+
+/* get the count and 256-bit sum of hashes of records in [start,end) ordered by (ts,hash) for set reconciliation (uses stored per-bucket sums for whole buckets) */
+void ZTLF_DB_GetRangeSum(struct ZTLF_DB *db,const uint64_t tsStart,const void *hashStart,const uint64_t tsEnd,const void *hashEnd,uint64_t sum[4],uint64_t *count);
+
+/* get the lowest data offset of any record with a timestamp of at least ts, or -1 if there are none */
+int64_t ZTLF_DB_GetFirstDoffSince(struct ZTLF_DB *db,const uint64_t ts);
+
+/* Stop the graph thread so the graph and weights do not change (used by integrity checker, DB must still be closed) */
+void ZTLF_DB_StopGraphThread(struct ZTLF_DB *db);
+
+/* get index information for up to max records with a doff greater than afterDoff in doff order */
+long ZTLF_DB_GetRecordInfo(struct ZTLF_DB *db,const int64_t afterDoff,struct ZTLF_DB_RecordInfo *ri,const long max);
+
+/* get a graph node's linked graph node offsets (up to 256) and weight, returning link count or -1 if the node is out of range */
+int ZTLF_DB_GetGraphNode(struct ZTLF_DB *db,const int64_t goff,int64_t *links,uint32_t weight[3]);
+
+/* count (and delete if repair is non-zero) selectors, holes, dangling links, and pending entries that refer to nonexistent records */
+void ZTLF_DB_CheckOrphans(struct ZTLF_DB *db,const int repair,int64_t counts[4]);
+
 int ZTLF_DB_UpdatePulse(struct ZTLF_DB *db,const uint64_t token,const uint64_t minutes,const uint64_t startRangeStart,const uint64_t startRangeEnd);
 
 uint64_t ZTLF_DB_GetPulse(struct ZTLF_DB *db,const uint64_t token);
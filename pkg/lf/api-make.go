@@ -59,7 +59,7 @@ func doMakeRequestSetup(n *Node, selectors []MakeSelector, passphrase string, ow
 	}
 
 	if scanForOlderRecord {
-		_ = n.db.query(selectorRanges, nil, func(ts, _, _, doff, dlen uint64, _ int, _ uint64, recOwner []byte, _ uint) bool {
+		_ = n.db.query(selectorRanges, nil, func(ts, _, _, doff, dlen uint64, _ int, _ uint64, recOwner []byte, _ uint, _ []byte) bool {
 			if bytes.Equal(recOwner, owner.Public) {
 				if ts > recTS {
 					recTS = ts
@@ -95,6 +95,7 @@ type MakeRecord struct {
 	Passphrase       string         `json:",omitempty"` // Passphrase to override OwnerPrivate and (if empty) MaskingKey
 	Timestamp        *uint64        `json:",omitempty"` // Timestamp or current time if nil
 	PulseIfUnchanged *bool          `json:",omitempty"` // If true create a pulse if value matches previous record
+	Delete           *bool          `json:",omitempty"` // If true create a tombstone hiding this owner's earlier records with these selectors (Value is ignored)
 }
 
 // MakePulse requests server-side generation of a pulse.
@@ -107,8 +108,28 @@ type MakePulse struct {
 	NewRecordIfPulseSpanExceeded *bool          `json:",omitempty"` // If true (or missing), create new record if pulse is later than max pulse span
 }
 
-func (m *MakeRecord) execute(n *Node) (*Record, Pulse, bool, error) {
-	pulseIfUnchanged := m.PulseIfUnchanged != nil && *m.PulseIfUnchanged // default: false
+// runJob returns a function that executes this request as a job (see node-jobs.go).
+func (m *MakeRecord) runJob(n *Node) jobRunFunc {
+	return func(s *JobStatus, cancelled func() bool) (err error) {
+		s.Record, s.Pulse, s.Accepted, err = m.execute(n, cancelled)
+		return
+	}
+}
+
+// runJob returns a function that executes this request as a job (see node-jobs.go).
+func (m *MakePulse) runJob(n *Node) jobRunFunc {
+	return func(s *JobStatus, cancelled func() bool) (err error) {
+		s.Pulse, s.Record, s.Accepted, err = m.execute(n, cancelled)
+		return
+	}
+}
+
+func (m *MakeRecord) execute(n *Node, cancelled func() bool) (*Record, Pulse, bool, error) {
+	deleteRecord := m.Delete != nil && *m.Delete                                          // default: false
+	pulseIfUnchanged := m.PulseIfUnchanged != nil && *m.PulseIfUnchanged && !deleteRecord // default: false
+	if deleteRecord && len(m.Selectors) == 0 {
+		return nil, nil, false, ErrInvalidParameter
+	}
 	owner, selectorNames, selectorOrdinals, maskingKey, recTS, recDoff, recDlen, err := doMakeRequestSetup(n, m.Selectors, m.Passphrase, m.OwnerPrivate, m.MaskingKey, pulseIfUnchanged)
 	if err != nil {
 		return nil, nil, false, err
@@ -124,7 +145,7 @@ func (m *MakeRecord) execute(n *Node) (*Record, Pulse, bool, error) {
 		oldb, err := n.db.getDataByOffset(recDoff, recDlen, nil)
 		if err == nil {
 			old, err := NewRecordFromBytes(oldb)
-			if old != nil && err == nil {
+			if old != nil && err == nil && old.Type != RecordTypeDelete {
 				oldv, err := old.GetValue(maskingKey)
 				if err == nil && bytes.Equal(oldv, m.Value) {
 					if pulseIfUnchanged {
@@ -154,7 +175,17 @@ func (m *MakeRecord) execute(n *Node) (*Record, Pulse, bool, error) {
 		return nil, nil, false, ErrRecordInsufficientLinks
 	}
 
-	rec, err := NewRecord(RecordTypeDatum, m.Value, l, maskingKey, selectorNames, selectorOrdinals, ts, wg, owner)
+	recordType, value := RecordTypeDatum, []byte(m.Value)
+	if deleteRecord {
+		recordType, value = RecordTypeDelete, nil
+	}
+	if cancelled() {
+		return nil, nil, false, ErrJobCancelled
+	}
+	rec, err := NewRecord(recordType, value, l, maskingKey, selectorNames, selectorOrdinals, ts, wg, owner)
+	if cancelled() {
+		return nil, nil, false, ErrJobCancelled
+	}
 	if err != nil {
 		return nil, nil, false, err
 	}
@@ -166,7 +197,7 @@ func (m *MakeRecord) execute(n *Node) (*Record, Pulse, bool, error) {
 	return nil, nil, false, err
 }
 
-func (m *MakePulse) execute(n *Node) (Pulse, *Record, bool, error) {
+func (m *MakePulse) execute(n *Node, cancelled func() bool) (Pulse, *Record, bool, error) {
 	newRecordIfPulseSpanExceeded := m.NewRecordIfPulseSpanExceeded == nil || *m.NewRecordIfPulseSpanExceeded // default: true
 	owner, selectorNames, selectorOrdinals, maskingKey, recTS, recDoff, recDlen, err := doMakeRequestSetup(n, m.Selectors, m.Passphrase, m.OwnerPrivate, m.MaskingKey, newRecordIfPulseSpanExceeded)
 	if err != nil {
@@ -210,7 +241,13 @@ func (m *MakePulse) execute(n *Node) (Pulse, *Record, bool, error) {
 			if uint(len(l)) < n.genesisParameters.RecordMinLinks {
 				return nil, nil, false, ErrRecordInsufficientLinks
 			}
-			rec, err := NewRecord(old.Type, oldv, nil, maskingKey, selectorNames, selectorOrdinals, ts, wg, owner)
+			if cancelled() {
+				return nil, nil, false, ErrJobCancelled
+			}
+			rec, err := NewRecord(old.Type, oldv, l, maskingKey, selectorNames, selectorOrdinals, ts, wg, owner)
+			if cancelled() {
+				return nil, nil, false, ErrJobCancelled
+			}
 			if err != nil {
 				return nil, nil, false, err
 			}
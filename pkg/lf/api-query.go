@@ -16,9 +16,11 @@ package lf
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/binary"
 	"hash/crc64"
 	"math"
 	"sort"
+	"time"
 )
 
 const (
@@ -30,6 +32,17 @@ const (
 
 	// QuerySortOrderTimestamp ignores trust and weight and sorts by time
 	QuerySortOrderTimestamp = "timestamp"
+
+	// QuerySortOrderPulse ignores trust and weight and sorts by time of last pulse (or timestamp if never pulsed)
+	QuerySortOrderPulse = "pulse"
+)
+
+const (
+	// QueryAggregateCount summarizes results (counts, ordinal and time ranges, owners) without returning records
+	QueryAggregateCount = "count"
+
+	// QueryAggregateLatest summarizes results and also returns only the latest record in each result
+	QueryAggregateLatest = "latest"
 )
 
 const trustSigDigits float64 = 10000000000.0 // rounding precision for comparing trust values and considering them "equal"
@@ -48,14 +61,19 @@ type QueryRange struct {
 
 // Query (request) describes a query for records in the form of an ordered series of selector ranges.
 type Query struct {
-	Ranges     []QueryRange  `json:",omitempty"` // Selectors or selector range(s)
-	TimeRange  []uint64      `json:",omitempty"` // If present, constrain record times to after first value (if [1]) or range (if [2])
-	MaskingKey Blob          `json:",omitempty"` // Masking key to unmask record value(s) server-side (if non-empty)
-	Owners     []OwnerPublic `json:",omitempty"` // Restrict to these owners only
-	SortOrder  string        `json:",omitempty"` // Sort order within each result (default: trust)
-	Limit      *int          `json:",omitempty"` // If non-zero, limit maximum lower trust records per result
-	Open       *bool         `json:",omitempty"` // If true, include records with extra selectors not named in Ranges
-	Oracles    []OwnerPublic `json:",omitempty"` // Trust these oracles during trust computation
+	Ranges      []QueryRange  `json:",omitempty"` // Selectors or selector range(s)
+	TimeRange   []uint64      `json:",omitempty"` // If present, constrain record times to after first value (if [1]) or range (if [2])
+	MaskingKey  Blob          `json:",omitempty"` // Masking key to unmask record value(s) server-side (if non-empty)
+	Owners      []OwnerPublic `json:",omitempty"` // Restrict to these owners only
+	SortOrder   string        `json:",omitempty"` // Sort order within each result (default: trust)
+	Limit       *int          `json:",omitempty"` // If non-zero, limit maximum lower trust records per result
+	Open        *bool         `json:",omitempty"` // If true, include records with extra selectors not named in Ranges
+	Oracles     []OwnerPublic `json:",omitempty"` // Trust these oracles during trust computation
+	PageSize    *int          `json:",omitempty"` // If non-zero, return at most this many results (selector sets) in order of first selector ordinal
+	Cursor      Blob          `json:",omitempty"` // If non-empty, return results after this cursor (from a previous page's QueryResults)
+	TrustPolicy *TrustPolicy  `json:",omitempty"` // If non-nil, compute trust according to this policy instead of the default
+	Aggregate   string        `json:",omitempty"` // If non-empty, return a QueryAggregate instead of results (count or latest, ignored by ExecuteQuery and Watch)
+	MaxPulseAge uint64        `json:",omitempty"` // If non-zero, include only records pulsed (or created) within this many seconds of the node's current time
 }
 
 // QueryResultWeight is a 128-bit value broken into four 32-bit valu
@@ -98,6 +116,21 @@ type QueryResult struct {
 	OracleTrust float64           ``                  // Oracle trust only
 	Weight      QueryResultWeight `json:",omitempty"` // Record weight as a 128-bit big-endian value decomposed into 4 32-bit integers
 	Signed      bool              ``                  // If true, record's owner is signed and cert's timestamps match this record
+	Cursor      Blob              `json:",omitempty"` // Cursor to continue a paged query after this result (only for paged queries)
+}
+
+// QueryAggregate (response) summarizes the results of a query with an Aggregate instead of returning every record.
+// Ordinals are masked and sort like the ordinals they hide. They can be recovered with Ordinal.Get() and the
+// selector's name, so a time series can be queried by selector key without revealing its name to the node.
+type QueryAggregate struct {
+	ResultCount  int           ``                  // Number of results (distinct selector sets)
+	RecordCount  int           ``                  // Number of records in all results
+	MinOrdinal   []Ordinal     `json:",omitempty"` // Lowest masked ordinal of each selector in results
+	MaxOrdinal   []Ordinal     `json:",omitempty"` // Highest masked ordinal of each selector in results
+	MinTimestamp uint64        ``                  // Earliest record timestamp in results
+	MaxTimestamp uint64        ``                  // Latest record timestamp in results
+	Owners       []OwnerPublic `json:",omitempty"` // Distinct owners of records in results
+	Latest       QueryResults  `json:",omitempty"` // Latest record in each result (only if Aggregate is latest)
 }
 
 // QueryResults is a list of results to a query.
@@ -106,6 +139,28 @@ type QueryResult struct {
 // zero records, though remote code should check to prevent exceptions.
 type QueryResults [][]QueryResult
 
+// Cursor returns the cursor that continues a paged query after these results or nil if these results are not paged.
+// A page with fewer results than the requested PageSize is the last page.
+func (qr QueryResults) Cursor() Blob {
+	for i := len(qr) - 1; i >= 0; i-- {
+		if len(qr[i]) > 0 {
+			return qr[i][0].Cursor
+		}
+	}
+	return nil
+}
+
+// queryPageKey computes a key that sorts result sets in ordinal order for paging.
+// It consists of the key of the first selector, which for a given selector name sorts in ordinal order,
+// and the cumulative selector key as a tie breaker. Both come from the index so no records must be loaded.
+func queryPageKey(selectorKey []byte, ckey uint64) []byte {
+	k := make([]byte, 0, len(selectorKey)+8)
+	k = append(k, selectorKey...)
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], ckey)
+	return append(k, tmp[:]...)
+}
+
 type apiQueryResultTmp struct {
 	weightL, weightH, doff, dlen uint64
 	ts                           int64
@@ -113,14 +168,15 @@ type apiQueryResultTmp struct {
 	negativeComments             uint
 }
 
-func (m *Query) execute(n *Node) (qr QueryResults, err error) {
+// selectorKeyRanges computes the selector key ranges for this query and the masking key implied by it (if any).
+func (m *Query) selectorKeyRanges() (selectorRanges [][2][]byte, maskingKey []byte, err error) {
 	// Set up selector ranges using sender-supplied or computed selector keys.
 	mm := m.Ranges
 	if len(mm) == 0 {
-		return nil, ErrQueryRequiresSelectors
+		err = ErrQueryRequiresSelectors
+		return
 	}
-	maskingKey := m.MaskingKey
-	var selectorRanges [][2][]byte
+	maskingKey = m.MaskingKey
 	for i := 0; i < len(mm); i++ {
 		if len(mm[i].KeyRange) == 0 {
 			// If KeyRange is not used the selectors' names are specified in the clear and we generate keys locally.
@@ -148,12 +204,114 @@ func (m *Query) execute(n *Node) (qr QueryResults, err error) {
 		}
 	}
 	if len(selectorRanges) == 0 {
-		return nil, ErrQueryRequiresSelectors
+		err = ErrQueryRequiresSelectors
+	}
+	return
+}
+
+func (m *Query) execute(n *Node) (qr QueryResults, err error) {
+	return m.results(n, true)
+}
+
+// aggregate executes this query and summarizes its results according to its Aggregate field.
+// Paging, Limit, and SortOrder are ignored since aggregates cover all records in all results.
+// Record bodies are read to apply the same filters as ordinary queries but are not returned.
+func (m *Query) aggregate(n *Node) (*QueryAggregate, error) {
+	if m.Aggregate != QueryAggregateCount && m.Aggregate != QueryAggregateLatest {
+		return nil, ErrQueryInvalidAggregate
+	}
+	q := *m
+	q.SortOrder = ""
+	q.Limit = nil
+	q.PageSize = nil
+	q.Cursor = nil
+	qr, err := q.results(n, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var qa QueryAggregate
+	owners := make(map[string]OwnerPublic)
+	fetchDeadline := time.Now().Add(partialNodeFetchTimeout)
+	for _, qrSet := range qr {
+		qa.ResultCount++
+		latest := 0
+		for i := range qrSet {
+			rec := qrSet[i].Record
+			qa.RecordCount++
+			if qa.RecordCount == 1 || rec.Timestamp < qa.MinTimestamp {
+				qa.MinTimestamp = rec.Timestamp
+			}
+			if rec.Timestamp > qa.MaxTimestamp {
+				qa.MaxTimestamp = rec.Timestamp
+			}
+			if rec.Timestamp > qrSet[latest].Record.Timestamp {
+				latest = i
+			}
+			owners[string(rec.Owner)] = rec.Owner
+		}
+
+		// Records in a result share selectors, so their ordinals only have to be checked once per result.
+		sels := qrSet[0].Record.Selectors
+		for i := range sels {
+			if i >= len(qa.MinOrdinal) {
+				qa.MinOrdinal = append(qa.MinOrdinal, sels[i].Ordinal)
+				qa.MaxOrdinal = append(qa.MaxOrdinal, sels[i].Ordinal)
+				continue
+			}
+			if bytes.Compare(sels[i].Ordinal[:], qa.MinOrdinal[i][:]) < 0 {
+				qa.MinOrdinal[i] = sels[i].Ordinal
+			}
+			if bytes.Compare(sels[i].Ordinal[:], qa.MaxOrdinal[i][:]) > 0 {
+				qa.MaxOrdinal[i] = sels[i].Ordinal
+			}
+		}
+
+		// Values were not fetched for every record on partial nodes, so fetch only the latest ones.
+		if m.Aggregate == QueryAggregateLatest {
+			lr := qrSet[latest]
+			if lr.Record.IsAbbreviated() && fetchDeadline.After(time.Now()) {
+				if fr := n.fetchRecord(lr.Record.Hash(), time.Until(fetchDeadline)); fr != nil {
+					lr.Record = fr
+					lr.Value, _ = fr.GetValue(m.unmaskingKey(n))
+				}
+			}
+			qa.Latest = append(qa.Latest, []QueryResult{lr})
+		}
 	}
 
+	for _, o := range owners {
+		qa.Owners = append(qa.Owners, o)
+	}
+	sort.Slice(qa.Owners, func(a, b int) bool { return bytes.Compare(qa.Owners[a], qa.Owners[b]) < 0 })
+
+	return &qa, nil
+}
+
+// unmaskingKey returns the key used to unmask values server-side or nil if none is given or the node does not allow it.
+func (m *Query) unmaskingKey(n *Node) []byte {
+	if !n.queryPolicy.allowUnmasking() {
+		return nil
+	}
+	_, maskingKey, _ := m.selectorKeyRanges()
+	return maskingKey
+}
+
+// results executes this query, fetching values discarded by partial nodes from peers if fetchAbbreviated is true.
+func (m *Query) results(n *Node, fetchAbbreviated bool) (qr QueryResults, err error) {
+	if err = n.queryPolicy.check(m); err != nil {
+		return nil, err
+	}
+	selectorRanges, _, err := m.selectorKeyRanges()
+	if err != nil {
+		return nil, err
+	}
+	maskingKey := m.unmaskingKey(n) // nil if the node's query policy does not allow unmasking
+
 	// Get query timestamp range (or use min..max)
 	tsMin := int64(0)
 	tsMax := int64(9223372036854775807)
+	now := TimeSec()
 	if len(m.TimeRange) == 1 {
 		tsMin = int64(m.TimeRange[0])
 	} else if len(m.TimeRange) == 2 {
@@ -169,7 +327,8 @@ func (m *Query) execute(n *Node) (qr QueryResults, err error) {
 
 	// Get all results grouped by selector composite key.
 	bySelectorKey := make(map[uint64]*[]apiQueryResultTmp)
-	_ = n.db.query(selectorRanges, m.Oracles, func(ts, weightL, weightH, doff, dlen uint64, localReputation int, ckey uint64, owner []byte, negativeComments uint) bool {
+	firstSelectorKeys := make(map[uint64][]byte)
+	_ = n.db.query(selectorRanges, m.Oracles, func(ts, weightL, weightH, doff, dlen uint64, localReputation int, ckey uint64, owner []byte, negativeComments uint, firstSelectorKey []byte) bool {
 		includeOwner := true
 		if len(m.Owners) > 0 {
 			includeOwner = false
@@ -186,20 +345,78 @@ func (m *Query) execute(n *Node) (qr QueryResults, err error) {
 				tmp := make([]apiQueryResultTmp, 0, 4)
 				rptr = &tmp
 				bySelectorKey[ckey] = rptr
+				firstSelectorKeys[ckey] = firstSelectorKey
 			}
 			*rptr = append(*rptr, apiQueryResultTmp{weightL, weightH, doff, dlen, int64(ts), localReputation, negativeComments})
 		}
 		return true
 	})
 
+	// Order result sets for iteration. Paged queries are walked in ordinal order starting after the
+	// cursor so that only one page worth of records must be loaded, while unpaged queries can be
+	// processed in any order since they are sorted at the end.
+	pageSize := 0
+	if m.PageSize != nil && *m.PageSize > 0 {
+		pageSize = *m.PageSize
+	}
+	paged := pageSize > 0 || len(m.Cursor) > 0
+	resultSets := make([]*[]apiQueryResultTmp, 0, len(bySelectorKey))
+	var resultSetPageKeys map[*[]apiQueryResultTmp][]byte
+	if paged {
+		resultSetPageKeys = make(map[*[]apiQueryResultTmp][]byte)
+		for ckey, rptr := range bySelectorKey {
+			pk := queryPageKey(firstSelectorKeys[ckey], ckey)
+			if len(m.Cursor) == 0 || bytes.Compare(pk, m.Cursor) > 0 {
+				resultSetPageKeys[rptr] = pk
+				resultSets = append(resultSets, rptr)
+			}
+		}
+		sort.Slice(resultSets, func(a, b int) bool {
+			return bytes.Compare(resultSetPageKeys[resultSets[a]], resultSetPageKeys[resultSets[b]]) < 0
+		})
+	} else {
+		for _, rptr := range bySelectorKey {
+			resultSets = append(resultSets, rptr)
+		}
+	}
+
 	// Actually grab the records and populate the qr[] slice. Also compute
 	// oracle trust per ID/owner combo.
 	slanderByIDOwner := make(map[uint64]float64)
 	totalOracles := float64(len(m.Oracles))
 	ownerCertCache := make(map[uint64][]*x509.Certificate)
 	var qrIDOwnerCRC64s [][]uint64
-	for _, rptr := range bySelectorKey {
+	fetchDeadline := time.Now().Add(partialNodeFetchTimeout)
+
+	// setTrust computes oracle trust and overall trust for the records in a result.
+	authCerts, _ := n.genesisParameters.GetAuthCertificates()
+	haveAuthCerts := len(authCerts) > 0
+	setTrust := func(qrSetIdx int) {
+		qrSet := qr[qrSetIdx]
+		var maxWork float64
+		for i := range qrSet {
+			maxWork = math.Max(maxWork, qrSet[i].Weight.float())
+		}
+		for i := range qrSet {
+			if len(m.Oracles) > 0 {
+				qrSet[i].OracleTrust = math.Max(1.0-slanderByIDOwner[qrIDOwnerCRC64s[qrSetIdx][i]], 0.0)
+			}
+			var work float64
+			if maxWork > 0.0 {
+				work = qrSet[i].Weight.float() / maxWork
+			}
+			qrSet[i].Trust = m.TrustPolicy.trust(&qrSet[i], len(m.Oracles), work, haveAuthCerts)
+		}
+	}
+
+	for _, rptr := range resultSets {
+		if pageSize > 0 && len(qr) >= pageSize {
+			break
+		}
+		pageKey := resultSetPageKeys[rptr]
+
 		// Collate results and add to query result
+		resultSetStarted := false
 		for rn := 0; rn < len(*rptr); rn++ {
 			result := &(*rptr)[rn]
 
@@ -220,6 +437,26 @@ func (m *Query) execute(n *Node) (qr QueryResults, err error) {
 				continue
 			}
 
+			// Each result is the latest record by its owner for this selector set, so if it's a
+			// tombstone this owner has retracted this selector set and nothing is shown for it.
+			if rec.Type == RecordTypeDelete {
+				continue
+			}
+
+			// Liveness queries skip records that have not been pulsed recently enough.
+			pulse := n.db.getPulse(rec.recordBody.PulseToken) * 60 // pulse is in a resolution of minutes
+			if m.MaxPulseAge > 0 && rec.recordBody.Timestamp+pulse+m.MaxPulseAge < now {
+				continue
+			}
+
+			// Partial nodes may have discarded this record's value, in which case try to fetch it
+			// from peers. Total time spent waiting for peers is bounded for each query.
+			if fetchAbbreviated && rec.IsAbbreviated() && fetchDeadline.After(time.Now()) {
+				if fr := n.fetchRecord(rec.Hash(), time.Until(fetchDeadline)); fr != nil {
+					rec = fr
+				}
+			}
+
 			// Get owner certs and check whether any non-revoked certs apply to this record.
 			ownerC64 := crc64.Checksum(rec.Owner, crc64ECMATable)
 			ownerCerts, haveCachedOwnerCerts := ownerCertCache[ownerC64]
@@ -257,7 +494,7 @@ func (m *Query) execute(n *Node) (qr QueryResults, err error) {
 					slanderByIDOwner[idOwnerC64] = slander
 				}
 
-				if rn == 0 {
+				if !resultSetStarted {
 					qrIDOwnerCRC64s = append(qrIDOwnerCRC64s, []uint64{idOwnerC64})
 				} else if len(qrIDOwnerCRC64s) > 0 {
 					qrIDOwnerCRC64s[len(qrIDOwnerCRC64s)-1] = append(qrIDOwnerCRC64s[len(qrIDOwnerCRC64s)-1], idOwnerC64)
@@ -271,9 +508,9 @@ func (m *Query) execute(n *Node) (qr QueryResults, err error) {
 			weight[3] = uint32(result.weightL)
 
 			v, _ := rec.GetValue(maskingKey)
-			pulse := n.db.getPulse(rec.recordBody.PulseToken) * 60 // pulse is in a resolution of minutes
 
-			if rn == 0 {
+			if !resultSetStarted {
+				resultSetStarted = true
 				qr = append(qr, []QueryResult{{
 					Hash:        rec.Hash(),
 					Size:        int(result.dlen),
@@ -285,6 +522,7 @@ func (m *Query) execute(n *Node) (qr QueryResults, err error) {
 					OracleTrust: localTrust,
 					Weight:      weight,
 					Signed:      recordIsSigned,
+					Cursor:      pageKey,
 				}})
 			} else if len(qr) > 0 {
 				qr[len(qr)-1] = append(qr[len(qr)-1], QueryResult{
@@ -298,63 +536,97 @@ func (m *Query) execute(n *Node) (qr QueryResults, err error) {
 					OracleTrust: localTrust,
 					Weight:      weight,
 					Signed:      recordIsSigned,
+					Cursor:      pageKey,
 				})
 			}
 		}
-	}
 
-	authCerts, _ := n.genesisParameters.GetAuthCertificates()
-	haveAuthCerts := len(authCerts) > 0
-
-	// Compute final trust and sort within each result.
-	if len(qrIDOwnerCRC64s) > 0 {
-		for qrSetIdx, qrSet := range qr {
-			// Compute oracle trust and overall trust as a function of local and oracle trust if there are oracles.
-			if len(m.Oracles) > 0 {
-				for qrSetResultIdx := range qrSet {
-					oracleTrust := math.Max(1.0-slanderByIDOwner[qrIDOwnerCRC64s[qrSetIdx][qrSetResultIdx]], 0.0)
-					qrSet[qrSetResultIdx].Trust = (qrSet[qrSetResultIdx].LocalTrust + (oracleTrust * totalOracles)) / (totalOracles + 1.0)
-					qrSet[qrSetResultIdx].OracleTrust = oracleTrust
+		// Paged queries stop after a page worth of results, so results in which no record meets the
+		// trust policy's minimum are dropped as they're loaded. Final trust is computed below.
+		if resultSetStarted && paged && m.TrustPolicy.minTrust() > 0.0 {
+			qrSetIdx := len(qr) - 1
+			setTrust(qrSetIdx)
+			trusted := false
+			for i := range qr[qrSetIdx] {
+				if qr[qrSetIdx][i].Trust >= m.TrustPolicy.minTrust() {
+					trusted = true
+					break
+				}
+			}
+			if !trusted {
+				qr = qr[0:qrSetIdx]
+				if len(m.Oracles) > 0 {
+					qrIDOwnerCRC64s = qrIDOwnerCRC64s[0:qrSetIdx]
 				}
 			}
+		}
+	}
 
-			// If this database has auth certs, penalize records that are not signed.
-			if haveAuthCerts {
-				for qrSetResultIdx := range qrSet {
-					if !qrSet[qrSetResultIdx].Signed {
-						qrSet[qrSetResultIdx].Trust *= 0.9
-					}
+	// Compute final trust according to the query's trust policy, drop results below its minimum
+	// trust, and sort within each result. Queries with neither a trust policy nor oracles return
+	// results in database order with local trust only, as they always have.
+	minTrust := m.TrustPolicy.minTrust()
+	applyTrust := m.TrustPolicy != nil || len(qrIDOwnerCRC64s) > 0
+	for qrSetIdx := 0; applyTrust && qrSetIdx < len(qr); qrSetIdx++ {
+		setTrust(qrSetIdx)
+		qrSet := qr[qrSetIdx]
+		if minTrust > 0.0 {
+			trusted := qrSet[:0]
+			for _, r := range qrSet {
+				if r.Trust >= minTrust {
+					trusted = append(trusted, r)
 				}
 			}
+			qrSet = trusted
+			qr[qrSetIdx] = qrSet
+		}
 
-			if len(m.SortOrder) == 0 || m.SortOrder == QuerySortOrderTrust {
-				sort.Slice(qrSet, func(b, a int) bool {
-					if qrSet[a].Trust < qrSet[b].Trust {
-						return true
-					} else if uint64(qrSet[a].Trust*trustSigDigits) == uint64(qrSet[b].Trust*trustSigDigits) {
-						return qrSet[a].Weight.Compare(&qrSet[b].Weight) < 0
-					}
-					return false
-				})
-			} else if m.SortOrder == QuerySortOrderWeight {
-				sort.Slice(qrSet, func(b, a int) bool {
+		if len(m.SortOrder) == 0 || m.SortOrder == QuerySortOrderTrust {
+			sort.Slice(qrSet, func(b, a int) bool {
+				if qrSet[a].Trust < qrSet[b].Trust {
+					return true
+				} else if uint64(qrSet[a].Trust*trustSigDigits) == uint64(qrSet[b].Trust*trustSigDigits) {
 					return qrSet[a].Weight.Compare(&qrSet[b].Weight) < 0
-				})
-			} else if m.SortOrder == QuerySortOrderTimestamp {
-				sort.Slice(qrSet, func(b, a int) bool {
+				}
+				return false
+			})
+		} else if m.SortOrder == QuerySortOrderWeight {
+			sort.Slice(qrSet, func(b, a int) bool {
+				return qrSet[a].Weight.Compare(&qrSet[b].Weight) < 0
+			})
+		} else if m.SortOrder == QuerySortOrderTimestamp {
+			sort.Slice(qrSet, func(b, a int) bool {
+				return qrSet[a].Record.Timestamp < qrSet[b].Record.Timestamp
+			})
+		} else if m.SortOrder == QuerySortOrderPulse {
+			sort.Slice(qrSet, func(b, a int) bool {
+				if qrSet[a].Pulse == qrSet[b].Pulse {
 					return qrSet[a].Record.Timestamp < qrSet[b].Record.Timestamp
-				})
-			} else {
-				return nil, ErrQueryInvalidSortOrder
-			}
+				}
+				return qrSet[a].Pulse < qrSet[b].Pulse
+			})
+		} else {
+			return nil, ErrQueryInvalidSortOrder
+		}
 
-			if m.Limit != nil && *m.Limit > 0 && len(qrSet) > *m.Limit {
-				qr[qrSetIdx] = qrSet[0:*m.Limit]
+		if m.Limit != nil && *m.Limit > 0 && len(qrSet) > *m.Limit {
+			qr[qrSetIdx] = qrSet[0:*m.Limit]
+		}
+	}
+	if minTrust > 0.0 {
+		nonEmpty := qr[:0]
+		for _, qrSet := range qr {
+			if len(qrSet) > 0 {
+				nonEmpty = append(nonEmpty, qrSet)
 			}
 		}
+		qr = nonEmpty
 	}
 
-	// Sort overall results
+	// Sort overall results (paged results are already in order)
+	if paged {
+		return
+	}
 	sort.Slice(qr, func(a, b int) bool {
 		sa := qr[a][0].Record.Selectors
 		sb := qr[b][0].Record.Selectors
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+import (
+	"crypto/sha512"
+	"sync/atomic"
+)
+
+// WorkRequest (request) asks a node to compute proof of work for a record built and signed by the client.
+// Only the record's work hash is sent, so unlike MakeRecord the node never sees the record's value or
+// its owner's private key. This lets clients without the memory or CPU for Wharrgarbl create records.
+// Nodes limit delegated work with per-token and per-address hourly quotas (see APIAuthConfig).
+type WorkRequest struct {
+	WorkHash   Blob   // Work hash from RecordBuilder.WorkHash()
+	Difficulty uint32 // Wharrgarbl difficulty from RecordBuilder.WorkDifficulty()
+}
+
+// WorkResult (response) contains proof of work computed for a WorkRequest.
+type WorkResult struct {
+	Work       Blob   // Wharrgarbl proof of work to pass to RecordBuilder.SetWork()
+	Iterations uint64 // Search iterations required to find it
+}
+
+// check returns an error if this request is not for a valid work hash and a difficulty a record could require.
+func (m *WorkRequest) check() error {
+	if len(m.WorkHash) != sha512.Size384 || m.Difficulty == 0 || m.Difficulty > recordWharrgarblCost(RecordMaxSize) {
+		return ErrInvalidParameter
+	}
+	return nil
+}
+
+// runJob returns a function that executes this request as a job (see node-jobs.go).
+func (m *WorkRequest) runJob(n *Node) jobRunFunc {
+	return func(s *JobStatus, cancelled func() bool) (err error) {
+		s.Work, err = m.execute(n, cancelled)
+		return
+	}
+}
+
+// execute computes work using the node's work function for MakeRecord requests.
+func (m *WorkRequest) execute(n *Node, cancelled func() bool) (*WorkResult, error) {
+	if cancelled() {
+		return nil, ErrJobCancelled
+	}
+	w, iter := n.getMakeRecordWorkFunction().Compute(m.WorkHash, m.Difficulty)
+	if atomic.LoadUint32(&n.shutdown) != 0 {
+		return nil, ErrNodeStopped
+	}
+	if cancelled() {
+		return nil, ErrJobCancelled
+	}
+	if iter == 0 || WharrgarblVerify(w[:], m.WorkHash) < m.Difficulty {
+		return nil, ErrWharrgarblFailed
+	}
+	return &WorkResult{Work: w[:], Iterations: iter}, nil
+}
@@ -55,16 +55,36 @@ type NodeStatus struct {
 	Oracle            OwnerPublic       `json:",omitempty"` // Owner public if this node is an oracle, empty otherwise
 	P2PPort           int               ``                  // This node's P2P port
 	LocalTestMode     bool              ``                  // If true, this node is in local test mode
+	PartialNode       bool              ``                  // If true, this node discards some record values and fetches them from peers
+	QueryPolicy       *QueryPolicy      `json:",omitempty"` // Query privacy policy if this node restricts queries that reveal names or values
 	Identity          Blob              `json:",omitempty"` // This node's peer identity
 	Peers             []Peer            `json:",omitempty"` // Currently connected peers
 }
 
+// AddRecordResult is the result of adding one record in a batch.
+// Error is nil if the record was accepted or was already present.
+type AddRecordResult struct {
+	Hash  *HashBlob `json:",omitempty"` // Record hash (absent if a record in a batch could not be deserialized)
+	Error *ErrAPI   `json:",omitempty"` // Reason record was rejected or nil if record was accepted
+}
+
+// QueryBatchResult is the result of one query in a batch.
+type QueryBatchResult struct {
+	Results   QueryResults    `json:",omitempty"` // Query results if query succeeded
+	Aggregate *QueryAggregate `json:",omitempty"` // Aggregate instead of results if query had an Aggregate
+	Error     *ErrAPI         `json:",omitempty"` // Reason query failed or nil on success
+}
+
 // LF provides a common interface for local (same Go process) or remote (HTTP/HTTPS API) nodes.
 type LF interface {
 	// AddRecord attempts to add a record.
 	// A record won't actually show up in queries until all its dependencies are satisfied (fully synchronized).
 	AddRecord(*Record) error
 
+	// AddRecords attempts to add multiple records, returning a result for each.
+	// A non-nil error indicates a failure of the whole request (e.g. a transport error).
+	AddRecords([]*Record) ([]AddRecordResult, error)
+
 	// GetRecord gets a record by its 32-byte / 256-bit hash.
 	GetRecord(hash []byte) (*Record, error)
 
@@ -84,12 +104,30 @@ type LF interface {
 	// ExecuteQuery runs this query against this node.
 	ExecuteQuery(*Query) (QueryResults, error)
 
+	// ExecuteAggregateQuery runs a query with an Aggregate against this node.
+	ExecuteAggregateQuery(*Query) (*QueryAggregate, error)
+
+	// ExecuteQueries runs multiple queries in one request, returning a result for each.
+	// A non-nil error indicates a failure of the whole request (e.g. a transport error).
+	ExecuteQueries([]*Query) ([]QueryBatchResult, error)
+
+	// Watch executes a query and re-executes it whenever matching records or pulses arrive.
+	// Each set of results is passed to the supplied function, starting with the initial results.
+	// Watch blocks until the function returns false or an error occurs.
+	Watch(*Query, func(QueryResults) bool) error
+
 	// ExecuteMakeRecord runs a MakeRecordRequest against this node.
 	ExecuteMakeRecord(*MakeRecord) (*Record, Pulse, bool, error)
 
+	// ExecuteWork runs a WorkRequest against this node, computing proof of work for a record built elsewhere.
+	ExecuteWork(*WorkRequest) (*WorkResult, error)
+
 	// ExecuteMakePulse runs a MakePulseRequest against this node.
 	ExecuteMakePulse(*MakePulse) (Pulse, *Record, bool, error)
 
+	// WorkEstimate estimates how long this node takes to compute proof of work for a record of a given size.
+	WorkEstimate(uint) (*WorkEstimate, error)
+
 	// DoPulse processes a pulse, also announcing it to the global network if the second boolean is true (usually should be true).
 	// This returns true if the pulse was accepted as novel and valid.
 	DoPulse(Pulse, bool) (bool, error)
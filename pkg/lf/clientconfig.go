@@ -14,12 +14,18 @@
 package lf
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"encoding/json"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"sort"
 	"strings"
+
+	"golang.org/x/crypto/scrypt"
 )
 
 // Client config is mostly used by the code in cmd/lf but it's here so Node can
@@ -28,25 +34,165 @@ import (
 // ClientConfigName is the default name of the client config file
 const ClientConfigName = "client.json"
 
+// Scrypt parameters for new passphrase-locked owner private keys (about 32MiB of memory).
+const (
+	clientConfigLockScryptN = 32768
+	clientConfigLockScryptR = 8
+	clientConfigLockScryptP = 1
+)
+
+// ClientConfigLockedKey is an owner private key encrypted with a key derived from a passphrase.
+// The key is derived with scrypt and the private key is encrypted with AES-256-GCM using the
+// owner's public key as additional authenticated data.
+type ClientConfigLockedKey struct {
+	ScryptN    int  // Scrypt CPU/memory cost
+	ScryptR    int  // Scrypt block size
+	ScryptP    int  // Scrypt parallelization
+	Salt       Blob // Random salt for scrypt
+	Nonce      Blob // AES-GCM nonce
+	Ciphertext Blob // Encrypted private key and GCM tag
+}
+
 // ClientConfigOwner is a locally configured owner with private key information.
 type ClientConfigOwner struct {
 	Public  OwnerPublic
-	Private Blob
+	Private Blob                   `json:",omitempty"` // Private key if not locked
+	Locked  *ClientConfigLockedKey `json:",omitempty"` // Passphrase-encrypted private key if locked
 	Default bool
 }
 
-// GetOwner gets an Owner object (including private key) from this ClientConfigOwner
+// GetOwner gets an Owner object (including private key) from this ClientConfigOwner.
+// ErrOwnerLocked is returned if the private key is locked, in which case use GetOwnerWithPassphrase.
 func (co *ClientConfigOwner) GetOwner() (o *Owner, err error) {
+	if co.IsLocked() {
+		return nil, ErrOwnerLocked
+	}
 	o, err = NewOwnerFromPrivateBytes(co.Private)
 	return
 }
 
+// IsLocked returns true if this owner's private key is encrypted with a passphrase.
+func (co *ClientConfigOwner) IsLocked() bool { return len(co.Private) == 0 && co.Locked != nil }
+
+// GetOwnerWithPassphrase gets an Owner object, decrypting its private key with a passphrase if it is locked.
+// ErrIncorrectKey is returned if the passphrase is wrong.
+func (co *ClientConfigOwner) GetOwnerWithPassphrase(passphrase string) (*Owner, error) {
+	if !co.IsLocked() {
+		return co.GetOwner()
+	}
+	priv, err := co.decryptPrivate(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewOwnerFromPrivateBytes(priv)
+}
+
+// Lock encrypts this owner's private key with a passphrase and removes the plain text private key.
+// The config must be saved for this to take effect on disk.
+func (co *ClientConfigOwner) Lock(passphrase string) error {
+	if co.IsLocked() {
+		return ErrOwnerLocked
+	}
+	if len(co.Private) == 0 || len(passphrase) == 0 {
+		return ErrInvalidParameter
+	}
+	lk := &ClientConfigLockedKey{
+		ScryptN: clientConfigLockScryptN,
+		ScryptR: clientConfigLockScryptR,
+		ScryptP: clientConfigLockScryptP,
+		Salt:    make([]byte, 32),
+	}
+	_, _ = secureRandom.Read(lk.Salt)
+	gcm, err := lk.cipher(passphrase)
+	if err != nil {
+		return err
+	}
+	lk.Nonce = make([]byte, gcm.NonceSize())
+	_, _ = secureRandom.Read(lk.Nonce)
+	lk.Ciphertext = gcm.Seal(nil, lk.Nonce, co.Private, co.Public)
+	co.Locked = lk
+	co.Private = nil
+	return nil
+}
+
+// Unlock decrypts this owner's private key with a passphrase and stores it in plain text again.
+// The config must be saved for this to take effect on disk.
+func (co *ClientConfigOwner) Unlock(passphrase string) error {
+	if !co.IsLocked() {
+		return nil
+	}
+	priv, err := co.decryptPrivate(passphrase)
+	if err != nil {
+		return err
+	}
+	co.Private = priv
+	co.Locked = nil
+	return nil
+}
+
+func (co *ClientConfigOwner) decryptPrivate(passphrase string) ([]byte, error) {
+	gcm, err := co.Locked.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(co.Locked.Nonce) != gcm.NonceSize() {
+		return nil, ErrInvalidPrivateKey
+	}
+	priv, err := gcm.Open(nil, co.Locked.Nonce, co.Locked.Ciphertext, co.Public)
+	if err != nil {
+		return nil, ErrIncorrectKey
+	}
+	return priv, nil
+}
+
+// cipher derives the AES-GCM cipher for this locked key from a passphrase.
+func (lk *ClientConfigLockedKey) cipher(passphrase string) (cipher.AEAD, error) {
+	k, err := scrypt.Key([]byte(passphrase), lk.Salt, lk.ScryptN, lk.ScryptR, lk.ScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
 // ClientConfig is the JSON format for the client configuration file.
 type ClientConfig struct {
-	URLs    []RemoteNode                  ``         // Remote nodes
-	Oracles []OwnerPublic                 ``         // Oracles to trust during queries
-	Owners  map[string]*ClientConfigOwner ``         // Owners by name
-	Dirty   bool                          `json:"-"` // Non-persisted flag that can be used to indicate the config should be saved on client exit
+	URLs           []RemoteNode                  ``                  // Remote nodes
+	AuthTokens     map[string]string             `json:",omitempty"` // HTTP API auth tokens by remote node URL
+	Oracles        []OwnerPublic                 ``                  // Oracles to trust during queries
+	TrustPolicies  map[string]*TrustPolicy       `json:",omitempty"` // Named trust policies that can be selected for queries
+	Owners         map[string]*ClientConfigOwner ``                  // Owners by name
+	LocalAuthToken string                        `json:"-"`          // Non-persisted token for loopback URLs without a configured token (e.g. a local node's authtoken.secret)
+	Dirty          bool                          `json:"-"`          // Non-persisted flag that can be used to indicate the config should be saved on client exit
+}
+
+// RemoteNode returns a remote node with its configured auth token (if any) attached.
+// Loopback URLs without a configured token get LocalAuthToken if it is set.
+func (c *ClientConfig) RemoteNode(rn RemoteNode) RemoteNode {
+	if token := c.AuthTokens[string(rn)]; len(token) > 0 {
+		return rn.WithAuthToken(token)
+	}
+	if len(c.LocalAuthToken) > 0 {
+		if u, err := url.Parse(string(rn)); err == nil && u.User == nil {
+			h := u.Hostname()
+			if h == "localhost" || net.ParseIP(h).IsLoopback() {
+				return rn.WithAuthToken(c.LocalAuthToken)
+			}
+		}
+	}
+	return rn
+}
+
+// RemoteNodes returns this config's remote nodes with any configured auth tokens attached.
+func (c *ClientConfig) RemoteNodes() []RemoteNode {
+	rns := make([]RemoteNode, 0, len(c.URLs))
+	for _, u := range c.URLs {
+		rns = append(rns, c.RemoteNode(u))
+	}
+	return rns
 }
 
 // Load loads this client config from disk or initializes it with defaults if load fails.
@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*
  * Copyright (c)2019 ZeroTier, Inc.
  *
@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*
  * Copyright (c)2019 ZeroTier, Inc.
  *
@@ -47,22 +50,21 @@ import (
 const (
 	dbMaxOwnerSize       int = C.ZTLF_DB_QUERY_MAX_OWNER_SIZE
 	dbMaxConfigValueSize int = 1048576
-
-	// Reputations are in descending order in a circles of hell sense -- 0 is the worst possible thing.
-	// Note that 0 and 63 must match native/db.h defines.
-	dbReputationDefault                     = 63 // normal perfectly good looking record
-	dbReputationTemporalViolation           = 48 // leave a bit of room above and below
-	dbReputationRecordDeserializationFailed = 1  // record appears corrupt (shouldn't really happen at all)
-	dbReputationCollision                   = 0  // record's selector names collide with another owner
 )
 
+func init() {
+	storeBackends[StoreBackendNative] = func() Store { return new(db) }
+}
+
 // DB is an instance of the LF database that stores records and manages record weights and linkages.
+// This is the native storage backend, which uses SQLite and memory mapped graph and weight files.
 type db struct {
 	log                   [logLevelCount]*log.Logger
 	globalLoggerIdx       uint
 	globalSyncCallbackIdx uint
 	cdb                   *C.struct_ZTLF_DB
 	cdbLock               sync.Mutex
+	snapshotLock          sync.RWMutex // held for read by snapshots instead of cdbLock and for write by close
 }
 
 // Global variables that store logger instances for use by the callback in db-log-callback.go.
@@ -113,6 +115,8 @@ func (db *db) open(basePath string, loggers [logLevelCount]*log.Logger, syncCall
 }
 
 func (db *db) close() {
+	db.snapshotLock.Lock()
+	defer db.snapshotLock.Unlock()
 	db.cdbLock.Lock()
 	defer db.cdbLock.Unlock()
 
@@ -275,14 +279,7 @@ func (db *db) getLinks2(count uint) (ll [][32]byte, err error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(l) >= 32 {
-		ll = make([][32]byte, len(l)/32)
-		for i, j := 0, 0; (j + 32) <= len(l); j += 32 {
-			copy(ll[i][:], l[j:j+32])
-			i++
-		}
-	}
-	return
+	return linksToArrays(l), nil
 }
 
 func (db *db) updateRecordReputationByHash(h []byte, reputation int) {
@@ -308,6 +305,25 @@ func (db *db) crc64() uint64 {
 	return uint64(C.ZTLF_DB_CRC64(db.cdb))
 }
 
+// snapshot writes a consistent copy of the database's files into an existing directory and returns its CRC64 and stats.
+// The native code locks the database only while copying the parts that must be consistent with each other, so
+// cdbLock is not held here and the node keeps running while most of the copy is made.
+func (db *db) snapshot(outPath string) (crc, recordCount, dataSize uint64, err error) {
+	cpath := C.CString(outPath)
+	defer C.free(unsafe.Pointer(cpath))
+	db.snapshotLock.RLock()
+	defer db.snapshotLock.RUnlock()
+	if db.cdb == nil {
+		err = ErrIO
+		return
+	}
+	cerr := C.ZTLF_DB_Snapshot(db.cdb, cpath, (*C.uint64_t)(unsafe.Pointer(&crc)), (*C.uint64_t)(unsafe.Pointer(&recordCount)), (*C.uint64_t)(unsafe.Pointer(&dataSize)))
+	if cerr != 0 {
+		err = ErrDatabase{int(cerr), "snapshot failed"}
+	}
+	return
+}
+
 // hasPending returns true if this database is not waiting for any records to fill any graph gaps or satisfy any links.
 // This can also be used to check whether synchronization is complete since it returns true only if there are records
 // and all links for them are satisfied.
@@ -317,6 +333,13 @@ func (db *db) hasPending() bool {
 	return C.ZTLF_DB_HasPending(db.cdb) > 0
 }
 
+// getPendingCount returns the number of records awaiting weight application by the graph thread.
+func (db *db) getPendingCount() int {
+	db.cdbLock.Lock()
+	defer db.cdbLock.Unlock()
+	return int(C.ZTLF_DB_GetPendingCount(db.cdb))
+}
+
 // haveDanglingLinks returns true if we have dangling links that haven't been retried more than N times.
 func (db *db) haveDanglingLinks(ignoreAfterNRetries int) bool {
 	db.cdbLock.Lock()
@@ -327,8 +350,9 @@ func (db *db) haveDanglingLinks(ignoreAfterNRetries int) bool {
 // query executes a query against a number of selector ranges. The function is executed for each result, with
 // results not sorted. The loop is broken if the function returns false. The owner is passed as a pointer to
 // an array that is reused, so a copy must be made if you want to keep it. The arguments to the function are:
-// timestamp, weight (low), weight (high), data offset, data length, local reputation, cumulative selector key, owner, negative comments.
-func (db *db) query(selectorRanges [][2][]byte, oracles []OwnerPublic, f func(uint64, uint64, uint64, uint64, uint64, int, uint64, []byte, uint) bool) error {
+// timestamp, weight (low), weight (high), data offset, data length, local reputation, cumulative selector key, owner, negative comments,
+// and the key of the first selector in its index (which sorts in ordinal order).
+func (db *db) query(selectorRanges [][2][]byte, oracles []OwnerPublic, f func(uint64, uint64, uint64, uint64, uint64, int, uint64, []byte, uint, []byte) bool) error {
 	if len(selectorRanges) == 0 {
 		return nil
 	}
@@ -387,7 +411,7 @@ func (db *db) query(selectorRanges [][2][]byte, oracles []OwnerPublic, f func(ui
 		for i := C.long(0); i < cresults.count; i++ {
 			cr := (*C.struct_ZTLF_QueryResult)(unsafe.Pointer(uintptr(unsafe.Pointer(&cresults.results[0])) + (uintptr(i) * uintptr(C.sizeof_struct_ZTLF_QueryResult))))
 			if cr.ownerSize > 0 && cr.dlen > 0 {
-				if !f(uint64(cr.ts), uint64(cr.weightL), uint64(cr.weightH), uint64(cr.doff), uint64(cr.dlen), int(cr.localReputation), uint64(cr.ckey), C.GoBytes(unsafe.Pointer(&cr.owner[0]), C.int(cr.ownerSize)), uint(cr.negativeComments)) {
+				if !f(uint64(cr.ts), uint64(cr.weightL), uint64(cr.weightH), uint64(cr.doff), uint64(cr.dlen), int(cr.localReputation), uint64(cr.ckey), C.GoBytes(unsafe.Pointer(&cr.owner[0]), C.int(cr.ownerSize)), uint(cr.negativeComments), C.GoBytes(unsafe.Pointer(&cr.selectorKey[0]), C.ZTLF_DB_SELECTOR_KEY_SIZE)) {
 					break
 				}
 			}
@@ -478,6 +502,13 @@ func (db *db) getWanted(max, retryCountMin, retryCountMax int, incrementRetryCou
 	return count, buf[0 : count*32]
 }
 
+// getWantedCount returns the number of hashes getWanted would return with an unlimited maximum.
+func (db *db) getWantedCount(retryCountMin, retryCountMax int) int {
+	db.cdbLock.Lock()
+	defer db.cdbLock.Unlock()
+	return int(C.ZTLF_DB_GetWantedCount(db.cdb, C.uint(retryCountMin), C.uint(retryCountMax)))
+}
+
 func (db *db) logComment(byRecordDoff uint64, assertion, reason int, subject []byte) error {
 	var sub unsafe.Pointer
 	if len(subject) > 0 {
@@ -597,6 +628,127 @@ func (db *db) markInLimbo(hash, owner []byte, localReceiveTime, ts uint64) error
 	return nil
 }
 
+// getLimboCount returns the number of records in limbo awaiting possible future approval.
+func (db *db) getLimboCount() int {
+	db.cdbLock.Lock()
+	defer db.cdbLock.Unlock()
+	return int(C.ZTLF_DB_GetLimboCount(db.cdb))
+}
+
+// getRangeHashes returns up to maxCount hashes and timestamps of records in [start,end) ordered by timestamp and then hash.
+func (db *db) getRangeHashes(start, end *reconcileBound, offset, maxCount int) ([][32]byte, []uint64) {
+	if maxCount <= 0 {
+		return nil, nil
+	}
+	hashes := make([][32]byte, maxCount)
+	timestamps := make([]uint64, maxCount)
+	db.cdbLock.Lock()
+	count := int(C.ZTLF_DB_GetRangeHashes(db.cdb, C.uint64_t(start.ts), unsafe.Pointer(&start.hash[0]), C.uint64_t(end.ts), unsafe.Pointer(&end.hash[0]), C.long(offset), C.long(maxCount), unsafe.Pointer(&hashes[0]), (*C.uint64_t)(unsafe.Pointer(&timestamps[0]))))
+	db.cdbLock.Unlock()
+	return hashes[0:count], timestamps[0:count]
+}
+
+// getRangeSum returns the count and 256-bit sum (as four little-endian 64-bit words) of record hashes in [start,end).
+func (db *db) getRangeSum(start, end *reconcileBound) (sum [4]uint64, count uint64) {
+	db.cdbLock.Lock()
+	C.ZTLF_DB_GetRangeSum(db.cdb, C.uint64_t(start.ts), unsafe.Pointer(&start.hash[0]), C.uint64_t(end.ts), unsafe.Pointer(&end.hash[0]), (*C.uint64_t)(unsafe.Pointer(&sum[0])), (*C.uint64_t)(unsafe.Pointer(&count)))
+	db.cdbLock.Unlock()
+	return
+}
+
+// getFirstDoffSince returns the lowest data offset of any record with a timestamp of at least ts.
+// False is returned if there are no such records.
+func (db *db) getFirstDoffSince(ts uint64) (uint64, bool) {
+	db.cdbLock.Lock()
+	doff := int64(C.ZTLF_DB_GetFirstDoffSince(db.cdb, C.uint64_t(ts)))
+	db.cdbLock.Unlock()
+	if doff < 0 {
+		return 0, false
+	}
+	return uint64(doff), true
+}
+
+// getRecordInfo returns index information for up to max records with a data offset greater than afterDoff in data offset order.
+func (db *db) getRecordInfo(afterDoff int64, max int) []dbRecordInfo {
+	if max <= 0 {
+		return nil
+	}
+	cri := make([]C.struct_ZTLF_DB_RecordInfo, max)
+	db.cdbLock.Lock()
+	count := int(C.ZTLF_DB_GetRecordInfo(db.cdb, C.int64_t(afterDoff), &cri[0], C.long(max)))
+	db.cdbLock.Unlock()
+	ri := make([]dbRecordInfo, count)
+	for i := 0; i < count; i++ {
+		ri[i].doff = uint64(cri[i].doff)
+		ri[i].dlen = uint64(cri[i].dlen)
+		ri[i].goff = int64(cri[i].goff)
+		ri[i].score = uint64(cri[i].score)
+		ri[i].linkCount = uint(cri[i].linkCount)
+		for j := range ri[i].hash {
+			ri[i].hash[j] = byte(cri[i].hash[j])
+		}
+	}
+	return ri
+}
+
+// rewriteRecordData overwrites a record's data in place with data no longer than its dlen and zeroes the rest.
+// The zeroed part is deallocated if the filesystem supports it.
+func (db *db) rewriteRecordData(doff uint64, data []byte, dlen uint) error {
+	if len(data) == 0 || uint(len(data)) > dlen {
+		return ErrInvalidParameter
+	}
+	db.cdbLock.Lock()
+	cerr := C.ZTLF_DB_RewriteRecordData(db.cdb, C.uint64_t(doff), unsafe.Pointer(&data[0]), C.uint(len(data)), C.uint(dlen))
+	db.cdbLock.Unlock()
+	if cerr != 0 {
+		return ErrDatabase{int(cerr), "record rewrite failed (" + strconv.Itoa(int(cerr)) + ")"}
+	}
+	return nil
+}
+
+// getGraphNode returns a graph node's links (graph node offsets or -1 for holes) and its 96-bit weight.
+// False is returned if the graph node offset is out of range.
+func (db *db) getGraphNode(goff int64) (links []int64, weight [3]uint32, ok bool) {
+	var clinks [256]C.int64_t
+	var cweight [3]C.uint32_t
+	db.cdbLock.Lock()
+	linkCount := int(C.ZTLF_DB_GetGraphNode(db.cdb, C.int64_t(goff), &clinks[0], &cweight[0]))
+	db.cdbLock.Unlock()
+	if linkCount < 0 {
+		return
+	}
+	links = make([]int64, linkCount)
+	for i := range links {
+		links[i] = int64(clinks[i])
+	}
+	for i := range weight {
+		weight[i] = uint32(cweight[i])
+	}
+	ok = true
+	return
+}
+
+// checkOrphans counts (and deletes if repair is true) selectors, holes, dangling links, and pending graph
+// entries that refer to records that do not exist.
+func (db *db) checkOrphans(repair bool) (selectors, holes, danglingLinks, pending uint64) {
+	var counts [4]C.int64_t
+	r := C.int(0)
+	if repair {
+		r = 1
+	}
+	db.cdbLock.Lock()
+	C.ZTLF_DB_CheckOrphans(db.cdb, r, &counts[0])
+	db.cdbLock.Unlock()
+	return uint64(counts[0]), uint64(counts[1]), uint64(counts[2]), uint64(counts[3])
+}
+
+// stopGraphThread stops background weight application so the graph and weights do not change.
+func (db *db) stopGraphThread() {
+	db.cdbLock.Lock()
+	C.ZTLF_DB_StopGraphThread(db.cdb)
+	db.cdbLock.Unlock()
+}
+
 func (db *db) haveRecordIncludeLimbo(hash []byte) bool {
 	if len(hash) != 32 {
 		return false
@@ -55,6 +55,14 @@ const (
 	ErrPrivateKeyRequired     Err = "private key required"
 	ErrQueryRequiresSelectors Err = "query requires at least one selector"
 	ErrQueryInvalidSortOrder  Err = "invalid sort order value"
+	ErrQueryInvalidAggregate  Err = "invalid aggregate value"
+	ErrQueryNamesNotAllowed   Err = "node query policy does not allow plain text selector names (use selector keys)"
+	ErrQueryUnmaskNotAllowed  Err = "node query policy does not allow server-side unmasking with a masking key"
+	ErrNodeStopped            Err = "node is stopped or shutting down"
+	ErrWorkQueueFull          Err = "work queue is full"
+	ErrWorkQuotaExceeded      Err = "delegated work quota exceeded"
+	ErrJobCancelled           Err = "job cancelled"
+	ErrOwnerLocked            Err = "owner private key is locked with a passphrase"
 )
 
 //////////////////////////////////////////////////////////////////////////////
@@ -82,6 +90,7 @@ const (
 	ErrRecordCertificateInvalid        ErrRecord = "certificate invalid"
 	ErrRecordCertificateRequired       ErrRecord = "certificate required"
 	ErrRecordProhibited                ErrRecord = "record administratively prohibited"
+	ErrRecordValueMissing              ErrRecord = "record value missing (abbreviated records are not accepted)"
 )
 
 //////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,490 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// The integrity checker is run against the database of a node that is not running. It checks
+// records.lf against the SQLite index, graph.bin, and the weights files. The index, graph, and
+// weights can be rebuilt from records.lf alone since every record's hash, selectors, links,
+// and score can be recomputed from its data.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fsckMaxProblems is the maximum number of problem descriptions kept in a FsckResult.
+const fsckMaxProblems = 256
+
+// fsckDatabaseFiles are the files rebuilt from records.lf, which is moved aside and replaced by a rebuilt copy.
+var fsckDatabaseFiles = []string{"node.db", "node.db-journal", "node.db-wal", "node.db-shm", "graph.bin", "weights.b00", "weights.b32", "weights.b64", "records.lf"}
+
+// FsckResult contains the results of a database integrity check.
+type FsckResult struct {
+	RecordsInFile         uint64   // Records read from records.lf
+	InvalidRecords        uint64   // Records in records.lf that failed Record.Validate() or are not in canonical form
+	TrailingBytes         uint64   // Bytes after the last readable record in records.lf (harmless after a crash since they will be overwritten)
+	IndexedRecords        uint64   // Records in SQLite index
+	UnindexedRecords      uint64   // Valid records in records.lf that are not in the index
+	IndexErrors           uint64   // Index entries that do not match a record in records.lf
+	GraphErrors           uint64   // Graph nodes that are missing or whose links do not match their records
+	WeightsChecked        bool     // True if weights were checked
+	WeightErrors          uint64   // Graph nodes whose weights do not match the weights recomputed from the graph
+	PendingRecords        uint64   // Records whose weights have not yet been applied to the graph
+	OrphanedSelectors     uint64   // Selectors for records that do not exist
+	OrphanedHoles         uint64   // Holes in the graph below records that do not exist
+	OrphanedDanglingLinks uint64   // Dangling links from records that do not exist
+	OrphanedPending       uint64   // Pending graph updates for records that do not exist
+	OrphansRepaired       bool     // True if orphaned entries were deleted
+	Problems              []string // Descriptions of problems found (up to 256)
+}
+
+// OK returns true if no errors were found.
+// Trailing bytes and pending records are normal after an unclean shutdown and are not considered errors.
+func (fr *FsckResult) OK() bool {
+	return fr.InvalidRecords == 0 && fr.UnindexedRecords == 0 && fr.IndexErrors == 0 && fr.GraphErrors == 0 && fr.WeightErrors == 0 && (fr.OrphansRepaired || (fr.OrphanedSelectors == 0 && fr.OrphanedHoles == 0 && fr.OrphanedDanglingLinks == 0 && fr.OrphanedPending == 0))
+}
+
+func (fr *FsckResult) problem(f string, args ...interface{}) {
+	if len(fr.Problems) < fsckMaxProblems {
+		fr.Problems = append(fr.Problems, fmt.Sprintf(f, args...))
+	}
+}
+
+// dbRecordInfo is index information about a record used by the integrity checker and partial nodes.
+type dbRecordInfo struct {
+	doff      uint64
+	dlen      uint64
+	goff      int64
+	score     uint64
+	linkCount uint
+	hash      [32]byte
+}
+
+// fsckStore is implemented by storage backends that can be checked and rebuilt (currently only the native backend).
+type fsckStore interface {
+	Store
+	getGraphNode(goff int64) (links []int64, weight [3]uint32, ok bool)
+	checkOrphans(repair bool) (selectors, holes, danglingLinks, pending uint64)
+	stopGraphThread()
+}
+
+// fsckRecord is information about a record read from records.lf.
+type fsckRecord struct {
+	hash    [32]byte
+	dlen    uint64
+	links   []HashBlob
+	valid   bool
+	indexed bool
+}
+
+// fsckCheckNotRunning returns an error if lf.pid exists in basePath and names a running process.
+func fsckCheckNotRunning(basePath string) error {
+	pidStr, err := ioutil.ReadFile(path.Join(basePath, "lf.pid"))
+	if err != nil {
+		return nil
+	}
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(pidStr)), 10, 64)
+	if err != nil || pid <= 0 || int(pid) == os.Getpid() {
+		return nil
+	}
+	p, err := os.FindProcess(int(pid))
+	if err == nil && p.Signal(syscall.Signal(0)) == nil {
+		return fmt.Errorf("node appears to be running (lf.pid contains %d), stop it first", pid)
+	}
+	return nil
+}
+
+// fsckCheckBackend returns an error if a node does not use a storage backend that can be checked.
+func fsckCheckBackend(basePath string) error {
+	sc, _, err := readStoreConfig(basePath)
+	if err != nil {
+		return err
+	}
+	if sc.Backend != StoreBackendNative {
+		return fmt.Errorf("node uses the %q storage backend, only the %q backend can be checked", sc.Backend, StoreBackendNative)
+	}
+	if _, have := storeBackends[StoreBackendNative]; !have {
+		return fmt.Errorf("storage backend %q is not available (LF was built without cgo)", StoreBackendNative)
+	}
+	return nil
+}
+
+// fsckOpenDatabase opens a native database with logging disabled and no action taken on record synchronization.
+func fsckOpenDatabase(basePath string, syncCallback func(uint64, uint, int, *[32]byte)) (fsckStore, error) {
+	var loggers [logLevelCount]*log.Logger
+	for i := range loggers {
+		loggers[i] = nullLogger
+	}
+	if syncCallback == nil {
+		syncCallback = func(uint64, uint, int, *[32]byte) {}
+	}
+	s, err := openStoreBackend(StoreBackendNative, basePath, loggers, syncCallback)
+	if err != nil {
+		return nil, err
+	}
+	return s.(fsckStore), nil
+}
+
+// fsckScanRecords reads a records.lf file and calls a function with each record and its data offset.
+// A gap left after a record whose value was discarded in place is included in that record's size.
+// It returns the number of bytes that were read successfully as records.
+func fsckScanRecords(recordsPath string, f func(uint64, *Record, uint64) bool) (uint64, error) {
+	in, err := os.Open(recordsPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	br := bufio.NewReaderSize(in, 1048576)
+	cr := CountingReader{R: br}
+	for {
+		doff := cr.N
+		var rec Record
+		if rec.UnmarshalFrom(&cr) != nil {
+			return doff, nil
+		}
+		if next, _ := br.Peek(1); len(next) == 1 && next[0] == recordDataGapMarker {
+			var gh [recordDataGapHeaderSize]byte
+			if _, err = io.ReadFull(&cr, gh[:]); err != nil {
+				return doff, nil
+			}
+			gapSize := int64(binary.BigEndian.Uint32(gh[1:]))
+			if n, _ := io.CopyN(ioutil.Discard, &cr, gapSize); n != gapSize {
+				return doff, nil
+			}
+		}
+		if !f(doff, &rec, cr.N-doff) {
+			return cr.N, nil
+		}
+	}
+}
+
+// fsckCanonicalSize returns true if dlen is a record's serialized size, or at least that if its value was discarded in place.
+func fsckCanonicalSize(rec *Record, dlen uint64) bool {
+	rl := uint64(len(rec.Bytes()))
+	return rl == dlen || (rec.IsAbbreviated() && rl < dlen)
+}
+
+// CheckDatabase checks the integrity of a node's database. The node must not be running.
+// If checkWeights is true all record weights are recomputed by traversing the graph, which can be slow.
+// If repair is true orphaned selectors, holes, dangling links, and pending graph entries are deleted.
+// Other problems require a rebuild with RebuildDatabase. Progress is logged to the progress logger if
+// it is not nil.
+func CheckDatabase(basePath string, checkWeights, repair bool, progress *log.Logger) (*FsckResult, error) {
+	if progress == nil {
+		progress = nullLogger
+	}
+	if err := fsckCheckNotRunning(basePath); err != nil {
+		return nil, err
+	}
+	if err := fsckCheckBackend(basePath); err != nil {
+		return nil, err
+	}
+	recordsPath := path.Join(basePath, "records.lf")
+	if _, err := os.Stat(recordsPath); err != nil {
+		return nil, err
+	}
+
+	var fr FsckResult
+
+	// Read and validate every record in records.lf.
+	progress.Printf("checking records in %s...", recordsPath)
+	fileRecords := make(map[uint64]*fsckRecord)
+	goodSize, err := fsckScanRecords(recordsPath, func(doff uint64, rec *Record, dlen uint64) bool {
+		fr.RecordsInFile++
+		r := &fsckRecord{hash: rec.Hash(), dlen: dlen, links: rec.Links, valid: true}
+		if err := rec.Validate(); err != nil {
+			fr.InvalidRecords++
+			fr.problem("record =%s at %d in records.lf is invalid: %s", Base62Encode(r.hash[:]), doff, err.Error())
+			r.valid = false
+		} else if !fsckCanonicalSize(rec, dlen) {
+			fr.InvalidRecords++
+			fr.problem("record =%s at %d in records.lf is not in canonical form", Base62Encode(r.hash[:]), doff)
+			r.valid = false
+		}
+		fileRecords[doff] = r
+		if (fr.RecordsInFile % 100000) == 0 {
+			progress.Printf("  %d records", fr.RecordsInFile)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(recordsPath); err == nil && uint64(fi.Size()) > goodSize {
+		fr.TrailingBytes = uint64(fi.Size()) - goodSize
+	}
+	progress.Printf("  %d records, %d invalid, %d trailing bytes", fr.RecordsInFile, fr.InvalidRecords, fr.TrailingBytes)
+
+	d, err := fsckOpenDatabase(basePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer d.close()
+	d.stopGraphThread()
+
+	// Check that index entries match records in records.lf and load graph node offsets.
+	progress.Print("checking index...")
+	var indexed []dbRecordInfo
+	goffHashes := make(map[int64][32]byte)
+	hashGoffs := make(map[[32]byte]int64)
+	afterDoff := int64(-1)
+	for {
+		ri := d.getRecordInfo(afterDoff, 4096)
+		if len(ri) == 0 {
+			break
+		}
+		for i := range ri {
+			fr.IndexedRecords++
+			r := fileRecords[ri[i].doff]
+			if r == nil {
+				fr.IndexErrors++
+				fr.problem("indexed record =%s at %d is not at that offset in records.lf", Base62Encode(ri[i].hash[:]), ri[i].doff)
+				continue
+			}
+			r.indexed = true
+			if r.hash != ri[i].hash || r.dlen != ri[i].dlen {
+				fr.IndexErrors++
+				fr.problem("indexed record =%s at %d does not match record =%s in records.lf", Base62Encode(ri[i].hash[:]), ri[i].doff, Base62Encode(r.hash[:]))
+				continue
+			}
+			if ri[i].goff >= 0 {
+				goffHashes[ri[i].goff] = ri[i].hash
+				hashGoffs[ri[i].hash] = ri[i].goff
+			}
+			indexed = append(indexed, ri[i])
+		}
+		afterDoff = int64(ri[len(ri)-1].doff)
+	}
+	for doff, r := range fileRecords {
+		if r.valid && !r.indexed {
+			fr.UnindexedRecords++
+			fr.problem("record =%s at %d in records.lf is not indexed", Base62Encode(r.hash[:]), doff)
+		}
+	}
+	progress.Printf("  %d indexed records, %d unindexed, %d index errors", fr.IndexedRecords, fr.UnindexedRecords, fr.IndexErrors)
+
+	// Check that graph nodes exist and that their links point to the graph nodes of linked records.
+	progress.Print("checking graph...")
+	graphLinks := make([][]int64, len(indexed))
+	graphWeights := make([][3]uint32, len(indexed))
+	for i := range indexed {
+		ri := &indexed[i]
+		links, weight, ok := d.getGraphNode(ri.goff)
+		if !ok {
+			fr.GraphErrors++
+			fr.problem("graph node for record =%s at %d is missing", Base62Encode(ri.hash[:]), ri.goff)
+			continue
+		}
+		graphLinks[i] = links
+		graphWeights[i] = weight
+		recordLinks := fileRecords[ri.doff].links
+		if len(links) != len(recordLinks) || uint(len(links)) != ri.linkCount {
+			fr.GraphErrors++
+			fr.problem("graph node for record =%s at %d has %d links but record has %d", Base62Encode(ri.hash[:]), ri.goff, len(links), len(recordLinks))
+			continue
+		}
+		for li, lgoff := range links {
+			if lgoff >= 0 {
+				if lh, have := goffHashes[lgoff]; !have || lh != recordLinks[li] {
+					fr.GraphErrors++
+					fr.problem("graph node for record =%s at %d link %d does not point to linked record =%s", Base62Encode(ri.hash[:]), ri.goff, li, Base62Encode(recordLinks[li][:]))
+				}
+			} else if _, have := hashGoffs[recordLinks[li]]; have {
+				fr.GraphErrors++
+				fr.problem("graph node for record =%s at %d link %d is dangling but linked record =%s exists", Base62Encode(ri.hash[:]), ri.goff, li, Base62Encode(recordLinks[li][:]))
+			}
+		}
+	}
+	fr.PendingRecords = uint64(d.getPendingCount())
+	progress.Printf("  %d graph errors, %d records pending graph update", fr.GraphErrors, fr.PendingRecords)
+
+	// Recompute weights: each record's weight is its own score plus the scores of every record from which it can be reached.
+	if checkWeights {
+		if fr.PendingRecords > 0 {
+			fr.problem("weights not checked since %d records are pending graph update or link to missing records", fr.PendingRecords)
+		} else {
+			progress.Print("checking weights...")
+			fr.WeightsChecked = true
+			goffIndex := make(map[int64]int)
+			for i := range indexed {
+				goffIndex[indexed[i].goff] = i
+			}
+			expected := make([]uint64, len(indexed))
+			visited := make([]int, len(indexed))
+			var queue []int
+			for i := range indexed {
+				expected[i] += indexed[i].score
+				queue = append(queue[:0], i)
+				for len(queue) > 0 {
+					j := queue[len(queue)-1]
+					queue = queue[:len(queue)-1]
+					for _, lgoff := range graphLinks[j] {
+						if k, have := goffIndex[lgoff]; have && lgoff >= 0 && visited[k] != i+1 {
+							visited[k] = i + 1
+							expected[k] += indexed[i].score
+							queue = append(queue, k)
+						}
+					}
+				}
+				if (i % 10000) == 9999 {
+					progress.Printf("  %d/%d records", i+1, len(indexed))
+				}
+			}
+			for i := range indexed {
+				w := graphWeights[i]
+				if w[2] != 0 || ((uint64(w[1])<<32)|uint64(w[0])) != expected[i] {
+					fr.WeightErrors++
+					fr.problem("weight of record =%s is %.8x%.8x%.8x but should be %.24x", Base62Encode(indexed[i].hash[:]), w[2], w[1], w[0], expected[i])
+				}
+			}
+			progress.Printf("  %d weight errors", fr.WeightErrors)
+		}
+	}
+
+	// Check for index entries that refer to records that do not exist.
+	progress.Print("checking for orphaned index entries...")
+	fr.OrphanedSelectors, fr.OrphanedHoles, fr.OrphanedDanglingLinks, fr.OrphanedPending = d.checkOrphans(repair)
+	fr.OrphansRepaired = repair
+	if fr.OrphanedSelectors > 0 || fr.OrphanedHoles > 0 || fr.OrphanedDanglingLinks > 0 || fr.OrphanedPending > 0 {
+		fr.problem("orphaned entries: %d selectors, %d holes, %d dangling links, %d pending graph updates", fr.OrphanedSelectors, fr.OrphanedHoles, fr.OrphanedDanglingLinks, fr.OrphanedPending)
+	}
+
+	return &fr, nil
+}
+
+// RebuildDatabase rebuilds a node's SQLite index, graph, and weights from records.lf. The node must not be running.
+// Existing database files including records.lf are moved into a backup directory whose path is returned, and every
+// valid record in the old records.lf is then added to a new database. Certificates, CRLs, and commentary are indexed
+// again as records are synchronized. Records in limbo and pulses are not in records.lf and are not restored. They
+// will be received again from peers.
+func RebuildDatabase(basePath string, progress *log.Logger) (recordCount, skippedCount uint64, backupPath string, err error) {
+	if progress == nil {
+		progress = nullLogger
+	}
+	if err = fsckCheckNotRunning(basePath); err != nil {
+		return
+	}
+	if err = fsckCheckBackend(basePath); err != nil {
+		return
+	}
+	if _, err = os.Stat(path.Join(basePath, "records.lf")); err != nil {
+		return
+	}
+
+	backupPath = path.Join(basePath, "fsck-backup-"+strconv.FormatUint(TimeSec(), 10))
+	if err = os.Mkdir(backupPath, 0755); err != nil {
+		return
+	}
+	for _, name := range fsckDatabaseFiles {
+		if _, err = os.Stat(path.Join(basePath, name)); err == nil {
+			progress.Printf("moving %s to %s", name, backupPath)
+			if err = os.Rename(path.Join(basePath, name), path.Join(backupPath, name)); err != nil {
+				return
+			}
+		}
+	}
+	err = nil
+
+	type syncedRecord struct {
+		doff uint64
+		dlen uint
+	}
+	var synced []syncedRecord
+	var syncedLock sync.Mutex
+	d, err := fsckOpenDatabase(basePath, func(doff uint64, dlen uint, _ int, _ *[32]byte) {
+		syncedLock.Lock()
+		synced = append(synced, syncedRecord{doff: doff, dlen: dlen})
+		syncedLock.Unlock()
+	})
+	if err != nil {
+		return
+	}
+	defer d.close()
+
+	progress.Print("adding records to new database...")
+	var putErr error
+	_, err = fsckScanRecords(path.Join(backupPath, "records.lf"), func(doff uint64, rec *Record, dlen uint64) bool {
+		rh := rec.Hash()
+		if rec.Validate() != nil || !fsckCanonicalSize(rec, dlen) || d.hasRecord(rh[:]) {
+			skippedCount++
+			return true
+		}
+		if putErr = d.putRecord(rec); putErr != nil {
+			return false
+		}
+		recordCount++
+		if (recordCount % 10000) == 0 {
+			progress.Printf("  %d records", recordCount)
+		}
+		return true
+	})
+	if err == nil {
+		err = putErr
+	}
+	if err != nil {
+		return
+	}
+	progress.Printf("  %d records added, %d invalid or duplicate records skipped", recordCount, skippedCount)
+
+	// Wait for the graph thread to apply weights. Records linking to records that are not present will remain pending.
+	progress.Print("updating graph and weights...")
+	lastPending, lastChange := d.getPendingCount(), time.Now()
+	for lastPending > 0 && time.Since(lastChange) < (10*time.Second) {
+		time.Sleep(250 * time.Millisecond)
+		if p := d.getPendingCount(); p != lastPending {
+			lastPending, lastChange = p, time.Now()
+			progress.Printf("  %d records pending", p)
+		}
+	}
+
+	// Index certificates, CRLs, and comments in synchronized records in the order in which they were added.
+	// The graph thread is stopped first since it calls the sync callback with the database locked. Records
+	// still pending are synchronized and indexed by the node when it starts.
+	progress.Print("indexing certificates and commentary...")
+	d.stopGraphThread()
+	syncedLock.Lock()
+	sort.Slice(synced, func(a, b int) bool { return synced[a].doff < synced[b].doff })
+	for _, sr := range synced {
+		rdata, err := d.getDataByOffset(sr.doff, sr.dlen, nil)
+		if err != nil {
+			continue
+		}
+		r, err := NewRecordFromBytes(rdata)
+		if err != nil {
+			continue
+		}
+		storeIndexRecord(d, r, sr.doff, sr.dlen)
+	}
+	syncedLock.Unlock()
+
+	if recordCount == 0 {
+		err = errors.New("no valid records found in records.lf")
+	}
+	return
+}
@@ -44,6 +44,7 @@ type GenesisParameters struct {
 	RecordMinLinks          uint     ``                  // Minimum number of links required for non-genesis records
 	RecordMaxValueSize      uint     ``                  // Maximum size of record values
 	RecordMaxTimeDrift      uint     ``                  // Maximum number of seconds of time drift permitted for records
+	SeedPeers               []Peer   `json:",omitempty"` // Peers nodes can contact to join this network if they know of no others
 
 	state  unsafe.Pointer
 	stateP *genesisParametersState
@@ -119,6 +120,11 @@ func (gp *GenesisParameters) Update(jsonValue []byte) (bool, error) {
 				gp.RecordMaxTimeDrift = ngp.RecordMaxTimeDrift
 				changed = true
 			}
+		case "seedpeers":
+			if !peersEqual(gp.SeedPeers, ngp.SeedPeers) {
+				gp.SeedPeers = ngp.SeedPeers
+				changed = true
+			}
 		}
 	}
 
@@ -133,6 +139,19 @@ func (gp *GenesisParameters) Update(jsonValue []byte) (bool, error) {
 	return changed, nil
 }
 
+// peersEqual returns true if two peer lists contain the same peers in the same order.
+func peersEqual(a, b []Peer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].IP.Equal(b[i].IP) || a[i].Port != b[i].Port || !bytes.Equal(a[i].Identity, b[i].Identity) {
+			return false
+		}
+	}
+	return true
+}
+
 // SetAmendableFields validates and sets the AmendableFields field
 func (gp *GenesisParameters) SetAmendableFields(fields []string) error {
 	if len(fields) == 0 {
@@ -34,6 +34,26 @@ import (
 	"github.com/tidwall/pretty"
 )
 
+// These must be the same as the log levels in native/common.h.
+const (
+	// LogLevelFatal messages precede fatal error shutdowns and indicate serious problems like I/O errors or bugs.
+	LogLevelFatal int = 0
+
+	// LogLevelWarning messages indicate a non-fatal but potentailly serious problem such as a database that may have corruption.
+	LogLevelWarning int = 1
+
+	// LogLevelNormal indicates normal log messages that most users would want to see or record.
+	LogLevelNormal int = 2
+
+	// LogLevelVerbose tracks details that some users might not care about.
+	LogLevelVerbose int = 3
+
+	// LogLevelTrace only works if tracing is enabled at compile time and outputs a ton of detail useful only to developers.
+	LogLevelTrace int = 4
+
+	logLevelCount = 5
+)
+
 var (
 	big1 = new(big.Int).SetUint64(1)
 	big2 = new(big.Int).SetUint64(2)
@@ -67,6 +87,19 @@ func (cr *countingWriter) Write(b []byte) (n int, err error) {
 	return
 }
 
+// CountingReader wraps an io.Reader and counts bytes read from it.
+type CountingReader struct {
+	R io.Reader // Underlying reader
+	N uint64    // Bytes read so far
+}
+
+// Read implements io.Reader
+func (cr *CountingReader) Read(b []byte) (n int, err error) {
+	n, err = cr.R.Read(b)
+	cr.N += uint64(n)
+	return
+}
+
 // writeUVarint writes a varint to a writer because this is missing from the 'binary' package for some reason.
 func writeUVarint(out io.Writer, v uint64) (int, error) {
 	var tmp [10]byte
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// This is the HTTP API authorization parts of Node, see node.go for main object.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// APIAuthConfigName is the name of the file in a node's base path that configures HTTP API authorization.
+const APIAuthConfigName = "apiauth.json"
+
+// HTTP API authorization scopes.
+// Requests present tokens as "Authorization: Bearer <token>". The token in authtoken.secret has
+// all scopes. Requests from loopback addresses that present no token are treated like any other
+// unless loopback trust is enabled, since behind a reverse proxy every request looks local.
+const (
+	APIScopeQuery      = "query"      // Queries, record and status lookups, watches, and metrics
+	APIScopePost       = "post"       // Submission of records and pulses
+	APIScopeMakeRecord = "makerecord" // Delegated creation of records and pulses (node does work and sees owner keys)
+	APIScopeWork       = "work"       // Delegated proof of work for records built and signed by clients (subject to quotas)
+	APIScopeConnect    = "connect"    // Suggesting P2P peers for the node to connect to
+	APIScopeAdmin      = "admin"      // All of the above
+)
+
+// apiAuthDefaultAnonymousScopes are the scopes granted to requests without a token if none are configured.
+var apiAuthDefaultAnonymousScopes = []string{APIScopeQuery, APIScopePost}
+
+// apiAuthDefaultWorkQuota is the hourly delegated work quota for tokens and addresses that don't set one.
+// It's enough for about one 1KiB record per minute.
+var apiAuthDefaultWorkQuota = 60 * uint64(recordWharrgarblCost(1024))
+
+// APIAuthToken is a named token with a set of scopes.
+type APIAuthToken struct {
+	Token     string   ``                  // Secret bearer token
+	Scopes    []string `json:",omitempty"` // Scopes this token grants (see APIScope constants)
+	WorkQuota uint64   `json:",omitempty"` // Maximum total difficulty of delegated work per hour (default: about one 1KiB record per minute)
+}
+
+// APIAuthConfig configures additional HTTP API tokens and the access granted to requests without tokens.
+type APIAuthConfig struct {
+	Tokens             map[string]*APIAuthToken `json:",omitempty"` // Additional tokens by name
+	AnonymousScopes    []string                 `json:",omitempty"` // Scopes for requests without a token (default: query and post)
+	AnonymousWorkQuota uint64                   `json:",omitempty"` // Maximum total difficulty of delegated work per hour for each address without a token (default: about one 1KiB record per minute)
+	TrustLoopback      bool                     `json:",omitempty"` // If true loopback requests without a token get all scopes (unsafe behind a reverse proxy)
+}
+
+func (c *APIAuthConfig) anonymousScopes() []string {
+	if c.AnonymousScopes == nil {
+		return apiAuthDefaultAnonymousScopes
+	}
+	return c.AnonymousScopes
+}
+
+// loadAPIAuthConfig reads an API auth config, returning an empty config if the file does not exist.
+func loadAPIAuthConfig(path string) (*APIAuthConfig, error) {
+	c := new(APIAuthConfig)
+	d, err := ioutil.ReadFile(path)
+	if err != nil || len(d) == 0 {
+		return c, nil
+	}
+	err = json.Unmarshal(d, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// apiRequestScopes returns the token sent with a request (if any) and the scopes it grants. All is true if every
+// scope is granted and valid is false if a token was sent but isn't recognized.
+func (n *Node) apiRequestScopes(req *http.Request) (token string, scopes []string, all, valid bool) {
+	token = apiRequestAuthToken(req)
+	if len(token) > 0 {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(n.apiAuthToken)) == 1 {
+			return token, nil, true, true
+		}
+		for _, t := range n.apiAuthConfig.Tokens {
+			if t != nil && subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return token, t.Scopes, false, true
+			}
+		}
+		return token, nil, false, false
+	}
+	if n.apiAuthConfig.TrustLoopback {
+		ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+		if net.ParseIP(ip).IsLoopback() {
+			return "", nil, true, true
+		}
+	}
+	return "", n.apiAuthConfig.anonymousScopes(), false, true
+}
+
+// apiHasScope returns true if a request's bearer token (or lack thereof) grants a scope.
+func (n *Node) apiHasScope(req *http.Request, scope string) bool {
+	_, scopes, all, valid := n.apiRequestScopes(req)
+	if all {
+		return true
+	}
+	if valid {
+		for _, s := range scopes {
+			if s == scope || s == APIScopeAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apiAuthorize checks whether a request's bearer token (or lack thereof) grants a scope, sending an error and returning false if not.
+func (n *Node) apiAuthorize(out http.ResponseWriter, req *http.Request, scope string) bool {
+	if n.apiHasScope(req, scope) {
+		return true
+	}
+	token, _, _, valid := n.apiRequestScopes(req)
+	apiSetStandardHeaders(out)
+	if !valid {
+		out.Header().Set("WWW-Authenticate", "Bearer")
+		apiSendObj(out, req, http.StatusUnauthorized, &ErrAPI{Code: http.StatusUnauthorized, Message: "invalid auth token"})
+	} else if len(token) == 0 {
+		out.Header().Set("WWW-Authenticate", "Bearer")
+		apiSendObj(out, req, http.StatusUnauthorized, &ErrAPI{Code: http.StatusUnauthorized, Message: "an auth token with scope '" + scope + "' is required for this path"})
+	} else {
+		apiSendObj(out, req, http.StatusForbidden, &ErrAPI{Code: http.StatusForbidden, Message: "auth token does not have scope '" + scope + "' required for this path"})
+	}
+	return false
+}
+
+// apiWorkQuota returns a key identifying the caller for work quota purposes and its hourly work quota.
+// A quota of zero means no limit, which is only the case for the master token and trusted loopback callers.
+func (n *Node) apiWorkQuota(req *http.Request) (string, uint64) {
+	token := apiRequestAuthToken(req)
+	if len(token) > 0 {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(n.apiAuthToken)) == 1 {
+			return "", 0
+		}
+		for name, t := range n.apiAuthConfig.Tokens {
+			if t != nil && subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return "token:" + name, apiWorkQuotaOrDefault(t.WorkQuota)
+			}
+		}
+	}
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if n.apiAuthConfig.TrustLoopback && net.ParseIP(ip).IsLoopback() {
+		return "", 0
+	}
+	return "address:" + ip, apiWorkQuotaOrDefault(n.apiAuthConfig.AnonymousWorkQuota)
+}
+
+// apiWorkQuotaOrDefault returns a configured work quota or apiAuthDefaultWorkQuota if it's not set.
+func apiWorkQuotaOrDefault(quota uint64) uint64 {
+	if quota == 0 {
+		return apiAuthDefaultWorkQuota
+	}
+	return quota
+}
+
+// apiRequestAuthToken extracts a bearer token from a request's Authorization header.
+func apiRequestAuthToken(req *http.Request) string {
+	auth := strings.TrimSpace(req.Header.Get("Authorization"))
+	if len(auth) > 7 && strings.EqualFold(auth[0:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
@@ -0,0 +1,433 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// This is the asynchronous job parts of Node, see node.go for main object.
+// Record creation, pulse creation, and delegated work all use the node's MakeRecord work function,
+// which can only compute one proof of work at a time. Jobs are queued per caller and callers take
+// turns, so one caller submitting many jobs can't starve others.
+
+import (
+	"crypto/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// JobTypeMakeRecord is a job that runs a MakeRecord request.
+	JobTypeMakeRecord = "makerecord"
+
+	// JobTypeMakePulse is a job that runs a MakePulse request.
+	JobTypeMakePulse = "makepulse"
+
+	// JobTypeWork is a job that runs a WorkRequest.
+	JobTypeWork = "work"
+
+	// JobTypeBenchmark is a job that benchmarks the node's work function for work estimates.
+	JobTypeBenchmark = "benchmark"
+)
+
+// Job states
+const (
+	JobStateQueued    = "queued"    // Job is waiting for its turn
+	JobStateRunning   = "running"   // Job is running
+	JobStateDone      = "done"      // Job completed successfully
+	JobStateFailed    = "failed"    // Job failed (see Error)
+	JobStateCancelled = "cancelled" // Job was cancelled before it completed
+)
+
+// nodeJobQueueSize is the maximum number of jobs waiting to run.
+const nodeJobQueueSize = 64
+
+// nodeJobQueueSizePerCaller is the maximum number of jobs one caller can have waiting to run.
+const nodeJobQueueSizePerCaller = 8
+
+// nodeJobRetention is how long finished jobs can be looked up before they're forgotten.
+const nodeJobRetention = 10 * time.Minute
+
+// JobStatus (response) describes the state, progress, and result of an asynchronous job.
+// Requests to /makerecord, /makepulse, and /work create jobs and return their status immediately if
+// the async URL parameter is set. The job's status can then be polled with GET /jobs/<ID> and the job
+// can be cancelled with DELETE /jobs/<ID>.
+type JobStatus struct {
+	ID            string      ``                  // Unique random job ID
+	Type          string      ``                  // Job type (makerecord, makepulse, work, or benchmark)
+	State         string      ``                  // Job state (queued, running, done, failed, or cancelled)
+	QueuePosition int         `json:",omitempty"` // Number of jobs that will run before this one if queued
+	Created       uint64      ``                  // Time job was created (seconds since epoch)
+	Difficulty    uint32      `json:",omitempty"` // Difficulty of proof of work being computed if running
+	Iterations    uint64      `json:",omitempty"` // Wharrgarbl iterations so far (total if finished)
+	EstimatedTime float64     `json:",omitempty"` // Rough estimate of seconds until work is found if running
+	Record        *Record     `json:",omitempty"` // Record created by a makerecord or makepulse job
+	Pulse         Pulse       `json:",omitempty"` // Pulse created by a makerecord or makepulse job
+	Accepted      bool        ``                  // True if the record or pulse was accepted by the node
+	Work          *WorkResult `json:",omitempty"` // Work computed by a work job
+	Error         *ErrAPI     `json:",omitempty"` // Reason job failed
+}
+
+// finished returns true if this job will not change state again.
+func (s *JobStatus) finished() bool {
+	return s.State == JobStateDone || s.State == JobStateFailed || s.State == JobStateCancelled
+}
+
+// jobRunFunc runs a job and fills in result fields in its status. Aborting the work function only stops a
+// computation that's already in progress, so jobs must also call cancelled before and after computing
+// work and return ErrJobCancelled if it returns true.
+type jobRunFunc func(s *JobStatus, cancelled func() bool) error
+
+// nodeJob is a job in a node's job queue. Its fields are guarded by the node's jobsLock.
+type nodeJob struct {
+	status     JobStatus
+	err        error         // Error returned by run (if any)
+	caller     string        // Key identifying caller for scheduling (token, address, or empty if local)
+	scope      string        // HTTP API scope required to see or cancel this job
+	run        jobRunFunc    // Runs job and fills in result fields in a status (called without lock)
+	onFail     func()        // If non-nil, called if job fails or is cancelled (e.g. to refund quota)
+	cancel     bool          // Set to request cancellation of a running job
+	iter0      uint64        // Work function iteration count when job started
+	finishedAt time.Time     // Time job finished
+	done       chan struct{} // Closed when job finishes
+}
+
+// submitJob adds a job to the queue, returning ErrWorkQueueFull if the queue or the caller's share of it is full.
+func (n *Node) submitJob(jobType, caller, scope string, run jobRunFunc, onFail func()) (*nodeJob, error) {
+	if atomic.LoadUint32(&n.shutdown) != 0 {
+		return nil, ErrNodeStopped
+	}
+	var idb [16]byte
+	_, _ = rand.Read(idb[:])
+	j := &nodeJob{
+		status: JobStatus{
+			ID:      Base62Encode(idb[:]),
+			Type:    jobType,
+			State:   JobStateQueued,
+			Created: TimeSec(),
+		},
+		caller: caller,
+		scope:  scope,
+		run:    run,
+		onFail: onFail,
+		done:   make(chan struct{}),
+	}
+
+	n.jobsLock.Lock()
+	queued := 0
+	for _, q := range n.jobQueues {
+		queued += len(q)
+	}
+	if queued >= nodeJobQueueSize || len(n.jobQueues[caller]) >= nodeJobQueueSizePerCaller {
+		n.jobsLock.Unlock()
+		return nil, ErrWorkQueueFull
+	}
+	n.jobs[j.status.ID] = j
+	if len(n.jobQueues[caller]) == 0 {
+		n.jobCallers = append(n.jobCallers, caller)
+	}
+	n.jobQueues[caller] = append(n.jobQueues[caller], j)
+	n.jobsLock.Unlock()
+
+	select {
+	case n.jobSignal <- struct{}{}:
+	default:
+	}
+	return j, nil
+}
+
+// runJob submits a job and waits for it to finish or for cancel to be closed, in which case the job is cancelled
+// and ErrJobCancelled is returned.
+func (n *Node) runJob(jobType, caller, scope string, run jobRunFunc, onFail func(), cancel <-chan struct{}) (*JobStatus, error) {
+	j, err := n.submitJob(jobType, caller, scope, run, onFail)
+	if err != nil {
+		if onFail != nil {
+			onFail()
+		}
+		return nil, err
+	}
+	select {
+	case <-j.done:
+	case <-cancel:
+		n.CancelJob(j.status.ID)
+		<-j.done
+	}
+	n.jobsLock.Lock()
+	s, err := j.status, j.err
+	n.jobsLock.Unlock()
+	if err == nil && s.State == JobStateCancelled {
+		err = ErrJobCancelled
+	}
+	return &s, err
+}
+
+// finishJob sets a job's final state and wakes anyone waiting for it. The caller must hold jobsLock.
+func (n *Node) finishJob(j *nodeJob, state string, err error) {
+	j.status.State = state
+	j.status.QueuePosition = 0
+	j.status.Difficulty = 0
+	j.status.EstimatedTime = 0
+	j.err = err
+	if err != nil {
+		j.status.Error = &ErrAPI{Code: http.StatusBadRequest, Message: j.status.Type + " failed: " + err.Error(), ErrTypeName: errTypeName(err)}
+	}
+	j.finishedAt = time.Now()
+	if state != JobStateDone && j.onFail != nil {
+		j.onFail()
+	}
+	close(j.done)
+}
+
+// Job returns the status of a job or nil if there is no job with this ID.
+func (n *Node) Job(id string) *JobStatus {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+	j := n.jobs[id]
+	if j == nil {
+		return nil
+	}
+	s := n.jobStatus(j)
+	return &s
+}
+
+// jobStatus returns a copy of a job's status with current progress filled in. The caller must hold jobsLock.
+func (n *Node) jobStatus(j *nodeJob) JobStatus {
+	s := j.status
+	switch s.State {
+
+	case JobStateQueued:
+		// Callers take turns, so jobs run before this one are the caller's earlier jobs plus as many
+		// jobs from each other caller, plus one more from callers whose turn comes first.
+		q := n.jobQueues[j.caller]
+		k := 0
+		for k < len(q) && q[k] != j {
+			k++
+		}
+		for _, c := range n.jobCallers {
+			if c == j.caller {
+				s.QueuePosition += k
+				continue
+			}
+			cl := len(n.jobQueues[c])
+			if cl > k {
+				cl = k
+			}
+			s.QueuePosition += cl
+		}
+		for _, c := range n.jobCallers {
+			if c == j.caller {
+				break
+			}
+			if len(n.jobQueues[c]) > k {
+				s.QueuePosition++
+			}
+		}
+		if n.jobRunning != nil {
+			s.QueuePosition++
+		}
+
+	case JobStateRunning:
+		wf := n.getMakeRecordWorkFunction()
+		iter, diff, elapsed := wf.Progress()
+		if diff != 0 {
+			s.Difficulty = diff
+			s.Iterations = iter
+			if iter > 0 && elapsed > 0 {
+				expected := WharrgarblExpectedIterations(diff)
+				if expected > iter {
+					s.EstimatedTime = float64(expected-iter) / (float64(iter) / elapsed.Seconds())
+				}
+			}
+		}
+	}
+	return s
+}
+
+// CancelJob cancels a queued or running job and returns its status or nil if there is no job with this ID.
+// Cancelling a running job aborts its proof of work computation and the job stops at its next cancellation
+// check, but a job that has already computed its work might still complete.
+func (n *Node) CancelJob(id string) *JobStatus {
+	n.jobsLock.Lock()
+	j := n.jobs[id]
+	if j == nil {
+		n.jobsLock.Unlock()
+		return nil
+	}
+	switch j.status.State {
+	case JobStateQueued:
+		q := n.jobQueues[j.caller]
+		for i := range q {
+			if q[i] == j {
+				q = append(q[0:i], q[i+1:]...)
+				break
+			}
+		}
+		if len(q) > 0 {
+			n.jobQueues[j.caller] = q
+		} else {
+			delete(n.jobQueues, j.caller)
+			for i := range n.jobCallers {
+				if n.jobCallers[i] == j.caller {
+					n.jobCallers = append(n.jobCallers[0:i], n.jobCallers[i+1:]...)
+					break
+				}
+			}
+		}
+		n.finishJob(j, JobStateCancelled, nil)
+	case JobStateRunning:
+		j.cancel = true
+		n.getMakeRecordWorkFunction().Abort()
+	}
+	s := n.jobStatus(j)
+	n.jobsLock.Unlock()
+	return &s
+}
+
+// nextJob dequeues the next job, giving each caller with queued jobs a turn in order.
+func (n *Node) nextJob() *nodeJob {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+	if len(n.jobCallers) == 0 {
+		return nil
+	}
+	caller := n.jobCallers[0]
+	n.jobCallers = n.jobCallers[1:]
+	q := n.jobQueues[caller]
+	j := q[0]
+	if len(q) > 1 {
+		n.jobQueues[caller] = q[1:]
+		n.jobCallers = append(n.jobCallers, caller)
+	} else {
+		delete(n.jobQueues, caller)
+	}
+	j.status.State = JobStateRunning
+	j.iter0, _ = n.getMakeRecordWorkFunction().Stats()
+	n.jobRunning = j
+	return j
+}
+
+// backgroundThreadJobs runs queued jobs one at a time and forgets finished jobs after a while.
+func (n *Node) backgroundThreadJobs() {
+	defer n.backgroundThreadWG.Done()
+	for atomic.LoadUint32(&n.shutdown) == 0 {
+		j := n.nextJob()
+		if j == nil {
+			select {
+			case <-n.jobSignal:
+			case <-time.After(time.Second):
+			}
+		} else {
+			result := j.status
+			cancelled := func() bool {
+				n.jobsLock.Lock()
+				c := j.cancel
+				n.jobsLock.Unlock()
+				return c
+			}
+			var err error
+			if cancelled() { // cancelled between being dequeued and starting
+				err = ErrJobCancelled
+			} else {
+				err = j.run(&result, cancelled)
+			}
+			iter1, _ := n.getMakeRecordWorkFunction().Stats()
+
+			n.jobsLock.Lock()
+			j.status.Record = result.Record
+			j.status.Pulse = result.Pulse
+			j.status.Accepted = result.Accepted
+			j.status.Work = result.Work
+			j.status.Iterations = iter1 - j.iter0
+			n.jobRunning = nil
+			if err == nil {
+				n.finishJob(j, JobStateDone, nil)
+			} else if j.cancel {
+				n.finishJob(j, JobStateCancelled, nil)
+			} else {
+				n.finishJob(j, JobStateFailed, err)
+			}
+			n.jobsLock.Unlock()
+		}
+
+		now := time.Now()
+		n.jobsLock.Lock()
+		for id, j := range n.jobs {
+			if j.status.finished() && now.Sub(j.finishedAt) > nodeJobRetention {
+				delete(n.jobs, id)
+			}
+		}
+		n.jobsLock.Unlock()
+	}
+
+	// Fail any jobs still in the queue so nothing waits for them forever.
+	n.jobsLock.Lock()
+	for _, q := range n.jobQueues {
+		for _, j := range q {
+			n.finishJob(j, JobStateFailed, ErrNodeStopped)
+		}
+	}
+	n.jobQueues = make(map[string][]*nodeJob)
+	n.jobCallers = nil
+	n.jobsLock.Unlock()
+}
+
+// jobScope returns the HTTP API scope required to see or cancel a job.
+func (n *Node) jobScope(id string) string {
+	n.jobsLock.Lock()
+	defer n.jobsLock.Unlock()
+	if j := n.jobs[id]; j != nil {
+		return j.scope
+	}
+	return ""
+}
+
+// apiRunJob runs a job for an HTTP API request. If the async URL parameter is set the job's status is
+// sent immediately, otherwise the job's result is sent when it finishes as if it ran synchronously.
+func (n *Node) apiRunJob(out http.ResponseWriter, req *http.Request, jobType, scope string, run jobRunFunc, onFail func()) {
+	errPrefix := "record creation failed: "
+	if jobType == JobTypeWork {
+		errPrefix = "work failed: "
+	}
+	caller, _ := n.apiWorkQuota(req)
+
+	var s *JobStatus
+	var err error
+	if req.URL.Query().Get("async") != "" {
+		var j *nodeJob
+		j, err = n.submitJob(jobType, caller, scope, run, onFail)
+		if err == nil {
+			n.jobsLock.Lock()
+			st := n.jobStatus(j)
+			n.jobsLock.Unlock()
+			apiSendObj(out, req, http.StatusOK, &st)
+			return
+		}
+		if onFail != nil {
+			onFail()
+		}
+	} else {
+		s, err = n.runJob(jobType, caller, scope, run, onFail, req.Context().Done())
+	}
+
+	switch {
+	case err == nil && jobType == JobTypeWork:
+		apiSendObj(out, req, http.StatusOK, s.Work)
+	case err == nil:
+		apiSendObj(out, req, http.StatusOK, &remoteMakeResult{s.Pulse, s.Record, s.Accepted})
+	case err == ErrWorkQueueFull:
+		apiSendObj(out, req, http.StatusServiceUnavailable, &ErrAPI{Code: http.StatusServiceUnavailable, Message: errPrefix + err.Error(), ErrTypeName: errTypeName(err)})
+	case err == ErrNodeStopped || err == ErrJobCancelled || jobType == JobTypeWork:
+		apiSendObj(out, req, http.StatusInternalServerError, &ErrAPI{Code: http.StatusInternalServerError, Message: errPrefix + err.Error(), ErrTypeName: errTypeName(err)})
+	default:
+		apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: errPrefix + err.Error(), ErrTypeName: errTypeName(err)})
+	}
+}
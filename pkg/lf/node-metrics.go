@@ -0,0 +1,239 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// This is the metrics parts of Node, see node.go for main object.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpLatencyBuckets are the upper bounds in seconds of HTTP API latency histogram buckets.
+var httpLatencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// httpRouteMetrics tracks request count and latency for a single HTTP API route.
+type httpRouteMetrics struct {
+	buckets [len(httpLatencyBuckets)]uint64
+	count   uint64
+	sum     float64
+}
+
+// nodeMetrics holds counters that are exported via the /metrics endpoint.
+// Gauges such as peer counts and queue depths are computed when metrics are rendered.
+type nodeMetrics struct {
+	p2pMessagesIn       [len(p2pProtoMessageNames)]uint64 // Messages received by type
+	p2pBytesIn          [len(p2pProtoMessageNames)]uint64 // Message bytes received by type
+	p2pMessagesOut      [len(p2pProtoMessageNames)]uint64 // Messages sent by type
+	p2pBytesOut         [len(p2pProtoMessageNames)]uint64 // Message bytes sent by type
+	recordsAdded        uint64                            // Records successfully added via AddRecord()
+	recordsRejected     map[string]uint64                 // Records rejected by AddRecord() by reason
+	recordsRejectedLock sync.Mutex                        //
+	httpRoutes          map[string]*httpRouteMetrics      // HTTP API request metrics by route
+	httpRoutesLock      sync.Mutex                        //
+}
+
+func newNodeMetrics() *nodeMetrics {
+	return &nodeMetrics{
+		recordsRejected: make(map[string]uint64),
+		httpRoutes:      make(map[string]*httpRouteMetrics),
+	}
+}
+
+func (m *nodeMetrics) p2pReceived(msg []byte) {
+	if len(msg) > 0 && int(msg[0]) < len(p2pProtoMessageNames) {
+		atomic.AddUint64(&m.p2pMessagesIn[msg[0]], 1)
+		atomic.AddUint64(&m.p2pBytesIn[msg[0]], uint64(len(msg)))
+	}
+}
+
+func (m *nodeMetrics) p2pSent(msg []byte) {
+	if len(msg) > 0 && int(msg[0]) < len(p2pProtoMessageNames) {
+		atomic.AddUint64(&m.p2pMessagesOut[msg[0]], 1)
+		atomic.AddUint64(&m.p2pBytesOut[msg[0]], uint64(len(msg)))
+	}
+}
+
+// recordAddResult counts the result of an attempt to add a record.
+// Rejections are labeled with the message of LF errors (e.g. ErrRecord values) or the type name of others.
+func (m *nodeMetrics) recordAddResult(err error) {
+	if err == nil {
+		atomic.AddUint64(&m.recordsAdded, 1)
+		return
+	}
+	var reason string
+	switch e := err.(type) {
+	case ErrRecord:
+		reason = string(e)
+	case Err:
+		reason = string(e)
+	default:
+		reason = errTypeName(err)
+	}
+	m.recordsRejectedLock.Lock()
+	m.recordsRejected[reason]++
+	m.recordsRejectedLock.Unlock()
+}
+
+func (m *nodeMetrics) httpRequestDone(route string, latency time.Duration) {
+	sec := latency.Seconds()
+	m.httpRoutesLock.Lock()
+	rm := m.httpRoutes[route]
+	if rm == nil {
+		rm = new(httpRouteMetrics)
+		m.httpRoutes[route] = rm
+	}
+	for i, le := range httpLatencyBuckets {
+		if sec <= le {
+			rm.buckets[i]++
+		}
+	}
+	rm.count++
+	rm.sum += sec
+	m.httpRoutesLock.Unlock()
+}
+
+// httpMetricsHandler wraps the HTTP API to record request latencies by route.
+// Routes are labeled by the ServeMux pattern that handles them so that arbitrary URLs can't create new series.
+func (n *Node) httpMetricsHandler(smux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := smux.Handler(r)
+		smux.ServeHTTP(w, r)
+		n.metrics.httpRequestDone(route, time.Since(start))
+	})
+}
+
+// metricsEscapeLabel escapes a label value for the Prometheus text exposition format.
+func metricsEscapeLabel(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(v)
+}
+
+func metricsWriteHeader(w io.Writer, name, metricType, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeMetrics writes this node's metrics in Prometheus text exposition format (version 0.0.4).
+func (n *Node) writeMetrics(w io.Writer) {
+	var inbound, outbound int
+	n.peersLock.RLock()
+	for _, p := range n.peers {
+		if p.inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	n.peersLock.RUnlock()
+	n.knownPeersLock.Lock()
+	knownPeerCount := len(n.knownPeers)
+	n.knownPeersLock.Unlock()
+
+	metricsWriteHeader(w, "lf_peers", "gauge", "Currently connected P2P peers.")
+	_, _ = fmt.Fprintf(w, "lf_peers{direction=\"inbound\"} %d\nlf_peers{direction=\"outbound\"} %d\n", inbound, outbound)
+	metricsWriteHeader(w, "lf_known_peers", "gauge", "Peers known to this node whether connected or not.")
+	_, _ = fmt.Fprintf(w, "lf_known_peers %d\n", knownPeerCount)
+
+	metricsWriteHeader(w, "lf_p2p_messages_total", "counter", "P2P messages by direction and type.")
+	for t, name := range p2pProtoMessageNames {
+		_, _ = fmt.Fprintf(w, "lf_p2p_messages_total{direction=\"in\",type=\"%s\"} %d\n", name, atomic.LoadUint64(&n.metrics.p2pMessagesIn[t]))
+		_, _ = fmt.Fprintf(w, "lf_p2p_messages_total{direction=\"out\",type=\"%s\"} %d\n", name, atomic.LoadUint64(&n.metrics.p2pMessagesOut[t]))
+	}
+	metricsWriteHeader(w, "lf_p2p_bytes_total", "counter", "P2P message payload bytes (excluding framing and encryption overhead) by direction and type.")
+	for t, name := range p2pProtoMessageNames {
+		_, _ = fmt.Fprintf(w, "lf_p2p_bytes_total{direction=\"in\",type=\"%s\"} %d\n", name, atomic.LoadUint64(&n.metrics.p2pBytesIn[t]))
+		_, _ = fmt.Fprintf(w, "lf_p2p_bytes_total{direction=\"out\",type=\"%s\"} %d\n", name, atomic.LoadUint64(&n.metrics.p2pBytesOut[t]))
+	}
+
+	rc, ds := n.db.stats()
+	metricsWriteHeader(w, "lf_records", "gauge", "Records in the local database.")
+	_, _ = fmt.Fprintf(w, "lf_records %d\n", rc)
+	metricsWriteHeader(w, "lf_data_bytes", "gauge", "Size of record data in the local database.")
+	_, _ = fmt.Fprintf(w, "lf_data_bytes %d\n", ds)
+	metricsWriteHeader(w, "lf_synchronized", "gauge", "1 if this node believes it is fully synchronized.")
+	_, _ = fmt.Fprintf(w, "lf_synchronized %d\n", atomic.LoadUint32(&n.synchronized))
+
+	metricsWriteHeader(w, "lf_records_added_total", "counter", "Records accepted by this node.")
+	_, _ = fmt.Fprintf(w, "lf_records_added_total %d\n", atomic.LoadUint64(&n.metrics.recordsAdded))
+	metricsWriteHeader(w, "lf_records_rejected_total", "counter", "Records rejected by this node by reason.")
+	n.metrics.recordsRejectedLock.Lock()
+	reasons := make([]string, 0, len(n.metrics.recordsRejected))
+	for reason := range n.metrics.recordsRejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		_, _ = fmt.Fprintf(w, "lf_records_rejected_total{reason=\"%s\"} %d\n", metricsEscapeLabel(reason), n.metrics.recordsRejected[reason])
+	}
+	n.metrics.recordsRejectedLock.Unlock()
+
+	metricsWriteHeader(w, "lf_limbo_records", "gauge", "Records in limbo awaiting possible future approval.")
+	_, _ = fmt.Fprintf(w, "lf_limbo_records %d\n", n.db.getLimboCount())
+	metricsWriteHeader(w, "lf_wanted_records", "gauge", "Wanted record hashes that have not yet exceeded the maximum retry count.")
+	_, _ = fmt.Fprintf(w, "lf_wanted_records %d\n", n.db.getWantedCount(0, p2pProtoMaxRetries))
+	metricsWriteHeader(w, "lf_graph_pending_records", "gauge", "Records awaiting weight application by the graph thread.")
+	_, _ = fmt.Fprintf(w, "lf_graph_pending_records %d\n", n.db.getPendingCount())
+
+	n.workFunctionLock.Lock()
+	wf0 := n.workFunction
+	n.workFunctionLock.Unlock()
+	n.makeRecordWorkFunctionLock.Lock()
+	wf1 := n.makeRecordWorkFunction
+	n.makeRecordWorkFunctionLock.Unlock()
+	var wgIterations uint64
+	var wgTime time.Duration
+	for _, wf := range []*Wharrgarblr{wf0, wf1} {
+		if wf != nil {
+			i, t := wf.Stats()
+			wgIterations += i
+			wgTime += t
+		}
+	}
+	wgRate := 0.0
+	if wgTime > 0 {
+		wgRate = float64(wgIterations) / wgTime.Seconds()
+	}
+	metricsWriteHeader(w, "lf_wharrgarbl_iterations_total", "counter", "Wharrgarbl proof of work search iterations computed by this node.")
+	_, _ = fmt.Fprintf(w, "lf_wharrgarbl_iterations_total %d\n", wgIterations)
+	metricsWriteHeader(w, "lf_wharrgarbl_seconds_total", "counter", "Time spent computing Wharrgarbl proof of work.")
+	_, _ = fmt.Fprintf(w, "lf_wharrgarbl_seconds_total %s\n", strconv.FormatFloat(wgTime.Seconds(), 'f', -1, 64))
+	metricsWriteHeader(w, "lf_wharrgarbl_iterations_per_second", "gauge", "Average Wharrgarbl proof of work iterations per second.")
+	_, _ = fmt.Fprintf(w, "lf_wharrgarbl_iterations_per_second %s\n", strconv.FormatFloat(wgRate, 'f', -1, 64))
+
+	metricsWriteHeader(w, "lf_http_request_duration_seconds", "histogram", "HTTP API request latencies by route.")
+	n.metrics.httpRoutesLock.Lock()
+	routes := make([]string, 0, len(n.metrics.httpRoutes))
+	for route := range n.metrics.httpRoutes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		rm := n.metrics.httpRoutes[route]
+		route = metricsEscapeLabel(route)
+		for i, le := range httpLatencyBuckets {
+			_, _ = fmt.Fprintf(w, "lf_http_request_duration_seconds_bucket{route=\"%s\",le=\"%s\"} %d\n", route, strconv.FormatFloat(le, 'f', -1, 64), rm.buckets[i])
+		}
+		_, _ = fmt.Fprintf(w, "lf_http_request_duration_seconds_bucket{route=\"%s\",le=\"+Inf\"} %d\n", route, rm.count)
+		_, _ = fmt.Fprintf(w, "lf_http_request_duration_seconds_sum{route=\"%s\"} %s\n", route, strconv.FormatFloat(rm.sum, 'f', -1, 64))
+		_, _ = fmt.Fprintf(w, "lf_http_request_duration_seconds_count{route=\"%s\"} %d\n", route, rm.count)
+	}
+	n.metrics.httpRoutesLock.Unlock()
+}
@@ -27,7 +27,10 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -48,6 +51,9 @@ const (
 	p2pProtoMessageTypeHaveRecords          byte = 4 // one or more 32-byte hashes we have
 	p2pProtoMessageTypePeer                 byte = 5 // Peer (JSON)
 	p2pProtoMessageTypePulse                byte = 6 // 11-byte pulse
+	p2pProtoMessageTypeRequestPeers         byte = 7 // request for known peers (no payload)
+	p2pProtoMessageTypePeers                byte = 8 // []Peer (JSON) in response to RequestPeers
+	p2pProtoMessageTypeReconcile            byte = 9 // set reconciliation ranges (see node-reconcile.go)
 
 	// p2pProtoMaxRetries is the maximum number of times we'll try to retry a record
 	p2pProtoMaxRetries = 256
@@ -63,9 +69,31 @@ const (
 
 	// Maximum unsuccessful reconnection attempts before a peer is forgotten
 	p2pPeerMaxAttempts = 30
+
+	// Maximum number of known peers, which limits how many can be learned via peer exchange
+	p2pMaxKnownPeers = 1024
+
+	// Maximum number of known peers in the same address bucket (see p2pAddressBucket)
+	p2pMaxKnownPeersPerBucket = 16
+
+	// Maximum number of connected peers in the same address bucket when making outbound connections
+	p2pMaxConnectionsPerBucket = 2
+
+	// Maximum number of peers sent or accepted in a peer exchange response
+	p2pPeerExchangeMaxPeers = 32
+
+	// Minimum interval in seconds between peer exchange responses to the same connection
+	p2pPeerExchangeInterval = 60
+
+	// Best scoring peers from which connection candidates are randomly chosen
+	p2pPeerSelectionPoolSize = 4
+
+	// Connected peers protected from eviction by each eviction criterion
+	p2pEvictionProtectCount = 4
 )
 
-// var p2pProtoMessageNames = []string{"Nop", "Hello", "Record", "RequestRecordsByHash", "HaveRecords", "Peer"}
+// p2pProtoMessageNames are the names of P2P message types indexed by type (used for metrics).
+var p2pProtoMessageNames = [...]string{"Nop", "Hello", "Record", "RequestRecordsByHash", "HaveRecords", "Peer", "Pulse", "RequestPeers", "Peers", "Reconcile"}
 
 // peerHelloMsg is a JSON message used to say 'hello' to other nodes via the P2P protocol.
 type peerHelloMsg struct {
@@ -79,6 +107,7 @@ type peerHelloMsg struct {
 
 // connectedPeer represents a single TCP connection to another peer using the LF P2P TCP protocol
 type connectedPeer struct {
+	recordsAdded   uint64               // Records received from this peer that were new to us (atomic, first for alignment)
 	n              *Node                // Node that owns this peer
 	address        string               // Address in string format
 	tcpAddress     *net.TCPAddr         // IP and port
@@ -91,6 +120,12 @@ type connectedPeer struct {
 	identity       []byte               // Remote node's identity (public key)
 	peerHelloMsg   peerHelloMsg         // Hello message received from peer
 	inbound        bool                 // True if this is an incoming connection
+	connectedAt    uint64               // Time (seconds) connection was established
+	latency        time.Duration        // Time taken by connection handshake (a few round trips)
+	lastPeersSent  uint64               // Time (seconds) of last peer exchange response to this peer
+	peersRequested uint32               // Non-zero while a RequestPeers sent to this peer is unanswered (atomic)
+	reconcileStart uint64               // Start (seconds) of current reconcile rate limit window (reader goroutine only)
+	reconcileCount int                  // Reconcile messages handled in current window (reader goroutine only)
 }
 
 // knownPeer contains info about a peer we know about via another peer or the API
@@ -101,6 +136,47 @@ type knownPeer struct {
 	LastSuccessfulConnection  uint64 // Time (seconds) of most recent successful connection
 	LastReconnectionAttempt   uint64 // Time (seconds) of most recent connection attempt (zeroed on success)
 	TotalReconnectionAttempts int    // Total connection attempts (zeroed on success)
+	Latency                   uint64 // Smoothed connection handshake time in milliseconds (0 if unknown)
+	TotalConnectedTime        uint64 // Total seconds this peer has been connected
+	RecordsContributed        uint64 // Total records received from this peer that were new to us
+}
+
+// score estimates how valuable a peer is to connect to based on its history.
+// Long uptime and record contribution count in its favor while high latency and failed
+// connection attempts count against it. Peers learned via exchange start at zero.
+func (kp *knownPeer) score() float64 {
+	s := math.Log2(1.0+float64(kp.TotalConnectedTime)/60.0) + math.Log2(1.0+float64(kp.RecordsContributed))
+	s -= float64(kp.Latency) / 250.0
+	s -= float64(kp.TotalReconnectionAttempts) / 2.0
+	return s
+}
+
+// p2pIsLocalAddress returns true for loopback, link-local, and private (RFC1918 and IPv6 ULA) addresses.
+func p2pIsLocalAddress(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 || ip4[0] == 127 || (ip4[0] == 172 && (ip4[1]&0xf0) == 16) || (ip4[0] == 192 && ip4[1] == 168) || (ip4[0] == 169 && ip4[1] == 254)
+	}
+	return len(ip) == 16 && (ip.IsLoopback() || ip.IsLinkLocalUnicast() || (ip[0]&0xfe) == 0xfc)
+}
+
+// p2pAddressBucket returns a string identifying an address's network for diversity constraints.
+// Global IPv4 addresses are bucketed by /16 and IPv6 by /32, which roughly approximates grouping
+// by provider and makes it costly for an attacker to surround (eclipse) a node with its own peers.
+// Private and local addresses are not grouped since these are typically private test networks.
+func p2pAddressBucket(ip net.IP) string {
+	if p2pIsLocalAddress(ip) {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String()
+		}
+		return ip.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return "4/" + string(ip4[0:2])
+	}
+	if len(ip) == 16 {
+		return "6/" + string(ip[0:4])
+	}
+	return ""
 }
 
 // updateKnownPeersOnConnectSuccess is called from p2pConnectionHandler to update n.knownPeers.
@@ -119,6 +195,9 @@ func (n *Node) updateKnownPeersOnConnectSuccess(ip net.IP, port int, identity []
 	idStr := Base62Encode(identity)
 	kp := n.knownPeers[idStr]
 	if kp == nil {
+		if !n.makeRoomForKnownPeer(p2pAddressBucket(ip)) {
+			return
+		}
 		n.knownPeers[idStr] = &knownPeer{
 			Peer: Peer{
 				IP:       ip,
@@ -137,6 +216,9 @@ func (n *Node) updateKnownPeersOnConnectSuccess(ip net.IP, port int, identity []
 			}
 			kp.LastSuccessfulConnection = now
 		} else {
+			if bucket := p2pAddressBucket(ip); bucket != p2pAddressBucket(kp.IP) && n.knownPeersInBucket(bucket) >= p2pMaxKnownPeersPerBucket {
+				return
+			}
 			kp.IP = ip
 			kp.Port = port
 			kp.FirstConnect = now
@@ -161,6 +243,243 @@ func (n *Node) writeKnownPeers() {
 	_ = ioutil.WriteFile(n.peersFilePath, []byte(PrettyJSON(&n.knownPeers)), 0644)
 }
 
+// updateKnownPeerOnDisconnect adds a connection's uptime, latency, and record contribution to its known peer entry.
+func (n *Node) updateKnownPeerOnDisconnect(p *connectedPeer) {
+	if p.connectedAt == 0 {
+		return
+	}
+	now := TimeSec()
+	n.knownPeersLock.Lock()
+	kp := n.knownPeers[Base62Encode(p.identity)]
+	if kp != nil {
+		if now > p.connectedAt {
+			kp.TotalConnectedTime += now - p.connectedAt
+		}
+		kp.RecordsContributed += atomic.LoadUint64(&p.recordsAdded)
+		lms := uint64(p.latency / time.Millisecond)
+		if kp.Latency == 0 {
+			kp.Latency = lms
+		} else {
+			kp.Latency = ((kp.Latency * 3) + lms) / 4
+		}
+	}
+	n.knownPeersLock.Unlock()
+}
+
+// learnPeer adds a peer learned via peer exchange or announcement to known peers if it's new and there is room.
+// Existing entries are never modified so peers can't redirect us away from addresses we've verified.
+// Local and private addresses are only accepted in local test mode so peers can't point us at
+// services on our own network.
+func (n *Node) learnPeer(peer *Peer) bool {
+	if len(peer.Identity) == 0 || bytes.Equal(peer.Identity, n.identity) || peer.Port <= 0 || peer.Port > 65535 || (!peer.IP.IsGlobalUnicast() && !peer.IP.IsLoopback()) {
+		return false
+	}
+	if !n.localTest && p2pIsLocalAddress(peer.IP) {
+		return false
+	}
+	idStr := Base62Encode(peer.Identity)
+	bucket := p2pAddressBucket(peer.IP)
+
+	n.knownPeersLock.Lock()
+	defer n.knownPeersLock.Unlock()
+
+	if _, have := n.knownPeers[idStr]; have {
+		return false
+	}
+	if !n.makeRoomForKnownPeer(bucket) {
+		return false
+	}
+	n.knownPeers[idStr] = &knownPeer{
+		Peer: Peer{
+			IP:       peer.IP,
+			Port:     peer.Port,
+			Identity: peer.Identity,
+		},
+	}
+	return true
+}
+
+// makeRoomForKnownPeer returns true if a new known peer in an address bucket would stay within p2pMaxKnownPeers
+// and p2pMaxKnownPeersPerBucket. If known peers is full an entry we've never connected to is removed to make
+// room, preferring the one with the most failed connection attempts. The caller must hold knownPeersLock.
+func (n *Node) makeRoomForKnownPeer(bucket string) bool {
+	if n.knownPeersInBucket(bucket) >= p2pMaxKnownPeersPerBucket {
+		return false
+	}
+	victim := ""
+	for knownPeerID, kp := range n.knownPeers {
+		if kp.LastSuccessfulConnection == 0 && (len(victim) == 0 || kp.TotalReconnectionAttempts > n.knownPeers[victim].TotalReconnectionAttempts) {
+			victim = knownPeerID
+		}
+	}
+	if len(n.knownPeers) >= p2pMaxKnownPeers {
+		if len(victim) == 0 {
+			return false
+		}
+		delete(n.knownPeers, victim)
+	}
+	return true
+}
+
+// knownPeersInBucket returns how many known peers are in an address bucket. The caller must hold knownPeersLock.
+func (n *Node) knownPeersInBucket(bucket string) (count int) {
+	for _, kp := range n.knownPeers {
+		if p2pAddressBucket(kp.IP) == bucket {
+			count++
+		}
+	}
+	return
+}
+
+// sendKnownPeers sends this peer a diverse set of our best verified known peers in response to a RequestPeers message.
+func (p *connectedPeer) sendKnownPeers() {
+	now := TimeSec()
+	if (now - p.lastPeersSent) < p2pPeerExchangeInterval {
+		return
+	}
+	p.lastPeersSent = now
+
+	p.n.knownPeersLock.Lock()
+	candidates := make([]*knownPeer, 0, len(p.n.knownPeers))
+	for _, kp := range p.n.knownPeers {
+		if kp.LastSuccessfulConnection > 0 && !bytes.Equal(kp.Identity, p.identity) {
+			candidates = append(candidates, kp)
+		}
+	}
+	sort.Slice(candidates, func(a, b int) bool { return candidates[a].score() > candidates[b].score() })
+	peers := make([]Peer, 0, p2pPeerExchangeMaxPeers)
+	buckets := make(map[string]int)
+	for _, kp := range candidates {
+		bucket := p2pAddressBucket(kp.IP)
+		if buckets[bucket] < p2pMaxConnectionsPerBucket {
+			buckets[bucket]++
+			peers = append(peers, kp.Peer)
+			if len(peers) >= p2pPeerExchangeMaxPeers {
+				break
+			}
+		}
+	}
+	p.n.knownPeersLock.Unlock()
+
+	peersJSON, err := json.Marshal(peers)
+	if err == nil {
+		p.send(append([]byte{p2pProtoMessageTypePeers}, peersJSON...))
+	}
+}
+
+// p2pConnectToBestPeer tries to connect to a good known peer that is not connected.
+// Candidates whose address bucket already has p2pMaxConnectionsPerBucket connections are
+// skipped. The choice is made at random from the best scoring candidates so that nodes
+// don't all converge on the same peers. Returns false if there were no candidates.
+func (n *Node) p2pConnectToBestPeer() bool {
+	connected := make(map[string]bool)
+	buckets := make(map[string]int)
+	n.peersLock.RLock()
+	for _, p := range n.peers {
+		connected[Base62Encode(p.identity)] = true
+		buckets[p2pAddressBucket(p.tcpAddress.IP)]++
+	}
+	n.peersLock.RUnlock()
+
+	now := TimeSec()
+	var kp *knownPeer
+	n.knownPeersLock.Lock()
+	candidates := make([]*knownPeer, 0, len(n.knownPeers))
+	for idStr, kp := range n.knownPeers {
+		if !connected[idStr] && buckets[p2pAddressBucket(kp.IP)] < p2pMaxConnectionsPerBucket && (now-kp.LastReconnectionAttempt) >= (p2pPeerAttemptInterval*uint64(kp.TotalReconnectionAttempts)) {
+			candidates = append(candidates, kp)
+		}
+	}
+	if len(candidates) > 0 {
+		sort.Slice(candidates, func(a, b int) bool { return candidates[a].score() > candidates[b].score() })
+		if len(candidates) > p2pPeerSelectionPoolSize {
+			candidates = candidates[0:p2pPeerSelectionPoolSize]
+		}
+		kp = candidates[rand.Int()%len(candidates)]
+		kp.LastReconnectionAttempt = now
+		kp.TotalReconnectionAttempts++
+	}
+	n.knownPeersLock.Unlock()
+
+	if kp == nil {
+		return false
+	}
+	_ = n.Connect(kp.IP, kp.Port, kp.Identity)
+	return true
+}
+
+// p2pRequestPeers asks a random connected peer for its known peers.
+func (n *Node) p2pRequestPeers() {
+	n.peersLock.RLock()
+	if len(n.peers) > 0 {
+		n.peers[rand.Int()%len(n.peers)].requestPeers()
+	}
+	n.peersLock.RUnlock()
+}
+
+// requestPeers asks this peer for its known peers. Only one response is accepted per request.
+func (p *connectedPeer) requestPeers() {
+	atomic.StoreUint32(&p.peersRequested, 1)
+	p.send([]byte{p2pProtoMessageTypeRequestPeers})
+}
+
+// p2pEvictPeer closes one connection if we have more than p2pDesiredConnectionCount.
+// A few peers are protected by each of: most records contributed, longest connected, and
+// lowest latency. This makes it hard for an attacker to displace our best peers by making
+// lots of connections. The victim is the most recently connected remaining peer in the
+// most crowded address bucket.
+func (n *Node) p2pEvictPeer() {
+	n.peersLock.RLock()
+	peerCount := len(n.peers)
+	if peerCount <= p2pDesiredConnectionCount {
+		n.peersLock.RUnlock()
+		return
+	}
+	candidates := make([]*connectedPeer, 0, len(n.peers))
+	for _, p := range n.peers {
+		if p.connectedAt > 0 {
+			candidates = append(candidates, p)
+		}
+	}
+	n.peersLock.RUnlock()
+
+	protect := func(less func(a, b *connectedPeer) bool) {
+		sort.Slice(candidates, func(a, b int) bool { return less(candidates[a], candidates[b]) })
+		if len(candidates) > p2pEvictionProtectCount {
+			candidates = candidates[p2pEvictionProtectCount:]
+		} else {
+			candidates = nil
+		}
+	}
+	protect(func(a, b *connectedPeer) bool {
+		return atomic.LoadUint64(&a.recordsAdded) > atomic.LoadUint64(&b.recordsAdded)
+	})
+	protect(func(a, b *connectedPeer) bool { return a.connectedAt < b.connectedAt })
+	protect(func(a, b *connectedPeer) bool { return a.latency < b.latency })
+	if len(candidates) == 0 {
+		return
+	}
+
+	buckets := make(map[string][]*connectedPeer)
+	var crowded []*connectedPeer
+	for _, p := range candidates {
+		bucket := p2pAddressBucket(p.tcpAddress.IP)
+		buckets[bucket] = append(buckets[bucket], p)
+		if len(buckets[bucket]) > len(crowded) {
+			crowded = buckets[bucket]
+		}
+	}
+	victim := crowded[0]
+	for _, p := range crowded {
+		if p.connectedAt > victim.connectedAt {
+			victim = p
+		}
+	}
+
+	n.log[LogLevelVerbose].Printf("P2P connection to %s closed: evicted (%d connections exceeds desired %d)", victim.address, peerCount, p2pDesiredConnectionCount)
+	_ = victim.c.Close()
+}
+
 // sendPeerAnnouncement sends a peer announcement to this peer for the given address and public key
 func (p *connectedPeer) sendPeerAnnouncement(tcpAddr *net.TCPAddr, identity []byte) {
 	var peerMsg Peer
@@ -182,6 +501,7 @@ func (p *connectedPeer) send(msg []byte) {
 	if len(msg) < 1 {
 		return
 	}
+	p.n.metrics.p2pSent(msg)
 	p.sendLock.Lock()
 	go func() {
 		defer func() {
@@ -217,6 +537,7 @@ func (p *connectedPeer) send(msg []byte) {
 func (n *Node) p2pConnectionHandler(c *net.TCPConn, identity []byte, inbound bool) {
 	var err error
 	var p *connectedPeer
+	handshakeStart := time.Now()
 
 	tcpAddr, tcpAddrOk := c.RemoteAddr().(*net.TCPAddr)
 	if tcpAddr == nil || !tcpAddrOk {
@@ -256,6 +577,10 @@ func (n *Node) p2pConnectionHandler(c *net.TCPConn, identity []byte, inbound boo
 		}
 		n.peersLock.Unlock()
 
+		if p != nil {
+			n.updateKnownPeerOnDisconnect(p)
+		}
+
 		n.backgroundThreadWG.Done()
 	}()
 
@@ -374,6 +699,8 @@ func (n *Node) p2pConnectionHandler(c *net.TCPConn, identity []byte, inbound boo
 		outgoingNonce: outgoingNonce,
 		identity:      remoteIdentity,
 		inbound:       inbound,
+		connectedAt:   TimeSec(),
+		latency:       time.Since(handshakeStart),
 	}
 
 	msgbuf, err := json.Marshal(&peerHelloMsg{
@@ -413,6 +740,8 @@ func (n *Node) p2pConnectionHandler(c *net.TCPConn, identity []byte, inbound boo
 
 	if !inbound {
 		n.updateKnownPeersOnConnectSuccess(tcpAddr.IP, tcpAddr.Port, remoteIdentity)
+		p.requestPeers()
+		p.startReconciliation()
 	}
 
 	n.log[LogLevelNormal].Printf("P2P connection established to %s %d %s", tcpAddr.IP.String(), tcpAddr.Port, Base62Encode(remoteIdentity))
@@ -474,6 +803,7 @@ mainReaderLoop:
 			n.log[LogLevelNormal].Printf("P2P connection to %s closed: invalid message size", peerAddressStr)
 			break
 		}
+		n.metrics.p2pReceived(msg)
 		fullMsg := msg
 		incomingMessageType := msg[0]
 		msg = msg[1:]
@@ -529,7 +859,11 @@ mainReaderLoop:
 					p.hasRecordsLock.Lock()
 					p.hasRecords[rh] = atomic.LoadUintptr(&n.timeTicker)
 					p.hasRecordsLock.Unlock()
-					_ = n.addRemoteRecord(msg, rh[:], rec, tcpAddr.IP.String())
+					if !n.deliverFetchedRecord(rh, rec) {
+						if n.addRemoteRecord(msg, rh[:], rec, tcpAddr.IP.String()) == nil {
+							atomic.AddUint64(&p.recordsAdded, 1)
+						}
+					}
 				}
 			}
 
@@ -538,7 +872,7 @@ mainReaderLoop:
 				rdata := make([]byte, 1, 2048)
 				rdata[0] = p2pProtoMessageTypeRecord
 				_, rdata, err = n.db.getDataByHash(msg[0:32], rdata)
-				if err == nil && len(rdata) > 1 {
+				if err == nil && len(rdata) > 1 && !recordDataIsAbbreviated(rdata[1:]) { // partial nodes can't send records whose values they've discarded
 					p.send(rdata)
 				}
 				msg = msg[32:]
@@ -585,8 +919,9 @@ mainReaderLoop:
 		case p2pProtoMessageTypePeer:
 			if len(msg) > 0 {
 				var peerMsg Peer
+				// Announced peers go through the same checks as peer exchange and are only dialed if they're new.
 				if json.Unmarshal(msg, &peerMsg) == nil {
-					if len(peerMsg.Identity) > 0 {
+					if n.learnPeer(&peerMsg) {
 						n.peersLock.RLock()
 						connectionCount := len(n.peers)
 						n.peersLock.RUnlock()
@@ -600,6 +935,32 @@ mainReaderLoop:
 				}
 			}
 
+		case p2pProtoMessageTypeRequestPeers:
+			p.sendKnownPeers()
+
+		case p2pProtoMessageTypePeers:
+			var peers []Peer
+			if atomic.SwapUint32(&p.peersRequested, 0) != 0 && json.Unmarshal(msg, &peers) == nil { // unsolicited responses are ignored
+				if len(peers) > p2pPeerExchangeMaxPeers {
+					peers = peers[0:p2pPeerExchangeMaxPeers]
+				}
+				learned := 0
+				for i := range peers {
+					if n.learnPeer(&peers[i]) {
+						learned++
+					}
+				}
+				if learned > 0 {
+					n.log[LogLevelVerbose].Printf("P2P learned %d new peers from %s", learned, peerAddressStr)
+				}
+			}
+
+		case p2pProtoMessageTypeReconcile:
+			err = p.handleReconcile(msg)
+			if err != nil {
+				n.log[LogLevelVerbose].Printf("P2P reconcile message from %s rejected: %s", peerAddressStr, err.Error())
+			}
+
 		case p2pProtoMessageTypePulse:
 			if len(msg) == 11 {
 				if ok, _ := n.DoPulse(msg, false); ok {
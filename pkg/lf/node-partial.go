@@ -0,0 +1,272 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// This is the partial (fractional) node parts of Node, see node.go for main object.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// PartialNodePolicyName is the name of the file in a node's base path that enables partial node mode.
+const PartialNodePolicyName = "partial.json"
+
+// partialNodeFetchTimeout is the maximum time a query or record lookup will wait for missing values from peers.
+const partialNodeFetchTimeout = 5 * time.Second
+
+// partialNodeFetchPeerCount is the number of peers asked for a missing record value.
+const partialNodeFetchPeerCount = 3
+
+// partialNodeHorizonBatchSize is the number of stored records checked against ValueHorizon each time the horizon pass runs.
+const partialNodeHorizonBatchSize = 4096
+
+// recordDataGapMarker starts a gap left in records.lf after a record whose value was discarded in place.
+// It's followed by the number of bytes after the gap header as a 32-bit big-endian integer. Records begin
+// with a flags varint whose first byte holds flag bits 0-3 and the low bits of the link count, and can be
+// 0x80 or more when the varint is longer than one byte. The marker can't be mistaken for a record only
+// because flag bit 0x8 is never set. If a flag is ever assigned to that bit this format must change.
+const recordDataGapMarker = 0xff
+
+// recordDataGapHeaderSize is the size of a gap marker and its length.
+const recordDataGapHeaderSize = 5
+
+// PartialNodePolicy determines which record values a partial node keeps.
+// Partial nodes store every record's links, selectors, work, and signature so the full DAG
+// structure and weights are maintained, but they store abbreviated records (with values
+// replaced by their hashes) for records that fall outside this policy. Missing values are
+// fetched from peers on demand. The policy is applied when records are stored, and stored
+// records are periodically checked again so values are discarded as records pass the
+// horizon. Only normal data records are abbreviated since other types are needed by the
+// node itself.
+type PartialNodePolicy struct {
+	ValueHorizon      uint64        `json:",omitempty"` // If non-zero, discard values of records more than this many seconds old
+	Owners            []OwnerPublic `json:",omitempty"` // If non-empty, discard values of records not by one of these owners
+	SelectorKeyRanges [][2]Blob     `json:",omitempty"` // If non-empty, discard values of records with no selector key in one of these ranges
+}
+
+// keepValue returns true if a record's value should be stored under this policy.
+func (p *PartialNodePolicy) keepValue(r *Record, now uint64) bool {
+	if r.Type != RecordTypeDatum {
+		return true
+	}
+	if p.ValueHorizon > 0 && r.Timestamp < now && (now-r.Timestamp) > p.ValueHorizon {
+		return false
+	}
+	if len(p.Owners) > 0 {
+		ownerMatch := false
+		for _, o := range p.Owners {
+			if bytes.Equal(o, r.Owner) {
+				ownerMatch = true
+				break
+			}
+		}
+		if !ownerMatch {
+			return false
+		}
+	}
+	if len(p.SelectorKeyRanges) > 0 {
+		for i := range r.Selectors {
+			sk := r.SelectorKey(i)
+			for _, kr := range p.SelectorKeyRanges {
+				if bytes.Compare(sk, kr[0]) >= 0 && bytes.Compare(sk, kr[1]) <= 0 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// loadPartialNodePolicy reads a partial node policy, returning nil if the file does not exist.
+func loadPartialNodePolicy(path string) (*PartialNodePolicy, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil || len(d) == 0 {
+		return nil, nil
+	}
+	p := new(PartialNodePolicy)
+	err = json.Unmarshal(d, p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// abbreviatedRecordData returns a stored record's abbreviated form followed by the header of a gap filling the
+// rest of its dlen bytes in records.lf, or nil if its value is too small for abbreviation to leave room for a gap.
+func abbreviatedRecordData(r *Record, dlen uint64) []byte {
+	ad := r.abbreviated().Bytes()
+	if uint64(len(ad)+recordDataGapHeaderSize) > dlen {
+		return nil
+	}
+	var gh [recordDataGapHeaderSize]byte
+	gh[0] = recordDataGapMarker
+	binary.BigEndian.PutUint32(gh[1:], uint32(dlen-uint64(len(ad)+recordDataGapHeaderSize)))
+	return append(ad, gh[:]...)
+}
+
+// applyValueHorizon discards the values of stored records that have passed the partial node policy's ValueHorizon.
+// Records are checked in data offset order a batch at a time starting after afterDoff, and their data is rewritten
+// in place with abbreviated versions. The offset to pass next time is returned, which is -1 after the last record.
+func (n *Node) applyValueHorizon(afterDoff int64) int64 {
+	ri := n.db.getRecordInfo(afterDoff, partialNodeHorizonBatchSize)
+	if len(ri) == 0 {
+		return -1
+	}
+	now := TimeSec()
+	discarded := 0
+	next := int64(ri[len(ri)-1].doff)
+	for i := range ri {
+		if ok, ts := n.db.getRecordTimestampByHash(ri[i].hash[:]); !ok || ts >= now || (now-ts) <= n.partialPolicy.ValueHorizon {
+			continue
+		}
+		flags, err := n.db.getDataByOffset(ri[i].doff, 1, nil) // check flags first to skip already abbreviated records cheaply
+		if err != nil || len(flags) != 1 || recordDataIsAbbreviated(flags) {
+			continue
+		}
+		rdata, err := n.db.getDataByOffset(ri[i].doff, uint(ri[i].dlen), nil)
+		if err != nil {
+			continue
+		}
+		r, err := NewRecordFromBytes(rdata)
+		if err != nil || n.partialPolicy.keepValue(r, now) {
+			continue
+		}
+		if ad := abbreviatedRecordData(r, ri[i].dlen); len(ad) > 0 {
+			if err = n.db.rewriteRecordData(ri[i].doff, ad, uint(ri[i].dlen)); err != nil {
+				// This fails while a snapshot is being made, so pick up from this record next time.
+				n.log[LogLevelVerbose].Printf("partial node: unable to discard value of record =%s (will retry): %s", Base62Encode(ri[i].hash[:]), err.Error())
+				next = int64(ri[i].doff) - 1
+				break
+			}
+			discarded++
+		}
+	}
+	if discarded > 0 {
+		n.log[LogLevelVerbose].Printf("partial node: discarded values of %d records older than the value horizon", discarded)
+	}
+	return next
+}
+
+// canSendRecord returns false if a stored record is abbreviated, since peers can't be sent records whose values
+// were discarded. Only partial nodes store abbreviated records, so this is always true on other nodes.
+func (n *Node) canSendRecord(hash []byte) bool {
+	if n.partialPolicy == nil {
+		return true
+	}
+	var buf [1024]byte
+	_, rdata, err := n.db.getDataByHash(hash, buf[:0])
+	return err == nil && len(rdata) > 0 && !recordDataIsAbbreviated(rdata)
+}
+
+// sendableRecordHashes returns the hashes of records in a list that canSendRecord() allows to be announced to peers.
+func (n *Node) sendableRecordHashes(hashes [][32]byte) [][32]byte {
+	if n.partialPolicy == nil {
+		return hashes
+	}
+	sendable := hashes[:0]
+	for i := range hashes {
+		if n.canSendRecord(hashes[i][:]) {
+			sendable = append(sendable, hashes[i])
+		}
+	}
+	return sendable
+}
+
+// fetchRecord attempts to get the full version of an abbreviated record from peers, waiting up to timeout.
+// Records fetched this way are cached for a few minutes but are not stored in the database.
+func (n *Node) fetchRecord(hash [32]byte, timeout time.Duration) *Record {
+	n.fetchedRecordsLock.Lock()
+	if fr := n.fetchedRecords[hash]; fr != nil {
+		fr.ticker = atomic.LoadUintptr(&n.timeTicker)
+		n.fetchedRecordsLock.Unlock()
+		return fr.record
+	}
+	c := make(chan *Record, 1)
+	n.fetchWaiters[hash] = append(n.fetchWaiters[hash], c)
+	n.fetchedRecordsLock.Unlock()
+
+	req := make([]byte, 33)
+	req[0] = p2pProtoMessageTypeRequestRecordsByHash
+	copy(req[1:], hash[:])
+	n.peersLock.RLock()
+	if len(n.peers) > 0 {
+		start := rand.Int()
+		for i := 0; i < len(n.peers) && i < partialNodeFetchPeerCount; i++ {
+			n.peers[(start+i)%len(n.peers)].send(req)
+		}
+	}
+	n.peersLock.RUnlock()
+
+	var rec *Record
+	select {
+	case rec = <-c:
+	case <-time.After(timeout):
+	}
+
+	n.fetchedRecordsLock.Lock()
+	waiters := n.fetchWaiters[hash]
+	for i := range waiters {
+		if waiters[i] == c {
+			waiters = append(waiters[0:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(n.fetchWaiters, hash)
+	} else {
+		n.fetchWaiters[hash] = waiters
+	}
+	n.fetchedRecordsLock.Unlock()
+
+	return rec
+}
+
+// deliverFetchedRecord hands a full record received from a peer to anyone waiting for it in fetchRecord.
+// It returns true if the record was wanted. The caller must have verified that hash is the record's hash.
+func (n *Node) deliverFetchedRecord(hash [32]byte, rec *Record) bool {
+	if rec.IsAbbreviated() {
+		return false
+	}
+	n.fetchedRecordsLock.Lock()
+	defer n.fetchedRecordsLock.Unlock()
+	waiters := n.fetchWaiters[hash]
+	if len(waiters) == 0 {
+		return false
+	}
+	if rec.Validate() != nil {
+		return false
+	}
+	n.fetchedRecords[hash] = &fetchedRecord{record: rec, ticker: atomic.LoadUintptr(&n.timeTicker)}
+	for _, c := range waiters {
+		select {
+		case c <- rec:
+		default:
+		}
+	}
+	delete(n.fetchWaiters, hash)
+	return true
+}
+
+// fetchedRecord is a full record fetched from a peer by a partial node.
+type fetchedRecord struct {
+	record *Record
+	ticker uintptr
+}
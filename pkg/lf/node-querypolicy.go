@@ -0,0 +1,110 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// This is the query privacy policy parts of Node, see node.go for main object.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// QueryPolicyName is the name of the file in a node's base path that configures its query privacy policy.
+const QueryPolicyName = "querypolicy.json"
+
+// QueryPolicy determines how a node handles queries that reveal selector names or record values to it.
+// Queries can name selectors in plain text (QueryRange.Name) or by key (QueryRange.KeyRange), and can ask
+// the node to unmask values with a masking key that is given explicitly or implied by the first selector
+// name. Public nodes can refuse to see names and values so users can't accidentally reveal them, while
+// private deployments can keep an audit log of which selector names are queried.
+type QueryPolicy struct {
+	RejectNames      bool `json:",omitempty"` // If true reject queries with plain text selector names (KeyRange must be used)
+	RejectMaskingKey bool `json:",omitempty"` // If true reject queries with a MaskingKey and never unmask values server-side
+	AuditNames       bool `json:",omitempty"` // If true log plain text selector names and masking key use of queries
+}
+
+// check returns an error if a query is not allowed by this policy. A nil policy allows everything.
+func (p *QueryPolicy) check(m *Query) error {
+	if p == nil {
+		return nil
+	}
+	if p.RejectNames {
+		for i := range m.Ranges {
+			if len(m.Ranges[i].KeyRange) == 0 {
+				return ErrQueryNamesNotAllowed
+			}
+		}
+	}
+	if p.RejectMaskingKey && len(m.MaskingKey) > 0 {
+		return ErrQueryUnmaskNotAllowed
+	}
+	return nil
+}
+
+// allowUnmasking returns true if values may be unmasked server-side under this policy.
+func (p *QueryPolicy) allowUnmasking() bool {
+	return p == nil || !p.RejectMaskingKey
+}
+
+// loadQueryPolicy reads a query policy, returning nil if the file does not exist.
+func loadQueryPolicy(path string) (*QueryPolicy, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil || len(d) == 0 {
+		return nil, nil
+	}
+	p := new(QueryPolicy)
+	err = json.Unmarshal(d, p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// auditQuery logs the plain text selector names in a query if the node's policy asks for this.
+// Queries that use only selector keys reveal nothing and are not logged.
+func (n *Node) auditQuery(m *Query, source string) {
+	if n.queryPolicy == nil || !n.queryPolicy.AuditNames {
+		return
+	}
+	var names []string
+	for i := range m.Ranges {
+		if len(m.Ranges[i].KeyRange) == 0 {
+			name := strconv.Quote(string(m.Ranges[i].Name))
+			if len(m.Ranges[i].Range) == 1 {
+				name += "#" + strconv.FormatUint(m.Ranges[i].Range[0], 10)
+			} else if len(m.Ranges[i].Range) == 2 {
+				name += "#" + strconv.FormatUint(m.Ranges[i].Range[0], 10) + ".." + strconv.FormatUint(m.Ranges[i].Range[1], 10)
+			}
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && len(m.MaskingKey) == 0 {
+		return
+	}
+	n.log[LogLevelNormal].Printf("query audit: %s queried selectors [%s] (masking key supplied: %t)", source, strings.Join(names, ", "), len(m.MaskingKey) > 0)
+}
+
+// apiCheckQueryPolicy audits a query received via the HTTP API and checks it against the node's query policy,
+// sending an error and returning false if it is not allowed.
+func (n *Node) apiCheckQueryPolicy(out http.ResponseWriter, req *http.Request, m *Query) bool {
+	n.auditQuery(m, req.RemoteAddr)
+	if err := n.queryPolicy.check(m); err != nil {
+		apiSendObj(out, req, http.StatusForbidden, &ErrAPI{Code: http.StatusForbidden, Message: "query failed: " + err.Error(), ErrTypeName: errTypeName(err)})
+		return false
+	}
+	return true
+}
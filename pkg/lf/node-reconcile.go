@@ -0,0 +1,350 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// This is the set reconciliation parts of Node, see node.go for main object.
+//
+// Set reconciliation lets two nodes find the records one has and the other doesn't in a few
+// round trips. Records are ordered by timestamp and then hash. A Reconcile message contains
+// a series of contiguous ranges in this order, each identified by its exclusive upper bound
+// (the lower bound being the previous range's upper bound or zero for the first). Each range
+// carries a fingerprint of the hashes in it, a list of all the hashes in it, or nothing if it
+// needs no further work. A node receiving a fingerprint that differs from its own splits the
+// range into smaller ranges, or sends its hashes if the range is small. A node receiving a
+// hash list requests records it lacks and announces records the other side lacks. This repeats
+// until all ranges match, which takes O(log(n)) rounds for n records with few differences.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	reconcileModeSkip        byte = 0 // range needs no further work (no payload)
+	reconcileModeFingerprint byte = 1 // range is described by a 16-byte fingerprint
+	reconcileModeHashList    byte = 2 // range is described by a varint count and all hashes in it
+
+	// reconcileHashListThreshold is the maximum number of records in a range sent as a hash list instead of being split.
+	reconcileHashListThreshold = 32
+
+	// reconcileBranchFactor is the number of sub-ranges a range with a different fingerprint is split into.
+	reconcileBranchFactor = 16
+
+	// reconcileMaxAnnounce is the maximum number of hashes announced or requested for one range in one round.
+	// Anything beyond this will be caught by subsequent reconciliations.
+	reconcileMaxAnnounce = 16384
+
+	// reconcileMaxMessageSize is the size after which remaining ranges in a reply are coalesced into one.
+	// The margin leaves room for the largest single range description (a full hash list or a split into
+	// reconcileBranchFactor fingerprints) plus the coalesced fingerprint.
+	reconcileMaxMessageSize = p2pProtoMaxMessageSize - 4096
+
+	// reconcileMaxRoundsPerMinute limits how many Reconcile messages we'll answer per connection per minute.
+	reconcileMaxRoundsPerMinute = 64
+
+	// reconcileSumBucketSeconds is the timestamp span of the per-bucket hash sums and counts stores keep so
+	// range sums and offsets in large ranges don't require scanning every record in them. This must match
+	// ZTLF_DB_RECONCILE_BUCKET_SECONDS in native/db.h.
+	reconcileSumBucketSeconds = 86400
+)
+
+var errReconcileInvalidMessage = errors.New("invalid reconcile message")
+
+// reconcileBound is a position in the timestamp then hash ordering of records.
+type reconcileBound struct {
+	ts   uint64
+	hash [32]byte
+}
+
+// reconcileBoundMin and reconcileBoundMax are the lower and upper bounds of all records.
+// Timestamps are stored as signed 64-bit integers in the database so max is MaxInt64.
+var (
+	reconcileBoundMin = reconcileBound{}
+	reconcileBoundMax = reconcileBound{ts: math.MaxInt64, hash: [32]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}
+)
+
+// less returns true if b comes before b2 in timestamp then hash order.
+func (b *reconcileBound) less(b2 *reconcileBound) bool {
+	if b.ts == b2.ts {
+		return bytes.Compare(b.hash[:], b2.hash[:]) < 0
+	}
+	return b.ts < b2.ts
+}
+
+func (b *reconcileBound) appendTo(msg []byte) []byte {
+	var tmp [10]byte
+	msg = append(msg, tmp[0:binary.PutUvarint(tmp[:], b.ts)]...)
+	return append(msg, b.hash[:]...)
+}
+
+func (b *reconcileBound) readFrom(msg []byte) ([]byte, error) {
+	ts, l := binary.Uvarint(msg)
+	if l <= 0 || len(msg) < (l+32) {
+		return nil, errReconcileInvalidMessage
+	}
+	b.ts = ts
+	copy(b.hash[:], msg[l:l+32])
+	return msg[l+32:], nil
+}
+
+// reconcileSumAdd adds a 256-bit little-endian sum of record hashes to another, ignoring overflow.
+func reconcileSumAdd(sum *[4]uint64, s2 *[4]uint64) {
+	var carry uint64
+	for i := 0; i < 4; i++ {
+		s1 := sum[i] + s2[i]
+		c1 := uint64(0)
+		if s1 < s2[i] {
+			c1 = 1
+		}
+		s := s1 + carry
+		if s < s1 {
+			c1++
+		}
+		carry = c1
+		sum[i] = s
+	}
+}
+
+// reconcileSumAddHash adds a record hash to a 256-bit little-endian sum of record hashes, ignoring overflow.
+func reconcileSumAddHash(sum *[4]uint64, h *[32]byte) {
+	var w [4]uint64
+	for i := 0; i < 4; i++ {
+		w[i] = binary.LittleEndian.Uint64(h[i*8 : (i*8)+8])
+	}
+	reconcileSumAdd(sum, &w)
+}
+
+// reconcileSumBuckets returns the range of sum buckets [b0,b1) entirely within [start,end).
+// If b1 <= b0 no bucket is entirely within the range.
+func reconcileSumBuckets(start, end *reconcileBound) (b0, b1 uint64) {
+	b0 = start.ts / reconcileSumBucketSeconds
+	if (start.ts%reconcileSumBucketSeconds) != 0 || start.hash != ([32]byte{}) {
+		b0++
+	}
+	b1 = end.ts / reconcileSumBucketSeconds
+	return
+}
+
+// reconcileFingerprint computes a fingerprint of the records in [start,end).
+// It's the first 16 bytes of SHA256 of the 256-bit sum of record hashes and the record count.
+// Sums can be combined in any order, so both sides arrive at the same value for the same set.
+func (n *Node) reconcileFingerprint(start, end *reconcileBound) (fp [16]byte, count uint64) {
+	sum, count := n.db.getRangeSum(start, end)
+	var tmp [40]byte
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint64(tmp[i*8:], sum[i])
+	}
+	binary.BigEndian.PutUint64(tmp[32:], count)
+	h := sha256.Sum256(tmp[:])
+	copy(fp[:], h[0:16])
+	return
+}
+
+// reconcileAppendFingerprint appends a single fingerprint for the range [start,end) to a Reconcile message.
+func (n *Node) reconcileAppendFingerprint(msg []byte, start, end *reconcileBound) []byte {
+	fp, _ := n.reconcileFingerprint(start, end)
+	msg = end.appendTo(msg)
+	msg = append(msg, reconcileModeFingerprint)
+	return append(msg, fp[:]...)
+}
+
+// reconcileAppendRange appends our description of the range [start,end) to a Reconcile message.
+// Small ranges are sent as hash lists and larger ones are split into reconcileBranchFactor ranges
+// with fingerprints.
+func (n *Node) reconcileAppendRange(msg []byte, start, end *reconcileBound, count uint64) []byte {
+	if count <= reconcileHashListThreshold {
+		hashes, _ := n.db.getRangeHashes(start, end, 0, reconcileHashListThreshold)
+		hashes = n.sendableRecordHashes(hashes) // don't invite requests for records we can't send
+		msg = end.appendTo(msg)
+		msg = append(msg, reconcileModeHashList)
+		var tmp [10]byte
+		msg = append(msg, tmp[0:binary.PutUvarint(tmp[:], uint64(len(hashes)))]...)
+		for i := range hashes {
+			msg = append(msg, hashes[i][:]...)
+		}
+		return msg
+	}
+
+	// Sub-range boundaries are the positions of evenly spaced records within this range. Each is found
+	// relative to the previous one so the store only has to skip over the records in one sub-range.
+	lower := *start
+	var lowerPos, pos uint64
+	for i := uint64(1); i <= reconcileBranchFactor; i++ {
+		upper := *end
+		if i < reconcileBranchFactor {
+			pos = (count * i) / reconcileBranchFactor
+			hashes, timestamps := n.db.getRangeHashes(&lower, end, int(pos-lowerPos), 1)
+			if len(hashes) != 1 {
+				continue
+			}
+			upper.ts = timestamps[0]
+			upper.hash = hashes[0]
+			if upper == lower {
+				continue
+			}
+		}
+		msg = n.reconcileAppendFingerprint(msg, &lower, &upper)
+		lower, lowerPos = upper, pos
+	}
+	return msg
+}
+
+// startReconciliation begins reconciling our records with this peer's records.
+func (p *connectedPeer) startReconciliation() {
+	fp, _ := p.n.reconcileFingerprint(&reconcileBoundMin, &reconcileBoundMax)
+	msg := make([]byte, 1, 64)
+	msg[0] = p2pProtoMessageTypeReconcile
+	msg = reconcileBoundMax.appendTo(msg)
+	msg = append(msg, reconcileModeFingerprint)
+	msg = append(msg, fp[:]...)
+	p.send(msg)
+}
+
+// handleReconcile handles a Reconcile message from a peer and replies if there is more work to do.
+func (p *connectedPeer) handleReconcile(msg []byte) error {
+	now := TimeSec()
+	if (now - p.reconcileStart) >= 60 {
+		p.reconcileStart = now
+		p.reconcileCount = 0
+	}
+	p.reconcileCount++
+	if p.reconcileCount > reconcileMaxRoundsPerMinute {
+		return nil
+	}
+
+	n := p.n
+	reply := make([]byte, 1, 4096)
+	reply[0] = p2pProtoMessageTypeReconcile
+	replyNeeded := false
+	var requested, announced int
+
+	// Once the reply reaches reconcileMaxMessageSize the remaining ranges are coalesced into one range
+	// starting at coalesceStart, which is described by a single fingerprint at the end.
+	lower := reconcileBoundMin
+	var upper, coalesceStart reconcileBound
+	coalescing := false
+	var err error
+	for len(msg) > 0 {
+		msg, err = upper.readFrom(msg)
+		if err != nil {
+			return err
+		}
+		if len(msg) < 1 || upper.less(&lower) {
+			return errReconcileInvalidMessage
+		}
+		mode := msg[0]
+		msg = msg[1:]
+		if !coalescing && len(reply) >= reconcileMaxMessageSize {
+			coalescing = true
+			coalesceStart = lower
+		}
+
+		switch mode {
+
+		case reconcileModeSkip:
+			if !coalescing {
+				reply = upper.appendTo(reply)
+				reply = append(reply, reconcileModeSkip)
+			}
+
+		case reconcileModeFingerprint:
+			if len(msg) < 16 {
+				return errReconcileInvalidMessage
+			}
+			if !coalescing {
+				fp, count := n.reconcileFingerprint(&lower, &upper)
+				if bytes.Equal(fp[:], msg[0:16]) {
+					reply = upper.appendTo(reply)
+					reply = append(reply, reconcileModeSkip)
+				} else {
+					reply = n.reconcileAppendRange(reply, &lower, &upper, count)
+					replyNeeded = true
+				}
+			}
+			msg = msg[16:]
+
+		case reconcileModeHashList:
+			hc, l := binary.Uvarint(msg)
+			if l <= 0 || hc > (uint64(len(msg)-l)/32) {
+				return errReconcileInvalidMessage
+			}
+			msg = msg[l:]
+			theirs := make(map[[32]byte]bool)
+			for i := uint64(0); i < hc; i++ {
+				var h [32]byte
+				copy(h[:], msg[0:32])
+				theirs[h] = true
+				msg = msg[32:]
+			}
+
+			ours, _ := n.db.getRangeHashes(&lower, &upper, 0, reconcileMaxAnnounce)
+			ours = n.sendableRecordHashes(ours)
+			have := make([]byte, 1, 1+(len(ours)*32))
+			have[0] = p2pProtoMessageTypeHaveRecords
+			for i := range ours {
+				if theirs[ours[i]] {
+					delete(theirs, ours[i])
+				} else {
+					have = append(have, ours[i][:]...)
+				}
+			}
+			want := make([]byte, 1, 1+(len(theirs)*32))
+			want[0] = p2pProtoMessageTypeRequestRecordsByHash
+			for h := range theirs {
+				if !n.db.haveRecordIncludeLimbo(h[:]) {
+					want = append(want, h[:]...)
+				}
+			}
+
+			for i := 1; i < len(have); {
+				j := i + ((p2pProtoMaxMessageSize - 64) / 32 * 32)
+				if j > len(have) {
+					j = len(have)
+				}
+				p.send(append([]byte{p2pProtoMessageTypeHaveRecords}, have[i:j]...))
+				announced += (j - i) / 32
+				i = j
+			}
+			if len(want) > 1 {
+				p.send(want)
+				requested += (len(want) - 1) / 32
+			}
+
+			if !coalescing {
+				reply = upper.appendTo(reply)
+				reply = append(reply, reconcileModeSkip)
+			}
+
+		default:
+			return errReconcileInvalidMessage
+		}
+
+		lower = upper
+	}
+	if coalescing {
+		reply = n.reconcileAppendFingerprint(reply, &coalesceStart, &upper)
+		replyNeeded = true
+	}
+
+	if requested > 0 || announced > 0 {
+		n.log[LogLevelVerbose].Printf("sync: reconciliation with %s found %d records to request and %d to announce", p.address, requested, announced)
+	}
+	if replyNeeded {
+		p.send(reply)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// This is the watch/subscribe parts of Node, see node.go for main object.
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// nodeWatch is a registered watch on a set of selector key ranges.
+type nodeWatch struct {
+	selectorRanges  [][2][]byte         // Selector key ranges from the watched query
+	pulseTokens     map[uint64]struct{} // Pulse tokens of records in the most recent results
+	pulseTokensLock sync.Mutex          //
+	changed         chan struct{}       // Signaled (non-blocking, buffer of one) when something relevant changes
+}
+
+func (w *nodeWatch) signal() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// matchesRecord returns true if this record's selectors fall within this watch's selector key ranges.
+func (w *nodeWatch) matchesRecord(r *Record) bool {
+	if len(r.Selectors) < len(w.selectorRanges) {
+		return false
+	}
+	for i := range w.selectorRanges {
+		sk := r.SelectorKey(i)
+		if bytes.Compare(sk, w.selectorRanges[i][0]) < 0 || bytes.Compare(sk, w.selectorRanges[i][1]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *nodeWatch) matchesPulseToken(token uint64) (m bool) {
+	w.pulseTokensLock.Lock()
+	_, m = w.pulseTokens[token]
+	w.pulseTokensLock.Unlock()
+	return
+}
+
+func (w *nodeWatch) setResults(qr QueryResults) {
+	pt := make(map[uint64]struct{})
+	for _, qrSet := range qr {
+		for _, result := range qrSet {
+			if result.Record != nil && result.Record.PulseToken != 0 {
+				pt[result.Record.PulseToken] = struct{}{}
+			}
+		}
+	}
+	w.pulseTokensLock.Lock()
+	w.pulseTokens = pt
+	w.pulseTokensLock.Unlock()
+}
+
+// Watch executes a query and then re-executes it whenever a matching record is synchronized or a pulse
+// for a record in its current results is updated, calling the supplied function with each set of results.
+// The initial results are always delivered first. Watch blocks until the function returns false, in which
+// case it returns nil, or until an error occurs or the node is stopped.
+func (n *Node) Watch(query *Query, f func(QueryResults) bool) error {
+	return n.watch(query, nil, f)
+}
+
+// watch implements Watch and also returns nil if done is closed (used to end watches for departed HTTP clients).
+func (n *Node) watch(query *Query, done <-chan struct{}, f func(QueryResults) bool) error {
+	selectorRanges, _, err := query.selectorKeyRanges()
+	if err != nil {
+		return err
+	}
+
+	w := &nodeWatch{
+		selectorRanges: selectorRanges,
+		changed:        make(chan struct{}, 1),
+	}
+	n.watchesLock.Lock()
+	n.watches[w] = struct{}{}
+	n.watchesLock.Unlock()
+	defer func() {
+		n.watchesLock.Lock()
+		delete(n.watches, w)
+		n.watchesLock.Unlock()
+	}()
+
+	for atomic.LoadUint32(&n.shutdown) == 0 {
+		qr, err := query.execute(n)
+		if err != nil {
+			return err
+		}
+		w.setResults(qr)
+		if !f(qr) {
+			return nil
+		}
+
+	waitForChange:
+		for {
+			select {
+			case <-w.changed:
+				break waitForChange
+			case <-done:
+				return nil
+			case <-time.After(time.Second):
+				if atomic.LoadUint32(&n.shutdown) != 0 {
+					break waitForChange
+				}
+			}
+		}
+	}
+
+	return ErrNodeStopped
+}
+
+// notifyWatchesOfRecord signals any watches whose selector ranges match a newly synchronized record.
+func (n *Node) notifyWatchesOfRecord(r *Record) {
+	if len(r.Selectors) == 0 {
+		return
+	}
+	n.watchesLock.Lock()
+	for w := range n.watches {
+		if w.matchesRecord(r) {
+			w.signal()
+		}
+	}
+	n.watchesLock.Unlock()
+}
+
+// notifyWatchesOfPulse signals any watches whose most recent results contain a record with this pulse token.
+func (n *Node) notifyWatchesOfPulse(token uint64) {
+	n.watchesLock.Lock()
+	for w := range n.watches {
+		if w.matchesPulseToken(token) {
+			w.signal()
+		}
+	}
+	n.watchesLock.Unlock()
+}
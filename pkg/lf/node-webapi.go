@@ -16,17 +16,22 @@ package lf
 // This is the HTTP API parts of Node, see node.go for main object.
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
-	"net"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// apiWatchKeepaliveInterval is how often a comment line is sent on an idle watch stream so proxies and clients don't time it out.
+const apiWatchKeepaliveInterval = 30 * time.Second
+
 type remoteMakeResult struct {
 	Pulse    Pulse   `json:",omitempty"`
 	Record   *Record `json:",omitempty"`
@@ -51,6 +56,16 @@ func apiSetStandardHeaders(out http.ResponseWriter) {
 	h.Set("Server", SoftwareName)
 }
 
+// apiRefuseIfPartial sends an error and returns true if this is a partial node, whose records.lf contains abbreviated
+// records and gaps (see recordDataGapMarker) and so can't be served to clients expecting a stream of full records.
+func (n *Node) apiRefuseIfPartial(out http.ResponseWriter, req *http.Request) bool {
+	if n.partialPolicy == nil {
+		return false
+	}
+	apiSendObj(out, req, http.StatusConflict, &ErrAPI{Code: http.StatusConflict, Message: "this is a partial node that has discarded some record values, use a full node for record dumps and bootstrapping"})
+	return true
+}
+
 func apiSendObj(out http.ResponseWriter, req *http.Request, httpStatusCode int, obj interface{}) {
 	h := out.Header()
 	h.Set("Content-Type", "application/json")
@@ -75,22 +90,32 @@ func apiReadObj(out http.ResponseWriter, req *http.Request, dest interface{}) (e
 	return
 }
 
-func (n *Node) apiIsTrusted(req *http.Request) bool {
-	ip, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return false
-	}
-	return net.ParseIP(ip).IsLoopback()
-}
-
 func (n *Node) createHTTPServeMux() *http.ServeMux {
 	smux := http.NewServeMux()
 
-	smux.HandleFunc("/query", func(out http.ResponseWriter, req *http.Request) {
+	// Every route requires a scope, which is checked before its handler is called.
+	handle := func(pattern string, scope string, handler func(http.ResponseWriter, *http.Request)) {
+		smux.HandleFunc(pattern, func(out http.ResponseWriter, req *http.Request) {
+			if n.apiAuthorize(out, req, scope) {
+				handler(out, req)
+			}
+		})
+	}
+
+	handle("/query", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodPost || req.Method == http.MethodPut {
 			var m Query
-			if apiReadObj(out, req, &m) == nil {
+			if apiReadObj(out, req, &m) == nil && n.apiCheckQueryPolicy(out, req, &m) {
+				if len(m.Aggregate) > 0 {
+					qa, err := m.aggregate(n)
+					if err != nil {
+						apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "query failed: " + err.Error()})
+					} else {
+						apiSendObj(out, req, http.StatusOK, qa)
+					}
+					return
+				}
 				results, err := m.execute(n)
 				if err != nil {
 					apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "query failed: " + err.Error()})
@@ -104,9 +129,121 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/post", func(out http.ResponseWriter, req *http.Request) {
+	handle("/watch", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodPost || req.Method == http.MethodPut {
+			var m Query
+			if apiReadObj(out, req, &m) == nil && n.apiCheckQueryPolicy(out, req, &m) {
+				if _, _, err := m.selectorKeyRanges(); err != nil {
+					apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "query failed: " + err.Error()})
+					return
+				}
+
+				// Results are sent as server-sent events, one JSON QueryResults object per event.
+				// A comment line is sent periodically to keep idle streams from timing out.
+				flusher, _ := out.(http.Flusher)
+				out.Header().Set("Content-Type", "text/event-stream")
+				out.WriteHeader(http.StatusOK)
+				if flusher != nil {
+					flusher.Flush()
+				}
+				var outLock sync.Mutex
+				send := func(b []byte) error {
+					outLock.Lock()
+					defer outLock.Unlock()
+					_, err := out.Write(b)
+					if flusher != nil {
+						flusher.Flush()
+					}
+					return err
+				}
+				stopKeepalive := make(chan struct{})
+				keepaliveStopped := make(chan struct{})
+				go func() {
+					defer close(keepaliveStopped)
+					ticker := time.NewTicker(apiWatchKeepaliveInterval)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-stopKeepalive:
+							return
+						case <-ticker.C:
+							if send([]byte(": keepalive\n\n")) != nil {
+								return
+							}
+						}
+					}
+				}()
+				err := n.watch(&m, req.Context().Done(), func(results QueryResults) bool {
+					j, _ := json.Marshal(results)
+					return send(append(append([]byte("data: "), j...), '\n', '\n')) == nil
+				})
+				close(stopKeepalive)
+				<-keepaliveStopped
+				if err != nil {
+					j, _ := json.Marshal(&ErrAPI{Code: http.StatusInternalServerError, Message: "query failed: " + err.Error(), ErrTypeName: errTypeName(err)})
+					_, _ = out.Write(append(append([]byte("event: error\ndata: "), j...), '\n', '\n'))
+				}
+			}
+		} else {
+			out.Header().Set("Allow", "POST, PUT")
+			apiSendObj(out, req, http.StatusMethodNotAllowed, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: req.Method + " not supported for this path"})
+		}
+	})
+
+	handle("/query/batch", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
+		apiSetStandardHeaders(out)
+		if req.Method == http.MethodPost || req.Method == http.MethodPut {
+			var m []*Query
+			if apiReadObj(out, req, &m) == nil {
+				if len(m) > APIMaxBatchQueries {
+					apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "too many queries in batch (max " + strconv.Itoa(APIMaxBatchQueries) + ")"})
+					return
+				}
+				for _, q := range m {
+					if q == nil {
+						apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "batch contains a null query", ErrTypeName: errTypeName(ErrInvalidParameter)})
+						return
+					}
+				}
+				for _, q := range m {
+					n.auditQuery(q, req.RemoteAddr)
+				}
+				results, _ := n.ExecuteQueries(m)
+				apiSendObj(out, req, http.StatusOK, results)
+			}
+		} else {
+			out.Header().Set("Allow", "POST, PUT")
+			apiSendObj(out, req, http.StatusMethodNotAllowed, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: req.Method + " not supported for this path"})
+		}
+	})
+
+	handle("/post", APIScopePost, func(out http.ResponseWriter, req *http.Request) {
+		apiSetStandardHeaders(out)
+		if (req.Method == http.MethodPost || req.Method == http.MethodPut) && req.URL.Query().Get("batch") != "" {
+			// In batch mode the body is a stream of concatenated records (like genesis.lf) and a
+			// result is returned for each. Deserialization errors end the batch since framing is lost.
+			// Batches are limited in size and record count, and records past the limits are rejected.
+			results := make([]AddRecordResult, 0, 16)
+			body := bufio.NewReader(http.MaxBytesReader(out, req.Body, APIMaxBatchPostSize))
+			for {
+				if _, err := body.Peek(1); err != nil {
+					break
+				}
+				if len(results) >= APIMaxBatchRecords {
+					results = append(results, AddRecordResult{Error: &ErrAPI{Code: http.StatusBadRequest, Message: "too many records in batch (max " + strconv.Itoa(APIMaxBatchRecords) + ")"}})
+					break
+				}
+				rec := new(Record)
+				err := rec.UnmarshalFrom(body)
+				if err != nil {
+					results = append(results, AddRecordResult{Error: &ErrAPI{Code: http.StatusBadRequest, Message: "record deserialization failed: " + err.Error()}})
+					break
+				}
+				results = append(results, n.addRecordResult(rec))
+			}
+			apiSendObj(out, req, http.StatusOK, results)
+		} else if req.Method == http.MethodPost || req.Method == http.MethodPut {
 			var rec Record
 			err := rec.UnmarshalFrom(req.Body)
 			if err != nil {
@@ -125,7 +262,7 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/pulse", func(out http.ResponseWriter, req *http.Request) {
+	handle("/pulse", APIScopePost, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodPost || req.Method == http.MethodPut {
 			var pbuf [PulseSize]byte
@@ -143,21 +280,34 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/makerecord", func(out http.ResponseWriter, req *http.Request) {
+	handle("/makerecord", APIScopeMakeRecord, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodPost || req.Method == http.MethodPut {
-			if n.apiIsTrusted(req) {
-				var m MakeRecord
-				if apiReadObj(out, req, &m) == nil {
-					rec, pulse, ok, err := m.execute(n)
-					if err != nil {
-						apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "record creation failed: " + err.Error()})
-					} else {
-						apiSendObj(out, req, http.StatusOK, &remoteMakeResult{pulse, rec, ok})
-					}
+			var m MakeRecord
+			if apiReadObj(out, req, &m) == nil {
+				n.apiRunJob(out, req, JobTypeMakeRecord, APIScopeMakeRecord, m.runJob(n), nil)
+			}
+		} else {
+			out.Header().Set("Allow", "POST, PUT")
+			apiSendObj(out, req, http.StatusMethodNotAllowed, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: req.Method + " not supported for this path"})
+		}
+	})
+
+	handle("/work", APIScopeWork, func(out http.ResponseWriter, req *http.Request) {
+		apiSetStandardHeaders(out)
+		if req.Method == http.MethodPost || req.Method == http.MethodPut {
+			var m WorkRequest
+			if apiReadObj(out, req, &m) == nil {
+				if m.check() != nil {
+					apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "work failed: invalid work hash or difficulty", ErrTypeName: errTypeName(ErrInvalidParameter)})
+					return
 				}
-			} else {
-				apiSendObj(out, req, http.StatusForbidden, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: "only trusted clients can delegate record creation"})
+				quotaKey, quota := n.apiWorkQuota(req)
+				if err := n.chargeWorkQuota(quotaKey, quota, m.Difficulty); err != nil {
+					apiSendObj(out, req, http.StatusTooManyRequests, &ErrAPI{Code: http.StatusTooManyRequests, Message: "work failed: " + err.Error(), ErrTypeName: errTypeName(err)})
+					return
+				}
+				n.apiRunJob(out, req, JobTypeWork, APIScopeWork, m.runJob(n), func() { n.refundWorkQuota(quotaKey, quota, m.Difficulty) })
 			}
 		} else {
 			out.Header().Set("Allow", "POST, PUT")
@@ -165,17 +315,12 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/makepulse", func(out http.ResponseWriter, req *http.Request) {
+	handle("/makepulse", APIScopeMakeRecord, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodPost || req.Method == http.MethodPut {
 			var m MakePulse
 			if apiReadObj(out, req, &m) == nil {
-				pulse, rec, ok, err := m.execute(n)
-				if err != nil {
-					apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "record creation failed: " + err.Error()})
-				} else {
-					apiSendObj(out, req, http.StatusOK, &remoteMakeResult{pulse, rec, ok})
-				}
+				n.apiRunJob(out, req, JobTypeMakePulse, APIScopeMakeRecord, m.runJob(n), nil)
 			}
 		} else {
 			out.Header().Set("Allow", "POST, PUT")
@@ -183,17 +328,54 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/connect", func(out http.ResponseWriter, req *http.Request) {
+	handle("/workestimate/", APIScopeMakeRecord, func(out http.ResponseWriter, req *http.Request) {
+		apiSetStandardHeaders(out)
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			bytes, _ := strconv.ParseUint(req.URL.Path[14:], 10, 64)
+			if bytes == 0 || bytes > RecordMaxSize {
+				apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "record size must be between 1 and " + strconv.Itoa(RecordMaxSize) + " bytes", ErrTypeName: errTypeName(ErrInvalidParameter)})
+				return
+			}
+			e, err := n.WorkEstimate(uint(bytes))
+			if err != nil {
+				apiSendObj(out, req, http.StatusInternalServerError, &ErrAPI{Code: http.StatusInternalServerError, Message: "work estimate failed: " + err.Error(), ErrTypeName: errTypeName(err)})
+				return
+			}
+			apiSendObj(out, req, http.StatusOK, e)
+		} else {
+			out.Header().Set("Allow", "GET, HEAD")
+			apiSendObj(out, req, http.StatusMethodNotAllowed, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: req.Method + " not supported for this path"})
+		}
+	})
+
+	handle("/jobs/", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
+		apiSetStandardHeaders(out)
+		id := req.URL.Path[6:]
+		if req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodDelete {
+			// Seeing or cancelling a job requires the scope needed to create it. Jobs the caller can't see are
+			// reported as not found so job IDs and types can't be probed without that scope.
+			s := n.Job(id)
+			if s == nil || !n.apiHasScope(req, n.jobScope(id)) {
+				apiSendObj(out, req, http.StatusNotFound, &ErrAPI{Code: http.StatusNotFound, Message: "job not found"})
+				return
+			}
+			if req.Method == http.MethodDelete {
+				s = n.CancelJob(id)
+			}
+			apiSendObj(out, req, http.StatusOK, s)
+		} else {
+			out.Header().Set("Allow", "GET, HEAD, DELETE")
+			apiSendObj(out, req, http.StatusMethodNotAllowed, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: req.Method + " not supported for this path"})
+		}
+	})
+
+	handle("/connect", APIScopeConnect, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodPost || req.Method == http.MethodPut {
-			if n.apiIsTrusted(req) {
-				var m Peer
-				if apiReadObj(out, req, &m) == nil {
-					_ = n.Connect(m.IP, m.Port, m.Identity)
-					apiSendObj(out, req, http.StatusOK, nil)
-				}
-			} else {
-				apiSendObj(out, req, http.StatusForbidden, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: "only trusted clients can suggest P2P endpoints"})
+			var m Peer
+			if apiReadObj(out, req, &m) == nil {
+				_ = n.Connect(m.IP, m.Port, m.Identity)
+				apiSendObj(out, req, http.StatusOK, nil)
 			}
 		} else {
 			out.Header().Set("Allow", "POST, PUT")
@@ -201,7 +383,7 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/record/raw/", func(out http.ResponseWriter, req *http.Request) {
+	handle("/record/raw/", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodGet || req.Method == http.MethodHead {
 			urlPath := req.URL.Path
@@ -211,6 +393,13 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 					recordHash := Base62Decode(urlPath[1:])
 					if len(recordHash) == 32 {
 						_, data, _ := n.db.getDataByHash(recordHash, nil)
+						if recordDataIsAbbreviated(data) {
+							rec, err := n.GetRecord(recordHash)
+							data = nil
+							if err == nil && !rec.IsAbbreviated() {
+								data = rec.Bytes()
+							}
+						}
 						if len(data) > 0 {
 							out.Header().Set("Content-Type", "application/octet-stream")
 							out.WriteHeader(http.StatusOK)
@@ -229,7 +418,7 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/record/", func(out http.ResponseWriter, req *http.Request) {
+	handle("/record/", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodGet || req.Method == http.MethodHead {
 			urlPath := req.URL.Path
@@ -238,13 +427,10 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 				if len(urlPath) > 1 && urlPath[0] == '=' {
 					recordHash := Base62Decode(urlPath[1:])
 					if len(recordHash) == 32 {
-						_, data, _ := n.db.getDataByHash(recordHash, nil)
-						if len(data) > 0 {
-							rec, _ := NewRecordFromBytes(data)
-							if rec != nil {
-								apiSendObj(out, req, http.StatusOK, rec)
-								return
-							}
+						rec, err := n.GetRecord(recordHash)
+						if err == nil {
+							apiSendObj(out, req, http.StatusOK, rec)
+							return
 						}
 					}
 				}
@@ -256,7 +442,7 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/links", func(out http.ResponseWriter, req *http.Request) {
+	handle("/links", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodGet || req.Method == http.MethodHead {
 			desired := n.genesisParameters.RecordMinLinks // default is min links for this LF DAG
@@ -283,7 +469,7 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/status", func(out http.ResponseWriter, req *http.Request) {
+	handle("/status", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodGet || req.Method == http.MethodHead {
 			nodeStatus, err := n.NodeStatus()
@@ -297,9 +483,28 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/dumprecords", func(out http.ResponseWriter, req *http.Request) {
+	handle("/metrics", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
+		apiSetStandardHeaders(out)
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			var metrics bytes.Buffer
+			n.writeMetrics(&metrics)
+			out.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			out.WriteHeader(http.StatusOK)
+			if req.Method == http.MethodGet {
+				_, _ = out.Write(metrics.Bytes())
+			}
+		} else {
+			out.Header().Set("Allow", "GET, HEAD")
+			apiSendObj(out, req, http.StatusMethodNotAllowed, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: req.Method + " not supported for this path"})
+		}
+	})
+
+	handle("/dumprecords", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			if n.apiRefuseIfPartial(out, req) {
+				return
+			}
 			recordsLf, err := os.Open(path.Join(n.basePath, "records.lf"))
 			if err != nil {
 				apiSendObj(out, req, http.StatusInternalServerError, &ErrAPI{Code: http.StatusInternalServerError, Message: err.Error(), ErrTypeName: errTypeName(err)})
@@ -317,7 +522,72 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/owner/", func(out http.ResponseWriter, req *http.Request) {
+	// /records/since returns raw records starting at a data offset ("offset") or at the first record with a
+	// timestamp of at least "ts" and ending at the end of data as of the request. The actual starting offset
+	// is returned in X-LF-Records-Offset. HTTP Range requests are supported relative to this starting offset,
+	// allowing interrupted downloads to be resumed.
+	handle("/records/since", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
+		apiSetStandardHeaders(out)
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			if n.apiRefuseIfPartial(out, req) {
+				return
+			}
+			_, dataSize := n.db.stats()
+			var start uint64
+			if tsStr := req.URL.Query().Get("ts"); len(tsStr) > 0 {
+				ts, err := strconv.ParseUint(tsStr, 10, 64)
+				if err != nil {
+					apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "invalid ts: " + err.Error()})
+					return
+				}
+				var have bool
+				start, have = n.db.getFirstDoffSince(ts)
+				if !have {
+					start = dataSize
+				}
+			} else if offsetStr := req.URL.Query().Get("offset"); len(offsetStr) > 0 {
+				var err error
+				start, err = strconv.ParseUint(offsetStr, 10, 64)
+				if err != nil || start > dataSize {
+					apiSendObj(out, req, http.StatusBadRequest, &ErrAPI{Code: http.StatusBadRequest, Message: "invalid offset"})
+					return
+				}
+			}
+
+			recordsLf, err := os.Open(path.Join(n.basePath, "records.lf"))
+			if err != nil {
+				apiSendObj(out, req, http.StatusInternalServerError, &ErrAPI{Code: http.StatusInternalServerError, Message: err.Error(), ErrTypeName: errTypeName(err)})
+				return
+			}
+			defer func() {
+				_ = recordsLf.Close()
+			}()
+			out.Header().Set("Content-Type", "application/octet-stream")
+			out.Header().Set("X-LF-Records-Offset", strconv.FormatUint(start, 10))
+			http.ServeContent(out, req, "", time.Time{}, io.NewSectionReader(recordsLf, int64(start), int64(dataSize-start)))
+		} else {
+			out.Header().Set("Allow", "GET, HEAD")
+			apiSendObj(out, req, http.StatusMethodNotAllowed, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: req.Method + " not supported for this path"})
+		}
+	})
+
+	handle("/snapshot", APIScopeAdmin, func(out http.ResponseWriter, req *http.Request) {
+		apiSetStandardHeaders(out)
+		if req.Method == http.MethodGet {
+			out.Header().Set("Content-Type", "application/x-tar")
+			out.Header().Set("Content-Disposition", "attachment; filename=\"lf-snapshot.tar\"")
+			_, err := n.WriteSnapshot(out)
+			if err != nil {
+				// Headers have usually been sent by now, so the client will see a truncated archive with no manifest.
+				n.log[LogLevelWarning].Printf("WARNING: snapshot failed: %s", err.Error())
+			}
+		} else {
+			out.Header().Set("Allow", "GET")
+			apiSendObj(out, req, http.StatusMethodNotAllowed, &ErrAPI{Code: http.StatusMethodNotAllowed, Message: req.Method + " not supported for this path"})
+		}
+	})
+
+	handle("/owner/", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodGet || req.Method == http.MethodHead {
 			urlPath := req.URL.Path
@@ -342,7 +612,7 @@ func (n *Node) createHTTPServeMux() *http.ServeMux {
 		}
 	})
 
-	smux.HandleFunc("/", func(out http.ResponseWriter, req *http.Request) {
+	handle("/", APIScopeQuery, func(out http.ResponseWriter, req *http.Request) {
 		apiSetStandardHeaders(out)
 		if req.Method == http.MethodGet || req.Method == http.MethodHead {
 			apiSendObj(out, req, http.StatusNotFound, &ErrAPI{Code: http.StatusNotFound, Message: req.URL.Path + " not found"})
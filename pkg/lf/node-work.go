@@ -0,0 +1,49 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// This is the delegated work quota parts of Node, see node.go for main object. Delegated work
+// itself runs as a job (see node-jobs.go).
+
+// chargeWorkQuota counts work against a caller's hourly quota, returning ErrWorkQuotaExceeded if it would exceed it.
+func (n *Node) chargeWorkQuota(key string, quota uint64, difficulty uint32) error {
+	if quota == 0 {
+		return nil
+	}
+	hour := TimeSec() / 3600
+	n.workQuotaLock.Lock()
+	defer n.workQuotaLock.Unlock()
+	if hour != n.workQuotaHour || n.workQuotaUsed == nil {
+		n.workQuotaHour = hour
+		n.workQuotaUsed = make(map[string]uint64)
+	}
+	used := n.workQuotaUsed[key] + uint64(difficulty)
+	if used > quota {
+		return ErrWorkQuotaExceeded
+	}
+	n.workQuotaUsed[key] = used
+	return nil
+}
+
+// refundWorkQuota returns work that was charged but not done to a caller's quota.
+func (n *Node) refundWorkQuota(key string, quota uint64, difficulty uint32) {
+	if quota == 0 {
+		return
+	}
+	n.workQuotaLock.Lock()
+	if used := n.workQuotaUsed[key]; used >= uint64(difficulty) {
+		n.workQuotaUsed[key] = used - uint64(difficulty)
+	}
+	n.workQuotaLock.Unlock()
+}
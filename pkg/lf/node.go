@@ -19,6 +19,7 @@ import (
 	"container/list"
 	"crypto/ecdsa"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -34,6 +35,8 @@ import (
 	"path"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -67,13 +70,15 @@ type Node struct {
 	workFunctionLock           sync.Mutex
 	makeRecordWorkFunction     *Wharrgarblr
 	makeRecordWorkFunctionLock sync.Mutex
-	db                         db
+	db                         Store
 
 	owner        *Owner // Owner for commentary, key also currently used for ECDH on link
 	identity     []byte // Compressed public key from owner
 	identityStr  string // Identity in base62 format
 	apiAuthToken string // Secret auth token for HTTP API privileged commands
 
+	apiAuthConfig *APIAuthConfig // Additional HTTP API tokens and anonymous access settings
+
 	genesisParameters          GenesisParameters // Genesis configuration for this node's network
 	genesisOwner               OwnerPublic       // Owner of genesis record(s)
 	genesisRecords             []byte            // Genesis records concatenated together
@@ -96,6 +101,33 @@ type Node struct {
 	comments     *list.List // Accumulates commentary if commentary is enabled
 	commentsLock sync.Mutex //
 
+	watches     map[*nodeWatch]struct{} // Active watches from Watch()
+	watchesLock sync.Mutex              //
+
+	queryPolicy *QueryPolicy // If non-nil restricts and/or audits queries that reveal selector names or values
+
+	jobs       map[string]*nodeJob   // Queued, running, and recently finished jobs by ID
+	jobQueues  map[string][]*nodeJob // Queued jobs by caller
+	jobCallers []string              // Callers with queued jobs in the order in which they get turns
+	jobRunning *nodeJob              // Job currently running or nil if none
+	jobSignal  chan struct{}         // Signals job thread that a job was queued
+	jobsLock   sync.Mutex            //
+
+	workQuotaHour uint64            // Hour (since epoch) for which work quota usage is being counted
+	workQuotaUsed map[string]uint64 // Work difficulty used this hour by token or address
+	workQuotaLock sync.Mutex        //
+
+	workBenchmark     *WorkBenchmark // Benchmark of MakeRecord work function for work estimates (nil until run)
+	workBenchmarkLock sync.Mutex     //
+
+	partialPolicy      *PartialNodePolicy          // If non-nil this is a partial node that discards some record values
+	partialHorizonDoff int64                       // Data offset after which the value horizon pass resumes (maintenance thread only)
+	fetchedRecords     map[[32]byte]*fetchedRecord // Full records recently fetched from peers (partial nodes only)
+	fetchWaiters       map[[32]byte][]chan *Record // Channels waiting for records being fetched from peers
+	fetchedRecordsLock sync.Mutex                  //
+
+	metrics *nodeMetrics // Counters exported via /metrics
+
 	limboLock          sync.Mutex     // I/O lock for files in limbo/ subfolder
 	backgroundThreadWG sync.WaitGroup // used to wait for all goroutines
 	startTime          time.Time      // time node started
@@ -138,6 +170,14 @@ func NewNode(basePath string, p2pPort int, httpPort int, logger *log.Logger, log
 	n.recordsRequested = make(map[[32]byte]uintptr)
 	n.ownerCertificates = make(map[string][2][]*x509.Certificate)
 	n.comments = list.New()
+	n.watches = make(map[*nodeWatch]struct{})
+	n.jobs = make(map[string]*nodeJob)
+	n.jobQueues = make(map[string][]*nodeJob)
+	n.jobSignal = make(chan struct{}, 1)
+	n.metrics = newNodeMetrics()
+	n.fetchedRecords = make(map[[32]byte]*fetchedRecord)
+	n.fetchWaiters = make(map[[32]byte][]chan *Record)
+	n.partialHorizonDoff = -1
 	n.startTime = time.Now()
 
 	if logger == nil {
@@ -162,10 +202,11 @@ func NewNode(basePath string, p2pPort int, httpPort int, logger *log.Logger, log
 
 	n.log[LogLevelNormal].Printf("--- node starting up at %s ---", n.startTime.String())
 
-	err := n.db.open(basePath, n.log, n.handleSynchronizedRecord)
+	store, err := openStore(basePath, n.log, n.handleSynchronizedRecord)
 	if err != nil {
 		return nil, err
 	}
+	n.db = store
 
 	// Load or generate this node's identity, which is an owner that it uses to generate
 	// commentary if enabled and also a key pair for P2P key agreement.
@@ -201,11 +242,35 @@ func NewNode(basePath string, p2pPort int, httpPort int, logger *log.Logger, log
 	}
 	n.identityStr = Base62Encode(n.identity)
 
+	// Load partial.json if present, which causes this node to discard some record values.
+	n.partialPolicy, err = loadPartialNodePolicy(path.Join(basePath, PartialNodePolicyName))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", PartialNodePolicyName, err.Error())
+	}
+	if n.partialPolicy != nil {
+		n.log[LogLevelNormal].Printf("NOTICE: %s found, running as a partial node (some record values will be discarded)", PartialNodePolicyName)
+	}
+
+	// Load querypolicy.json if present, which restricts or audits queries that reveal selector names.
+	n.queryPolicy, err = loadQueryPolicy(path.Join(basePath, QueryPolicyName))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", QueryPolicyName, err.Error())
+	}
+	if n.queryPolicy != nil {
+		n.log[LogLevelNormal].Printf("NOTICE: %s found (reject names: %t, reject masking key: %t, audit names: %t)", QueryPolicyName, n.queryPolicy.RejectNames, n.queryPolicy.RejectMaskingKey, n.queryPolicy.AuditNames)
+	}
+
+	// Load workbenchmark.json if present, otherwise the first work estimate will run a benchmark.
+	n.workBenchmark, err = LoadWorkBenchmark(path.Join(basePath, WorkBenchmarkName))
+	if err != nil {
+		n.log[LogLevelWarning].Printf("WARNING: ignoring invalid %s: %s", WorkBenchmarkName, err.Error())
+	}
+
 	// Load or generate authtoken.secret for API.
 	authTokenPath := path.Join(basePath, "authtoken.secret")
 	authTokenBytes, _ := ioutil.ReadFile(authTokenPath)
-	if len(authTokenBytes) > 0 {
-		n.apiAuthToken = string(authTokenBytes)
+	if len(bytes.TrimSpace(authTokenBytes)) > 0 {
+		n.apiAuthToken = string(bytes.TrimSpace(authTokenBytes))
 	} else {
 		var junk [24]byte
 		_, _ = secureRandom.Read(junk[:])
@@ -215,6 +280,10 @@ func NewNode(basePath string, p2pPort int, httpPort int, logger *log.Logger, log
 			return nil, err
 		}
 	}
+	n.apiAuthConfig, err = loadAPIAuthConfig(path.Join(basePath, APIAuthConfigName))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", APIAuthConfigName, err.Error())
+	}
 
 	if httpPort > 0 {
 		n.httpTCPListener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: httpPort})
@@ -224,7 +293,7 @@ func NewNode(basePath string, p2pPort int, httpPort int, logger *log.Logger, log
 		n.httpServer = &http.Server{
 			MaxHeaderBytes: 4096,
 			ErrorLog:       n.log[LogLevelWarning],
-			Handler:        httpCompressionHandler(n.createHTTPServeMux()),
+			Handler:        httpCompressionHandler(n.httpMetricsHandler(n.createHTTPServeMux())),
 			IdleTimeout:    10 * time.Second,
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   600 * time.Second,
@@ -372,6 +441,10 @@ func NewNode(basePath string, p2pPort int, httpPort int, logger *log.Logger, log
 	n.backgroundThreadWG.Add(1)
 	go n.backgroundTaskReadBootstrapFile()
 
+	// Start background thread to run record creation and delegated work jobs
+	n.backgroundThreadWG.Add(1)
+	go n.backgroundThreadJobs()
+
 	// Set server's client.json URL list to point to itself
 	if n.httpTCPListener != nil {
 		clientConfigPath := path.Join(basePath, ClientConfigName)
@@ -443,7 +516,9 @@ func (n *Node) Stop() {
 		n.peers = nil
 		n.peersLock.Unlock()
 
-		n.db.close()
+		if n.db != nil {
+			n.db.close()
+		}
 
 		n.writeKnownPeers()
 
@@ -513,6 +588,33 @@ func (n *Node) Connect(ip net.IP, port int, identity []byte) error {
 // is the entry point for all but genesis records and it and the functions it calls are
 // where all record validation and commentary generating logic lives.
 func (n *Node) AddRecord(r *Record) error {
+	err := n.addRecord(r)
+	n.metrics.recordAddResult(err)
+	return err
+}
+
+// AddRecords adds multiple records, returning a result for each (duplicates are not considered errors).
+func (n *Node) AddRecords(recs []*Record) ([]AddRecordResult, error) {
+	results := make([]AddRecordResult, 0, len(recs))
+	for _, r := range recs {
+		results = append(results, n.addRecordResult(r))
+	}
+	return results, nil
+}
+
+func (n *Node) addRecordResult(r *Record) AddRecordResult {
+	if r == nil {
+		return AddRecordResult{Error: &ErrAPI{Code: http.StatusBadRequest, Message: ErrInvalidParameter.Error(), ErrTypeName: errTypeName(ErrInvalidParameter)}}
+	}
+	h := r.Hash()
+	err := n.AddRecord(r)
+	if err != nil && err != ErrDuplicateRecord {
+		return AddRecordResult{Hash: (*HashBlob)(&h), Error: &ErrAPI{Code: http.StatusBadRequest, Message: "record rejected or record import failed: " + err.Error(), ErrTypeName: errTypeName(err)}}
+	}
+	return AddRecordResult{Hash: (*HashBlob)(&h)}
+}
+
+func (n *Node) addRecord(r *Record) error {
 	if r == nil {
 		return ErrInvalidParameter
 	}
@@ -529,6 +631,16 @@ func (n *Node) AddRecord(r *Record) error {
 		return ErrRecordProhibited
 	}
 
+	// Abbreviated records can't be checked for sufficient work and are only stored locally by partial nodes.
+	if r.IsAbbreviated() {
+		return ErrRecordValueMissing
+	}
+
+	// Tombstones are meaningless without selectors to retract.
+	if r.Type == RecordTypeDelete && len(r.Selectors) == 0 {
+		return ErrRecordInvalid
+	}
+
 	// Is value too big?
 	if uint(r.ValueDataSize()) > n.genesisParameters.RecordMaxValueSize {
 		return ErrRecordValueTooLarge
@@ -560,6 +672,11 @@ func (n *Node) AddRecord(r *Record) error {
 		return ErrRecordNotApproved
 	}
 
+	// Partial nodes store only the hash of values they don't want to keep.
+	if n.partialPolicy != nil && !n.partialPolicy.keepValue(r, TimeSec()) {
+		r = r.abbreviated()
+	}
+
 	// Add record to database if it passes all checks
 	err = n.db.putRecord(r)
 	if err != nil {
@@ -578,7 +695,15 @@ func (n *Node) GetRecord(hash []byte) (*Record, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewRecordFromBytes(data)
+	rec, err := NewRecordFromBytes(data)
+	if err == nil && rec.IsAbbreviated() {
+		var h [32]byte
+		copy(h[:], hash)
+		if fr := n.fetchRecord(h, partialNodeFetchTimeout); fr != nil {
+			return fr, nil
+		}
+	}
+	return rec, err
 }
 
 // SetCommentaryEnabled sets whether or not background CPU power is used to render commentary.
@@ -631,8 +756,7 @@ func (n *Node) GetOwnerCertificates(owner OwnerPublic) (certs []*x509.Certificat
 	// since root CAs are not themselves stored directly in the DAG as Certificate records.
 	for _, rootCert := range rootsBySerialNo {
 		if (rootCert.KeyUsage & x509.KeyUsageDigitalSignature) != 0 {
-			pub, _ := rootCert.PublicKey.(*ecdsa.PublicKey)
-			ownerPub, _ := NewOwnerPublicFromECDSAPublicKey(pub)
+			ownerPub, _ := NewOwnerPublicFromPublicKey(rootCert.PublicKey)
 			if bytes.Equal(ownerPub, owner) {
 				certs = append(certs, rootCert)
 			}
@@ -640,8 +764,7 @@ func (n *Node) GetOwnerCertificates(owner OwnerPublic) (certs []*x509.Certificat
 	}
 	for _, rootCert := range revokedRootsBySerialNo {
 		if (rootCert.KeyUsage & x509.KeyUsageDigitalSignature) != 0 {
-			pub, _ := rootCert.PublicKey.(*ecdsa.PublicKey)
-			ownerPub, _ := NewOwnerPublicFromECDSAPublicKey(pub)
+			ownerPub, _ := NewOwnerPublicFromPublicKey(rootCert.PublicKey)
 			if bytes.Equal(ownerPub, owner) {
 				revokedCerts = append(certs, rootCert)
 			}
@@ -787,6 +910,8 @@ func (n *Node) NodeStatus() (*NodeStatus, error) {
 		Oracle:            oracle,
 		P2PPort:           n.p2pPort,
 		LocalTestMode:     n.localTest,
+		PartialNode:       n.partialPolicy != nil,
+		QueryPolicy:       n.queryPolicy,
 		Identity:          n.identity,
 		Peers:             peers,
 	}, nil
@@ -853,14 +978,103 @@ func (n *Node) ExecuteQuery(query *Query) (QueryResults, error) {
 	return query.execute(n)
 }
 
+// ExecuteAggregateQuery executes a query with an Aggregate against this local node.
+func (n *Node) ExecuteAggregateQuery(query *Query) (*QueryAggregate, error) {
+	return query.aggregate(n)
+}
+
+// ExecuteQueries executes multiple queries against this local node.
+func (n *Node) ExecuteQueries(queries []*Query) ([]QueryBatchResult, error) {
+	results := make([]QueryBatchResult, 0, len(queries))
+	for _, q := range queries {
+		if q == nil {
+			results = append(results, QueryBatchResult{Error: &ErrAPI{Code: http.StatusBadRequest, Message: "query failed: " + ErrInvalidParameter.Error(), ErrTypeName: errTypeName(ErrInvalidParameter)}})
+			continue
+		}
+		if len(q.Aggregate) > 0 {
+			qa, err := q.aggregate(n)
+			if err != nil {
+				results = append(results, QueryBatchResult{Error: &ErrAPI{Code: http.StatusBadRequest, Message: "query failed: " + err.Error(), ErrTypeName: errTypeName(err)}})
+			} else {
+				results = append(results, QueryBatchResult{Aggregate: qa})
+			}
+			continue
+		}
+		qr, err := q.execute(n)
+		if err != nil {
+			results = append(results, QueryBatchResult{Error: &ErrAPI{Code: http.StatusBadRequest, Message: "query failed: " + err.Error(), ErrTypeName: errTypeName(err)}})
+		} else {
+			results = append(results, QueryBatchResult{Results: qr})
+		}
+	}
+	return results, nil
+}
+
 // ExecuteMakeRecord executes a MakeRecord against this local node.
+// It runs as a job, taking turns with jobs submitted via the HTTP API.
 func (n *Node) ExecuteMakeRecord(mr *MakeRecord) (*Record, Pulse, bool, error) {
-	return mr.execute(n)
+	s, err := n.runJob(JobTypeMakeRecord, "", APIScopeMakeRecord, mr.runJob(n), nil, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return s.Record, s.Pulse, s.Accepted, nil
+}
+
+// ExecuteWork executes a WorkRequest against this local node.
+// Quotas do not apply since they're for HTTP API callers.
+func (n *Node) ExecuteWork(m *WorkRequest) (*WorkResult, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	s, err := n.runJob(JobTypeWork, "", APIScopeWork, m.runJob(n), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.Work, nil
 }
 
 // ExecuteMakePulse executes a MakePulse against this local node.
 func (n *Node) ExecuteMakePulse(mr *MakePulse) (Pulse, *Record, bool, error) {
-	return mr.execute(n)
+	s, err := n.runJob(JobTypeMakePulse, "", APIScopeMakeRecord, mr.runJob(n), nil, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return s.Pulse, s.Record, s.Accepted, nil
+}
+
+// WorkEstimate estimates how long this node takes to compute proof of work for records of a given size.
+// If the node's work function hasn't been benchmarked yet a benchmark is run first, which takes a while.
+func (n *Node) WorkEstimate(bytes uint) (*WorkEstimate, error) {
+	if bytes == 0 || bytes > RecordMaxSize {
+		return nil, ErrInvalidParameter
+	}
+	wf := n.getMakeRecordWorkFunction()
+	n.workBenchmarkLock.Lock()
+	b := n.workBenchmark
+	n.workBenchmarkLock.Unlock()
+	if b == nil || !b.Matches(wf) {
+		_, err := n.runJob(JobTypeBenchmark, "", APIScopeMakeRecord, func(*JobStatus, func() bool) error {
+			n.workBenchmarkLock.Lock()
+			b = n.workBenchmark
+			n.workBenchmarkLock.Unlock()
+			if b != nil && b.Matches(wf) { // another benchmark job finished while this one was queued
+				return nil
+			}
+			nb, err := BenchmarkWharrgarblr(wf, WorkBenchmarkDefaultDuration)
+			if err != nil {
+				return err
+			}
+			n.workBenchmarkLock.Lock()
+			n.workBenchmark = nb
+			n.workBenchmarkLock.Unlock()
+			b = nb
+			return nb.Save(path.Join(n.basePath, WorkBenchmarkName))
+		}, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Estimate(bytes), nil
 }
 
 // IsLocal implements IsLocal in the LF interface, always returns true for Node.
@@ -877,7 +1091,9 @@ func (n *Node) DoPulse(pulse Pulse, announce bool) (bool, error) {
 		if key != 0 {
 			minutes := pulse.Minutes()
 			startRangeMid := TimeSec() - uint64(minutes*60)
-			if n.db.updatePulse(pulse.Token(), uint64(minutes), startRangeMid-uint64(n.genesisParameters.RecordMaxTimeDrift), startRangeMid+uint64(n.genesisParameters.RecordMaxTimeDrift)) {
+			token := pulse.Token()
+			if n.db.updatePulse(token, uint64(minutes), startRangeMid-uint64(n.genesisParameters.RecordMaxTimeDrift), startRangeMid+uint64(n.genesisParameters.RecordMaxTimeDrift)) {
+				n.notifyWatchesOfPulse(token)
 				if announce {
 					var msg [PulseSize + 1]byte
 					msg[0] = p2pProtoMessageTypePulse
@@ -1028,11 +1244,14 @@ func (n *Node) handleSynchronizedRecord(doff uint64, dlen uint, reputation int,
 					}
 				}
 
+				// Wake up any watches on selector ranges that include this record.
+				n.notifyWatchesOfRecord(r)
+
 				// If record is of good reputation, announce that we have it to peers. Low reputation records
 				// are not announced, but peers can still request them. This causes them to propagate more
 				// slowly, increasing the odds of other less synchronized nodes also flagging them as
 				// suspect for temporal heuristic reasons.
-				if reputation >= dbReputationDefault {
+				if reputation >= dbReputationDefault && !r.IsAbbreviated() {
 					var msg [33]byte
 					msg[0] = p2pProtoMessageTypeHaveRecords
 					copy(msg[1:], hash[:])
@@ -1118,15 +1337,28 @@ func (n *Node) backgroundThreadMaintenance() {
 					}
 				}
 				n.recordsRequestedLock.Unlock()
+
+				n.fetchedRecordsLock.Lock()
+				for h, fr := range n.fetchedRecords {
+					if (ticker - fr.ticker) > 300 {
+						delete(n.fetchedRecords, h)
+					}
+				}
+				n.fetchedRecordsLock.Unlock()
 			}
 
 			// Announce some recent records to help keep nodes in sync during periods of low activity
+			// (this is also the only catch-up mechanism for older peers that don't reconcile)
 			if (ticker % 10) == 7 {
 				_, links, err := n.db.getLinks(2)
-				if err == nil && len(links) >= 32 {
-					hr := make([]byte, 1, 1+len(links))
-					hr[0] = p2pProtoMessageTypeHaveRecords
-					hr = append(hr, links...)
+				hr := make([]byte, 1, 1+len(links))
+				hr[0] = p2pProtoMessageTypeHaveRecords
+				for i := 0; err == nil && (i+32) <= len(links); i += 32 {
+					if n.canSendRecord(links[i : i+32]) {
+						hr = append(hr, links[i:i+32]...)
+					}
+				}
+				if len(hr) > 1 {
 					n.peersLock.RLock()
 					for _, p := range n.peers {
 						p.send(hr)
@@ -1135,6 +1367,15 @@ func (n *Node) backgroundThreadMaintenance() {
 				}
 			}
 
+			// Reconcile records with a random peer to catch anything missed by announcements
+			if (ticker % 30) == 7 {
+				n.peersLock.RLock()
+				if len(n.peers) > 0 {
+					n.peers[rand.Int()%len(n.peers)].startReconciliation()
+				}
+				n.peersLock.RUnlock()
+			}
+
 			// Peroidically clean and write peers.json
 			if (ticker % 120) == 11 {
 				n.writeKnownPeers()
@@ -1149,41 +1390,39 @@ func (n *Node) backgroundThreadMaintenance() {
 				n.requestWantedRecords(0, 0)
 			}
 
-			// If we don't have enough connections, try to make more to peers we've learned about.
+			// If we don't have enough connections, try to make more to the best peers we've learned
+			// about. Seed peers are tried if there are no eligible known peers and nothing is connected.
 			if (ticker % 10) == 1 {
-				n.peersLock.RLock()
-				if len(n.peers) < p2pDesiredConnectionCount {
-					n.knownPeersLock.Lock()
-					if len(n.knownPeers) > 0 {
-						now := TimeSec()
-					tryKnownPeers:
-						for _, kp := range n.knownPeers { // exploits Go's random map iteration order
-							if (now-kp.LastReconnectionAttempt) < p2pPeerAttemptInterval || (now-kp.LastReconnectionAttempt) > (p2pPeerAttemptInterval*uint64(len(n.knownPeers))) {
-								for _, cp := range n.peers {
-									if bytes.Equal(cp.identity, kp.Identity) {
-										continue tryKnownPeers
-									}
-								}
-								kp.LastReconnectionAttempt = now
-								kp.TotalReconnectionAttempts++
-								_ = n.Connect(kp.IP, kp.Port, kp.Identity)
-								break
-							}
-						}
-					} else {
-						var sp []Peer
-						if bytes.Equal(SolNetworkID[:], n.genesisParameters.ID[:]) {
+				if n.ConnectedPeerCount() < p2pDesiredConnectionCount {
+					if !n.p2pConnectToBestPeer() && n.ConnectedPeerCount() == 0 {
+						sp := n.genesisParameters.SeedPeers
+						if len(sp) == 0 && bytes.Equal(SolNetworkID[:], n.genesisParameters.ID[:]) {
 							sp = SolSeedPeers
 						}
 						if len(sp) > 0 {
 							spp := &sp[rand.Int()%len(sp)]
-							_ = n.Connect(spp.IP, spp.Port, spp.Identity)
+							if !bytes.Equal(spp.Identity, n.identity) {
+								_ = n.Connect(spp.IP, spp.Port, spp.Identity)
+							}
 						}
 					}
-					n.knownPeersLock.Unlock()
 				}
-				n.peersLock.RUnlock()
 			}
+
+			// Ask a peer for more peers if we still don't have enough connections.
+			if (ticker%60) == 21 && n.ConnectedPeerCount() < p2pDesiredConnectionCount {
+				n.p2pRequestPeers()
+			}
+
+			// Close a connection if we have too many (e.g. due to lots of inbound connections).
+			if (ticker % 10) == 6 {
+				n.p2pEvictPeer()
+			}
+		}
+
+		// Partial nodes discard values of stored records as they pass the value horizon.
+		if (ticker%10) == 9 && n.partialPolicy != nil && n.partialPolicy.ValueHorizon > 0 {
+			n.partialHorizonDoff = n.applyValueHorizon(n.partialHorizonDoff)
 		}
 
 		// Periodically check and update database full sync state.
@@ -1352,24 +1591,60 @@ func (n *Node) backgroundTaskProcessRecordsInLimbo(ownerPublic OwnerPublic) {
 func (n *Node) backgroundTaskReadBootstrapFile() {
 	defer n.backgroundThreadWG.Done()
 
+	// Import progress is saved to bootstrap.lf.offset so an import interrupted by shutdown resumes where it left off.
 	bootstrapFilePath := path.Join(n.basePath, "bootstrap.lf")
+	bootstrapOffsetPath := bootstrapFilePath + ".offset"
 	bootstrapFile, _ := os.Open(bootstrapFilePath)
 	if bootstrapFile != nil {
 		defer func() {
 			_ = bootstrapFile.Close()
 			if atomic.LoadUint32(&n.shutdown) == 0 {
 				_ = os.Remove(bootstrapFilePath)
+				_ = os.Remove(bootstrapOffsetPath)
 			}
 		}()
-		n.log[LogLevelNormal].Printf("sync: found bootstrap.lf, importing records...")
-		var count uint64
+
+		var offset uint64
+		if offsetStr, _ := ioutil.ReadFile(bootstrapOffsetPath); len(offsetStr) > 0 {
+			offset, _ = strconv.ParseUint(strings.TrimSpace(string(offsetStr)), 10, 64)
+			if _, err := bootstrapFile.Seek(int64(offset), io.SeekStart); err != nil {
+				offset = 0
+				_, _ = bootstrapFile.Seek(0, io.SeekStart)
+			}
+		}
+		if offset > 0 {
+			n.log[LogLevelNormal].Printf("sync: found bootstrap.lf, resuming import at byte %d...", offset)
+		} else {
+			n.log[LogLevelNormal].Printf("sync: found bootstrap.lf, importing records...")
+		}
+
+		// Bootstrap files copied from a partial node's records.lf may contain gaps and abbreviated records.
+		// Gaps are skipped, and so are abbreviated records since they can't be verified without their values.
+		br := bufio.NewReaderSize(bootstrapFile, 1048576)
+		in := CountingReader{R: br}
+		var count, skipped uint64
 		for atomic.LoadUint32(&n.shutdown) == 0 {
 			var rec Record
-			if rec.UnmarshalFrom(bootstrapFile) == nil {
+			if rec.UnmarshalFrom(&in) == nil {
+				if next, _ := br.Peek(1); len(next) == 1 && next[0] == recordDataGapMarker {
+					var gh [recordDataGapHeaderSize]byte
+					if _, err := io.ReadFull(&in, gh[:]); err != nil {
+						break
+					}
+					gapSize := int64(binary.BigEndian.Uint32(gh[1:]))
+					if c, _ := io.CopyN(ioutil.Discard, &in, gapSize); c != gapSize {
+						break
+					}
+				}
+				if rec.IsAbbreviated() {
+					skipped++
+					continue
+				}
 				rh := rec.Hash()
 				_ = n.addRemoteRecord(rec.Bytes(), rh[:], &rec, bootstrapFilePath)
 				count++
 				if (count % 1024) == 0 {
+					_ = ioutil.WriteFile(bootstrapOffsetPath, []byte(strconv.FormatUint(offset+in.N, 10)), 0644)
 					n.log[LogLevelNormal].Printf("sync: imported %d records from bootstrap file", count)
 				}
 			} else {
@@ -1377,6 +1652,9 @@ func (n *Node) backgroundTaskReadBootstrapFile() {
 				break
 			}
 		}
+		if skipped > 0 {
+			n.log[LogLevelWarning].Printf("WARNING: skipped %d records with discarded values in bootstrap file (was it copied from a partial node?)", skipped)
+		}
 	}
 }
 
@@ -15,6 +15,7 @@ package lf
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/sha256"
@@ -115,6 +116,20 @@ func NewOwnerPublicFromECDSAPublicKey(pub *ecdsa.PublicKey) (OwnerPublic, error)
 	return OwnerPublic(oh), nil
 }
 
+// NewOwnerPublicFromPublicKey creates an OwnerPublic from an ECDSA or ed25519 public key (e.g. from an x509 certificate).
+func NewOwnerPublicFromPublicKey(pub crypto.PublicKey) (OwnerPublic, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return NewOwnerPublicFromECDSAPublicKey(k)
+	case ed25519.PublicKey:
+		if len(k) != ed25519.PublicKeySize {
+			return nil, ErrInvalidParameter
+		}
+		return OwnerPublic(append([]byte{}, k...)), nil
+	}
+	return nil, ErrUnsupportedType
+}
+
 // String returns @base62 owner
 func (o OwnerPublic) String() string { return "@" + Base62Encode(o) }
 
@@ -253,6 +268,29 @@ func NewOwnerFromECDSAPrivateKey(key *ecdsa.PrivateKey) (*Owner, error) {
 	return &Owner{Private: key, Public: oh}, nil
 }
 
+// NewOwnerFromEd25519PrivateKey creates an owner from an ed25519 private key.
+func NewOwnerFromEd25519PrivateKey(key ed25519.PrivateKey) (*Owner, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidPrivateKey
+	}
+	priv := make(ed25519.PrivateKey, ed25519.PrivateKeySize)
+	copy(priv, key)
+	return &Owner{Private: &priv, Public: OwnerPublic(priv[32:])}, nil
+}
+
+// NewOwnerFromPrivateKey creates an owner from an ECDSA or ed25519 private key such as one parsed from a PKCS#8 PEM file.
+func NewOwnerFromPrivateKey(key crypto.PrivateKey) (*Owner, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return NewOwnerFromECDSAPrivateKey(k)
+	case ed25519.PrivateKey:
+		return NewOwnerFromEd25519PrivateKey(k)
+	case *ed25519.PrivateKey:
+		return NewOwnerFromEd25519PrivateKey(*k)
+	}
+	return nil, ErrUnsupportedType
+}
+
 // NewOwnerFromSeed creates a new owner whose key pair is generated using deterministic randomness from the given seed.
 func NewOwnerFromSeed(ownerType byte, seed []byte) (*Owner, error) {
 	var prng seededPrng
@@ -430,10 +468,21 @@ func (o *Owner) Verify(hash, sig []byte) (verdict bool) {
 	return
 }
 
+// x509Signer returns this owner's private key in the form expected by crypto/x509.
+func (o *Owner) x509Signer() (crypto.Signer, error) {
+	switch k := o.Private.(type) {
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case *ed25519.PrivateKey:
+		return *k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, ErrPrivateKeyRequired
+}
+
 // CreateCSR creates a CSR (certificate signing request) for an Owner.
-// The owner must contain its Private key. Currently only P224 and P384 type
-// owners can have CSRs generated for them. When GoLang x509 gets EDDSA support
-// then support for ed25519 CSRs will be added. The supplied subject is used
+// The owner must contain its Private key. The supplied subject is used
 // as a template but its SerialNumber will always be set to the Base62 encoded
 // owner public value (minus the leading @).
 func (o *Owner) CreateCSR(subject *pkix.Name) ([]byte, error) {
@@ -446,20 +495,27 @@ func (o *Owner) CreateCSR(subject *pkix.Name) ([]byte, error) {
 		sa = x509.ECDSAWithSHA256
 	case OwnerTypeNistP384:
 		sa = x509.ECDSAWithSHA384
+	case OwnerTypeEd25519:
+		sa = x509.PureEd25519
 	default:
 		return nil, ErrUnsupportedType
 	}
+	priv, err := o.x509Signer()
+	if err != nil {
+		return nil, err
+	}
 	tmpl := x509.CertificateRequest{
 		SignatureAlgorithm: sa,
 		Subject:            *subject,
 	}
 	tmpl.Subject.SerialNumber = Base62Encode(o.Public)
-	return x509.CreateCertificateRequest(secureRandom, &tmpl, o.Private)
+	return x509.CreateCertificateRequest(secureRandom, &tmpl, priv)
 }
 
 // CreateOwnerCertificate generates a certificate for an owner from an owner CSR.
 // The CSR is validated and the auth certificate is checked to ensure that it has
-// the proper key usage flags.
+// the proper key usage flags. The auth private key may be an ECDSA or ed25519 key.
+// Ed25519 keys may be either ed25519.PrivateKey or *ed25519.PrivateKey (as in Owner).
 func CreateOwnerCertificate(recordLinks [][32]byte, recordWorkFunction *Wharrgarblr, recordOwner *Owner, ownerCertificateRequest *x509.CertificateRequest, ttl time.Duration, authCertificate *x509.Certificate, authPrivateKey interface{}) (*Record, error) {
 	err := ownerCertificateRequest.CheckSignature()
 	if err != nil {
@@ -470,6 +526,10 @@ func CreateOwnerCertificate(recordLinks [][32]byte, recordWorkFunction *Wharrgar
 		return nil, errors.New("auth certificate is not a root or intermediate CA certificate")
 	}
 
+	if k, isPtr := authPrivateKey.(*ed25519.PrivateKey); isPtr && k != nil {
+		authPrivateKey = *k
+	}
+
 	var randomSerial [32]byte
 	_, _ = secureRandom.Read(randomSerial[:])
 	now := time.Now().UTC()
@@ -481,7 +541,7 @@ func CreateOwnerCertificate(recordLinks [][32]byte, recordWorkFunction *Wharrgar
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
 		BasicConstraintsValid: true,
 		IsCA:                  false,
-	}, authCertificate, authCertificate.PublicKey, authPrivateKey)
+	}, authCertificate, ownerCertificateRequest.PublicKey, authPrivateKey)
 	if err != nil {
 		return nil, err
 	}
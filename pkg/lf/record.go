@@ -32,6 +32,7 @@ const (
 	//   4-8   - link count (0...15)
 	//   8-12  - record type (0...15)
 	//  12-63  - additional boolean flags
+	// Bit 3 must stay clear since gaps in records.lf on partial nodes rely on it (see recordDataGapMarker).
 	recordBodyFlagHasValue           uint64 = 0x1
 	recordBodyFlagHasPulseToken      uint64 = 0x2
 	recordBodyFlagValueIsHash        uint64 = 0x4
@@ -91,9 +92,9 @@ const (
 	// This is a protocol constant and can't be changed.
 	RecordTypeCRL = 4
 
-	// RecordTypeDelete is a record that hides all other records by the same owner.
+	// RecordTypeDelete is a tombstone that hides all earlier records by the same owner with the same selectors.
 	// This is a protocol constant and can't be changed.
-	// RecordTypeDelete = 15 // reserved, not implemented yet
+	RecordTypeDelete = 15
 
 	// RecordCertificateMaskingKey is the masking key for certs and CRLs (used as byte array).
 	// This is a protocol constant and can't be changed.
@@ -297,7 +298,7 @@ func (rb *recordBody) marshalTo(w io.Writer, hashAsProxyForValue bool) error {
 		return err
 	}
 
-	if len(rb.Value) > 0 {
+	if len(rb.Value) > 0 || len(rb.ValueHash) == 48 {
 		if hashAsProxyForValue {
 			if len(rb.ValueHash) == 48 {
 				if _, err := w.Write(rb.ValueHash); err != nil {
@@ -468,8 +469,8 @@ func (r *Record) UnmarshalFrom(rdr io.Reader) error {
 
 // MarshalTo writes this record in serialized form to the supplied writer.
 // If hashAsProxyForValue is true SHA384(value) is stored in the stream instead
-// of the actual value. These streams can't (currently) be unmarshaled and are
-// only used to compute further hashes.
+// of the actual value. These streams unmarshal into abbreviated records that have
+// ValueHash instead of Value and are used to compute hashes and by partial nodes.
 func (r *Record) MarshalTo(w io.Writer, hashAsProxyForValue bool) error {
 	if len(r.Selectors) > 0xf || r.WorkAlgorithm < 0 || r.WorkAlgorithm > 0xf {
 		return ErrRecordInvalid
@@ -502,6 +503,28 @@ func (r *Record) MarshalTo(w io.Writer, hashAsProxyForValue bool) error {
 	return nil
 }
 
+// IsAbbreviated returns true if this record's value has been replaced by its hash (see Hash()).
+// Abbreviated records have the same hash and signature as their full versions but lack a value.
+func (r *Record) IsAbbreviated() bool { return len(r.ValueHash) == 48 }
+
+// abbreviated returns a copy of this record with its value replaced by SHA384(value).
+// Records without a value are returned as-is since there is nothing to discard.
+func (r *Record) abbreviated() *Record {
+	if len(r.Value) == 0 {
+		return r
+	}
+	ar := *r
+	vh := sha512.Sum384(r.Value)
+	ar.Value = nil
+	ar.ValueHash = vh[:]
+	return &ar
+}
+
+// recordDataIsAbbreviated checks the flags at the start of a serialized record to see if it's abbreviated.
+func recordDataIsAbbreviated(b []byte) bool {
+	return len(b) > 0 && (uint64(b[0])&recordBodyFlagValueIsHash) != 0
+}
+
 // NewRecordFromBytes deserializes a record from a byte array.
 func NewRecordFromBytes(b []byte) (r *Record, err error) {
 	r = new(Record)
@@ -754,6 +777,26 @@ func (rb *RecordBuilder) Start(recordType int, value []byte, links [][32]byte, m
 	return nil
 }
 
+// Resume continues building a record from an unsigned record such as one obtained from Record().
+// This allows work and signing to take place on different machines, since a serialized unsigned
+// record contains everything needed to compute work and sign. Any existing signature is discarded.
+func (rb *RecordBuilder) Resume(r *Record) error {
+	if r == nil || len(r.recordBody.Owner) == 0 || r.IsAbbreviated() {
+		return ErrInvalidParameter
+	}
+	nr := *r
+	nr.Signature = nil
+	nr.hash = nil
+	nr.id = nil
+	rb.record = &nr
+	rb.workHash, rb.workBillableBytes = nr.workHash()
+	return nil
+}
+
+// Record returns the record being built or nil if Start() or Resume() have not been called.
+// The record is unsigned until Complete() is called and should not be modified.
+func (rb *RecordBuilder) Record() *Record { return rb.record }
+
 // AddWork actually computes the work and sets the Work field in the RecordBuilder.
 // This doesn't need to be called if there is no work to be done, e.g. an auth signature only record.
 // The minWorkFunctionDifficulty parameter can be used if you want to do extra work to altruistically
@@ -774,6 +817,24 @@ func (rb *RecordBuilder) AddWork(workFunction *Wharrgarblr, minWorkFunctionDiffi
 	return nil
 }
 
+// WorkHash returns the hash over which proof of work is computed or nil if Start() or Resume() have not been called.
+// It can be sent to a node in a WorkRequest to delegate work without revealing the record or its owner's key.
+func (rb *RecordBuilder) WorkHash() []byte { return rb.workHash }
+
+// WorkDifficulty returns the minimum Wharrgarbl difficulty required to pay for the record being built.
+func (rb *RecordBuilder) WorkDifficulty() uint32 { return recordWharrgarblCost(rb.workBillableBytes) }
+
+// SetWork sets proof of work computed elsewhere, such as by a node in response to a WorkRequest.
+// ErrRecordInsufficientWork is returned if the work is not valid or not enough to pay for this record.
+func (rb *RecordBuilder) SetWork(work []byte) error {
+	if rb.record == nil || WharrgarblVerify(work, rb.workHash) < rb.WorkDifficulty() {
+		return ErrRecordInsufficientWork
+	}
+	rb.record.Work = append([]byte(nil), work...)
+	rb.record.WorkAlgorithm = RecordWorkAlgorithmWharrgarbl
+	return nil
+}
+
 // Complete computes the signing hash, signs the record, and returns a pointer to completed record on success.
 // It must be supplied with an Owner containing a full private key as well as public information.
 func (rb *RecordBuilder) Complete(owner *Owner) (*Record, error) {
@@ -14,6 +14,7 @@
 package lf
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
@@ -27,11 +28,88 @@ import (
 	"time"
 )
 
+// APIMaxBatchQueries is the maximum number of queries in one /query/batch request.
+const APIMaxBatchQueries = 256
+
+// APIMaxBatchRecords is the maximum number of records in one /post?batch request.
+const APIMaxBatchRecords = 1024
+
+// APIMaxBatchPostSize is the maximum size in bytes of the body of one /post?batch request.
+const APIMaxBatchPostSize = 16777216
+
 // APIMaxResponseSize is a sanity limit on the maximum size of a response from the LF HTTP API (can be increased)
 const APIMaxResponseSize = 4194304
 
 var httpClient = http.Client{Timeout: time.Second * 30}
 
+// httpWorkClient is used for delegated work, which can take as long as the node's HTTP write timeout.
+var httpWorkClient = http.Client{Timeout: time.Second * 600}
+
+// httpStreamClient is used for long-lived streaming requests like watches and has no overall timeout.
+var httpStreamClient = http.Client{}
+
+// httpDownloadClient is used for bulk downloads, which have no overall timeout but must connect and respond promptly.
+var httpDownloadClient = http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// httpDownloadIdleTimeout is how long a bulk download may stall before it's aborted.
+const httpDownloadIdleTimeout = 60 * time.Second
+
+// idleTimeoutReadCloser closes a response body if no data arrives from it for longer than a timeout.
+type idleTimeoutReadCloser struct {
+	body    io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleTimeoutReadCloser(body io.ReadCloser, timeout time.Duration) *idleTimeoutReadCloser {
+	return &idleTimeoutReadCloser{
+		body:    body,
+		timer:   time.AfterFunc(timeout, func() { _ = body.Close() }),
+		timeout: timeout,
+	}
+}
+
+// Read implements io.Reader
+func (r *idleTimeoutReadCloser) Read(b []byte) (int, error) {
+	n, err := r.body.Read(b)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+// Close implements io.Closer
+func (r *idleTimeoutReadCloser) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// apiNewRequest creates an HTTP request to a node, sending the password in the URL's user info (if any) as a bearer token.
+func apiNewRequest(method, urlStr string, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	var token string
+	if u.User != nil {
+		token, _ = u.User.Password()
+		u.User = nil
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
 func apiRequest(url string, m interface{}) ([]byte, error) {
 	var requestBody io.Reader
 	requestBody = http.NoBody
@@ -45,12 +123,22 @@ func apiRequest(url string, m interface{}) ([]byte, error) {
 		requestBody = bytes.NewReader(msgJSON)
 	}
 
-	req, err := http.NewRequest(method, url, requestBody)
+	req, err := apiNewRequest(method, url, requestBody)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Accept-Encoding", "gzip")
-	resp, err := httpClient.Do(req)
+	return apiDo(req)
+}
+
+// apiDo performs a request and returns its (decompressed) body or an ErrAPI if the response is not 200 OK.
+func apiDo(req *http.Request) ([]byte, error) {
+	return apiDoWithClient(&httpClient, req)
+}
+
+// apiDoWithClient is apiDo with a specific HTTP client.
+func apiDoWithClient(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -102,9 +190,29 @@ func NewRemoteNode(urlStr string) (RemoteNode, error) {
 	return RemoteNode(upstr), nil
 }
 
+// WithAuthToken returns this remote node's URL with an API auth token embedded as the password in its user info.
+// Requests to the returned RemoteNode send this token as a bearer token. An empty token removes any existing token.
+func (rn RemoteNode) WithAuthToken(token string) RemoteNode {
+	u, err := url.Parse(string(rn))
+	if err != nil {
+		return rn
+	}
+	if len(token) > 0 {
+		u.User = url.UserPassword("", token)
+	} else {
+		u.User = nil
+	}
+	return RemoteNode(u.String())
+}
+
 // AddRecord submits this record for addition to the data store.
 func (rn RemoteNode) AddRecord(rec *Record) error {
-	resp, err := httpClient.Post(string(rn)+"/post", "application/octet-stream", bytes.NewReader(rec.Bytes()))
+	req, err := apiNewRequest("POST", string(rn)+"/post", bytes.NewReader(rec.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -132,6 +240,50 @@ func (rn RemoteNode) AddRecord(rec *Record) error {
 	return nil
 }
 
+// AddRecords submits multiple records, sending them in batches of concatenated binary records.
+func (rn RemoteNode) AddRecords(recs []*Record) ([]AddRecordResult, error) {
+	results := make([]AddRecordResult, 0, len(recs))
+	for len(recs) > 0 {
+		// Add records to this batch until it's full or the next record would make it too big.
+		var body bytes.Buffer
+		var rb bytes.Buffer
+		count := 0
+		for count < len(recs) && count < APIMaxBatchRecords {
+			if recs[count] == nil {
+				return nil, ErrInvalidParameter
+			}
+			rb.Reset()
+			err := recs[count].MarshalTo(&rb, false)
+			if err != nil {
+				return nil, err
+			}
+			if count > 0 && body.Len()+rb.Len() > APIMaxBatchPostSize {
+				break
+			}
+			_, _ = body.Write(rb.Bytes())
+			count++
+		}
+		recs = recs[count:]
+		req, err := apiNewRequest("POST", string(rn)+"/post?batch=1", &body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Add("Accept-Encoding", "gzip")
+		respBody, err := apiDo(req)
+		if err != nil {
+			return nil, err
+		}
+		var br []AddRecordResult
+		err = json.Unmarshal(respBody, &br)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, br...)
+	}
+	return results, nil
+}
+
 // GetRecord looks up a record by its exact hash.
 func (rn RemoteNode) GetRecord(hash []byte) (*Record, error) {
 	if len(hash) == 32 {
@@ -190,7 +342,11 @@ func (rn RemoteNode) Links(count int) ([][32]byte, uint64, error) {
 	if count > 0 {
 		u = u + "?count=" + strconv.FormatUint(uint64(count), 10)
 	}
-	resp, err := httpClient.Get(u)
+	req, err := apiNewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -218,6 +374,11 @@ func (rn RemoteNode) Links(count int) ([][32]byte, uint64, error) {
 
 // ExecuteQuery executes a query against this remote node.
 func (rn RemoteNode) ExecuteQuery(q *Query) (QueryResults, error) {
+	if len(q.Aggregate) > 0 { // the node would return an aggregate instead of results
+		q2 := *q
+		q2.Aggregate = ""
+		q = &q2
+	}
 	body, err := apiRequest(string(rn)+"/query", q)
 	if err != nil {
 		return nil, err
@@ -230,12 +391,239 @@ func (rn RemoteNode) ExecuteQuery(q *Query) (QueryResults, error) {
 	return qr, nil
 }
 
+// ExecuteAggregateQuery executes a query with an Aggregate against this remote node.
+func (rn RemoteNode) ExecuteAggregateQuery(q *Query) (*QueryAggregate, error) {
+	if len(q.Aggregate) == 0 {
+		return nil, ErrQueryInvalidAggregate
+	}
+	body, err := apiRequest(string(rn)+"/query", q)
+	if err != nil {
+		return nil, err
+	}
+	var qa QueryAggregate
+	err = json.Unmarshal(body, &qa)
+	if err != nil {
+		return nil, err
+	}
+	return &qa, nil
+}
+
+// ExecuteQueries executes multiple queries against this remote node in one request.
+func (rn RemoteNode) ExecuteQueries(queries []*Query) ([]QueryBatchResult, error) {
+	results := make([]QueryBatchResult, 0, len(queries))
+	for len(queries) > 0 {
+		batch := queries
+		if len(batch) > APIMaxBatchQueries {
+			batch = batch[0:APIMaxBatchQueries]
+		}
+		queries = queries[len(batch):]
+
+		body, err := apiRequest(string(rn)+"/query/batch", batch)
+		if err != nil {
+			return nil, err
+		}
+		var br []QueryBatchResult
+		err = json.Unmarshal(body, &br)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, br...)
+	}
+	return results, nil
+}
+
+// remoteWatchMinRetryDelay and remoteWatchMaxRetryDelay bound the delay before a closed watch is re-established.
+// The delay doubles each time a stream ends quickly and resets once one lasts at least the maximum delay.
+const (
+	remoteWatchMinRetryDelay = time.Second
+	remoteWatchMaxRetryDelay = time.Minute
+)
+
+// Watch executes a query against this remote node and calls f with new results whenever they change.
+// If the node closes the stream (e.g. due to a server write timeout) the watch is transparently re-established
+// after a delay, and results identical to the last ones passed to f are not passed again.
+func (rn RemoteNode) Watch(q *Query, f func(QueryResults) bool) error {
+	var last []byte
+	delay := remoteWatchMinRetryDelay
+	for {
+		started := time.Now()
+		stopped, err := rn.watchOnce(q, &last, f)
+		if stopped || err != nil {
+			return err
+		}
+		if time.Since(started) >= remoteWatchMaxRetryDelay {
+			delay = remoteWatchMinRetryDelay
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > remoteWatchMaxRetryDelay {
+			delay = remoteWatchMaxRetryDelay
+		}
+	}
+}
+
+// watchOnce runs a single /watch request, returning true if f returned false.
+// Last holds the data of the last event passed to f so that repeated results can be skipped.
+func (rn RemoteNode) watchOnce(q *Query, last *[]byte, f func(QueryResults) bool) (bool, error) {
+	msgJSON, err := json.Marshal(q)
+	if err != nil {
+		return false, err
+	}
+	req, err := apiNewRequest("POST", string(rn)+"/watch", bytes.NewReader(msgJSON))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := httpStreamClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: int64(APIMaxResponseSize)})
+		if err != nil {
+			return false, err
+		}
+		var e ErrAPI
+		err = json.Unmarshal(body, &e)
+		if err != nil {
+			return false, err
+		}
+		return false, e
+	}
+
+	// Parse server-sent events, each of which carries one JSON object in its data field.
+	r := bufio.NewReader(resp.Body)
+	var event string
+	var data []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if len(data) > 0 {
+				if event == "error" {
+					var e ErrAPI
+					err = json.Unmarshal(data, &e)
+					if err != nil {
+						return false, err
+					}
+					return false, e
+				}
+				if !bytes.Equal(data, *last) {
+					var qr QueryResults
+					err = json.Unmarshal(data, &qr)
+					if err != nil {
+						return false, err
+					}
+					*last = data
+					if !f(qr) {
+						return true, nil
+					}
+				}
+			}
+			event = ""
+			data = nil
+		} else if bytes.HasPrefix(line, []byte("event:")) {
+			event = string(bytes.TrimSpace(line[6:]))
+		} else if bytes.HasPrefix(line, []byte("data:")) {
+			data = append(data, bytes.TrimSpace(line[5:])...)
+		}
+	}
+}
+
+// remoteJobPollInterval is how often RemoteNode checks the status of a running job.
+const remoteJobPollInterval = time.Second
+
+// runJob posts a request to a node as an asynchronous job and waits for it to finish.
+// If the node doesn't support jobs it runs the request synchronously and its response body is returned instead.
+func (rn RemoteNode) runJob(path string, m interface{}) (*JobStatus, []byte, error) {
+	msgJSON, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := apiNewRequest(http.MethodPost, string(rn)+path+"?async=1", bytes.NewReader(msgJSON))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Add("Accept-Encoding", "gzip")
+	body, err := apiDoWithClient(&httpWorkClient, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	var s JobStatus
+	if json.Unmarshal(body, &s) != nil || len(s.ID) == 0 {
+		return nil, body, nil
+	}
+	for !s.finished() {
+		time.Sleep(remoteJobPollInterval)
+		sp, err := rn.Job(s.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		s = *sp
+	}
+	switch s.State {
+	case JobStateFailed:
+		if s.Error != nil {
+			return &s, nil, *s.Error
+		}
+		return &s, nil, ErrAPI{Code: http.StatusInternalServerError, Message: s.Type + " failed"}
+	case JobStateCancelled:
+		return &s, nil, ErrJobCancelled
+	}
+	return &s, nil, nil
+}
+
+// Job gets the status of an asynchronous job on a remote node.
+func (rn RemoteNode) Job(id string) (*JobStatus, error) {
+	body, err := apiRequest(string(rn)+"/jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var s JobStatus
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CancelJob cancels an asynchronous job on a remote node and returns its status.
+func (rn RemoteNode) CancelJob(id string) (*JobStatus, error) {
+	req, err := apiNewRequest(http.MethodDelete, string(rn)+"/jobs/"+url.PathEscape(id), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	body, err := apiDo(req)
+	if err != nil {
+		return nil, err
+	}
+	var s JobStatus
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
 // ExecuteMakeRecord instructs a remote node to create a record.
 func (rn RemoteNode) ExecuteMakeRecord(mr *MakeRecord) (*Record, Pulse, bool, error) {
-	body, err := apiRequest(string(rn)+"/makerecord", mr)
+	s, body, err := rn.runJob("/makerecord", mr)
 	if err != nil {
 		return nil, nil, false, err
 	}
+	if s != nil {
+		return s.Record, s.Pulse, s.Accepted, nil
+	}
 	var qr remoteMakeResult
 	err = json.Unmarshal(body, &qr)
 	if err == nil {
@@ -244,12 +632,35 @@ func (rn RemoteNode) ExecuteMakeRecord(mr *MakeRecord) (*Record, Pulse, bool, er
 	return nil, nil, false, err
 }
 
+// ExecuteWork asks a remote node to compute proof of work for a record's work hash.
+func (rn RemoteNode) ExecuteWork(m *WorkRequest) (*WorkResult, error) {
+	s, body, err := rn.runJob("/work", m)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		if s.Work == nil {
+			return nil, ErrWharrgarblFailed
+		}
+		return s.Work, nil
+	}
+	var wr WorkResult
+	err = json.Unmarshal(body, &wr)
+	if err != nil {
+		return nil, err
+	}
+	return &wr, nil
+}
+
 // ExecuteMakePulse instructs a remote node to generate and post a pulse.
 func (rn RemoteNode) ExecuteMakePulse(mr *MakePulse) (Pulse, *Record, bool, error) {
-	body, err := apiRequest(string(rn)+"/makerecord", mr)
+	s, body, err := rn.runJob("/makepulse", mr)
 	if err != nil {
 		return nil, nil, false, err
 	}
+	if s != nil {
+		return s.Pulse, s.Record, s.Accepted, nil
+	}
 	var qr remoteMakeResult
 	err = json.Unmarshal(body, &qr)
 	if err == nil {
@@ -258,9 +669,33 @@ func (rn RemoteNode) ExecuteMakePulse(mr *MakePulse) (Pulse, *Record, bool, erro
 	return nil, nil, false, err
 }
 
+// WorkEstimate asks a remote node how long it takes to compute proof of work for records of a given size.
+func (rn RemoteNode) WorkEstimate(bytes uint) (*WorkEstimate, error) {
+	req, err := apiNewRequest(http.MethodGet, string(rn)+"/workestimate/"+strconv.FormatUint(uint64(bytes), 10), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept-Encoding", "gzip")
+	body, err := apiDoWithClient(&httpWorkClient, req)
+	if err != nil {
+		return nil, err
+	}
+	var e WorkEstimate
+	err = json.Unmarshal(body, &e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
 // DoPulse posts a pulse to this node and returns whether or not it was accepted.
 func (rn RemoteNode) DoPulse(pulse Pulse, announce bool) (bool, error) {
-	resp, err := httpClient.Post(string(rn)+"/pulse", "application/octet-stream", bytes.NewReader(pulse))
+	req, err := apiNewRequest("POST", string(rn)+"/pulse", bytes.NewReader(pulse))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return false, err
 	}
@@ -305,5 +740,71 @@ func (rn RemoteNode) Connect(ip net.IP, port int, identity []byte) error {
 	return err
 }
 
+// Snapshot downloads a snapshot of this node's database (see Node.WriteSnapshot) and writes it to w.
+// This requires the admin API scope.
+func (rn RemoteNode) Snapshot(w io.Writer) error {
+	req, err := apiNewRequest("GET", string(rn)+"/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpStreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		var e ErrAPI
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: APIMaxResponseSize})
+		if json.Unmarshal(body, &e) != nil {
+			e.Code = resp.StatusCode
+		}
+		return e
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// RecordsSince opens a stream of this node's records starting at a byte offset in its /records/since output.
+// The returned start offset is 0 if the node could not resume at the requested offset, and total is the
+// size of the whole stream (including start) or 0 if unknown. The caller must close the returned reader.
+func (rn RemoteNode) RecordsSince(offset uint64) (body io.ReadCloser, start uint64, total uint64, err error) {
+	req, err := apiNewRequest("GET", string(rn)+"/records/since", nil)
+	if err != nil {
+		return
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatUint(offset, 10)+"-")
+	}
+	resp, err := httpDownloadClient.Do(req)
+	if err != nil {
+		return
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		start = offset
+	case http.StatusRequestedRangeNotSatisfiable: // nothing new past offset
+		_ = resp.Body.Close()
+		return ioutil.NopCloser(http.NoBody), offset, offset, nil
+	default:
+		var e ErrAPI
+		b, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: APIMaxResponseSize})
+		_ = resp.Body.Close()
+		if json.Unmarshal(b, &e) != nil {
+			e.Code = resp.StatusCode
+			e.Message = resp.Status
+		}
+		err = e
+		return
+	}
+	if resp.ContentLength > 0 {
+		total = start + uint64(resp.ContentLength)
+	}
+	body = newIdleTimeoutReadCloser(resp.Body, httpDownloadIdleTimeout)
+	return
+}
+
 // IsLocal always returns false for RemoteNode.
 func (rn RemoteNode) IsLocal() bool { return false }
@@ -488,10 +488,22 @@ const testDatabaseInstances = 3
 const testDatabaseRecords = 4096
 const testDatabaseOwners = 16
 
-// TestDatabase tests the database using a large set of randomly generated records.
+// TestDatabase tests each storage backend available in this build using a large set of randomly generated records.
 func TestDatabase(testBasePath string, out io.Writer) bool {
+	for _, backend := range []string{StoreBackendNative, StoreBackendGo} {
+		if _, have := storeBackends[backend]; have {
+			_, _ = fmt.Fprintf(out, "Testing %q storage backend...\n", backend)
+			if !testDatabaseBackend(backend, path.Join(testBasePath, backend), out) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func testDatabaseBackend(backend string, testBasePath string, out io.Writer) bool {
 	var err error
-	var dbs [testDatabaseInstances]db
+	var dbs [testDatabaseInstances]Store
 
 	testBasePath = path.Join(testBasePath, strconv.FormatInt(int64(os.Getpid()), 10))
 	logger := log.New(os.Stdout, "[db] ", 0)
@@ -500,9 +512,12 @@ func TestDatabase(testBasePath string, out io.Writer) bool {
 	for i := range dbs {
 		p := path.Join(testBasePath, strconv.FormatInt(int64(i), 10))
 		_ = os.MkdirAll(p, 0755)
-		err = dbs[i].open(p, [logLevelCount]*log.Logger{logger, logger, logger, logger, logger}, func(doff uint64, dlen uint, reputation int, hash *[32]byte) {})
+		dbs[i], err = openStoreBackend(backend, p, [logLevelCount]*log.Logger{logger, logger, logger, logger, logger}, func(doff uint64, dlen uint, reputation int, hash *[32]byte) {})
 		if err != nil {
 			_, _ = fmt.Fprintf(out, "FAILED: %s\n", err.Error())
+			for j := 0; j < i; j++ {
+				dbs[j].close()
+			}
 			return false
 		}
 	}
@@ -637,7 +652,7 @@ func TestDatabase(testBasePath string, out io.Writer) bool {
 			defer wg.Done()
 			rb := make([]byte, 0, 4096)
 			for ri := 0; ri < testDatabaseRecords; ri++ {
-				err = dbs[dbi].query([][2][]byte{{selectorKeys[ri], selectorKeys[ri]}}, nil, func(ts, weightL, weightH, doff, dlen uint64, localReputation int, key uint64, owner []byte, negativeComments uint) bool {
+				err = dbs[dbi].query([][2][]byte{{selectorKeys[ri], selectorKeys[ri]}}, nil, func(ts, weightL, weightH, doff, dlen uint64, localReputation int, key uint64, owner []byte, negativeComments uint, selectorKey []byte) bool {
 					rdata, err := dbs[dbi].getDataByOffset(doff, uint(dlen), rb[:0])
 					if err != nil {
 						_, _ = fmt.Fprintf(out, "  FAILED to retrieve (selector key: %x) (%s)\n", selectorKeys[ri], err.Error())
@@ -683,7 +698,7 @@ func TestDatabase(testBasePath string, out io.Writer) bool {
 				ptk := []byte(fmt.Sprintf("%.16x%s", oi, selRandom))
 				sk0 := MakeSelectorKey(ptk, 0)
 				sk1 := MakeSelectorKey(ptk, 0xffffffffffffffff)
-				err = dbs[dbi].query([][2][]byte{{sk0, sk1}}, nil, func(ts, weightL, weightH, doff, dlen uint64, localReputation int, key uint64, owner []byte, negativeComments uint) bool {
+				err = dbs[dbi].query([][2][]byte{{sk0, sk1}}, nil, func(ts, weightL, weightH, doff, dlen uint64, localReputation int, key uint64, owner []byte, negativeComments uint, selectorKey []byte) bool {
 					_, err := dbs[dbi].getDataByOffset(doff, uint(dlen), rb[:0])
 					if err != nil {
 						_, _ = fmt.Fprintf(out, "  FAILED to retrieve (selector key range %x-%x) (%s)\n", sk0, sk1, err.Error())
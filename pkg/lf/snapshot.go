@@ -0,0 +1,282 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// Snapshots are tar archives containing a consistent copy of a node's database files followed by
+// a manifest with their SHA256 hashes and the database's CRC64. They're taken from a running node
+// and restored into an empty base path, after which a node can be started there. The node's
+// identity and configuration are not included, so a restored node is a clone of the data only.
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// SnapshotManifestName is the name of the manifest, which is the last file in a snapshot archive.
+const SnapshotManifestName = "snapshot.json"
+
+// snapshotVersion is the current snapshot format version.
+const snapshotVersion = 1
+
+// snapshotFiles are the files in a snapshot in the order in which they appear in the archive.
+var snapshotFiles = []string{"genesis.lf", "node.db", "records.lf", "graph.bin", "weights.b00", "weights.b32", "weights.b64"}
+
+// snapshotStore is implemented by storage backends that can write snapshots (currently only the native backend).
+type snapshotStore interface {
+	Store
+	snapshot(outPath string) (crc, recordCount, dataSize uint64, err error)
+}
+
+// SnapshotManifest describes the contents of a snapshot.
+type SnapshotManifest struct {
+	Version     int             ``                  // Snapshot format version
+	Timestamp   uint64          ``                  // Time snapshot was taken (seconds since epoch)
+	RecordCount uint64          ``                  // Number of records in snapshot
+	DataSize    uint64          ``                  // Size of record data in records.lf
+	CRC64       uint64          ``                  // CRC64 of database (see db.crc64)
+	Files       map[string]Blob `json:",omitempty"` // SHA256 hashes of files in snapshot
+}
+
+// WriteSnapshot writes a consistent snapshot of this node's database to a writer as a tar archive.
+// The node keeps running, but record addition and graph updates pause while database files are copied.
+func (n *Node) WriteSnapshot(w io.Writer) (*SnapshotManifest, error) {
+	tmpPath, err := ioutil.TempDir(n.basePath, "snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpPath)
+	}()
+
+	ss, ok := n.db.(snapshotStore)
+	if !ok {
+		return nil, errors.New("storage backend does not support snapshots")
+	}
+	crc, recordCount, dataSize, err := ss.snapshot(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	genesis, err := ioutil.ReadFile(path.Join(n.basePath, "genesis.lf"))
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path.Join(tmpPath, "genesis.lf"), genesis, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	m := SnapshotManifest{
+		Version:     snapshotVersion,
+		Timestamp:   TimeSec(),
+		RecordCount: recordCount,
+		DataSize:    dataSize,
+		CRC64:       crc,
+		Files:       make(map[string]Blob),
+	}
+	n.log[LogLevelNormal].Printf("snapshot: writing snapshot with %d records (CRC64 %.16x)", recordCount, crc)
+
+	tw := tar.NewWriter(w)
+	for _, name := range snapshotFiles {
+		f, err := os.Open(path.Join(tmpPath, name))
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		if err == nil {
+			h := sha256.New()
+			_, err = io.Copy(io.MultiWriter(tw, h), f)
+			m.Files[name] = h.Sum(nil)
+		}
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mj, _ := json.MarshalIndent(&m, "", "  ")
+	err = tw.WriteHeader(&tar.Header{Name: SnapshotManifestName, Mode: 0644, Size: int64(len(mj))})
+	if err == nil {
+		_, err = tw.Write(mj)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ReadSnapshotManifest reads a snapshot and returns its manifest after checking the hashes of the files in it.
+func ReadSnapshotManifest(r io.Reader) (*SnapshotManifest, error) {
+	hashes := make(map[string][]byte)
+	var m *SnapshotManifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == SnapshotManifestName {
+			if m, err = readSnapshotManifestEntry(tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		h := sha256.New()
+		if _, err = io.Copy(h, tr); err != nil {
+			return nil, err
+		}
+		hashes[hdr.Name] = h.Sum(nil)
+	}
+	return m, checkSnapshotManifest(m, hashes)
+}
+
+func readSnapshotManifestEntry(r io.Reader) (*SnapshotManifest, error) {
+	mj, err := ioutil.ReadAll(&io.LimitedReader{R: r, N: 1048576})
+	if err != nil {
+		return nil, err
+	}
+	var m SnapshotManifest
+	if err = json.Unmarshal(mj, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// checkSnapshotManifest checks a manifest against the hashes of the files actually found in a snapshot.
+func checkSnapshotManifest(m *SnapshotManifest, hashes map[string][]byte) error {
+	if m == nil {
+		return errors.New("snapshot is missing its manifest")
+	}
+	if m.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", m.Version)
+	}
+	for _, name := range snapshotFiles {
+		if !bytes.Equal(hashes[name], m.Files[name]) {
+			return fmt.Errorf("%s is missing from snapshot or its SHA256 hash does not match the manifest", name)
+		}
+	}
+	return nil
+}
+
+// RestoreSnapshot restores a snapshot read from a tar archive into a base path that does not contain a node.
+// File hashes and the database CRC64 are checked against the snapshot's manifest before files are moved
+// into place. Nothing in basePath is changed if the snapshot is invalid.
+func RestoreSnapshot(r io.Reader, basePath string) (*SnapshotManifest, error) {
+	for _, name := range snapshotFiles {
+		if _, err := os.Stat(path.Join(basePath, name)); err == nil {
+			return nil, fmt.Errorf("%s already exists in %s (will not restore over an existing node)", name, basePath)
+		}
+	}
+
+	err := os.MkdirAll(basePath, 0755)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath, err := ioutil.TempDir(basePath, "restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpPath)
+	}()
+
+	// Extract files, accepting only known names so nothing can be written elsewhere.
+	hashes := make(map[string][]byte)
+	var m *SnapshotManifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == SnapshotManifestName {
+			if m, err = readSnapshotManifestEntry(tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		known := false
+		for _, name := range snapshotFiles {
+			if hdr.Name == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unrecognized file %q in snapshot", hdr.Name)
+		}
+		f, err := os.OpenFile(path.Join(tmpPath, hdr.Name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(f, h), tr)
+		if err == nil {
+			err = f.Sync()
+		}
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		hashes[hdr.Name] = h.Sum(nil)
+	}
+
+	if err = checkSnapshotManifest(m, hashes); err != nil {
+		return nil, err
+	}
+
+	// Open the restored database and check its CRC64.
+	var loggers [logLevelCount]*log.Logger
+	for i := range loggers {
+		loggers[i] = nullLogger
+	}
+	d, err := openStoreBackend(StoreBackendNative, tmpPath, loggers, func(uint64, uint, int, *[32]byte) {})
+	if err != nil {
+		return nil, err
+	}
+	crc := d.crc64()
+	recordCount, _ := d.stats()
+	d.close()
+	if crc != m.CRC64 || recordCount != m.RecordCount {
+		return nil, fmt.Errorf("restored database CRC64 %.16x with %d records does not match snapshot CRC64 %.16x with %d records", crc, recordCount, m.CRC64, m.RecordCount)
+	}
+
+	for _, name := range snapshotFiles {
+		err = os.Rename(path.Join(tmpPath, name), path.Join(basePath, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
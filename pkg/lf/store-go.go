@@ -0,0 +1,1217 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+// The Go storage backend keeps all indexes, the DAG, and weights in memory and stores only
+// record data on disk in records.lf in the same format used by the native backend. On open
+// records.lf is replayed to rebuild everything. Reputation adjustments made after records
+// are added and pulse updates can't be rebuilt this way, so they are journaled in a state
+// file that is replayed after records.lf. Limbo and wanted record retry counts are not
+// persisted and are lost on restart. Weights are applied once a record's entire sub-DAG is present rather than
+// incrementally around holes, which gives the same result once a node is synchronized. This
+// backend is intended for small nodes, testing, and builds without cgo.
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"hash/crc64"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// goStoreCKeyTable is the table for the CRC64 used for composite selector keys (must match native/db.c).
+var goStoreCKeyTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// goStoreCRCTable is the table for the CRC64 of database state returned by crc64().
+var goStoreCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// goStoreStateName is the name of the state journal in the base path. It contains reputation changes
+// and pulse updates, and is rewritten with only the current state each time the store is opened.
+const goStoreStateName = "store-go-state.bin"
+
+// State journal entry types and sizes (including type byte). Integers are big-endian.
+const (
+	goStoreStateReputation     = 'R' // record hash[32], reputation[1]
+	goStoreStateReputationSize = 34
+	goStoreStatePulse          = 'P' // pulse token[8], start[8], minutes[8]
+	goStoreStatePulseSize      = 25
+)
+
+type goStoreRecord struct {
+	doff        uint64
+	dlen        uint64
+	ts          uint64
+	score       uint32
+	rtype       int
+	reputation  int
+	linkedCount int64
+	hash        [32]byte
+	id          [32]byte
+	ckey        uint64
+	owner       []byte
+	links       []*goStoreRecord // linked records or nil for dangling links
+	linkedBy    []*goStoreRecord // records that link to this one
+	incomplete  int              // number of links that are dangling or point to incomplete records
+	complete    bool             // true if this record's entire sub-DAG is present
+	pending     bool             // true until weights have been applied (never true for records with no links)
+	weightL     uint64           // weight (least significant 64 bits)
+	weightH     uint64           // weight (most significant 64 bits)
+	visit       uint64           // graph traversal generation
+}
+
+func (r *goStoreRecord) addWeight(w uint32) {
+	oldwl := r.weightL
+	r.weightL += uint64(w)
+	if r.weightL < oldwl {
+		r.weightH++
+	}
+}
+
+func (r *goStoreRecord) lessTime(r2 *goStoreRecord) bool {
+	if r.ts == r2.ts {
+		return bytes.Compare(r.hash[:], r2.hash[:]) < 0
+	}
+	return r.ts < r2.ts
+}
+
+type goStoreSelector struct {
+	sel [32]byte
+	rec *goStoreRecord
+}
+
+type goStoreDanglingLink struct {
+	rec *goStoreRecord
+	idx int
+}
+
+type goStoreComment struct {
+	byRecordDoff uint64
+	assertion    int
+	reason       int
+}
+
+type goStoreCert struct {
+	serial     string
+	recordDoff uint64
+	cert       *x509.Certificate
+}
+
+type goStoreCertRevocation struct {
+	recordDoff uint64
+	recordDlen uint
+}
+
+type goStoreLimbo struct {
+	owner            []byte
+	ts               uint64
+	localReceiveTime uint64
+}
+
+type goStorePulse struct {
+	start   uint64
+	minutes uint64
+}
+
+// goStoreTimeBucket is the count and sum of hashes of records in a reconcileSumBucketSeconds time span.
+type goStoreTimeBucket struct {
+	count uint64
+	sum   [4]uint64
+}
+
+// goStore is the pure Go storage backend.
+type goStore struct {
+	log          [logLevelCount]*log.Logger
+	syncCallback func(uint64, uint, int, *[32]byte)
+	df           *os.File
+	sf           *os.File // state journal (see goStoreStateName)
+
+	records      []*goStoreRecord // in data offset order
+	dataSize     uint64
+	byHash       map[[32]byte]*goStoreRecord
+	byDoff       map[uint64]*goStoreRecord
+	byID         map[[32]byte][]*goStoreRecord
+	byOwner      map[string][]*goStoreRecord
+	byTime       []*goStoreRecord // sorted by timestamp and hash when byTimeSorted is true
+	byTimeSorted bool
+	timeBuckets  map[uint64]*goStoreTimeBucket // hash sums by timestamp / reconcileSumBucketSeconds
+	selectors    [][]goStoreSelector           // by selector index, sorted when selSorted[i] is true
+	selSorted    []bool
+	dangling     map[[32]byte][]goStoreDanglingLink
+	wanted       map[[32]byte]int
+	limbo        map[[32]byte]*goStoreLimbo
+	comments     map[string][]goStoreComment
+	certs        map[string][]goStoreCert // by subject serial number
+	revocations  map[string][]goStoreCertRevocation
+	pulses       map[uint64][]goStorePulse
+
+	pendingCount int
+	graphQueue   []*goStoreRecord
+	visitGen     uint64
+	graphWake    chan struct{}
+	graphDone    chan struct{}
+	graphWG      sync.WaitGroup
+
+	lock sync.Mutex
+}
+
+func (s *goStore) open(basePath string, loggers [logLevelCount]*log.Logger, syncCallback func(uint64, uint, int, *[32]byte)) error {
+	s.log = loggers
+	s.syncCallback = syncCallback
+	s.byHash = make(map[[32]byte]*goStoreRecord)
+	s.byDoff = make(map[uint64]*goStoreRecord)
+	s.byID = make(map[[32]byte][]*goStoreRecord)
+	s.byOwner = make(map[string][]*goStoreRecord)
+	s.dangling = make(map[[32]byte][]goStoreDanglingLink)
+	s.wanted = make(map[[32]byte]int)
+	s.limbo = make(map[[32]byte]*goStoreLimbo)
+	s.comments = make(map[string][]goStoreComment)
+	s.certs = make(map[string][]goStoreCert)
+	s.revocations = make(map[string][]goStoreCertRevocation)
+	s.pulses = make(map[uint64][]goStorePulse)
+	s.timeBuckets = make(map[uint64]*goStoreTimeBucket)
+	s.graphWake = make(chan struct{}, 1)
+
+	recordsPath := path.Join(basePath, "records.lf")
+	df, err := os.OpenFile(recordsPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.df = df
+
+	// Replay records.lf, stopping at the first record that can't be read. Anything after that
+	// is the remains of an incomplete write and will be overwritten by the next record added.
+	s.dataSize, err = fsckScanRecords(recordsPath, func(doff uint64, r *Record, dlen uint64) bool {
+		if len(r.recordBody.Owner) > 0 {
+			s.addRecord(r, doff, dlen)
+		}
+		return true
+	})
+	if err != nil {
+		_ = s.df.Close()
+		s.df = nil
+		return err
+	}
+
+	// Apply weights for everything replayed. This is done here rather than in the background so
+	// records that were already synchronized are not announced again via the sync callback.
+	for len(s.graphQueue) > 0 {
+		r := s.graphQueue[0]
+		s.graphQueue = s.graphQueue[1:]
+		s.applyWeight(r)
+	}
+	for _, r := range s.records {
+		if len(r.links) > 0 && !r.pending && (r.rtype == RecordTypeCommentary || r.rtype == RecordTypeCertificate || r.rtype == RecordTypeCRL) {
+			rdata, _ := s.getDataByOffset(r.doff, uint(r.dlen), nil)
+			if rec, _ := NewRecordFromBytes(rdata); rec != nil {
+				storeIndexRecord(s, rec, r.doff, uint(r.dlen))
+			}
+		}
+	}
+	if len(s.records) > 0 {
+		s.log[LogLevelNormal].Printf("loaded %d records (%d bytes) from %s, %d awaiting links", len(s.records), s.dataSize, recordsPath, s.pendingCount)
+	}
+
+	if err = s.loadState(path.Join(basePath, goStoreStateName)); err != nil {
+		_ = s.df.Close()
+		s.df = nil
+		return err
+	}
+
+	s.graphDone = make(chan struct{})
+	s.graphWG.Add(1)
+	go s.graphMain(s.graphDone)
+
+	return nil
+}
+
+func (s *goStore) close() {
+	s.lock.Lock()
+	if s.graphDone == nil {
+		s.lock.Unlock()
+		return
+	}
+	close(s.graphDone)
+	s.graphDone = nil
+	s.lock.Unlock()
+
+	s.graphWG.Wait()
+
+	s.lock.Lock()
+	if s.df != nil {
+		_ = s.df.Close()
+		s.df = nil
+	}
+	if s.sf != nil {
+		_ = s.sf.Close()
+		s.sf = nil
+	}
+	s.lock.Unlock()
+}
+
+// loadState applies reputation changes and pulse updates from the state journal to replayed records.
+// The journal is then rewritten with only the current state so it doesn't grow without bound, and
+// left open for appending. Entries for records that are not present are dropped.
+func (s *goStore) loadState(statePath string) error {
+	d, _ := ioutil.ReadFile(statePath)
+	reputations := make(map[[32]byte]int)
+	for len(d) > 0 {
+		if d[0] == goStoreStateReputation && len(d) >= goStoreStateReputationSize {
+			var h [32]byte
+			copy(h[:], d[1:33])
+			if r := s.byHash[h]; r != nil {
+				r.reputation = int(d[33])
+				reputations[h] = r.reputation
+			}
+			d = d[goStoreStateReputationSize:]
+		} else if d[0] == goStoreStatePulse && len(d) >= goStoreStatePulseSize {
+			token, start, minutes := binary.BigEndian.Uint64(d[1:9]), binary.BigEndian.Uint64(d[9:17]), binary.BigEndian.Uint64(d[17:25])
+			s.updatePulseLocked(token, minutes, start, start)
+			d = d[goStoreStatePulseSize:]
+		} else {
+			break // anything else is the remains of an incomplete write
+		}
+	}
+
+	var state []byte
+	for h, reputation := range reputations {
+		state = appendGoStoreReputation(state, &h, reputation)
+	}
+	for token, pulses := range s.pulses {
+		for _, p := range pulses {
+			if p.minutes > 0 {
+				state = appendGoStorePulse(state, token, p.start, p.minutes)
+			}
+		}
+	}
+	tmpPath := statePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, state, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		return err
+	}
+	sf, err := os.OpenFile(statePath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.sf = sf
+	return nil
+}
+
+// writeState appends an entry to the state journal. Lock must be held.
+func (s *goStore) writeState(entry []byte) {
+	if s.sf != nil {
+		if _, err := s.sf.Write(entry); err != nil {
+			s.log[LogLevelWarning].Printf("WARNING: unable to write to %s: %s", goStoreStateName, err.Error())
+		}
+	}
+}
+
+func appendGoStoreReputation(b []byte, h *[32]byte, reputation int) []byte {
+	b = append(b, goStoreStateReputation)
+	b = append(b, h[:]...)
+	return append(b, byte(reputation))
+}
+
+func appendGoStorePulse(b []byte, token, start, minutes uint64) []byte {
+	var tmp [24]byte
+	binary.BigEndian.PutUint64(tmp[0:8], token)
+	binary.BigEndian.PutUint64(tmp[8:16], start)
+	binary.BigEndian.PutUint64(tmp[16:24], minutes)
+	b = append(b, goStoreStatePulse)
+	return append(b, tmp[:]...)
+}
+
+// graphMain applies weights for records whose sub-DAGs are complete and announces them via the sync callback.
+func (s *goStore) graphMain(done chan struct{}) {
+	defer s.graphWG.Done()
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.graphWake:
+		}
+		for {
+			s.lock.Lock()
+			if len(s.graphQueue) == 0 {
+				s.lock.Unlock()
+				break
+			}
+			r := s.graphQueue[0]
+			s.graphQueue = s.graphQueue[1:]
+			s.applyWeight(r)
+			doff, dlen, reputation, hash := r.doff, uint(r.dlen), r.reputation, r.hash
+			s.lock.Unlock()
+
+			s.syncCallback(doff, dlen, reputation, &hash)
+
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// applyWeight adds a record's score to the weight of every record below it in the DAG. Lock must be held.
+func (s *goStore) applyWeight(r *goStoreRecord) {
+	s.visitGen++
+	gen := s.visitGen
+	stack := make([]*goStoreRecord, 0, len(r.links)*4)
+	stack = append(stack, r.links...)
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[0 : len(stack)-1]
+		if n.visit != gen {
+			n.visit = gen
+			n.addWeight(r.score)
+			stack = append(stack, n.links...)
+		}
+	}
+	if r.pending {
+		r.pending = false
+		s.pendingCount--
+	}
+}
+
+// markComplete marks a record complete and propagates completion up through records that link to it. Lock must be held.
+func (s *goStore) markComplete(r *goStoreRecord) {
+	stack := []*goStoreRecord{r}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[0 : len(stack)-1]
+		n.complete = true
+		if n.pending {
+			s.graphQueue = append(s.graphQueue, n)
+		}
+		for _, p := range n.linkedBy {
+			p.incomplete--
+			if p.incomplete == 0 {
+				stack = append(stack, p)
+			}
+		}
+	}
+}
+
+// addRecord indexes a record whose data is at doff in records.lf. Lock must be held.
+func (s *goStore) addRecord(r *Record, doff, dlen uint64) *goStoreRecord {
+	rec := &goStoreRecord{
+		doff:    doff,
+		dlen:    dlen,
+		ts:      r.recordBody.Timestamp,
+		score:   r.Score(),
+		rtype:   r.Type,
+		hash:    r.Hash(),
+		id:      r.ID(),
+		owner:   r.recordBody.Owner,
+		weightL: uint64(r.Score()),
+	}
+
+	// Determine reputation the same way the native backend does: inherit the best reputation of
+	// synchronized records with this ID and owner, or demote everything if another owner has
+	// claimed this ID.
+	rec.reputation = dbReputationCollision
+	haveIDOwner := false
+	haveIDNotOwner := false
+	for _, r2 := range s.byID[rec.id] {
+		if bytes.Equal(r2.owner, rec.owner) {
+			if !r2.pending && (!haveIDOwner || r2.reputation > rec.reputation) {
+				rec.reputation = r2.reputation
+				haveIDOwner = true
+			}
+		} else {
+			haveIDNotOwner = true
+		}
+	}
+	if !haveIDOwner {
+		if haveIDNotOwner {
+			goodOwners := make(map[string]bool)
+			for _, r2 := range s.byID[rec.id] {
+				if r2.reputation > 0 && !r2.pending {
+					goodOwners[string(r2.owner)] = true
+				}
+			}
+			for _, r2 := range s.byID[rec.id] {
+				if r2.reputation > 0 && !goodOwners[string(r2.owner)] {
+					r2.reputation = dbReputationCollision
+				}
+			}
+		} else {
+			rec.reputation = dbReputationDefault
+		}
+	}
+
+	for i := range r.Selectors {
+		sk := r.SelectorKey(i)
+		rec.ckey = crc64.Update(rec.ckey, goStoreCKeyTable, sk)
+		for len(s.selectors) <= i {
+			s.selectors = append(s.selectors, nil)
+			s.selSorted = append(s.selSorted, true)
+		}
+		var gs goStoreSelector
+		copy(gs.sel[:], sk)
+		gs.rec = rec
+		s.selectors[i] = append(s.selectors[i], gs)
+		s.selSorted[i] = false
+	}
+
+	if r.recordBody.PulseToken != 0 {
+		have := false
+		for _, p := range s.pulses[r.recordBody.PulseToken] {
+			if p.start == rec.ts {
+				have = true
+				break
+			}
+		}
+		if !have {
+			s.pulses[r.recordBody.PulseToken] = append(s.pulses[r.recordBody.PulseToken], goStorePulse{start: rec.ts})
+		}
+	}
+
+	// Link to records below this one, noting dangling links and wanted records for those we don't have.
+	rec.links = make([]*goStoreRecord, len(r.recordBody.Links))
+	for i := range r.recordBody.Links {
+		var l [32]byte
+		copy(l[:], r.recordBody.Links[i][:])
+		if lr := s.byHash[l]; lr != nil {
+			rec.links[i] = lr
+			lr.linkedCount++
+			lr.linkedBy = append(lr.linkedBy, rec)
+			if !lr.complete {
+				rec.incomplete++
+			}
+		} else {
+			s.dangling[l] = append(s.dangling[l], goStoreDanglingLink{rec: rec, idx: i})
+			s.wanted[l] = 0
+			rec.incomplete++
+		}
+	}
+
+	// Fill dangling links in records above this one.
+	for _, dl := range s.dangling[rec.hash] {
+		if dl.rec.links[dl.idx] == nil {
+			dl.rec.links[dl.idx] = rec
+			rec.linkedCount++
+			rec.linkedBy = append(rec.linkedBy, dl.rec)
+		}
+	}
+	delete(s.dangling, rec.hash)
+	delete(s.wanted, rec.hash)
+	delete(s.limbo, rec.hash)
+
+	s.records = append(s.records, rec)
+	s.byHash[rec.hash] = rec
+	s.byDoff[rec.doff] = rec
+	s.byID[rec.id] = append(s.byID[rec.id], rec)
+	s.byOwner[string(rec.owner)] = append(s.byOwner[string(rec.owner)], rec)
+	s.byTime = append(s.byTime, rec)
+	s.byTimeSorted = false
+	tb := s.timeBuckets[rec.ts/reconcileSumBucketSeconds]
+	if tb == nil {
+		tb = new(goStoreTimeBucket)
+		s.timeBuckets[rec.ts/reconcileSumBucketSeconds] = tb
+	}
+	tb.count++
+	reconcileSumAddHash(&tb.sum, &rec.hash)
+	if (doff + dlen) > s.dataSize {
+		s.dataSize = doff + dlen
+	}
+
+	if len(rec.links) > 0 {
+		rec.pending = true
+		s.pendingCount++
+	}
+	if rec.incomplete == 0 {
+		s.markComplete(rec)
+	}
+
+	return rec
+}
+
+func (s *goStore) putRecord(r *Record) error {
+	if len(r.recordBody.Owner) == 0 {
+		return ErrRecordInvalid
+	}
+	rdata := r.Bytes()
+	if len(rdata) == 0 {
+		return ErrRecordInvalid
+	}
+	h := r.Hash()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.df == nil {
+		return ErrIO
+	}
+	if _, have := s.byHash[h]; have {
+		return ErrDuplicateRecord
+	}
+	doff := s.dataSize
+	if _, err := s.df.WriteAt(rdata, int64(doff)); err != nil {
+		return err
+	}
+	s.addRecord(r, doff, uint64(len(rdata)))
+
+	if len(s.graphQueue) > 0 {
+		select {
+		case s.graphWake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (s *goStore) getDataByHash(h []byte, buf []byte) (int, []byte, error) {
+	if len(h) != 32 {
+		return 0, buf, ErrInvalidParameter
+	}
+	var hh [32]byte
+	copy(hh[:], h)
+	s.lock.Lock()
+	r := s.byHash[hh]
+	s.lock.Unlock()
+	if r == nil {
+		return 0, buf, nil
+	}
+	startPos := len(buf)
+	buf, err := s.getDataByOffset(r.doff, uint(r.dlen), buf)
+	if err != nil {
+		return 0, buf, err
+	}
+	return len(buf) - startPos, buf, nil
+}
+
+func (s *goStore) getDataByOffset(doff uint64, dlen uint, buf []byte) ([]byte, error) {
+	startPos := len(buf)
+	buf = append(buf, make([]byte, dlen)...)
+	if _, err := s.df.ReadAt(buf[startPos:], int64(doff)); err != nil {
+		return buf[0:startPos], ErrIO
+	}
+	return buf, nil
+}
+
+func (s *goStore) hasRecord(h []byte) bool {
+	if len(h) == 32 {
+		var hh [32]byte
+		copy(hh[:], h)
+		s.lock.Lock()
+		_, have := s.byHash[hh]
+		s.lock.Unlock()
+		return have
+	}
+	return false
+}
+
+func (s *goStore) getRecordTimestampByHash(h []byte) (bool, uint64) {
+	if len(h) == 32 {
+		var hh [32]byte
+		copy(hh[:], h)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if r := s.byHash[hh]; r != nil {
+			return true, r.ts
+		}
+	}
+	return false, 0
+}
+
+// getLinks returns synchronized records with good reputations, preferring those with fewer links to them.
+func (s *goStore) getLinks(count uint) (uint, []byte, error) {
+	if count == 0 {
+		return 0, nil, nil
+	}
+	s.lock.Lock()
+	var candidates []*goStoreRecord
+	for _, r := range s.records {
+		if r.reputation >= dbReputationDefault && !r.pending {
+			candidates = append(candidates, r)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].linkedCount < candidates[j].linkedCount })
+	if uint(len(candidates)) > count {
+		candidates = candidates[0:count]
+	}
+	lbuf := make([]byte, 0, 32*len(candidates))
+	for _, r := range candidates {
+		lbuf = append(lbuf, r.hash[:]...)
+	}
+	s.lock.Unlock()
+	return uint(len(candidates)), lbuf, nil
+}
+
+func (s *goStore) getLinks2(count uint) ([][32]byte, error) {
+	_, l, err := s.getLinks(count)
+	if err != nil {
+		return nil, err
+	}
+	return linksToArrays(l), nil
+}
+
+func (s *goStore) updateRecordReputationByHash(h []byte, reputation int) {
+	if len(h) == 32 {
+		var hh [32]byte
+		copy(hh[:], h)
+		s.lock.Lock()
+		if r := s.byHash[hh]; r != nil && r.reputation != reputation {
+			r.reputation = reputation
+			s.writeState(appendGoStoreReputation(nil, &hh, reputation))
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *goStore) stats() (recordCount, dataSize uint64) {
+	s.lock.Lock()
+	recordCount = uint64(len(s.records))
+	dataSize = s.dataSize
+	s.lock.Unlock()
+	return
+}
+
+// crc64 returns a CRC64 of all record hashes, weights, and link counts in hash order.
+func (s *goStore) crc64() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sorted := make([]*goStoreRecord, len(s.records))
+	copy(sorted, s.records)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].hash[:], sorted[j].hash[:]) < 0 })
+	var crc uint64
+	var tmp [33]byte
+	for _, r := range sorted {
+		binary.LittleEndian.PutUint64(tmp[0:8], r.weightL)
+		binary.LittleEndian.PutUint64(tmp[8:16], r.weightH)
+		tmp[16] = byte(len(r.links))
+		binary.LittleEndian.PutUint64(tmp[17:25], uint64(r.linkedCount))
+		crc = crc64.Update(crc, goStoreCRCTable, tmp[0:25])
+		crc = crc64.Update(crc, goStoreCRCTable, r.hash[:])
+	}
+	return crc
+}
+
+func (s *goStore) hasPending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pendingCount > 0
+}
+
+func (s *goStore) getPendingCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pendingCount
+}
+
+func (s *goStore) haveDanglingLinks(ignoreAfterNRetries int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for h, retries := range s.wanted {
+		if retries <= ignoreAfterNRetries && len(s.dangling[h]) > 0 && s.limbo[h] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getWantedLocked returns wanted hashes in order of retry count. Lock must be held.
+func (s *goStore) getWantedLocked(retryCountMin, retryCountMax int) (wanted [][32]byte) {
+	for h, retries := range s.wanted {
+		if retries >= retryCountMin && retries <= retryCountMax && s.limbo[h] == nil {
+			wanted = append(wanted, h)
+		}
+	}
+	sort.Slice(wanted, func(i, j int) bool {
+		ri, rj := s.wanted[wanted[i]], s.wanted[wanted[j]]
+		if ri == rj {
+			return bytes.Compare(wanted[i][:], wanted[j][:]) < 0
+		}
+		return ri < rj
+	})
+	return
+}
+
+func (s *goStore) getWanted(max, retryCountMin, retryCountMax int, incrementRetryCount bool) (int, []byte) {
+	if max == 0 {
+		return 0, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	wanted := s.getWantedLocked(retryCountMin, retryCountMax)
+	if len(wanted) > max {
+		wanted = wanted[0:max]
+	}
+	buf := make([]byte, 0, len(wanted)*32)
+	for _, h := range wanted {
+		buf = append(buf, h[:]...)
+		if incrementRetryCount {
+			s.wanted[h]++
+		}
+	}
+	return len(wanted), buf
+}
+
+func (s *goStore) getWantedCount(retryCountMin, retryCountMax int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.getWantedLocked(retryCountMin, retryCountMax))
+}
+
+// getRecordInfo returns information about up to max records after afterDoff. There is no graph file so goff is always -1.
+func (s *goStore) getRecordInfo(afterDoff int64, max int) []dbRecordInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i := sort.Search(len(s.records), func(i int) bool { return int64(s.records[i].doff) > afterDoff })
+	var ri []dbRecordInfo
+	for ; i < len(s.records) && len(ri) < max; i++ {
+		r := s.records[i]
+		ri = append(ri, dbRecordInfo{doff: r.doff, dlen: r.dlen, goff: -1, score: uint64(r.score), linkCount: uint(len(r.links)), hash: r.hash})
+	}
+	return ri
+}
+
+// rewriteRecordData overwrites a record's data in place with data no longer than its dlen and zeroes the rest.
+func (s *goStore) rewriteRecordData(doff uint64, data []byte, dlen uint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r := s.byDoff[doff]; r == nil || r.dlen != uint64(dlen) || len(data) == 0 || uint(len(data)) > dlen {
+		return ErrInvalidParameter
+	}
+	if s.df == nil {
+		return ErrIO
+	}
+	if _, err := s.df.WriteAt(data, int64(doff)); err != nil {
+		return err
+	}
+	if _, err := s.df.WriteAt(make([]byte, dlen-uint(len(data))), int64(doff)+int64(len(data))); err != nil {
+		return err
+	}
+	return nil
+}
+
+// selectorRange returns records with a selector at index selIdx in [start,end]. Lock must be held.
+func (s *goStore) selectorRange(selIdx int, start, end []byte, f func(*goStoreSelector)) {
+	if selIdx >= len(s.selectors) {
+		return
+	}
+	sels := s.selectors[selIdx]
+	if !s.selSorted[selIdx] {
+		sort.Slice(sels, func(i, j int) bool { return bytes.Compare(sels[i].sel[:], sels[j].sel[:]) < 0 })
+		s.selSorted[selIdx] = true
+	}
+	for i := sort.Search(len(sels), func(i int) bool { return bytes.Compare(sels[i].sel[:], start) >= 0 }); i < len(sels); i++ {
+		if bytes.Compare(sels[i].sel[:], end) > 0 {
+			break
+		}
+		f(&sels[i])
+	}
+}
+
+// query works like the native backend's query: the first selector range selects records and each subsequent
+// range narrows results to those that also match it. Results are grouped by selector key and owner.
+func (s *goStore) query(selectorRanges [][2][]byte, oracles []OwnerPublic, f func(uint64, uint64, uint64, uint64, uint64, int, uint64, []byte, uint, []byte) bool) error {
+	if len(selectorRanges) == 0 {
+		return nil
+	}
+	for i := range selectorRanges {
+		if len(selectorRanges[i][0]) == 0 || len(selectorRanges[i][1]) == 0 {
+			return ErrInvalidParameter
+		}
+	}
+	for i := range oracles {
+		if len(oracles[i]) == 0 {
+			return ErrInvalidParameter
+		}
+	}
+
+	type queryResult struct {
+		ts, weightL, weightH, doff, dlen uint64
+		reputation                       int
+		ckey                             uint64
+		owner                            []byte
+		negativeComments                 uint
+		selectorKey                      [32]byte
+	}
+	var results []*queryResult
+
+	s.lock.Lock()
+
+	rs := make(map[*goStoreRecord][32]byte) // matching records and the keys of their first selectors
+	s.selectorRange(0, selectorRanges[0][0], selectorRanges[0][1], func(gs *goStoreSelector) { rs[gs.rec] = gs.sel })
+	for i := 1; i < len(selectorRanges) && len(rs) > 0; i++ {
+		rs2 := make(map[*goStoreRecord][32]byte)
+		s.selectorRange(i, selectorRanges[i][0], selectorRanges[i][1], func(gs *goStoreSelector) {
+			if sel, have := rs[gs.rec]; have {
+				rs2[gs.rec] = sel
+			}
+		})
+		rs = rs2
+	}
+
+	matches := make([]*goStoreRecord, 0, len(rs))
+	for r := range rs {
+		if r.reputation >= 0 && !r.pending && r.incomplete == 0 {
+			matches = append(matches, r)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.ckey != b.ckey {
+			return int64(a.ckey) < int64(b.ckey)
+		}
+		if c := bytes.Compare(a.owner, b.owner); c != 0 {
+			return c < 0
+		}
+		return a.ts < b.ts
+	})
+
+	var qr *queryResult
+	for _, r := range matches {
+		if qr == nil || qr.ckey != r.ckey || !bytes.Equal(qr.owner, r.owner) {
+			qr = &queryResult{reputation: dbReputationDefault, ckey: r.ckey, owner: r.owner, selectorKey: rs[r]}
+			results = append(results, qr)
+		}
+		qr.ts = r.ts
+		oldwl := qr.weightL
+		qr.weightL += r.weightL
+		qr.weightH += r.weightH
+		if qr.weightL < oldwl {
+			qr.weightH++
+		}
+		qr.doff = r.doff
+		qr.dlen = r.dlen
+		if r.reputation < qr.reputation {
+			qr.reputation = r.reputation
+		}
+		if len(oracles) > 0 {
+			for _, c := range s.comments[string(r.hash[:])] {
+				if c.assertion == int(commentAssertionRecordCollidesWithClaimedID) {
+					if by := s.byDoff[c.byRecordDoff]; by != nil {
+						for _, o := range oracles {
+							if bytes.Equal(by.owner, o) {
+								qr.negativeComments++
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	s.lock.Unlock()
+
+	for _, qr := range results {
+		if !f(qr.ts, qr.weightL, qr.weightH, qr.doff, qr.dlen, qr.reputation, qr.ckey, qr.owner, qr.negativeComments, qr.selectorKey[:]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// getSynchronized returns synchronized records from a list in ascending timestamp order.
+func (s *goStore) getSynchronized(recs []*goStoreRecord, include func(*goStoreRecord) bool) []*goStoreRecord {
+	var results []*goStoreRecord
+	s.lock.Lock()
+	for _, r := range recs {
+		if !r.pending && r.incomplete == 0 && include(r) {
+			results = append(results, r)
+		}
+	}
+	s.lock.Unlock()
+	sort.SliceStable(results, func(i, j int) bool { return results[i].ts < results[j].ts })
+	return results
+}
+
+func (s *goStore) getAllByOwner(owner []byte, f func(uint64, uint64, int) bool) error {
+	if len(owner) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	recs := s.byOwner[string(owner)]
+	s.lock.Unlock()
+	for _, r := range s.getSynchronized(recs, func(*goStoreRecord) bool { return true }) {
+		if !f(r.doff, r.dlen, r.reputation) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *goStore) getOwnerStats(owner []byte) (recordCount uint64, recordBytes uint64) {
+	if len(owner) == 0 {
+		return
+	}
+	s.lock.Lock()
+	recs := s.byOwner[string(owner)]
+	s.lock.Unlock()
+	for _, r := range s.getSynchronized(recs, func(*goStoreRecord) bool { return true }) {
+		recordCount++
+		recordBytes += r.dlen
+	}
+	return
+}
+
+func (s *goStore) getAllByIDNotOwner(id []byte, owner []byte, f func(uint64, uint64, int) bool) error {
+	if len(id) != 32 {
+		return ErrInvalidParameter
+	}
+	if len(owner) == 0 {
+		return nil
+	}
+	var idd [32]byte
+	copy(idd[:], id)
+	s.lock.Lock()
+	recs := s.byID[idd]
+	s.lock.Unlock()
+	for _, r := range s.getSynchronized(recs, func(r *goStoreRecord) bool { return !bytes.Equal(r.owner, owner) }) {
+		if !f(r.doff, r.dlen, r.reputation) {
+			break
+		}
+	}
+	return nil
+}
+
+// timeRange returns the records in [start,end) in timestamp and hash order. Lock must be held.
+func (s *goStore) timeRange(start, end *reconcileBound) []*goStoreRecord {
+	if !s.byTimeSorted {
+		sort.Slice(s.byTime, func(i, j int) bool { return s.byTime[i].lessTime(s.byTime[j]) })
+		s.byTimeSorted = true
+	}
+	bt := s.byTime
+	i := sort.Search(len(bt), func(i int) bool { return !(&reconcileBound{ts: bt[i].ts, hash: bt[i].hash}).less(start) })
+	j := sort.Search(len(bt), func(i int) bool { return !(&reconcileBound{ts: bt[i].ts, hash: bt[i].hash}).less(end) })
+	if j < i {
+		return nil
+	}
+	return bt[i:j]
+}
+
+func (s *goStore) getRangeHashes(start, end *reconcileBound, offset, maxCount int) ([][32]byte, []uint64) {
+	if maxCount <= 0 {
+		return nil, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	recs := s.timeRange(start, end)
+	if offset >= len(recs) {
+		return nil, nil
+	}
+	if offset > 0 {
+		recs = recs[offset:]
+	}
+	if len(recs) > maxCount {
+		recs = recs[0:maxCount]
+	}
+	hashes := make([][32]byte, len(recs))
+	timestamps := make([]uint64, len(recs))
+	for i, r := range recs {
+		hashes[i] = r.hash
+		timestamps[i] = r.ts
+	}
+	return hashes, timestamps
+}
+
+// getRangeSum sums hashes in whole time buckets from timeBuckets and only visits records in partial buckets at each end.
+func (s *goStore) getRangeSum(start, end *reconcileBound) (sum [4]uint64, count uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	addRecords := func(start, end *reconcileBound) {
+		for _, r := range s.timeRange(start, end) {
+			reconcileSumAddHash(&sum, &r.hash)
+			count++
+		}
+	}
+	b0, b1 := reconcileSumBuckets(start, end)
+	if b1 <= b0 {
+		addRecords(start, end)
+		return
+	}
+	addRecords(start, &reconcileBound{ts: b0 * reconcileSumBucketSeconds})
+	for b, tb := range s.timeBuckets {
+		if b >= b0 && b < b1 {
+			reconcileSumAdd(&sum, &tb.sum)
+			count += tb.count
+		}
+	}
+	addRecords(&reconcileBound{ts: b1 * reconcileSumBucketSeconds}, end)
+	return
+}
+
+func (s *goStore) getFirstDoffSince(ts uint64) (uint64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range s.records {
+		if r.ts >= ts {
+			return r.doff, true
+		}
+	}
+	return 0, false
+}
+
+func (s *goStore) logComment(byRecordDoff uint64, assertion, reason int, subject []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := goStoreComment{byRecordDoff: byRecordDoff, assertion: assertion, reason: reason}
+	for _, c2 := range s.comments[string(subject)] {
+		if c2 == c {
+			return nil
+		}
+	}
+	s.comments[string(subject)] = append(s.comments[string(subject)], c)
+	return nil
+}
+
+func (s *goStore) putCert(cert *x509.Certificate, recordDoff uint64) error {
+	if cert == nil || len(cert.Raw) == 0 {
+		return ErrInvalidParameter
+	}
+	serial := Base62Encode(cert.SerialNumber.Bytes())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	certs := s.certs[cert.Subject.SerialNumber]
+	for i := range certs {
+		if certs[i].serial == serial && certs[i].recordDoff == recordDoff {
+			certs[i].cert = cert
+			return nil
+		}
+	}
+	s.certs[cert.Subject.SerialNumber] = append(certs, goStoreCert{serial: serial, recordDoff: recordDoff, cert: cert})
+	return nil
+}
+
+func (s *goStore) putCertRevocation(revokedSerialNumber string, recordDoff uint64, recordDlen uint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cr := goStoreCertRevocation{recordDoff: recordDoff, recordDlen: recordDlen}
+	for _, cr2 := range s.revocations[revokedSerialNumber] {
+		if cr2 == cr {
+			return nil
+		}
+	}
+	s.revocations[revokedSerialNumber] = append(s.revocations[revokedSerialNumber], cr)
+	return nil
+}
+
+// getCertInfo returns the certificates and CRLs for all relevant end chain and intermediate certs for a subject serial.
+func (s *goStore) getCertInfo(subjectSerial string) (map[string]*x509.Certificate, map[string][]*pkix.CertificateList) {
+	cBySerialNo := make(map[string]*x509.Certificate)
+	crlByRevokedSerialNo := make(map[string][]*pkix.CertificateList)
+
+	var revocations []goStoreCertRevocation
+	s.lock.Lock()
+	certs := append([]goStoreCert(nil), s.certs[subjectSerial]...)
+	for _, c := range s.certs[subjectSerial] {
+		certs = append(certs, s.certs[c.serial]...) // intermediates
+	}
+	for _, c := range certs {
+		cBySerialNo[c.serial] = c.cert
+		revocations = append(revocations, s.revocations[c.serial]...)
+	}
+	s.lock.Unlock()
+
+	for _, cr := range revocations {
+		rdata, _ := s.getDataByOffset(cr.recordDoff, cr.recordDlen, nil)
+		if len(rdata) > 0 {
+			rec, _ := NewRecordFromBytes(rdata)
+			if rec != nil {
+				crlBytes, _ := rec.GetValue([]byte(RecordCertificateMaskingKey))
+				if len(crlBytes) > 0 {
+					crl, _ := x509.ParseCRL(crlBytes)
+					if crl != nil {
+						for _, revoked := range crl.TBSCertList.RevokedCertificates {
+							sn := Base62Encode(revoked.SerialNumber.Bytes())
+							crlByRevokedSerialNo[sn] = append(crlByRevokedSerialNo[sn], crl)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return cBySerialNo, crlByRevokedSerialNo
+}
+
+func (s *goStore) markInLimbo(hash, owner []byte, localReceiveTime, ts uint64) error {
+	if len(hash) != 32 || len(owner) == 0 {
+		return ErrInvalidParameter
+	}
+	var h [32]byte
+	copy(h[:], hash)
+	s.lock.Lock()
+	s.limbo[h] = &goStoreLimbo{owner: append([]byte(nil), owner...), ts: ts, localReceiveTime: localReceiveTime}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *goStore) getLimboCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.limbo)
+}
+
+func (s *goStore) haveRecordIncludeLimbo(hash []byte) bool {
+	if len(hash) != 32 {
+		return false
+	}
+	var h [32]byte
+	copy(h[:], hash)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.byHash[h] != nil || s.limbo[h] != nil
+}
+
+func (s *goStore) updatePulse(token, minutes, startRangeStart, startRangeEnd uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changed := false
+	for _, start := range s.updatePulseLocked(token, minutes, startRangeStart, startRangeEnd) {
+		s.writeState(appendGoStorePulse(nil, token, start, minutes))
+		changed = true
+	}
+	return changed
+}
+
+// updatePulseLocked updates pulses and returns the start times of those that changed. Lock must be held.
+func (s *goStore) updatePulseLocked(token, minutes, startRangeStart, startRangeEnd uint64) (changed []uint64) {
+	pulses := s.pulses[token]
+	for i := range pulses {
+		if pulses[i].start >= startRangeStart && pulses[i].start <= startRangeEnd && pulses[i].minutes < minutes {
+			pulses[i].minutes = minutes
+			changed = append(changed, pulses[i].start)
+		}
+	}
+	return
+}
+
+func (s *goStore) getPulse(token uint64) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var start, minutes uint64
+	for i, p := range s.pulses[token] {
+		if i == 0 || p.start > start {
+			start = p.start
+			minutes = p.minutes
+		}
+	}
+	return minutes
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// StoreConfigName is the name of the file in a node's base path that selects its storage backend.
+const StoreConfigName = "store.json"
+
+const (
+	// StoreBackendNative is the C backend using SQLite and memory mapped graph and weight files (requires cgo).
+	StoreBackendNative = "native"
+
+	// StoreBackendGo is the pure Go backend that keeps indexes in memory and rebuilds them from records.lf on open.
+	StoreBackendGo = "go"
+)
+
+const (
+	// Reputations are in descending order in a circles of hell sense -- 0 is the worst possible thing.
+	// Note that 0 and 63 must match native/db.h defines.
+	dbReputationDefault                     = 63 // normal perfectly good looking record
+	dbReputationTemporalViolation           = 48 // leave a bit of room above and below
+	dbReputationRecordDeserializationFailed = 1  // record appears corrupt (shouldn't really happen at all)
+	dbReputationCollision                   = 0  // record's selector names collide with another owner
+)
+
+// storeBackends contains constructors for storage backends available in this build.
+// The native backend registers itself here if LF is built with cgo.
+var storeBackends = map[string]func() Store{
+	StoreBackendGo: func() Store { return new(goStore) },
+}
+
+// Store is a storage backend for records, the DAG and its weights, and the indexes built on them.
+// Records are stored in records.lf by all backends, so data offsets and lengths have the same meaning
+// regardless of backend. When records' dependencies are fully satisfied all through the DAG and their
+// weights have been applied, the sync callback passed to open is called.
+type Store interface {
+	open(basePath string, loggers [logLevelCount]*log.Logger, syncCallback func(uint64, uint, int, *[32]byte)) error
+	close()
+
+	// Records and the DAG
+	putRecord(r *Record) error
+	getDataByHash(h []byte, buf []byte) (int, []byte, error)
+	getDataByOffset(doff uint64, dlen uint, buf []byte) ([]byte, error)
+	hasRecord(h []byte) bool
+	getRecordTimestampByHash(h []byte) (bool, uint64)
+	getLinks(count uint) (uint, []byte, error)
+	getLinks2(count uint) ([][32]byte, error)
+	updateRecordReputationByHash(h []byte, reputation int)
+	stats() (recordCount, dataSize uint64)
+	crc64() uint64
+	hasPending() bool
+	getPendingCount() int
+	haveDanglingLinks(ignoreAfterNRetries int) bool
+	getWanted(max, retryCountMin, retryCountMax int, incrementRetryCount bool) (int, []byte)
+	getWantedCount(retryCountMin, retryCountMax int) int
+	getRecordInfo(afterDoff int64, max int) []dbRecordInfo
+	rewriteRecordData(doff uint64, data []byte, dlen uint) error
+
+	// Queries
+	query(selectorRanges [][2][]byte, oracles []OwnerPublic, f func(uint64, uint64, uint64, uint64, uint64, int, uint64, []byte, uint, []byte) bool) error
+	getAllByOwner(owner []byte, f func(uint64, uint64, int) bool) error
+	getOwnerStats(owner []byte) (recordCount uint64, recordBytes uint64)
+	getAllByIDNotOwner(id []byte, owner []byte, f func(uint64, uint64, int) bool) error
+	getRangeHashes(start, end *reconcileBound, offset, maxCount int) ([][32]byte, []uint64)
+	getRangeSum(start, end *reconcileBound) (sum [4]uint64, count uint64)
+	getFirstDoffSince(ts uint64) (uint64, bool)
+
+	// Commentary, certificates, limbo, and pulses
+	logComment(byRecordDoff uint64, assertion, reason int, subject []byte) error
+	putCert(cert *x509.Certificate, recordDoff uint64) error
+	putCertRevocation(revokedSerialNumber string, recordDoff uint64, recordDlen uint) error
+	getCertInfo(subjectSerial string) (map[string]*x509.Certificate, map[string][]*pkix.CertificateList)
+	markInLimbo(hash, owner []byte, localReceiveTime, ts uint64) error
+	getLimboCount() int
+	haveRecordIncludeLimbo(hash []byte) bool
+	updatePulse(token, minutes, startRangeStart, startRangeEnd uint64) bool
+	getPulse(token uint64) uint64
+}
+
+// StoreConfig selects the storage backend used by a node.
+type StoreConfig struct {
+	Backend string // Storage backend ("native" or "go")
+}
+
+// defaultStoreBackend returns the native backend if it's available and the Go backend otherwise.
+func defaultStoreBackend() string {
+	if _, have := storeBackends[StoreBackendNative]; have {
+		return StoreBackendNative
+	}
+	return StoreBackendGo
+}
+
+// readStoreConfig reads store.json from a base path. If it does not exist the native backend is
+// assumed for existing nodes, since they predate store.json, and the default backend for new ones.
+func readStoreConfig(basePath string) (*StoreConfig, bool, error) {
+	var sc StoreConfig
+	d, err := ioutil.ReadFile(path.Join(basePath, StoreConfigName))
+	if err != nil || len(d) == 0 {
+		if _, err = os.Stat(path.Join(basePath, "records.lf")); err == nil {
+			sc.Backend = StoreBackendNative
+		} else {
+			sc.Backend = defaultStoreBackend()
+		}
+		return &sc, false, nil
+	}
+	if err = json.Unmarshal(d, &sc); err != nil {
+		return nil, true, fmt.Errorf("invalid %s: %s", StoreConfigName, err.Error())
+	}
+	if len(sc.Backend) == 0 {
+		sc.Backend = StoreBackendNative
+	}
+	return &sc, true, nil
+}
+
+// openStore opens a node's store using the backend selected by store.json, creating store.json
+// for new nodes so that a node is always reopened with the backend with which it was created.
+func openStore(basePath string, loggers [logLevelCount]*log.Logger, syncCallback func(uint64, uint, int, *[32]byte)) (Store, error) {
+	sc, exists, err := readStoreConfig(basePath)
+	if err != nil {
+		return nil, err
+	}
+	s, err := openStoreBackend(sc.Backend, basePath, loggers, syncCallback)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		scj, _ := json.MarshalIndent(sc, "", "  ")
+		_ = ioutil.WriteFile(path.Join(basePath, StoreConfigName), scj, 0644)
+	}
+	return s, nil
+}
+
+// openStoreBackend opens a store with a specific backend.
+func openStoreBackend(backend, basePath string, loggers [logLevelCount]*log.Logger, syncCallback func(uint64, uint, int, *[32]byte)) (Store, error) {
+	newStore := storeBackends[backend]
+	if newStore == nil {
+		if backend == StoreBackendNative {
+			return nil, fmt.Errorf("storage backend %q is not available (LF was built without cgo)", backend)
+		}
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+	s := newStore()
+	if err := s.open(basePath, loggers, syncCallback); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// storeIndexRecord adds the certificates, CRLs, and commentary in a synchronized record to a store.
+// This is what handleSynchronizedRecord does in a running node, minus logging and cache invalidation.
+func storeIndexRecord(s Store, r *Record, doff uint64, dlen uint) {
+	switch r.Type {
+	case RecordTypeCommentary:
+		cdata, _ := r.GetValue(nil)
+		for len(cdata) > 0 {
+			var c comment
+			var err error
+			if cdata, err = c.readFrom(cdata); err != nil {
+				break
+			}
+			_ = s.logComment(doff, int(c.assertion), int(c.reason), c.subject)
+		}
+	case RecordTypeCertificate:
+		cdata, _ := r.GetValue([]byte(RecordCertificateMaskingKey))
+		if len(cdata) > 0 {
+			certs, _ := x509.ParseCertificates(cdata)
+			for _, cert := range certs {
+				_ = s.putCert(cert, doff)
+			}
+		}
+	case RecordTypeCRL:
+		cdata, _ := r.GetValue([]byte(RecordCertificateMaskingKey))
+		if len(cdata) > 0 {
+			if crl, _ := x509.ParseCRL(cdata); crl != nil {
+				for _, revoked := range crl.TBSCertList.RevokedCertificates {
+					_ = s.putCertRevocation(Base62Encode(revoked.SerialNumber.Bytes()), doff, dlen)
+				}
+			}
+		}
+	}
+}
+
+// linksToArrays splits a buffer of concatenated 32-byte hashes returned by getLinks into an array of hashes.
+func linksToArrays(l []byte) (ll [][32]byte) {
+	if len(l) >= 32 {
+		ll = make([][32]byte, len(l)/32)
+		for i, j := 0, 0; (j + 32) <= len(l); j += 32 {
+			copy(ll[i][:], l[j:j+32])
+			i++
+		}
+	}
+	return
+}
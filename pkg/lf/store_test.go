@@ -0,0 +1,299 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// storeTestMaskingKey is the masking key for values of test records.
+var storeTestMaskingKey = []byte("store test")
+
+// forEachStoreBackend runs a test against every storage backend available in this build, each with its own empty base path.
+func forEachStoreBackend(t *testing.T, f func(t *testing.T, backend, basePath string)) {
+	for _, backend := range []string{StoreBackendNative, StoreBackendGo} {
+		if _, have := storeBackends[backend]; !have {
+			continue
+		}
+		t.Run(backend, func(t *testing.T) {
+			basePath, err := ioutil.TempDir("", "lf-store-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = os.RemoveAll(basePath)
+			}()
+			f(t, backend, basePath)
+		})
+	}
+}
+
+func openTestStore(t *testing.T, backend, basePath string) Store {
+	var loggers [logLevelCount]*log.Logger
+	for i := range loggers {
+		loggers[i] = nullLogger
+	}
+	s, err := openStoreBackend(backend, basePath, loggers, func(uint64, uint, int, *[32]byte) {})
+	if err != nil {
+		t.Fatalf("open %s store: %s", backend, err.Error())
+	}
+	return s
+}
+
+// makeTestRecords creates a chain of records by one owner in which each record links to the one before it.
+func makeTestRecords(t *testing.T, count int, selector string) (*Owner, []*Record) {
+	owner, err := NewOwner(OwnerTypeNistP224)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := TimeSec()
+	records := make([]*Record, count)
+	for i := range records {
+		var links [][32]byte
+		if i > 0 {
+			links = append(links, records[i-1].Hash())
+		}
+		records[i], err = NewRecord(RecordTypeDatum, []byte{byte(i)}, links, storeTestMaskingKey, [][]byte{[]byte(selector)}, []uint64{uint64(i)}, ts+uint64(i), nil, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return owner, records
+}
+
+func putTestRecords(t *testing.T, s Store, records []*Record) {
+	for _, r := range records {
+		if err := s.putRecord(r); err != nil {
+			t.Fatalf("putRecord: %s", err.Error())
+		}
+	}
+	for deadline := time.Now().Add(10 * time.Second); s.hasPending(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for weights to be applied")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStorePutAndGet(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, backend, basePath string) {
+		s := openTestStore(t, backend, basePath)
+		defer s.close()
+		_, records := makeTestRecords(t, 4, "put")
+		putTestRecords(t, s, records)
+
+		if count, _ := s.stats(); count != uint64(len(records)) {
+			t.Errorf("stats: got %d records, expected %d", count, len(records))
+		}
+		for _, r := range records {
+			h := r.Hash()
+			if !s.hasRecord(h[:]) {
+				t.Errorf("hasRecord: record =%s not found", Base62Encode(h[:]))
+			}
+			_, data, err := s.getDataByHash(h[:], nil)
+			if err != nil || !bytes.Equal(data, r.Bytes()) {
+				t.Errorf("getDataByHash: record =%s data does not match", Base62Encode(h[:]))
+			}
+			if ok, ts := s.getRecordTimestampByHash(h[:]); !ok || ts != r.Timestamp {
+				t.Errorf("getRecordTimestampByHash: got %d, expected %d", ts, r.Timestamp)
+			}
+		}
+		var missing [32]byte
+		if s.hasRecord(missing[:]) {
+			t.Error("hasRecord: found record that was never added")
+		}
+	})
+}
+
+func TestStoreQuery(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, backend, basePath string) {
+		s := openTestStore(t, backend, basePath)
+		defer s.close()
+		_, records := makeTestRecords(t, 8, "query")
+		putTestRecords(t, s, records)
+
+		// A single selector key should find exactly the record with that ordinal.
+		for i, r := range records {
+			sk := r.SelectorKey(0)
+			found := 0
+			err := s.query([][2][]byte{{sk, sk}}, nil, func(ts, weightL, weightH, doff, dlen uint64, reputation int, ckey uint64, owner []byte, negativeComments uint, selectorKey []byte) bool {
+				rdata, err := s.getDataByOffset(doff, uint(dlen), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rec, err := NewRecordFromBytes(rdata)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v, _ := rec.GetValue(storeTestMaskingKey); !bytes.Equal(v, []byte{byte(i)}) {
+					t.Errorf("query: record %d has wrong value %x", i, v)
+				}
+				if !bytes.Equal(selectorKey, sk) {
+					t.Errorf("query: record %d has wrong first selector key", i)
+				}
+				found++
+				return true
+			})
+			if err != nil || found != 1 {
+				t.Errorf("query: found %d records for ordinal %d, expected 1", found, i)
+			}
+		}
+
+		// A range covering every possible key should find every record.
+		found := 0
+		_ = s.query([][2][]byte{{bytes.Repeat([]byte{0x00}, 32), bytes.Repeat([]byte{0xff}, 32)}}, nil, func(uint64, uint64, uint64, uint64, uint64, int, uint64, []byte, uint, []byte) bool {
+			found++
+			return true
+		})
+		if found != len(records) {
+			t.Errorf("query: found %d records in full key range, expected %d", found, len(records))
+		}
+	})
+}
+
+func TestStoreLinks(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, backend, basePath string) {
+		s := openTestStore(t, backend, basePath)
+		defer s.close()
+		_, records := makeTestRecords(t, 4, "links")
+		putTestRecords(t, s, records)
+
+		// The newest record in the chain is the only one nothing links to, so it's the best link.
+		links, err := s.getLinks2(1)
+		if err != nil || len(links) != 1 {
+			t.Fatalf("getLinks2: got %d links (%v), expected 1", len(links), err)
+		}
+		if links[0] != records[len(records)-1].Hash() {
+			t.Error("getLinks2: did not return the newest record in the chain")
+		}
+		if s.haveDanglingLinks(0) {
+			t.Error("haveDanglingLinks: true with every linked record present")
+		}
+	})
+}
+
+func TestStorePulseAndReputationPersistence(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, backend, basePath string) {
+		s := openTestStore(t, backend, basePath)
+		owner, records := makeTestRecords(t, 2, "pulse")
+		putTestRecords(t, s, records)
+
+		token := records[0].PulseToken
+		if !s.updatePulse(token, 5, records[0].Timestamp, records[0].Timestamp) {
+			t.Error("updatePulse: no pulse updated")
+		}
+		if s.updatePulse(token, 3, records[0].Timestamp, records[0].Timestamp) {
+			t.Error("updatePulse: pulse moved backwards")
+		}
+		if m := s.getPulse(token); m != 5 {
+			t.Errorf("getPulse: got %d minutes, expected 5", m)
+		}
+		demoted := records[1].Hash()
+		s.updateRecordReputationByHash(demoted[:], dbReputationCollision)
+		s.close()
+
+		// Pulses and reputation changes must survive reopening the store.
+		s = openTestStore(t, backend, basePath)
+		defer s.close()
+		if m := s.getPulse(token); m != 5 {
+			t.Errorf("getPulse after reopen: got %d minutes, expected 5", m)
+		}
+		reputations := make(map[uint64]int)
+		_ = s.getAllByOwner(owner.Public, func(doff, dlen uint64, reputation int) bool {
+			reputations[doff] = reputation
+			return true
+		})
+		if len(reputations) != len(records) {
+			t.Fatalf("getAllByOwner: got %d records, expected %d", len(reputations), len(records))
+		}
+		for _, ri := range s.getRecordInfo(-1, len(records)) {
+			expected := dbReputationDefault
+			if ri.hash == demoted {
+				expected = dbReputationCollision
+			}
+			if reputations[ri.doff] != expected {
+				t.Errorf("reputation after reopen: record =%s has %d, expected %d", Base62Encode(ri.hash[:]), reputations[ri.doff], expected)
+			}
+		}
+	})
+}
+
+func TestStoreRangeSums(t *testing.T) {
+	forEachStoreBackend(t, func(t *testing.T, backend, basePath string) {
+		s := openTestStore(t, backend, basePath)
+		defer s.close()
+
+		// Records span several sum buckets so ranges can cover whole buckets as well as parts of them.
+		owner, err := NewOwner(OwnerTypeNistP224)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := make([]*Record, 12)
+		for i := range records {
+			var links [][32]byte
+			if i > 0 {
+				links = append(links, records[i-1].Hash())
+			}
+			records[i], err = NewRecord(RecordTypeDatum, []byte{byte(i)}, links, storeTestMaskingKey, [][]byte{[]byte("sums")}, []uint64{uint64(i)}, 1500000000+(uint64(i)*(reconcileSumBucketSeconds/3)), nil, owner)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		putTestRecords(t, s, records)
+
+		bounds := []reconcileBound{reconcileBoundMin, reconcileBoundMax}
+		for _, r := range records {
+			bounds = append(bounds, reconcileBound{ts: r.Timestamp, hash: r.Hash()})
+		}
+		for b := records[0].Timestamp / reconcileSumBucketSeconds; b <= (records[len(records)-1].Timestamp/reconcileSumBucketSeconds)+1; b++ {
+			bounds = append(bounds, reconcileBound{ts: b * reconcileSumBucketSeconds})
+		}
+
+		for i := range bounds {
+			for j := range bounds {
+				start, end := &bounds[i], &bounds[j]
+				if !start.less(end) {
+					continue
+				}
+				var expected [][32]byte
+				var expectedSum [4]uint64
+				for _, r := range records {
+					rb := reconcileBound{ts: r.Timestamp, hash: r.Hash()}
+					if !rb.less(start) && rb.less(end) {
+						expected = append(expected, rb.hash)
+						reconcileSumAddHash(&expectedSum, &rb.hash)
+					}
+				}
+				if sum, count := s.getRangeSum(start, end); sum != expectedSum || count != uint64(len(expected)) {
+					t.Errorf("getRangeSum: range %d..%d has %d records, expected %d (or sum differs)", i, j, count, len(expected))
+				}
+				for offset := 0; offset <= len(expected); offset++ {
+					hashes, _ := s.getRangeHashes(start, end, offset, 1)
+					if offset < len(expected) {
+						if len(hashes) != 1 || hashes[0] != expected[offset] {
+							t.Errorf("getRangeHashes: range %d..%d has wrong hash at offset %d", i, j, offset)
+						}
+					} else if len(hashes) != 0 {
+						t.Errorf("getRangeHashes: range %d..%d returned a hash past its end", i, j)
+					}
+				}
+			}
+		}
+	})
+}
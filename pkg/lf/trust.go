@@ -0,0 +1,102 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+import (
+	"bytes"
+	"math"
+)
+
+// TrustPolicy (request, part of Query) determines how the trust of query results is computed from local
+// reputation, oracle commentary, proof of work weight, and certificates. Trust is a weighted average of
+// these factors between 0.0 and 1.0, optionally penalized if the record is not signed. A nil policy or
+// a policy with all fields omitted gives the default trust computation.
+type TrustPolicy struct {
+	LocalWeight     *float64      `json:",omitempty"` // Weight of local trust (default: 1.0)
+	OracleWeight    *float64      `json:",omitempty"` // Weight of each oracle's opinion (default: 1.0)
+	WorkWeight      float64       `json:",omitempty"` // Weight of proof of work relative to the heaviest record in a result (default: 0.0)
+	SignedWeight    float64       `json:",omitempty"` // Weight of having a valid owner certificate (default: 0.0)
+	UnsignedPenalty *float64      `json:",omitempty"` // Trust multiplier for unsigned records if the network has auth certificates (default: 0.9)
+	TrustedOwners   []OwnerPublic `json:",omitempty"` // Records by these owners always have a trust of 1.0
+	MinTrust        float64       `json:",omitempty"` // Exclude records with trust below this value (default: 0.0)
+}
+
+const (
+	trustPolicyDefaultLocalWeight     = 1.0
+	trustPolicyDefaultOracleWeight    = 1.0
+	trustPolicyDefaultUnsignedPenalty = 0.9
+)
+
+// float returns this weight as an approximate floating point value.
+func (a *QueryResultWeight) float() float64 {
+	return math.Ldexp(float64(a[0]), 96) + math.Ldexp(float64(a[1]), 64) + math.Ldexp(float64(a[2]), 32) + float64(a[3])
+}
+
+// trust computes the trust of a query result. LocalTrust, OracleTrust, Weight, and Signed must already be set.
+// Work is the result's weight divided by the weight of the heaviest record in its result set.
+func (p *TrustPolicy) trust(r *QueryResult, oracleCount int, work float64, haveAuthCerts bool) float64 {
+	localWeight := trustPolicyDefaultLocalWeight
+	oracleWeight := trustPolicyDefaultOracleWeight
+	unsignedPenalty := trustPolicyDefaultUnsignedPenalty
+	var workWeight, signedWeight float64
+	if p != nil {
+		for _, o := range p.TrustedOwners {
+			if bytes.Equal(o, r.Record.Owner) {
+				return 1.0
+			}
+		}
+		if p.LocalWeight != nil {
+			localWeight = math.Max(*p.LocalWeight, 0.0)
+		}
+		if p.OracleWeight != nil {
+			oracleWeight = math.Max(*p.OracleWeight, 0.0)
+		}
+		if p.UnsignedPenalty != nil {
+			unsignedPenalty = math.Min(math.Max(*p.UnsignedPenalty, 0.0), 1.0)
+		}
+		workWeight = math.Max(p.WorkWeight, 0.0)
+		signedWeight = math.Max(p.SignedWeight, 0.0)
+	}
+
+	trust := localWeight * r.LocalTrust
+	totalWeight := localWeight
+	if oracleCount > 0 {
+		trust += oracleWeight * float64(oracleCount) * r.OracleTrust
+		totalWeight += oracleWeight * float64(oracleCount)
+	}
+	trust += workWeight * work
+	totalWeight += workWeight
+	if r.Signed {
+		trust += signedWeight
+	}
+	totalWeight += signedWeight
+	if totalWeight > 0.0 {
+		trust /= totalWeight
+	} else {
+		trust = 0.0
+	}
+
+	if haveAuthCerts && !r.Signed {
+		trust *= unsignedPenalty
+	}
+	return trust
+}
+
+// minTrust returns the minimum trust for results to be included.
+func (p *TrustPolicy) minTrust() float64 {
+	if p == nil {
+		return 0.0
+	}
+	return p.MinTrust
+}
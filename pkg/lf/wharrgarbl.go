@@ -21,11 +21,13 @@ import (
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"lf/third_party/lfmd5"
 )
@@ -44,10 +46,15 @@ const WharrgarblOutputSize = 14
 
 // Wharrgarblr is an instance of the Wharrgarbl proof of work function
 type Wharrgarblr struct {
-	memory      []uint64
-	lock        sync.Mutex
-	threadCount uint
-	done        uint32
+	totalIterations    uint64 // Total iterations across all calls to Compute() (first for 64-bit atomic alignment)
+	totalTime          uint64 // Total time in nanoseconds spent in Compute()
+	progressIterations uint64 // Approximate iterations so far in current Compute()
+	progressStart      int64  // Start time of current Compute() in nanoseconds since epoch
+	progressDifficulty uint32 // Difficulty of current Compute() or 0 if none is running
+	memory             []uint64
+	lock               sync.Mutex
+	threadCount        uint
+	done               uint32
 }
 
 // wharrgarblFrankenhash combines AES and MD5 with random accesses to a big static memory table for an
@@ -228,6 +235,7 @@ func (wg *Wharrgarblr) internalWorkerFunc(mmoCipher0, mmoCipher1 cipher.Block, r
 	for atomic.LoadUint32(&wg.done) == 0 {
 		iter++
 		if (iter & 0xff) == 0 {
+			atomic.AddUint64(&wg.progressIterations, 0x100)
 			runtime.Gosched() // this might not be necessary but doesn't seem to hurt and probably makes this coexist better on nodes
 		}
 
@@ -257,7 +265,7 @@ func (wg *Wharrgarblr) internalWorkerFunc(mmoCipher0, mmoCipher1 cipher.Block, r
 				collisionHashIn[6] = byte(otherCollider >> 8)
 				collisionHashIn[7] = byte(otherCollider)
 				if (wharrgarblFrankenhash(md5, mmoCipher0, mmoCipher1, tmp, &collisionHashIn) % diff64) == thisCollision {
-					atomic.StoreUint32(&wg.done, 1)
+					atomic.StoreUint32(&wg.done, 2)
 					outLock.Lock()
 					out[0] = byte(thisCollider >> 32)
 					out[1] = byte(thisCollider >> 24)
@@ -285,6 +293,7 @@ func (wg *Wharrgarblr) internalWorkerFunc(mmoCipher0, mmoCipher1 cipher.Block, r
 // Compute computes Wharrgarbl PoW using this instance.
 // It returns a proof of work and how many total search iterations were required to find it.
 // A single Wharrgarblr can only Compute one PoW at a time and uses all its threads to do so.
+// If Compute is aborted with Abort() it returns zero iterations.
 func (wg *Wharrgarblr) Compute(in []byte, difficulty uint32) (out [WharrgarblOutputSize]byte, iterations uint64) {
 	wg.lock.Lock()
 	wharrgarblTableLock.RLock()
@@ -294,8 +303,13 @@ func (wg *Wharrgarblr) Compute(in []byte, difficulty uint32) (out [WharrgarblOut
 	inHashed := sha512.Sum512(in)
 	mmoCipher0, _ := aes.NewCipher(inHashed[0:32])
 	mmoCipher1, _ := aes.NewCipher(inHashed[32:64])
-	diff64 := (uint64(difficulty) << 29) | 0x000000001fffffff // 64-bit modulus for collision search
-	runNonce := rand.Uint64()                                 // nonce that randomizes table entries to permit table re-use without memory zeroing
+	diff64 := wharrgarblDiff64(difficulty) // 64-bit modulus for collision search
+	runNonce := rand.Uint64()              // nonce that randomizes table entries to permit table re-use without memory zeroing
+	startTime := time.Now()
+
+	atomic.StoreUint64(&wg.progressIterations, 0)
+	atomic.StoreInt64(&wg.progressStart, startTime.UnixNano())
+	atomic.StoreUint32(&wg.progressDifficulty, difficulty)
 
 	var outLock sync.Mutex
 	var doneWG sync.WaitGroup
@@ -307,15 +321,50 @@ func (wg *Wharrgarblr) Compute(in []byte, difficulty uint32) (out [WharrgarblOut
 	wg.internalWorkerFunc(mmoCipher0, mmoCipher1, runNonce, diff64, &iterations, &outLock, out[:], &doneWG)
 	doneWG.Wait()
 
+	atomic.AddUint64(&wg.totalIterations, iterations)
+	atomic.AddUint64(&wg.totalTime, uint64(time.Since(startTime)))
+	atomic.StoreUint32(&wg.progressDifficulty, 0)
+
 	binary.BigEndian.PutUint32(out[10:14], difficulty)
 
+	if atomic.LoadUint32(&wg.done) != 2 { // 2 means work was found, 1 that Compute() was aborted
+		iterations = 0
+	}
 	return
 }
 
 // Abort aborts the current Compute() currently in process.
 // The return values of Compute() after this call are undefined and should be thrown away.
 func (wg *Wharrgarblr) Abort() {
-	atomic.StoreUint32(&wg.done, 1)
+	atomic.CompareAndSwapUint32(&wg.done, 0, 1)
+}
+
+// Progress returns the approximate number of iterations, difficulty, and elapsed time of the Compute() in progress.
+// Difficulty is zero if no Compute() is in progress.
+func (wg *Wharrgarblr) Progress() (iterations uint64, difficulty uint32, elapsed time.Duration) {
+	difficulty = atomic.LoadUint32(&wg.progressDifficulty)
+	if difficulty != 0 {
+		iterations = atomic.LoadUint64(&wg.progressIterations)
+		elapsed = time.Since(time.Unix(0, atomic.LoadInt64(&wg.progressStart)))
+	}
+	return
+}
+
+// WharrgarblExpectedIterations returns the approximate average number of iterations required to find work
+// at a given difficulty. Work is a collision search, so by the birthday bound this grows with the square
+// root of the collision space. Actual iterations vary a lot since the search is probabilistic.
+func WharrgarblExpectedIterations(difficulty uint32) uint64 {
+	return uint64(math.Sqrt(math.Pi / 2.0 * float64(wharrgarblDiff64(difficulty))))
+}
+
+// wharrgarblDiff64 returns the size of the collision space searched for work at a difficulty.
+func wharrgarblDiff64(difficulty uint32) uint64 {
+	return (uint64(difficulty) << 29) | 0x000000001fffffff
+}
+
+// Stats returns the total number of search iterations and total time spent in all calls to Compute() so far.
+func (wg *Wharrgarblr) Stats() (iterations uint64, duration time.Duration) {
+	return atomic.LoadUint64(&wg.totalIterations), time.Duration(atomic.LoadUint64(&wg.totalTime))
 }
 
 // SetThreadCount sets the thread count for subsequent calls to Compute() (use 0 for system thread count).
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c)2019 ZeroTier, Inc.
+ *
+ * Use of this software is governed by the Business Source License included
+ * in the LICENSE.TXT file in the project's root directory.
+ *
+ * Change Date: 2023-01-01
+ *
+ * On the date above, in accordance with the Business Source License, use
+ * of this software will be governed by version 2.0 of the Apache License.
+ */
+/****/
+
+package lf
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// WorkBenchmarkName is the name of the file in a client or node base path where a Wharrgarbl benchmark is saved.
+const WorkBenchmarkName = "workbenchmark.json"
+
+// WorkBenchmarkDefaultDuration is how long BenchmarkWharrgarblr runs by default.
+const WorkBenchmarkDefaultDuration = 10 * time.Second
+
+// workBenchmarkRecordSize is the record size whose difficulty is used for benchmarking.
+// It's small enough to give many samples in a short benchmark but large enough that setup time doesn't dominate.
+const workBenchmarkRecordSize = 256
+
+// workBenchmarkMinSamples is the minimum number of proofs of work computed by a benchmark regardless of its duration.
+const workBenchmarkMinSamples = 4
+
+// WorkBenchmark is the measured speed of Wharrgarbl proof of work on a machine with given memory and thread settings.
+type WorkBenchmark struct {
+	MemorySize          uint64  // Wharrgarbl collision table memory in bytes
+	Threads             int     // Wharrgarbl thread count
+	Samples             int     // Number of proofs of work computed
+	IterationsPerSecond float64 // Search iterations per second
+	IterationScale      float64 // Ratio of average measured iterations to WharrgarblExpectedIterations()
+	Timestamp           uint64  // Time benchmark was run (seconds since epoch)
+}
+
+// WorkEstimate (response) estimates how long proof of work will take for a record of a given size.
+// Proof of work is a probabilistic search, so times are given as an average and as percentiles.
+type WorkEstimate struct {
+	Bytes               uint    // Work billable record size in bytes (value, selectors, links, and other record fields)
+	Difficulty          uint32  // Wharrgarbl difficulty for this size
+	Iterations          uint64  // Expected (average) search iterations
+	IterationsPerSecond float64 // Benchmarked search iterations per second
+	Expected            float64 // Expected (average) time in seconds
+	Median              float64 // Time in seconds within which half of proofs of work are found
+	P90                 float64 // Time in seconds within which 90% of proofs of work are found
+	P99                 float64 // Time in seconds within which 99% of proofs of work are found
+}
+
+// BenchmarkWharrgarblr measures the speed of a Wharrgarblr by computing proofs of work for at least the given duration.
+// If the Wharrgarblr is aborted during the benchmark ErrWharrgarblFailed is returned.
+func BenchmarkWharrgarblr(wg *Wharrgarblr, duration time.Duration) (*WorkBenchmark, error) {
+	diff := recordWharrgarblCost(workBenchmarkRecordSize)
+	var in [32]byte
+	var iterations uint64
+	samples := 0
+	startTime := time.Now()
+	for samples < workBenchmarkMinSamples || time.Since(startTime) < duration {
+		_, _ = rand.Read(in[:])
+		_, iter := wg.Compute(in[:], diff)
+		if iter == 0 {
+			return nil, ErrWharrgarblFailed
+		}
+		iterations += iter
+		samples++
+	}
+	elapsed := time.Since(startTime).Seconds()
+	return &WorkBenchmark{
+		MemorySize:          uint64(len(wg.memory)) * 8,
+		Threads:             int(wg.threadCount),
+		Samples:             samples,
+		IterationsPerSecond: float64(iterations) / elapsed,
+		IterationScale:      float64(iterations) / float64(samples) / float64(WharrgarblExpectedIterations(diff)),
+		Timestamp:           TimeSec(),
+	}, nil
+}
+
+// Matches returns true if this benchmark was run with the same memory and thread settings as a Wharrgarblr.
+func (b *WorkBenchmark) Matches(wg *Wharrgarblr) bool {
+	return b.MemorySize == uint64(len(wg.memory))*8 && b.Threads == int(wg.threadCount)
+}
+
+// Estimate estimates proof of work time for a record with the given number of work billable bytes.
+func (b *WorkBenchmark) Estimate(bytes uint) *WorkEstimate {
+	diff := recordWharrgarblCost(bytes)
+	e := &WorkEstimate{
+		Bytes:               bytes,
+		Difficulty:          diff,
+		Iterations:          b.ExpectedIterations(diff),
+		IterationsPerSecond: b.IterationsPerSecond,
+	}
+	if b.IterationsPerSecond > 0 {
+		e.Expected = float64(e.Iterations) / b.IterationsPerSecond
+		e.Median = b.Duration(diff, 0.5).Seconds()
+		e.P90 = b.Duration(diff, 0.9).Seconds()
+		e.P99 = b.Duration(diff, 0.99).Seconds()
+	}
+	return e
+}
+
+// ExpectedIterations returns WharrgarblExpectedIterations() corrected by this benchmark's measurements.
+func (b *WorkBenchmark) ExpectedIterations(difficulty uint32) uint64 {
+	return uint64(float64(WharrgarblExpectedIterations(difficulty)) * b.scale())
+}
+
+// Duration returns the time within which proof of work at a difficulty is found with probability p.
+// Work is a collision search, so the chance of not having found it yet after i iterations falls off
+// as exp(-i^2 / 2N) where N is the size of the collision space.
+func (b *WorkBenchmark) Duration(difficulty uint32, p float64) time.Duration {
+	if b.IterationsPerSecond <= 0 || p <= 0 || p >= 1 {
+		return 0
+	}
+	iter := math.Sqrt(-2.0*float64(wharrgarblDiff64(difficulty))*math.Log(1.0-p)) * b.scale()
+	return time.Duration(iter / b.IterationsPerSecond * float64(time.Second))
+}
+
+// scale returns IterationScale or 1.0 if it's missing or nonsensical.
+func (b *WorkBenchmark) scale() float64 {
+	if b.IterationScale > 0 && !math.IsInf(b.IterationScale, 0) {
+		return b.IterationScale
+	}
+	return 1.0
+}
+
+// LoadWorkBenchmark reads a saved benchmark, returning nil if the file does not exist.
+func LoadWorkBenchmark(path string) (*WorkBenchmark, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil || len(d) == 0 {
+		return nil, nil
+	}
+	b := new(WorkBenchmark)
+	err = json.Unmarshal(d, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Save writes this benchmark to a file.
+func (b *WorkBenchmark) Save(path string) error {
+	d, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}